@@ -0,0 +1,472 @@
+package coap
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBlockSize is the block size used for block-wise transfers when none is negotiated
+const DefaultBlockSize = 1024
+
+// MaxBlockwiseBodySize limits the size of bodies reassembled from block-wise transferred responses
+// and requests
+const MaxBlockwiseBodySize = 1 << 20
+
+// Block1Lifetime is how long the blocks of an incomplete request body are kept
+const Block1Lifetime = 2 * time.Minute
+
+// MaxBlock1Transfers limits the number of incomplete request bodies kept by all servers
+const MaxBlock1Transfers = 256
+
+// MaxBlock1TransfersPerEndpoint limits the number of incomplete request bodies kept for an endpoint
+const MaxBlock1TransfersPerEndpoint = 4
+
+// MaxBlock1BufferSize limits the total size of the incomplete request bodies kept by all servers
+const MaxBlock1BufferSize = 16 << 20
+
+// MaxBlock1EndpointBufferSize limits the total size of the incomplete request bodies kept for an endpoint
+const MaxBlock1EndpointBufferSize = 2 * MaxBlockwiseBodySize
+
+// Block2Lifetime is how long a proxy keeps the body of a response transferred block-wise with Block2
+const Block2Lifetime = 2 * time.Minute
+
+/*
+	Block1/Block2 option value (RFC 7959)
+
+	 0 1 2 3 4 5 6 7
+	+-+-+-+-+-+-+-+-+
+	|  NUM  |M| SZX |
+	+-+-+-+-+-+-+-+-+
+*/
+
+// Instantiates a new block option for a given block number, more flag and block size.
+// Sizes which aren't a power of two between 16 and 1024 are rounded down
+func NewBlockOption(num uint32, more bool, size int) *BlockOption {
+	return &BlockOption{
+		Num:  num,
+		More: more,
+		SZX:  BlockSizeToSZX(size),
+	}
+}
+
+// Decodes a block option from its uint option value. The block size exponent 7 is reserved
+// and results in ErrInvalidBlockOption (RFC 7959 Section 2.2)
+func ParseBlockOption(v uint32) (*BlockOption, error) {
+	if v&0x07 == 7 {
+		return nil, ErrInvalidBlockOption
+	}
+
+	return &BlockOption{
+		Num:  v >> 4,
+		More: v&0x08 != 0,
+		SZX:  uint8(v & 0x07),
+	}, nil
+}
+
+// BlockOption represents the value of a Block1 or Block2 option
+type BlockOption struct {
+	Num  uint32
+	More bool
+	SZX  uint8
+}
+
+// Returns the block size in bytes
+func (b *BlockOption) Size() int {
+	return 1 << (uint(b.SZX) + 4)
+}
+
+// Returns the offset of the block's first byte in the full body
+func (b *BlockOption) Offset() int {
+	return int(b.Num) * b.Size()
+}
+
+// Returns the uint option value of the block option
+func (b *BlockOption) Value() uint32 {
+	v := b.Num<<4 | uint32(b.SZX&0x07)
+	if b.More {
+		v |= 0x08
+	}
+	return v
+}
+
+// BlockSizeToSZX converts a block size in bytes to its size exponent
+func BlockSizeToSZX(size int) uint8 {
+	var szx uint8
+	for szx < 6 && (1<<(uint(szx)+5)) <= size {
+		szx++
+	}
+	return szx
+}
+
+// Returns the Block1 or Block2 option of a message, or nil if the message has none or if it is
+// invalid, see HasInvalidBlockOption
+func (m *Message) GetBlockOption(code OptionCode) *BlockOption {
+	opt := m.GetOption(code)
+	if opt == nil {
+		return nil
+	}
+
+	v, ok := optionUintValue(opt)
+	if !ok {
+		return nil
+	}
+
+	block, err := ParseBlockOption(v)
+	if err != nil {
+		return nil
+	}
+	return block
+}
+
+// Determines if a message carries a Block1 or Block2 option which can't be decoded, such as one
+// with the reserved block size exponent 7
+func (m *Message) HasInvalidBlockOption(code OptionCode) bool {
+	return m.GetOption(code) != nil && m.GetBlockOption(code) == nil
+}
+
+// Sets a Block1 or Block2 option on a message, replacing any existing one
+func (m *Message) SetBlockOption(code OptionCode, block *BlockOption) {
+	m.RemoveOptions(code)
+	m.AddOption(code, block.Value())
+}
+
+// SetBlock2Payload sets the block of a body requested by a Block2 option as the payload of a
+// response, along with the Block2 and Size2 options. Bodies fitting into a single block are set
+// as is when no block was requested. False is returned if the block is beyond the end of the body
+func SetBlock2Payload(resp *Message, body []byte, block *BlockOption, size int) bool {
+	if block == nil {
+		if len(body) <= size {
+			resp.Payload = NewBytesPayload(body)
+			return true
+		}
+		block = NewBlockOption(0, false, size)
+	}
+
+	offset := block.Offset()
+	if offset > len(body) || (offset == len(body) && offset > 0) {
+		return false
+	}
+
+	end := offset + block.Size()
+	if end > len(body) {
+		end = len(body)
+	}
+
+	resp.Payload = NewBytesPayload(body[offset:end])
+	resp.SetBlockOption(OptionBlock2, &BlockOption{Num: block.Num, More: end < len(body), SZX: block.SZX})
+	resp.AddOption(OptionSize2, len(body))
+
+	return true
+}
+
+// SendAndWaitForBlockwiseResponse sends a request and waits for its response like
+// SendAndWaitForResponse. The remaining blocks of a block-wise transferred response are
+// retrieved, and the response is returned with the full body as its payload
+func SendAndWaitForBlockwiseResponse(s CoapServer, req CoapRequest, addr *net.UDPAddr, timeout time.Duration) (*Message, error) {
+	resp, err := SendAndWaitForResponse(s, req, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.HasInvalidBlockOption(OptionBlock2) {
+		return nil, ErrInvalidBlockOption
+	}
+
+	block := resp.GetBlockOption(OptionBlock2)
+	if block == nil || !block.More {
+		return resp, nil
+	}
+
+	var body bytes.Buffer
+	if resp.Payload != nil {
+		body.Write(resp.Payload.GetBytes())
+	}
+
+	msg := req.GetMessage().Clone()
+	msg.RemoveOptions(OptionObserve)
+	for block != nil && block.More {
+		if body.Len() > MaxBlockwiseBodySize {
+			return nil, ErrUnexpectedResponse
+		}
+
+		msg.MessageID = GenerateMessageID()
+		msg.SetBlockOption(OptionBlock2, &BlockOption{Num: block.Num + 1, SZX: block.SZX})
+
+		next, err := SendAndWaitForResponse(s, NewRequestFromMessage(msg), addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if next.Code != CoapCodeContent {
+			return nil, ErrUnexpectedResponse
+		}
+
+		if next.HasInvalidBlockOption(OptionBlock2) {
+			return nil, ErrInvalidBlockOption
+		}
+
+		if next.Payload != nil {
+			body.Write(next.Payload.GetBytes())
+		}
+		block = next.GetBlockOption(OptionBlock2)
+	}
+
+	resp.RemoveOptions(OptionBlock2)
+	resp.Payload = NewBytesPayload(body.Bytes())
+
+	return resp, nil
+}
+
+// SendAndWaitForBlockwiseRequest sends a request like SendAndWaitForResponse, transferring a
+// payload larger than the block size in blocks with the Block1 option. The blocks carry a random
+// Request-Tag, so that several bodies can be sent to the same resource concurrently
+// (RFC 9175 Section 3). The response to the last block, or to a block which the server didn't
+// continue, is returned
+func SendAndWaitForBlockwiseRequest(s CoapServer, req CoapRequest, addr *net.UDPAddr, size int, timeout time.Duration) (*Message, error) {
+	msg := req.GetMessage()
+
+	var body []byte
+	if msg.Payload != nil {
+		body = msg.Payload.GetBytes()
+	}
+
+	block := NewBlockOption(0, false, size)
+	if len(body) <= block.Size() {
+		return SendAndWaitForResponse(s, req, addr, timeout)
+	}
+
+	tag := make([]byte, 4)
+	rand.Read(tag)
+
+	blockMsg := msg.Clone()
+	blockMsg.RemoveOptions(OptionRequestTag)
+	blockMsg.AddOption(OptionRequestTag, tag)
+	blockMsg.RemoveOptions(OptionSize1)
+	blockMsg.AddOption(OptionSize1, len(body))
+
+	for {
+		offset := block.Offset()
+		end := offset + block.Size()
+		if end > len(body) {
+			end = len(body)
+		}
+		block.More = end < len(body)
+
+		blockMsg.MessageID = GenerateMessageID()
+		blockMsg.SetBlockOption(OptionBlock1, block)
+		blockMsg.Payload = NewBytesPayload(body[offset:end])
+
+		resp, err := SendAndWaitForResponse(s, NewRequestFromMessage(blockMsg), addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if !block.More || resp.Code != CoapCodeContinue {
+			return resp, nil
+		}
+
+		// The server may ask for smaller blocks, which continue at the same offset
+		next := &BlockOption{Num: block.Num + 1, SZX: block.SZX}
+		if b := resp.GetBlockOption(OptionBlock1); b != nil && b.SZX < block.SZX {
+			next = &BlockOption{SZX: b.SZX}
+			next.Num = uint32(end / next.Size())
+		}
+		block = next
+	}
+}
+
+// Incomplete request bodies received with the Block1 option
+var block1Transfers = newBlock1TransferStore()
+
+type block1Transfer struct {
+	key      string
+	endpoint string
+	body     []byte
+	updated  time.Time
+}
+
+// Block1 transfers by key, ordered from the least to the most recently updated so that expired
+// transfers are removed from the front. The number and size of the transfers are limited in
+// total and per endpoint
+type block1TransferStore struct {
+	sync.Mutex
+
+	transfers map[string]*list.Element
+	lru       *list.List
+	size      int
+
+	endpoints map[string]*block1EndpointUsage
+}
+
+type block1EndpointUsage struct {
+	transfers int
+	size      int
+}
+
+func newBlock1TransferStore() *block1TransferStore {
+	return &block1TransferStore{
+		transfers: make(map[string]*list.Element),
+		lru:       list.New(),
+		endpoints: make(map[string]*block1EndpointUsage),
+	}
+}
+
+// Removes the transfers which haven't been continued within Block1Lifetime
+func (ts *block1TransferStore) expire(now time.Time) {
+	for el := ts.lru.Front(); el != nil; el = ts.lru.Front() {
+		if now.Sub(el.Value.(*block1Transfer).updated) <= Block1Lifetime {
+			return
+		}
+		ts.remove(el)
+	}
+}
+
+func (ts *block1TransferStore) remove(el *list.Element) {
+	t := el.Value.(*block1Transfer)
+
+	ts.lru.Remove(el)
+	delete(ts.transfers, t.key)
+	ts.size -= len(t.body)
+
+	usage := ts.endpoints[t.endpoint]
+	usage.transfers--
+	usage.size -= len(t.body)
+	if usage.transfers == 0 {
+		delete(ts.endpoints, t.endpoint)
+	}
+}
+
+// Stores a transfer with its body extended by a block. Nil is returned if it is stored, otherwise
+// the response to the block: 5.03 Service Unavailable if too many transfers are ongoing or the
+// blocks of all transfers exceed MaxBlock1BufferSize, and 4.13 Request Entity Too Large if the
+// blocks of the endpoint's transfers exceed MaxBlock1EndpointBufferSize
+func (ts *block1TransferStore) store(t *block1Transfer, payload []byte, msg *Message, now time.Time) *Message {
+	usage := ts.endpoints[t.endpoint]
+	if usage == nil {
+		usage = &block1EndpointUsage{}
+	}
+
+	if _, ok := ts.transfers[t.key]; !ok {
+		if ts.lru.Len() >= MaxBlock1Transfers || usage.transfers >= MaxBlock1TransfersPerEndpoint {
+			return ServiceUnavailableMessage(msg.MessageID, MessageAcknowledgment)
+		}
+	}
+
+	if usage.size+len(payload) > MaxBlock1EndpointBufferSize {
+		ret := RequestEntityTooLargeMessage(msg.MessageID, MessageAcknowledgment)
+		ret.AddOption(OptionSize1, MaxBlock1EndpointBufferSize-usage.size+len(t.body))
+		return ret
+	}
+
+	if ts.size+len(payload) > MaxBlock1BufferSize {
+		return ServiceUnavailableMessage(msg.MessageID, MessageAcknowledgment)
+	}
+
+	if el, ok := ts.transfers[t.key]; ok {
+		ts.lru.MoveToBack(el)
+	} else {
+		ts.transfers[t.key] = ts.lru.PushBack(t)
+		ts.endpoints[t.endpoint] = usage
+		usage.transfers++
+	}
+
+	t.body = append(t.body, payload...)
+	t.updated = now
+	ts.size += len(payload)
+	usage.size += len(payload)
+
+	return nil
+}
+
+// Returns the key of the transfer a block of a request body belongs to. Blocks belong to the same
+// transfer if they are sent by the same client to the same resource with the same method and
+// Request-Tag options, including their absence (RFC 9175 Section 3.3)
+func block1TransferKey(local, addr *net.UDPAddr, msg *Message) string {
+	var b strings.Builder
+	if local != nil {
+		b.WriteString(local.String())
+	}
+	b.WriteString(" " + addr.String() + " " + strconv.Itoa(int(msg.Code)))
+
+	for _, opt := range msg.Options {
+		switch opt.Code {
+		case OptionURIHost, OptionURIPort, OptionURIPath, OptionURIQuery, OptionRequestTag:
+			raw, _ := opt.RawValue()
+			b.WriteString(" " + strconv.Itoa(int(opt.Code)) + ":" + strconv.Quote(string(raw)))
+		}
+	}
+	return b.String()
+}
+
+// Collects a block of a request body sent by an endpoint. The full body is returned with the last
+// block, otherwise the response to the block is returned: 2.31 Continue asking for the next block,
+// 4.08 Request Entity Incomplete for blocks which don't continue a transfer, 4.13 Request Entity
+// Too Large for bodies exceeding MaxBlockwiseBodySize, or the response of a full transfer store
+func receiveBlock1(endpoint, key string, msg *Message, block *BlockOption) ([]byte, *Message) {
+	var payload []byte
+	if msg.Payload != nil {
+		payload = msg.Payload.GetBytes()
+	}
+
+	ts := block1Transfers
+	ts.Lock()
+	defer ts.Unlock()
+
+	now := time.Now()
+	ts.expire(now)
+
+	var t *block1Transfer
+	if el, ok := ts.transfers[key]; ok {
+		if block.Num == 0 {
+			// A transfer starting again replaces the previous one
+			ts.remove(el)
+		} else {
+			t = el.Value.(*block1Transfer)
+		}
+	}
+
+	if block.Num == 0 {
+		t = &block1Transfer{key: key, endpoint: endpoint}
+	}
+
+	if t == nil || block.Offset() != len(t.body) {
+		if el, ok := ts.transfers[key]; ok {
+			ts.remove(el)
+		}
+		return nil, RequestEntityIncompleteMessage(msg.MessageID, MessageAcknowledgment)
+	}
+
+	if len(t.body)+len(payload) > MaxBlockwiseBodySize {
+		if el, ok := ts.transfers[key]; ok {
+			ts.remove(el)
+		}
+
+		ret := RequestEntityTooLargeMessage(msg.MessageID, MessageAcknowledgment)
+		ret.AddOption(OptionSize1, MaxBlockwiseBodySize)
+		return nil, ret
+	}
+
+	if !block.More {
+		if el, ok := ts.transfers[key]; ok {
+			ts.remove(el)
+		}
+		return append(t.body, payload...), nil
+	}
+
+	if ret := ts.store(t, payload, msg, now); ret != nil {
+		if el, ok := ts.transfers[key]; ok {
+			ts.remove(el)
+		}
+		return nil, ret
+	}
+
+	ret := ContinueMessage(msg.MessageID, MessageAcknowledgment)
+	ret.SetBlockOption(OptionBlock1, block)
+	return nil, ret
+}
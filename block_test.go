@@ -0,0 +1,235 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerBlockSize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 120)
+
+	handler := func(req CoapRequest) CoapResponse {
+		msg := ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment)
+		msg.Payload = NewBytesPayload(body)
+
+		return NewResponseWithMessage(msg)
+	}
+
+	whole, wholeAddr := newTestServer(t)
+	whole.Get("/big", handler)
+	whole.SetBlockSize(-1)
+
+	if size := whole.GetBlockSize(); size != 0 {
+		t.Errorf("GetBlockSize = %d, want 0", size)
+	}
+
+	blockwise, blockwiseAddr := newTestServer(t)
+	blockwise.Get("/big", handler)
+	blockwise.SetBlockSize(600)
+
+	if size := blockwise.GetBlockSize(); size != 512 {
+		t.Errorf("GetBlockSize = %d, want 512", size)
+	}
+
+	client, _ := newTestServer(t)
+
+	startTestServer(t, whole)
+	startTestServer(t, blockwise)
+	startTestServer(t, client)
+
+	get := func(addr string, block *BlockOption) *Message {
+		req := NewRequest(MessageConfirmable, Get, GenerateMessageID())
+		req.SetRequestURI("big")
+		if block != nil {
+			req.GetMessage().SetBlockOption(OptionBlock2, block)
+		}
+
+		udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+		resp, err := SendAndWaitForResponse(client, req, udpAddr, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Responses are sent whole unless block-wise transfers are enabled
+	resp := get(wholeAddr, nil)
+	if resp.GetOption(OptionBlock2) != nil || !bytes.Equal(resp.Payload.GetBytes(), body) {
+		t.Errorf("response of %d bytes with Block2 %v", resp.Payload.Length(), resp.GetBlockOption(OptionBlock2))
+	}
+
+	resp = get(blockwiseAddr, nil)
+	if block := resp.GetBlockOption(OptionBlock2); block == nil || block.Num != 0 || !block.More || block.Size() != 512 {
+		t.Errorf("Block2 = %+v", block)
+	}
+
+	if !bytes.Equal(resp.Payload.GetBytes(), body[:512]) {
+		t.Errorf("first block of %d bytes", resp.Payload.Length())
+	}
+
+	if size := resp.GetOption(OptionSize2); size == nil || size.IntValue() != len(body) {
+		t.Errorf("Size2 = %v", size)
+	}
+
+	// Clients may request smaller blocks
+	resp = get(blockwiseAddr, NewBlockOption(4, false, 256))
+	if block := resp.GetBlockOption(OptionBlock2); block == nil || block.Num != 4 || block.More || block.Size() != 256 {
+		t.Errorf("Block2 = %+v", block)
+	}
+
+	if !bytes.Equal(resp.Payload.GetBytes(), body[1024:]) {
+		t.Errorf("last block of %d bytes", resp.Payload.Length())
+	}
+
+	// Blocks beyond the end of the body are rejected
+	if resp = get(blockwiseAddr, NewBlockOption(3, false, 512)); resp.Code != CoapCodeBadOption {
+		t.Errorf("block beyond the body = %s, want 4.02", CoapCodeToString(resp.Code))
+	}
+
+	// The reserved block size exponent 7 is rejected
+	if resp = get(blockwiseAddr, &BlockOption{Num: 1, SZX: 7}); resp.Code != CoapCodeBadRequest {
+		t.Errorf("Block2 with SZX 7 = %s, want 4.00", CoapCodeToString(resp.Code))
+	}
+
+	req := NewRequest(MessageConfirmable, Get, GenerateMessageID())
+	req.SetRequestURI("big")
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", blockwiseAddr)
+	full, err := SendAndWaitForBlockwiseResponse(client, req, udpAddr, 2*time.Second)
+	if err != nil || !bytes.Equal(full.Payload.GetBytes(), body) {
+		t.Errorf("block-wise transfer failed: %v", err)
+	}
+}
+
+func TestBlockOptionReservedSZX(t *testing.T) {
+	if _, err := ParseBlockOption(0x17); err != ErrInvalidBlockOption {
+		t.Errorf("ParseBlockOption(SZX 7) = %v, want %v", err, ErrInvalidBlockOption)
+	}
+
+	if block, err := ParseBlockOption(0x1e); err != nil || block.Num != 1 || !block.More || block.Size() != 1024 {
+		t.Errorf("ParseBlockOption(0x1e) = %+v (%v)", block, err)
+	}
+
+	msg := NewMessage(MessageConfirmable, Post, 1)
+	msg.AddOption(OptionBlock1, 0x0f)
+	if msg.GetBlockOption(OptionBlock1) != nil || !msg.HasInvalidBlockOption(OptionBlock1) {
+		t.Error("the Block1 option with SZX 7 wasn't reported as invalid")
+	}
+
+	if msg.HasInvalidBlockOption(OptionBlock2) {
+		t.Error("a missing Block2 option was reported as invalid")
+	}
+
+	server, addr := newTestServer(t)
+	server.Post("/upload", func(req CoapRequest) CoapResponse {
+		return NewResponseWithMessage(ChangedMessage(req.GetMessage().MessageID, MessageAcknowledgment))
+	})
+
+	client, _ := newTestServer(t)
+
+	startTestServer(t, server)
+	startTestServer(t, client)
+
+	req := NewRequest(MessageConfirmable, Post, GenerateMessageID())
+	req.SetRequestURI("upload")
+	req.GetMessage().AddOption(OptionBlock1, 0x0f)
+	req.GetMessage().SetStringPayload("block")
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+	resp, err := SendAndWaitForResponse(client, req, udpAddr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Code != CoapCodeBadRequest {
+		t.Errorf("Block1 with SZX 7 = %s, want 4.00", CoapCodeToString(resp.Code))
+	}
+}
+
+func TestBlock1TransferLimits(t *testing.T) {
+	defer func(ts *block1TransferStore) { block1Transfers = ts }(block1Transfers)
+	block1Transfers = newBlock1TransferStore()
+
+	block := make([]byte, 1024)
+	send := func(endpoint, key string, num uint32, more bool) CoapCode {
+		msg := NewMessage(MessageConfirmable, Post, 1)
+		msg.Payload = NewBytesPayload(block)
+
+		_, ret := receiveBlock1(endpoint, endpoint+" "+key, msg, &BlockOption{Num: num, More: more, SZX: 6})
+		if ret == nil {
+			return CoapCodeChanged
+		}
+		return ret.Code
+	}
+
+	// Transfers per endpoint
+	for i := 0; i < MaxBlock1TransfersPerEndpoint; i++ {
+		if code := send("a", strconv.Itoa(i), 0, true); code != CoapCodeContinue {
+			t.Fatalf("transfer %d = %s", i, CoapCodeToString(code))
+		}
+	}
+
+	if code := send("a", "new", 0, true); code != CoapCodeServiceUnavailable {
+		t.Errorf("transfer beyond the endpoint's limit = %s, want 5.03", CoapCodeToString(code))
+	}
+
+	// Transfers are continued and completed
+	if code := send("a", "0", 1, true); code != CoapCodeContinue {
+		t.Errorf("second block = %s", CoapCodeToString(code))
+	}
+
+	if code := send("a", "0", 2, false); code != CoapCodeChanged {
+		t.Errorf("last block = %s", CoapCodeToString(code))
+	}
+
+	if code := send("a", "new", 0, true); code != CoapCodeContinue {
+		t.Errorf("transfer after one completed = %s", CoapCodeToString(code))
+	}
+
+	// Buffered bytes per endpoint
+	for num := uint32(0); num < MaxBlockwiseBodySize/1024; num++ {
+		if code := send("b", "0", num, true); code != CoapCodeContinue {
+			t.Fatalf("block %d = %s", num, CoapCodeToString(code))
+		}
+	}
+
+	for num := uint32(0); num < MaxBlockwiseBodySize/1024; num++ {
+		if code := send("b", "1", num, true); code != CoapCodeContinue {
+			t.Fatalf("block %d = %s", num, CoapCodeToString(code))
+		}
+	}
+
+	if code := send("b", "2", 0, true); code != CoapCodeRequestEntityTooLarge {
+		t.Errorf("block beyond the endpoint's buffer = %s, want 4.13", CoapCodeToString(code))
+	}
+
+	// Buffered bytes in total
+	code := CoapCodeContinue
+	for e := 0; code == CoapCodeContinue; e++ {
+		endpoint := "c" + strconv.Itoa(e)
+		for num := uint32(0); code == CoapCodeContinue && num < MaxBlockwiseBodySize/1024; num++ {
+			code = send(endpoint, "0", num, true)
+		}
+	}
+
+	if code != CoapCodeServiceUnavailable {
+		t.Errorf("block beyond the buffer = %s, want 5.03", CoapCodeToString(code))
+	}
+
+	if size := block1Transfers.size; size > MaxBlock1BufferSize {
+		t.Errorf("%d bytes buffered", size)
+	}
+
+	// Transfers expire
+	block1Transfers.Lock()
+	block1Transfers.expire(time.Now().Add(Block1Lifetime + time.Second))
+	size, transfers, endpoints := block1Transfers.size, block1Transfers.lru.Len(), len(block1Transfers.endpoints)
+	block1Transfers.Unlock()
+
+	if size != 0 || transfers != 0 || endpoints != 0 {
+		t.Errorf("%d bytes of %d transfers by %d endpoints kept after expiry", size, transfers, endpoints)
+	}
+}
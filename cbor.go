@@ -0,0 +1,1061 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Major types of CBOR data items (RFC 8949 Section 3.1)
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborMajorTag    = 6
+	cborMajorSimple = 7
+)
+
+// Simple values and markers of major type 7
+const (
+	cborFalse     = 0xf4
+	cborTrue      = 0xf5
+	cborNull      = 0xf6
+	cborUndefined = 0xf7
+	cborFloat16   = 0xf9
+	cborFloat32   = 0xfa
+	cborFloat64   = 0xfb
+	cborBreak     = 0xff
+)
+
+// CBORMaxDepth limits the nesting of arrays, maps and tags accepted by the decoder
+const CBORMaxDepth = 64
+
+// CBORTag represents a tagged CBOR data item which is decoded into an interface value
+type CBORTag struct {
+	Number  uint64
+	Content interface{}
+}
+
+// CBORMarshal encodes a value as CBOR (RFC 8949). Struct fields are encoded as a map keyed by
+// field name, which can be changed with a cbor struct tag. A tag name which is an integer
+// (e.g. `cbor:"-2"`) encodes the key as an integer, "omitempty" omits empty values and "-"
+// skips the field. Map keys are sorted as required for deterministic encoding
+func CBORMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CBORMarshalSequence encodes values as a CBOR sequence (RFC 8742)
+func CBORMarshalSequence(values ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := cborEncode(&buf, reflect.ValueOf(v)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// CBORUnmarshal decodes a single CBOR data item into the value pointed to by v. Decoding into an
+// interface value yields uint64, int64, float64, bool, nil, string, []byte, []interface{},
+// map[interface{}]interface{} and CBORTag values
+func CBORUnmarshal(data []byte, v interface{}) error {
+	d := NewCBORDecoder(data)
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+
+	if d.More() {
+		return ErrCBORTrailingData
+	}
+	return nil
+}
+
+// Instantiates a new decoder of the CBOR data items in a buffer, e.g. a CBOR sequence
+func NewCBORDecoder(data []byte) *CBORDecoder {
+	return &CBORDecoder{
+		data: data,
+	}
+}
+
+// CBORDecoder decodes consecutive CBOR data items from a buffer
+type CBORDecoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+// Checks if the decoder has data items left to decode
+func (d *CBORDecoder) More() bool {
+	return d.off < len(d.data)
+}
+
+// Decodes the next data item into the value pointed to by v
+func (d *CBORDecoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrCBORInvalidTarget
+	}
+
+	start := d.off
+	if err := d.decode(rv.Elem()); err != nil {
+		d.off = start
+		return err
+	}
+	return nil
+}
+
+// Encoding
+
+func cborWriteHead(buf *bytes.Buffer, major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		buf.WriteByte(m | byte(n))
+
+	case n <= math.MaxUint8:
+		buf.WriteByte(m | 24)
+		buf.WriteByte(byte(n))
+
+	case n <= math.MaxUint16:
+		buf.WriteByte(m | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+
+	case n <= math.MaxUint32:
+		buf.WriteByte(m | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+
+	default:
+		buf.WriteByte(m | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborEncodeInt(buf *bytes.Buffer, i int64) {
+	if i < 0 {
+		cborWriteHead(buf, cborMajorNegInt, uint64(-(i + 1)))
+	} else {
+		cborWriteHead(buf, cborMajorUint, uint64(i))
+	}
+}
+
+// Encodes a float in the shortest form preserving its value
+func cborEncodeFloat(buf *bytes.Buffer, f float64) {
+	if f32 := float32(f); float64(f32) == f || math.IsNaN(f) {
+		if h, ok := float32ToFloat16(f32); ok {
+			buf.WriteByte(cborFloat16)
+			binary.Write(buf, binary.BigEndian, h)
+			return
+		}
+
+		buf.WriteByte(cborFloat32)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(f32))
+		return
+	}
+
+	buf.WriteByte(cborFloat64)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+var cborTagType = reflect.TypeOf(CBORTag{})
+
+func cborEncode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(cborNull)
+		return nil
+	}
+
+	if v.Type() == cborTagType {
+		tag := v.Interface().(CBORTag)
+		cborWriteHead(buf, cborMajorTag, tag.Number)
+
+		return cborEncode(buf, reflect.ValueOf(tag.Content))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		return cborEncode(buf, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cborEncodeInt(buf, v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cborWriteHead(buf, cborMajorUint, v.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		cborEncodeFloat(buf, v.Float())
+
+	case reflect.String:
+		cborWriteHead(buf, cborMajorText, uint64(v.Len()))
+		buf.WriteString(v.String())
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				buf.WriteByte(cborNull)
+				return nil
+			}
+
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			cborWriteHead(buf, cborMajorBytes, uint64(len(b)))
+			buf.Write(b)
+			return nil
+		}
+
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+
+		cborWriteHead(buf, cborMajorArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := cborEncode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		return cborEncodeMap(buf, v)
+
+	case reflect.Struct:
+		return cborEncodeStruct(buf, v)
+
+	default:
+		return ErrCBORUnsupportedType
+	}
+	return nil
+}
+
+type cborMapEntry struct {
+	key   []byte
+	value []byte
+}
+
+// Encodes a map with its keys sorted bytewise (RFC 8949 Section 4.2.1)
+func cborEncodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	entries := make([]cborMapEntry, 0, v.Len())
+
+	iter := v.MapRange()
+	for iter.Next() {
+		var k, e bytes.Buffer
+		if err := cborEncode(&k, iter.Key()); err != nil {
+			return err
+		}
+
+		if err := cborEncode(&e, iter.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, cborMapEntry{key: k.Bytes(), value: e.Bytes()})
+	}
+
+	cborWriteEntries(buf, entries)
+
+	return nil
+}
+
+// Writes the entries of a map sorted bytewise by their encoded keys
+func cborWriteEntries(buf *bytes.Buffer, entries []cborMapEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	cborWriteHead(buf, cborMajorMap, uint64(len(entries)))
+	for _, entry := range entries {
+		buf.Write(entry.key)
+		buf.Write(entry.value)
+	}
+}
+
+func cborEncodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	fields := cborStructFields(v.Type())
+
+	entries := make([]cborMapEntry, 0, len(fields))
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && cborIsEmpty(fv) {
+			continue
+		}
+
+		var k, e bytes.Buffer
+		if f.intKey {
+			cborEncodeInt(&k, f.keyInt)
+		} else {
+			cborWriteHead(&k, cborMajorText, uint64(len(f.name)))
+			k.WriteString(f.name)
+		}
+
+		if err := cborEncode(&e, fv); err != nil {
+			return err
+		}
+		entries = append(entries, cborMapEntry{key: k.Bytes(), value: e.Bytes()})
+	}
+
+	cborWriteEntries(buf, entries)
+
+	return nil
+}
+
+func cborIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+
+	case reflect.Bool:
+		return !v.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// A struct field as described by its cbor struct tag
+type cborField struct {
+	index     int
+	name      string
+	intKey    bool
+	keyInt    int64
+	omitEmpty bool
+}
+
+var cborFieldCache sync.Map
+
+func cborStructFields(t reflect.Type) []cborField {
+	if cached, ok := cborFieldCache.Load(t); ok {
+		return cached.([]cborField)
+	}
+
+	var fields []cborField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		f := cborField{index: i, name: sf.Name}
+
+		tag := sf.Tag.Get("cbor")
+		if tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			f.name = parts[0]
+			if k, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+				f.intKey = true
+				f.keyInt = k
+			}
+		}
+
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		fields = append(fields, f)
+	}
+
+	cborFieldCache.Store(t, fields)
+
+	return fields
+}
+
+// Converts a float32 to half precision if this preserves its value
+func float32ToFloat16(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits >> 23) & 0xff)
+	mant := bits & 0x7fffff
+
+	switch {
+	case exp == 0xff:
+		// Infinity and NaN, using the canonical NaN
+		if mant != 0 {
+			return 0x7e00, true
+		}
+		return sign | 0x7c00, true
+
+	case exp == 0 && mant == 0:
+		return sign, true
+	}
+
+	e := exp - 127 + 15
+	switch {
+	case e >= 0x1f:
+		return 0, false
+
+	case e <= 0:
+		// Subnormal half precision values, with the implicit leading bit made explicit
+		shift := uint(126 - exp)
+		full := mant | 0x800000
+		if shift > 24 || full&(1<<shift-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(full>>shift), true
+	}
+
+	if mant&0x1fff != 0 {
+		return 0, false
+	}
+	return sign | uint16(e)<<10 | uint16(mant>>13), true
+}
+
+// Converts a half precision float (RFC 8949 Appendix D)
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+
+	case 0x1f:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+// Decoding
+
+// Reads the head of a data item, returning its major type, additional information and argument
+func (d *CBORDecoder) readHead() (byte, byte, uint64, error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, ErrCBORTruncated
+	}
+
+	ib := d.data[d.off]
+	d.off++
+
+	major := ib >> 5
+	info := ib & 0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+
+	case info <= 27:
+		size = 1 << (info - 24)
+
+	case info == 31:
+		// Indefinite length or break
+		if major < cborMajorBytes || major == cborMajorTag {
+			return 0, 0, 0, ErrInvalidCBOR
+		}
+		return major, info, 0, nil
+
+	default:
+		return 0, 0, 0, ErrInvalidCBOR
+	}
+
+	if len(d.data)-d.off < size {
+		return 0, 0, 0, ErrCBORTruncated
+	}
+
+	var n uint64
+	for _, b := range d.data[d.off : d.off+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.off += size
+
+	return major, info, n, nil
+}
+
+// Reads the contents of a byte or text string, concatenating indefinite length chunks
+func (d *CBORDecoder) readString(major, info byte, n uint64) ([]byte, error) {
+	if info != 31 {
+		if n > uint64(len(d.data)-d.off) {
+			return nil, ErrCBORTruncated
+		}
+		b := d.data[d.off : d.off+int(n)]
+		d.off += int(n)
+
+		return b, nil
+	}
+
+	var b []byte
+	for {
+		if d.off >= len(d.data) {
+			return nil, ErrCBORTruncated
+		}
+
+		if d.data[d.off] == cborBreak {
+			d.off++
+			return b, nil
+		}
+
+		chunkMajor, chunkInfo, chunkLen, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+
+		// Chunks must be definite length strings of the same major type
+		if chunkMajor != major || chunkInfo == 31 {
+			return nil, ErrInvalidCBOR
+		}
+
+		chunk, err := d.readString(chunkMajor, chunkInfo, chunkLen)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+// Checks whether an array or map has an item left after i items. Indefinite length arrays
+// and maps end with a break marker, which is consumed
+func (d *CBORDecoder) hasNext(indefinite bool, i, n uint64) (bool, error) {
+	if !indefinite {
+		return i < n, nil
+	}
+
+	if d.off >= len(d.data) {
+		return false, ErrCBORTruncated
+	}
+
+	if d.data[d.off] == cborBreak {
+		d.off++
+		return false, nil
+	}
+	return true, nil
+}
+
+// Checks that a declared number of items can be present in the remaining data, so that
+// corrupt lengths don't result in huge allocations
+func (d *CBORDecoder) checkLength(n uint64) error {
+	if n > uint64(len(d.data)-d.off) {
+		return ErrCBORTruncated
+	}
+	return nil
+}
+
+func (d *CBORDecoder) decode(v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+
+	if d.depth > CBORMaxDepth {
+		return ErrCBORMaxDepth
+	}
+
+	if d.off >= len(d.data) {
+		return ErrCBORTruncated
+	}
+
+	// Null and undefined clear the target
+	if b := d.data[d.off]; b == cborNull || b == cborUndefined {
+		d.off++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		item, err := d.decodeInterface()
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(item))
+		}
+		return nil
+	}
+
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+
+	switch major {
+	case cborMajorUint, cborMajorNegInt:
+		return cborSetInt(v, major, n)
+
+	case cborMajorBytes, cborMajorText:
+		b, err := d.readString(major, info, n)
+		if err != nil {
+			return err
+		}
+		return cborSetString(v, major, b)
+
+	case cborMajorArray:
+		return d.decodeArray(v, info, n)
+
+	case cborMajorMap:
+		return d.decodeMap(v, info, n)
+
+	case cborMajorTag:
+		if v.Type() == cborTagType {
+			tag := CBORTag{Number: n}
+			if err := d.decode(reflect.ValueOf(&tag.Content).Elem()); err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(tag))
+			return nil
+		}
+		// Tags are ignored when decoding into other types
+		return d.decode(v)
+
+	default:
+		return d.decodeSimple(v, info, n)
+	}
+}
+
+func (d *CBORDecoder) decodeSimple(v reflect.Value, info byte, n uint64) error {
+	switch info {
+	case 20, 21:
+		if v.Kind() != reflect.Bool {
+			return ErrCBORTypeMismatch
+		}
+		v.SetBool(info == 21)
+
+	case 25:
+		return cborSetFloat(v, float16ToFloat64(uint16(n)))
+
+	case 26:
+		return cborSetFloat(v, float64(math.Float32frombits(uint32(n))))
+
+	case 27:
+		return cborSetFloat(v, math.Float64frombits(n))
+
+	case 31:
+		return ErrInvalidCBOR
+
+	default:
+		return ErrCBORTypeMismatch
+	}
+	return nil
+}
+
+func cborSetInt(v reflect.Value, major byte, n uint64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 {
+			return ErrCBOROverflow
+		}
+
+		i := int64(n)
+		if major == cborMajorNegInt {
+			i = -1 - i
+		}
+
+		if v.OverflowInt(i) {
+			return ErrCBOROverflow
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major == cborMajorNegInt || v.OverflowUint(n) {
+			return ErrCBOROverflow
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f := float64(n)
+		if major == cborMajorNegInt {
+			f = -1 - f
+		}
+		v.SetFloat(f)
+
+	default:
+		return ErrCBORTypeMismatch
+	}
+	return nil
+}
+
+func cborSetFloat(v reflect.Value, f float64) error {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(f)
+		return nil
+	}
+	return ErrCBORTypeMismatch
+}
+
+func cborSetString(v reflect.Value, major byte, b []byte) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		c := make([]byte, len(b))
+		copy(c, b)
+		v.SetBytes(c)
+
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(b) > v.Len() {
+			return ErrCBOROverflow
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+
+	default:
+		return ErrCBORTypeMismatch
+	}
+	return nil
+}
+
+func (d *CBORDecoder) decodeArray(v reflect.Value, info byte, n uint64) error {
+	indefinite := info == 31
+	if !indefinite {
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 0, int(n))
+		for i := 0; ; i++ {
+			if more, err := d.hasNext(indefinite, uint64(i), n); err != nil {
+				return err
+			} else if !more {
+				break
+			}
+
+			s = reflect.Append(s, reflect.Zero(v.Type().Elem()))
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+
+	case reflect.Array:
+		for i := 0; ; i++ {
+			if more, err := d.hasNext(indefinite, uint64(i), n); err != nil {
+				return err
+			} else if !more {
+				break
+			}
+
+			if i >= v.Len() {
+				return ErrCBOROverflow
+			}
+
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return ErrCBORTypeMismatch
+	}
+	return nil
+}
+
+func (d *CBORDecoder) decodeMap(v reflect.Value, info byte, n uint64) error {
+	indefinite := info == 31
+	if !indefinite {
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		for i := uint64(0); ; i++ {
+			if more, err := d.hasNext(indefinite, i, n); err != nil {
+				return err
+			} else if !more {
+				break
+			}
+
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+
+			if !cborIsHashable(key) {
+				return ErrInvalidCBOR
+			}
+
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+
+	case reflect.Struct:
+		fields := cborStructFields(v.Type())
+
+		for i := uint64(0); ; i++ {
+			if more, err := d.hasNext(indefinite, i, n); err != nil {
+				return err
+			} else if !more {
+				break
+			}
+
+			var key interface{}
+			if err := d.decode(reflect.ValueOf(&key).Elem()); err != nil {
+				return err
+			}
+
+			f, ok := cborFindField(fields, key)
+			if !ok {
+				// Unknown keys are skipped
+				var skip interface{}
+				if err := d.decode(reflect.ValueOf(&skip).Elem()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := d.decode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return ErrCBORTypeMismatch
+	}
+	return nil
+}
+
+// Determines if a decoded value can be used as a map key. Byte strings, arrays and maps can't,
+// neither as keys nor as the content of tagged keys
+func cborIsHashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil() || cborIsHashable(v.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !cborIsHashable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.Type().Comparable()
+}
+
+// Finds the struct field of a map key. Text keys are matched case-insensitively if no
+// field matches exactly
+func cborFindField(fields []cborField, key interface{}) (cborField, bool) {
+	switch k := key.(type) {
+	case string:
+		for _, f := range fields {
+			if !f.intKey && f.name == k {
+				return f, true
+			}
+		}
+
+		for _, f := range fields {
+			if !f.intKey && strings.EqualFold(f.name, k) {
+				return f, true
+			}
+		}
+
+	case uint64:
+		for _, f := range fields {
+			if f.intKey && f.keyInt >= 0 && uint64(f.keyInt) == k {
+				return f, true
+			}
+		}
+
+	case int64:
+		for _, f := range fields {
+			if f.intKey && f.keyInt == k {
+				return f, true
+			}
+		}
+	}
+	return cborField{}, false
+}
+
+// Decodes a data item into its generic Go representation
+func (d *CBORDecoder) decodeInterface() (interface{}, error) {
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborMajorUint:
+		return n, nil
+
+	case cborMajorNegInt:
+		if n > math.MaxInt64 {
+			return nil, ErrCBOROverflow
+		}
+		return -1 - int64(n), nil
+
+	case cborMajorBytes:
+		b, err := d.readString(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		c := make([]byte, len(b))
+		copy(c, b)
+
+		return c, nil
+
+	case cborMajorText:
+		b, err := d.readString(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case cborMajorArray:
+		var s []interface{}
+		err := d.decodeArray(reflect.ValueOf(&s).Elem(), info, n)
+		if s == nil {
+			s = []interface{}{}
+		}
+		return s, err
+
+	case cborMajorMap:
+		m := make(map[interface{}]interface{})
+		err := d.decodeMap(reflect.ValueOf(&m).Elem(), info, n)
+
+		return m, err
+
+	case cborMajorTag:
+		tag := CBORTag{Number: n}
+		err := d.decode(reflect.ValueOf(&tag.Content).Elem())
+
+		return tag, err
+	}
+
+	switch info {
+	case 20, 21:
+		return info == 21, nil
+
+	case 22, 23:
+		return nil, nil
+
+	case 25:
+		return float16ToFloat64(uint16(n)), nil
+
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+
+	case 27:
+		return math.Float64frombits(n), nil
+
+	case 31:
+		return nil, ErrInvalidCBOR
+	}
+
+	// Other simple values are returned as their number
+	return n, nil
+}
+
+// CBORDiagnostic returns the diagnostic notation (RFC 8949 Section 8) of CBOR data, e.g.
+// {"temp": 21.5}. Invalid data is returned as hex
+func CBORDiagnostic(data []byte) string {
+	d := NewCBORDecoder(data)
+
+	var items []string
+	for d.More() {
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return "h'" + hex.EncodeToString(data) + "'"
+		}
+		items = append(items, cborDiagnosticValue(v))
+	}
+	return strings.Join(items, ", ")
+}
+
+func cborDiagnosticValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+
+	case string:
+		return strconv.Quote(t)
+
+	case []byte:
+		return "h'" + hex.EncodeToString(t) + "'"
+
+	case float64:
+		s := strconv.FormatFloat(t, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+
+	case []interface{}:
+		var items []string
+		for _, item := range t {
+			items = append(items, cborDiagnosticValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+
+	case map[interface{}]interface{}:
+		var items []string
+		for k, item := range t {
+			items = append(items, cborDiagnosticValue(k)+": "+cborDiagnosticValue(item))
+		}
+		sort.Strings(items)
+
+		return "{" + strings.Join(items, ", ") + "}"
+
+	case CBORTag:
+		return strconv.FormatUint(t.Number, 10) + "(" + cborDiagnosticValue(t.Content) + ")"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,244 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Encoding examples of RFC 8949 Appendix A
+func TestCBORMarshal(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{uint64(18446744073709551615), "1bffffffffffffffff"},
+		{-1, "20"},
+		{-1000, "3903e7"},
+		{1.5, "f93e00"},
+		{100000.0, "fa47c35000"},
+		{1.1, "fb3ff199999999999a"},
+		{math.Inf(1), "f97c00"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{"", "60"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]interface{}{}, "80"},
+		{[]interface{}{1, []interface{}{2, 3}}, "8201820203"},
+		{map[string]interface{}{"a": 1, "b": []interface{}{2, 3}}, "a26161016162820203"},
+		{CBORTag{Number: 1, Content: 1363896240}, "c11a514b67b0"},
+	}
+
+	for _, test := range tests {
+		b, err := CBORMarshal(test.v)
+		if err != nil {
+			t.Errorf("CBORMarshal(%#v) failed: %v", test.v, err)
+			continue
+		}
+
+		if got := hex.EncodeToString(b); got != test.want {
+			t.Errorf("CBORMarshal(%#v) = %s, want %s", test.v, got, test.want)
+		}
+	}
+}
+
+func TestCBORUnmarshalInterface(t *testing.T) {
+	tests := []struct {
+		data string
+		want interface{}
+	}{
+		{"00", uint64(0)},
+		{"3903e7", int64(-1000)},
+		{"f93e00", 1.5},
+		{"f97e00", math.NaN()},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+		{"a201020304", map[interface{}]interface{}{uint64(1): uint64(2), uint64(3): uint64(4)}},
+		{"c11a514b67b0", CBORTag{Number: 1, Content: uint64(1363896240)}},
+		{"f0", uint64(16)},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+
+		var v interface{}
+		if err := CBORUnmarshal(data, &v); err != nil {
+			t.Errorf("CBORUnmarshal(%s) failed: %v", test.data, err)
+			continue
+		}
+
+		if f, ok := test.want.(float64); ok && math.IsNaN(f) {
+			if got, ok := v.(float64); !ok || !math.IsNaN(got) {
+				t.Errorf("CBORUnmarshal(%s) = %#v, want NaN", test.data, v)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(v, test.want) {
+			t.Errorf("CBORUnmarshal(%s) = %#v, want %#v", test.data, v, test.want)
+		}
+	}
+}
+
+func TestCBORUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		data string
+		err  error
+	}{
+		{"", ErrCBORTruncated},
+		{"18", ErrCBORTruncated},
+		{"1b000000", ErrCBORTruncated},
+		{"62c3", ErrCBORTruncated},
+		{"8201", ErrCBORTruncated},
+		{"a201", ErrCBORTruncated},
+		{"0000", ErrCBORTrailingData},
+		{"1c", ErrInvalidCBOR},
+		{"ff", ErrInvalidCBOR},
+		{"3bffffffffffffffff", ErrCBOROverflow},
+		{"5f01ff", ErrInvalidCBOR},
+
+		// Map keys which can't be map keys in Go
+		{"a2ca40cc27", ErrInvalidCBOR},
+		{"a14100f6", ErrInvalidCBOR},
+		{"a18000f6", ErrInvalidCBOR},
+		{"a1a000f6", ErrInvalidCBOR},
+		{"a1c1810000", ErrInvalidCBOR},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+
+		var v interface{}
+		if err := CBORUnmarshal(data, &v); err != test.err {
+			t.Errorf("CBORUnmarshal(%s) = %v, want %v", test.data, err, test.err)
+		}
+	}
+
+	// Nesting beyond CBORMaxDepth
+	deep := append(bytes.Repeat([]byte{0x81}, CBORMaxDepth+1), 0x00)
+
+	var v interface{}
+	if err := CBORUnmarshal(deep, &v); err != ErrCBORMaxDepth {
+		t.Errorf("decoding deeply nested arrays = %v, want %v", err, ErrCBORMaxDepth)
+	}
+}
+
+type cborTestRecord struct {
+	Name   string            `cbor:"n"`
+	Value  float64           `cbor:"-2"`
+	Count  uint32            `cbor:"c,omitempty"`
+	Tags   []string          `cbor:"t,omitempty"`
+	Attrs  map[string]string `cbor:"a,omitempty"`
+	Data   []byte            `cbor:"d,omitempty"`
+	Ignore string            `cbor:"-"`
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	in := cborTestRecord{
+		Name:   "temp",
+		Value:  -21.5,
+		Count:  70000,
+		Tags:   []string{"a", "b"},
+		Attrs:  map[string]string{"unit": "Cel"},
+		Data:   []byte{0, 1, 2},
+		Ignore: "not encoded",
+	}
+
+	b, err := CBORMarshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out cborTestRecord
+	if err := CBORUnmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	in.Ignore = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip changed the value: %#v != %#v", out, in)
+	}
+
+	// Empty fields are omitted
+	b, err = CBORMarshal(cborTestRecord{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := hex.EncodeToString(b), "a221f90000616e6178"; got != want {
+		t.Fatalf("CBORMarshal = %s, want %s", got, want)
+	}
+}
+
+func TestCBORDiagnostic(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"a26161016162820203", `{"a": 1, "b": [2, 3]}`},
+		{"f93e00", "1.5"},
+		{"c11a514b67b0", "1(1363896240)"},
+		{"4401020304", "h'01020304'"},
+		{"0102", "1, 2"},
+		{"a2ca40cc27", "h'a2ca40cc27'"},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		if got := CBORDiagnostic(data); got != test.want {
+			t.Errorf("CBORDiagnostic(%s) = %s, want %s", test.data, got, test.want)
+		}
+	}
+}
+
+// Decoding arbitrary data must not panic, and decoded values must survive an encode/decode
+// round trip unchanged
+func FuzzCBORUnmarshal(f *testing.F) {
+	for _, seed := range []string{
+		"00", "3903e7", "f93e00", "fb3ff199999999999a", "4401020304", "5f42010243030405ff",
+		"7f657374726561646d696e67ff", "9f018202039f0405ffff", "a26161016162820203",
+		"c11a514b67b0", "a2ca40cc27", "27c7acc5",
+	} {
+		data, _ := hex.DecodeString(seed)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		CBORDiagnostic(data)
+
+		var record cborTestRecord
+		CBORUnmarshal(data, &record)
+
+		var v interface{}
+		if err := CBORUnmarshal(data, &v); err != nil {
+			return
+		}
+
+		b, err := CBORMarshal(v)
+		if err != nil {
+			// Simple values other than booleans and null aren't encoded
+			return
+		}
+
+		var decoded interface{}
+		if err := CBORUnmarshal(b, &decoded); err != nil {
+			t.Fatalf("decoding an encoded value failed: %v", err)
+		}
+
+		b2, err := CBORMarshal(decoded)
+		if err != nil || !bytes.Equal(b, b2) {
+			t.Fatalf("round trip changed the value: %x != %x (%v)", b, b2, err)
+		}
+	})
+}
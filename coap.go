@@ -53,6 +53,7 @@ const (
 	OptionContentFormat OptionCode = 12
 	OptionMaxAge        OptionCode = 14
 	OptionURIQuery      OptionCode = 15
+	OptionHopLimit      OptionCode = 16
 	OptionAccept        OptionCode = 17
 	OptionLocationQuery OptionCode = 20
 	OptionBlock2        OptionCode = 23
@@ -61,6 +62,9 @@ const (
 	OptionProxyURI      OptionCode = 35
 	OptionProxyScheme   OptionCode = 39
 	OptionSize1         OptionCode = 60
+	OptionEcho          OptionCode = 252
+	OptionNoResponse    OptionCode = 258
+	OptionRequestTag    OptionCode = 292
 )
 
 // CoapCode defines a valid CoAP Code Type
@@ -72,12 +76,18 @@ const (
 	Put    CoapCode = 3
 	Delete CoapCode = 4
 
+	// Methods of RFC 8132, which routes don't handle yet
+	Fetch  CoapCode = 5
+	Patch  CoapCode = 6
+	IPatch CoapCode = 7
+
 	CoapCodeEmpty                    CoapCode = 0
 	CoapCodeCreated                  CoapCode = 65
 	CoapCodeDeleted                  CoapCode = 66
 	CoapCodeValid                    CoapCode = 67
 	CoapCodeChanged                  CoapCode = 68
 	CoapCodeContent                  CoapCode = 69
+	CoapCodeContinue                 CoapCode = 95
 	CoapCodeBadRequest               CoapCode = 128
 	CoapCodeUnauthorized             CoapCode = 129
 	CoapCodeBadOption                CoapCode = 130
@@ -85,16 +95,19 @@ const (
 	CoapCodeNotFound                 CoapCode = 132
 	CoapCodeMethodNotAllowed         CoapCode = 133
 	CoapCodeNotAcceptable            CoapCode = 134
+	CoapCodeRequestEntityIncomplete  CoapCode = 136
 	CoapCodeConflict                 CoapCode = 137
 	CoapCodePreconditionFailed       CoapCode = 140
 	CoapCodeRequestEntityTooLarge    CoapCode = 141
 	CoapCodeUnsupportedContentFormat CoapCode = 143
+	CoapCodeTooManyRequests          CoapCode = 157
 	CoapCodeInternalServerError      CoapCode = 160
 	CoapCodeNotImplemented           CoapCode = 161
 	CoapCodeBadGateway               CoapCode = 162
 	CoapCodeServiceUnavailable       CoapCode = 163
 	CoapCodeGatewayTimeout           CoapCode = 164
 	CoapCodeProxyingNotSupported     CoapCode = 165
+	CoapCodeHopLimitReached          CoapCode = 168
 )
 
 const DefaultAckTimeout = 2
@@ -111,6 +124,20 @@ const CoapsDefaultPort = 5684
 const PayloadMarker = 0xff
 const MaxPacketSize = 1500
 
+// DefaultMaxTokenLength is the token length every CoAP implementation supports (RFC 7252)
+const DefaultMaxTokenLength = 8
+
+// MaxTokenLength is the longest token expressible with extended token lengths (RFC 8974)
+const MaxTokenLength = 65804
+
+// Values of the No-Response option suppressing the responses of a class (RFC 7967 Section 2.1).
+// Values are combined to suppress several classes
+const (
+	NoResponseSuccess     uint8 = 0x02
+	NoResponseClientError uint8 = 0x08
+	NoResponseServerError uint8 = 0x10
+)
+
 // MessageIDPurgeDuration defines the number of seconds before a MessageID Purge is initiated
 const MessageIDPurgeDuration = 60
 
@@ -141,6 +168,10 @@ const (
 	MediaTypeApplicationSoapFastInfoSet MediaType = 49
 	MediaTypeApplicationJSON            MediaType = 50
 	MediaTypeApplicationXObitBinary     MediaType = 51
+	MediaTypeApplicationCBOR            MediaType = 60
+	MediaTypeApplicationCBORSeq         MediaType = 63
+	MediaTypeApplicationSenMLJSON       MediaType = 110
+	MediaTypeApplicationSenMLCBOR       MediaType = 112
 	MediaTypeTextPlainVndOmaLwm2m       MediaType = 1541
 	MediaTypeTlvVndOmaLwm2m             MediaType = 1542
 	MediaTypeJSONVndOmaLwm2m            MediaType = 1543
@@ -161,22 +192,61 @@ var ErrPacketLengthLessThan4 = errors.New("Packet length less than 4 bytes")
 var ErrInvalidCoapVersion = errors.New("Invalid CoAP version. Should be 1.")
 var ErrOptionLengthUsesValue15 = errors.New(("Message format error. Option length has reserved value of 15"))
 var ErrOptionDeltaUsesValue15 = errors.New(("Message format error. Option delta has reserved value of 15"))
+var ErrTruncatedToken = errors.New("Message format error. Token exceeds the message length")
+var ErrOptionOverflow = errors.New("Message format error. Option exceeds the message length")
+var ErrOptionNumberOverflow = errors.New("Message format error. Option number exceeds 65535")
+var ErrEmptyPayload = errors.New("Message format error. Payload marker followed by an empty payload")
 var ErrUnknownMessageType = errors.New("Unknown message type")
-var ErrInvalidTokenLength = errors.New("Invalid Token Length ( > 8)")
+var ErrInvalidTokenLength = errors.New("Invalid Token Length")
+var ErrTokenTooLong = errors.New("Token exceeds the maximum token length")
 var ErrUnknownCriticalOption = errors.New("Unknown critical option encountered")
+var ErrInvalidOptionDefinition = errors.New("Invalid option definition")
+var ErrOptionAlreadyRegistered = errors.New("Option number is already registered")
+var ErrInvalidOptionValue = errors.New("Option value doesn't match the option's format")
+var ErrInvalidOptionLength = errors.New("Option value length is out of range")
+var ErrInvalidBlockOption = errors.New("Block option uses the reserved block size exponent 7")
 var ErrUnsupportedMethod = errors.New("Unsupported Method")
 var ErrNoMatchingRoute = errors.New("No matching route found")
 var ErrUnsupportedContentFormat = errors.New("Unsupported Content-Format")
+var ErrNotAcceptable = errors.New("No acceptable representation")
+var ErrUnsupportedRepresentation = errors.New("Value can't be encoded in the representation")
+var ErrInvalidCBOR = errors.New("Invalid CBOR data")
+var ErrCBORTruncated = errors.New("CBOR data is truncated")
+var ErrCBORTrailingData = errors.New("Unexpected data after CBOR data item")
+var ErrCBORMaxDepth = errors.New("CBOR data is nested too deeply")
+var ErrCBOROverflow = errors.New("CBOR value overflows the target type")
+var ErrCBORTypeMismatch = errors.New("CBOR data item doesn't match the target type")
+var ErrCBORUnsupportedType = errors.New("Type can't be encoded as CBOR")
+var ErrCBORInvalidTarget = errors.New("CBOR can only be decoded into a non-nil pointer")
+var ErrUnsupportedPayloadFormat = errors.New("No decoder for the payload's Content-Format")
+var ErrInvalidSenML = errors.New("Invalid SenML pack")
+var ErrUnsupportedSenMLVersion = errors.New("Unsupported SenML version")
+var ErrInvalidLwM2MTLV = errors.New("Invalid LwM2M TLV payload")
+var ErrInvalidLwM2MJSON = errors.New("Invalid LwM2M JSON payload")
+var ErrLwM2MValueType = errors.New("LwM2M value is not of the requested type")
+var ErrInvalidLwM2MPath = errors.New("Invalid LwM2M path")
+var ErrLwM2MNotFound = errors.New("LwM2M object, instance or resource not found")
+var ErrLwM2MUnknownClient = errors.New("LwM2M client is not registered")
 var ErrNoMatchingMethod = errors.New("No matching method")
 var ErrNilMessage = errors.New("Message is nil")
 var ErrNilConn = errors.New("Connection object is nil")
 var ErrNilAddr = errors.New("Address cannot be nil")
+var ErrResponseTimeout = errors.New("Timed out waiting for a response")
+var ErrUnexpectedResponse = errors.New("Unexpected response received")
+var ErrInvalidProxyURI = errors.New("Invalid proxy URI")
+var ErrInvalidRequestURI = errors.New("Invalid CoAP request URI")
+var ErrInvalidRequestType = errors.New("Requests must be Confirmable or Non-Confirmable")
+var ErrInvalidLocation = errors.New("Invalid location reference")
+var ErrRDNotRegistered = errors.New("Endpoint is not registered with a Resource Directory")
+var ErrRDRequestFailed = errors.New("Resource Directory request failed")
 
 // Interfaces
 type CoapServer interface {
 	Start()
 	Stop()
 	SetProxyFilter(fn ProxyFilter)
+	SetProxyFilterChain(chain *ProxyFilterChain)
+	GetProxyFilterChain() *ProxyFilterChain
 	Get(path string, fn RouteHandler) *Route
 	Delete(path string, fn RouteHandler) *Route
 	Put(path string, fn RouteHandler) *Route
@@ -188,6 +258,7 @@ type CoapServer interface {
 	SendAndWaitForCallback(req CoapRequest, handler AwaitResponseHandler) error
 	SendTo(req CoapRequest, addr *net.UDPAddr) (CoapResponse, error)
 	NotifyChange(resource, value string, confirm bool)
+	NotifyChangePayload(resource string, payload MessagePayload, mt MediaType, confirm bool)
 	Dial(host string)
 	Dial6(host string)
 	OnNotify(fn FnEventNotify)
@@ -200,10 +271,21 @@ type CoapServer interface {
 	OnMessage(fn FnEventMessage)
 	ProxyHTTP(enabled bool)
 	ProxyCoap(enabled bool)
+	SetProxyHandler(proxyType ProxyType, fn ProxyHandler)
+	SetProxyCache(cache *ProxyCache)
+	GetProxyCache() *ProxyCache
+	ReverseProxy(prefix string, pool *UpstreamPool) *ReverseProxy
 	GetEvents() *Events
 	GetLocalAddress() *net.UDPAddr
+	SetMaxTokenLength(n int)
+	GetMaxTokenLength() int
+	SetEchoPolicy(policy *EchoPolicy)
+	GetEchoPolicy() *EchoPolicy
+	SetBlockSize(size int)
+	GetBlockSize() int
 
 	AllowProxyForwarding(*Message, *net.UDPAddr) bool
+	FilterProxyRequest(*Message, *net.UDPAddr) ProxyFilterResult
 	GetRoutes() []*Route
 	ForwardCoap(msg *Message, conn *net.UDPConn, addr *net.UDPAddr)
 	ForwardHTTP(msg *Message, conn *net.UDPConn, addr *net.UDPAddr)
@@ -0,0 +1,60 @@
+package coap
+
+import "bytes"
+
+// Evaluates the preconditions of a request against the current entity-tag of the route's
+// resource (RFC 7252 Sections 5.10.6, 5.10.8 and 5.10.9). A 2.03 Valid or 4.12 Precondition
+// Failed response is returned if the request must not be passed to the route's handler
+func checkPreconditions(route *Route, req CoapRequest) *Message {
+	if route.ETag == nil {
+		return nil
+	}
+
+	msg := req.GetMessage()
+	etag := route.ETag(req)
+
+	switch msg.Code {
+	case Get:
+		if etag != nil && containsETag(msg.GetETags(), etag) {
+			resp := ValidMessage(msg.MessageID, MessageAcknowledgment)
+			resp.AddOption(OptionEtag, etag)
+
+			return resp
+		}
+
+	case Post, Put, Delete:
+		if ifMatch := msg.GetOptions(OptionIfMatch); len(ifMatch) > 0 && !matchesIfMatch(ifMatch, etag) {
+			return PreconditionFailedMessage(msg.MessageID, MessageAcknowledgment)
+		}
+
+		if msg.GetOption(OptionIfNoneMatch) != nil && etag != nil {
+			return PreconditionFailedMessage(msg.MessageID, MessageAcknowledgment)
+		}
+	}
+	return nil
+}
+
+// Checks if the If-Match options of a request match the current entity-tag of a resource. An
+// empty If-Match option matches any existing resource
+func matchesIfMatch(ifMatch []*Option, etag []byte) bool {
+	if etag == nil {
+		return false
+	}
+
+	for _, opt := range ifMatch {
+		v := optionBytesValue(opt)
+		if len(v) == 0 || bytes.Equal(v, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsETag(etags [][]byte, etag []byte) bool {
+	for _, e := range etags {
+		if bytes.Equal(e, etag) {
+			return true
+		}
+	}
+	return false
+}
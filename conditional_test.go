@@ -0,0 +1,114 @@
+package coap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	handled := make(chan string, 4)
+	handler := func(req CoapRequest) CoapResponse {
+		msg := req.GetMessage()
+		handled <- msg.GetURIPath()
+
+		code := CoapCodeChanged
+		if msg.Code == Get {
+			code = CoapCodeContent
+		}
+		return NewResponseWithMessage(NewMessage(MessageAcknowledgment, code, msg.MessageID))
+	}
+	etag := func(CoapRequest) []byte { return []byte("v1") }
+
+	server, serverAddr := newTestServer(t)
+	server.Get("/res", handler).ETag = etag
+
+	put := server.Put("/res", handler)
+	put.ETag = etag
+	put.AutoAck = true
+
+	observed := make(chan string, 2)
+	server.OnObserve(func(resource string, msg *Message) {
+		observed <- resource
+	})
+
+	startTestServer(t, server)
+
+	conn := newTestConn(t)
+
+	receive := func() *Message {
+		msg := receiveTestMessage(t, conn, 2*time.Second)
+		if msg == nil {
+			t.Fatal("no response")
+		}
+		return msg
+	}
+
+	// Sends a request and returns the first message received in return
+	send := func(msg *Message) *Message {
+		msg.MessageID = GenerateMessageID()
+		msg.Token = []byte("t")
+		msg.AddOption(OptionURIPath, "res")
+
+		sendTestMessage(t, conn, msg, serverAddr)
+		return receive()
+	}
+
+	// Expects an event to be received, or not
+	expect := func(events chan string, want bool, event string) {
+		select {
+		case <-events:
+			if !want {
+				t.Errorf("the request was %s", event)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Errorf("the request wasn't %s", event)
+			}
+		}
+	}
+
+	// Failed preconditions are answered before the request is acknowledged
+	msg := NewMessage(MessageConfirmable, Put, 0)
+	msg.AddOption(OptionIfMatch, []byte("v0"))
+	if resp := send(msg); resp.Code != CoapCodePreconditionFailed {
+		t.Errorf("If-Match with another entity-tag = %s, want 4.12", CoapCodeToString(resp.Code))
+	}
+	expect(handled, false, "handled")
+
+	msg = NewMessage(MessageConfirmable, Put, 0)
+	msg.AddOption(OptionIfNoneMatch, nil)
+	if resp := send(msg); resp.Code != CoapCodePreconditionFailed {
+		t.Errorf("If-None-Match on an existing resource = %s, want 4.12", CoapCodeToString(resp.Code))
+	}
+	expect(handled, false, "handled")
+
+	msg = NewMessage(MessageConfirmable, Put, 0)
+	msg.AddOption(OptionIfMatch, []byte("v1"))
+	if resp := send(msg); resp.Code != CoapCodeEmpty || resp.MessageType != MessageAcknowledgment {
+		t.Errorf("If-Match with the current entity-tag = %s, want an empty ACK", CoapCodeToString(resp.Code))
+	}
+	expect(handled, true, "handled")
+
+	if resp := receive(); resp.Code != CoapCodeChanged {
+		t.Errorf("response after the ACK = %s, want 2.04", CoapCodeToString(resp.Code))
+	}
+
+	// Valid representations aren't observed
+	msg = NewMessage(MessageConfirmable, Get, 0)
+	msg.AddOption(OptionObserve, 0)
+	msg.AddOption(OptionEtag, []byte("v1"))
+	if resp := send(msg); resp.Code != CoapCodeValid {
+		t.Errorf("GET with the current entity-tag = %s, want 2.03", CoapCodeToString(resp.Code))
+	}
+	expect(handled, false, "handled")
+	expect(observed, false, "observed")
+
+	msg = NewMessage(MessageConfirmable, Get, 0)
+	msg.AddOption(OptionObserve, 0)
+	msg.AddOption(OptionEtag, []byte("v0"))
+	if resp := send(msg); resp.Code != CoapCodeContent {
+		t.Errorf("GET with another entity-tag = %s, want 2.05", CoapCodeToString(resp.Code))
+	}
+	expect(handled, true, "handled")
+	expect(observed, true, "observed")
+}
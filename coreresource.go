@@ -1,5 +1,28 @@
 package coap
 
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// CoRE Link Format (RFC 6690) target attributes
+const (
+	CoreAttributeContentType  = "ct"
+	CoreAttributeResourceType = "rt"
+	CoreAttributeInterface    = "if"
+	CoreAttributeMaxSize      = "sz"
+	CoreAttributeObservable   = "obs"
+	CoreAttributeTitle        = "title"
+	CoreAttributeAnchor       = "anchor"
+	CoreAttributeRelation     = "rel"
+	CoreAttributeHref         = "href"
+	CoreAttributeRevRelation  = "rev"
+	CoreAttributeHrefLanguage = "hreflang"
+	CoreAttributeMedia        = "media"
+	CoreAttributeMediaType    = "type"
+)
+
 // Instantiates a new core-attribute with a given key/value
 func NewCoreAttribute(key string, value interface{}) *CoreAttribute {
 	return &CoreAttribute{
@@ -8,11 +31,44 @@ func NewCoreAttribute(key string, value interface{}) *CoreAttribute {
 	}
 }
 
+// A CoreAttribute is a single link-param of a CoRE Link. Attributes without a value
+// (e.g. 'obs') have a nil Value
 type CoreAttribute struct {
 	Key   string
 	Value interface{}
 }
 
+// Returns the string value of an attribute, or an empty string for attributes without a value
+func (a *CoreAttribute) StringValue() string {
+	switch v := a.Value.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return v
+
+	case int:
+		return strconv.Itoa(v)
+
+	case MediaType:
+		return strconv.Itoa(int(v))
+	}
+	return ""
+}
+
+// Returns the attribute in link-format (e.g. rt="temperature")
+func (a *CoreAttribute) String() string {
+	if a.Value == nil {
+		return a.Key
+	}
+
+	v := a.StringValue()
+	if v != "" && isCoreCardinal(v) {
+		return a.Key + "=" + v
+	}
+	return a.Key + "=" + quoteCoreValue(v)
+}
+
 // Instantiates a new Core Resource Object
 func NewCoreResource() *CoreResource {
 	c := &CoreResource{}
@@ -40,3 +96,329 @@ func (c *CoreResource) GetAttribute(key string) *CoreAttribute {
 	}
 	return nil
 }
+
+// Gets all values of an attribute. Repeated attributes and space-separated
+// values (e.g. rt="light-lux core.sen") are returned as separate entries
+func (c *CoreResource) GetAttributeValues(key string) []string {
+	var values []string
+	for _, attr := range c.Attributes {
+		if attr.Key != key {
+			continue
+		}
+
+		if isCoreMultiValueAttribute(key) {
+			values = append(values, strings.Fields(attr.StringValue())...)
+		} else {
+			values = append(values, attr.StringValue())
+		}
+	}
+	return values
+}
+
+// Checks if the resource matches a discovery query (RFC 6690 Section 4.1). A value
+// ending with '*' matches any value prefixed with the value before the '*'
+func (c *CoreResource) MatchesQuery(key, value string) bool {
+	if key == CoreAttributeHref {
+		return matchCoreQueryValue(c.Target, value)
+	}
+
+	for _, attr := range c.Attributes {
+		if attr.Key == key && attr.Value == nil && value == "" {
+			return true
+		}
+	}
+
+	for _, v := range c.GetAttributeValues(key) {
+		if matchCoreQueryValue(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the resource as a link-value (e.g. </sensors/temp>;rt="temperature";obs)
+func (c *CoreResource) String() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("<")
+	buf.WriteString(c.Target)
+	buf.WriteString(">")
+	for _, attr := range c.Attributes {
+		buf.WriteString(";")
+		buf.WriteString(attr.String())
+	}
+	return buf.String()
+}
+
+// CoreResourcesToString serializes a list of CoRE Resources to application/link-format
+func CoreResourcesToString(resources []*CoreResource) string {
+	links := make([]string, 0, len(resources))
+	for _, r := range resources {
+		links = append(links, r.String())
+	}
+	return strings.Join(links, ",")
+}
+
+// FilterCoreResources returns the resources matching all given queries. Queries are
+// in the form of 'key=value' as sent in the Uri-Query options of a discovery request
+func FilterCoreResources(resources []*CoreResource, queries []string) []*CoreResource {
+	if len(queries) == 0 {
+		return resources
+	}
+
+	var filtered []*CoreResource
+	for _, r := range resources {
+		match := true
+		for _, q := range queries {
+			key, value := q, ""
+			if idx := strings.Index(q, "="); idx >= 0 {
+				key, value = q[:idx], q[idx+1:]
+			}
+
+			if !r.MatchesQuery(key, value) {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// CoreResourcesFromRoutes builds the list of discoverable resources from a set of routes.
+// Routes sharing the same path are merged into a single resource, while templated routes
+// (e.g. /users/:id) and the discovery resource itself are not listed
+func CoreResourcesFromRoutes(routes []*Route) []*CoreResource {
+	var resources []*CoreResource
+	seen := make(map[string]*CoreResource)
+
+	for _, r := range routes {
+		target := "/" + strings.TrimLeft(r.Path, "/")
+		if target == "/.well-known/core" || r.IsTemplated() {
+			continue
+		}
+
+		if existing, ok := seen[target]; ok {
+			mergeRouteMediaTypes(existing, r)
+			continue
+		}
+
+		resource := r.GetCoreResource()
+		seen[target] = resource
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+func mergeRouteMediaTypes(resource *CoreResource, r *Route) {
+	ct := resource.GetAttribute(CoreAttributeContentType)
+	existing := resource.GetAttributeValues(CoreAttributeContentType)
+
+	for _, mt := range r.MediaTypes {
+		v := strconv.Itoa(int(mt))
+		found := false
+		for _, e := range existing {
+			if e == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			existing = append(existing, v)
+		}
+	}
+
+	if len(existing) == 0 {
+		return
+	}
+
+	if ct == nil {
+		resource.AddAttribute(CoreAttributeContentType, strings.Join(existing, " "))
+	} else {
+		ct.Value = strings.Join(existing, " ")
+	}
+}
+
+func matchCoreQueryValue(v, query string) bool {
+	if strings.HasSuffix(query, "*") {
+		return strings.HasPrefix(v, query[:len(query)-1])
+	}
+	return v == query
+}
+
+func isCoreMultiValueAttribute(key string) bool {
+	switch key {
+	case CoreAttributeContentType, CoreAttributeResourceType, CoreAttributeInterface,
+		CoreAttributeRelation, CoreAttributeRevRelation:
+		return true
+	}
+	return false
+}
+
+func isCoreCardinal(v string) bool {
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteCoreValue(v string) string {
+	var buf bytes.Buffer
+
+	buf.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		if v[i] == '"' || v[i] == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(v[i])
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
+
+// Scanner for application/link-format documents
+type coreLinkScanner struct {
+	s   string
+	pos int
+}
+
+func (p *coreLinkScanner) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *coreLinkScanner) peek() byte {
+	return p.s[p.pos]
+}
+
+func (p *coreLinkScanner) skipWhitespace() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+
+		default:
+			return
+		}
+	}
+}
+
+// Skips to the start of the next link-value, used to recover from malformed links
+func (p *coreLinkScanner) skipLink() {
+	inQuote := false
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+
+		switch {
+		case inQuote && c == '\\':
+			p.pos++
+
+		case c == '"':
+			inQuote = !inQuote
+
+		case !inQuote && c == ',':
+			return
+		}
+	}
+}
+
+func (p *coreLinkScanner) readUntil(stop string) string {
+	start := p.pos
+	for !p.eof() && strings.IndexByte(stop, p.peek()) < 0 {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *coreLinkScanner) readQuoted() (string, bool) {
+	var buf bytes.Buffer
+
+	// Opening quote
+	p.pos++
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+
+		switch c {
+		case '\\':
+			if p.eof() {
+				return "", false
+			}
+			buf.WriteByte(p.peek())
+			p.pos++
+
+		case '"':
+			return buf.String(), true
+
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+func (p *coreLinkScanner) readLink() (*CoreResource, bool) {
+	if p.peek() != '<' {
+		return nil, false
+	}
+	p.pos++
+
+	target := p.readUntil(">")
+	if p.eof() {
+		return nil, false
+	}
+	p.pos++
+
+	resource := NewCoreResource()
+	resource.Target = target
+
+	for {
+		p.skipWhitespace()
+		if p.eof() {
+			return resource, true
+		}
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+			return resource, true
+
+		case ';':
+			p.pos++
+
+		default:
+			return nil, false
+		}
+
+		p.skipWhitespace()
+		key := strings.TrimSpace(p.readUntil("=;, \t\r\n"))
+		if key == "" {
+			return nil, false
+		}
+
+		p.skipWhitespace()
+		if p.eof() || p.peek() != '=' {
+			resource.AddAttribute(key, nil)
+			continue
+		}
+		p.pos++
+		p.skipWhitespace()
+
+		if !p.eof() && p.peek() == '"' {
+			value, ok := p.readQuoted()
+			if !ok {
+				return nil, false
+			}
+			resource.AddAttribute(key, value)
+		} else {
+			resource.AddAttribute(key, p.readUntil(";, \t\r\n"))
+		}
+	}
+}
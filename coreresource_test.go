@@ -0,0 +1,116 @@
+package coap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoreResourcesFromString(t *testing.T) {
+	doc := `</sensors/temp>;rt="temperature-c";if="sensor";ct="0 41";obs, ` +
+		`</sensors/light>;rt="light-lux core.sen";title="Light, \"lux\"";sz=1024,` +
+		`<http://example.com/x>;anchor="/sensors/temp";rel="describedby"`
+
+	resources := CoreResourcesFromString(doc)
+	if len(resources) != 3 {
+		t.Fatalf("parsed %d resources, want 3", len(resources))
+	}
+
+	temp := resources[0]
+	if temp.Target != "/sensors/temp" {
+		t.Errorf("target = %q", temp.Target)
+	}
+
+	if got := temp.GetAttributeValues(CoreAttributeContentType); !reflect.DeepEqual(got, []string{"0", "41"}) {
+		t.Errorf("ct = %q", got)
+	}
+
+	if attr := temp.GetAttribute(CoreAttributeObservable); attr == nil || attr.Value != nil {
+		t.Errorf("obs = %#v, want an attribute without value", attr)
+	}
+
+	light := resources[1]
+	if got := light.GetAttribute(CoreAttributeTitle).StringValue(); got != `Light, "lux"` {
+		t.Errorf("title = %q", got)
+	}
+
+	if got := light.GetAttributeValues(CoreAttributeResourceType); !reflect.DeepEqual(got, []string{"light-lux", "core.sen"}) {
+		t.Errorf("rt = %q", got)
+	}
+
+	if got := resources[2].GetAttribute(CoreAttributeAnchor).StringValue(); got != "/sensors/temp" {
+		t.Errorf("anchor = %q", got)
+	}
+}
+
+func TestCoreResourcesRoundTrip(t *testing.T) {
+	r := NewCoreResource()
+	r.Target = "/a"
+	r.AddAttribute(CoreAttributeResourceType, "x y")
+	r.AddAttribute(CoreAttributeContentType, MediaTypeApplicationJSON)
+	r.AddAttribute(CoreAttributeMaxSize, 64)
+	r.AddAttribute(CoreAttributeObservable, nil)
+	r.AddAttribute(CoreAttributeTitle, `say "hi"\`)
+
+	s := CoreResourcesToString([]*CoreResource{r, {Target: "/b"}})
+	if want := `</a>;rt="x y";ct=50;sz=64;obs;title="say \"hi\"\\",</b>`; s != want {
+		t.Fatalf("CoreResourcesToString = %s, want %s", s, want)
+	}
+
+	if got := CoreResourcesToString(CoreResourcesFromString(s)); got != s {
+		t.Fatalf("round trip = %s, want %s", got, s)
+	}
+}
+
+func TestCoreResourcesFromStringMalformed(t *testing.T) {
+	tests := []struct {
+		doc     string
+		targets []string
+	}{
+		{"", nil},
+		{",,, ", nil},
+		{"/a>;rt=x,</b>", []string{"/b"}},
+		{"</a", nil},
+		{`</a>;title="unterminated,</b>`, nil},
+		{"</a>;;rt=x,</b>;=x,</c>", []string{"/c"}},
+	}
+
+	for _, test := range tests {
+		var targets []string
+		for _, r := range CoreResourcesFromString(test.doc) {
+			targets = append(targets, r.Target)
+		}
+
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("CoreResourcesFromString(%q) = %q, want %q", test.doc, targets, test.targets)
+		}
+	}
+}
+
+func TestFilterCoreResources(t *testing.T) {
+	resources := CoreResourcesFromString(`</s/temp>;rt="temperature core.sen";ct=0,</s/light>;rt="light";obs,</a>;if=core.a`)
+
+	tests := []struct {
+		queries []string
+		targets []string
+	}{
+		{nil, []string{"/s/temp", "/s/light", "/a"}},
+		{[]string{"rt=core.sen"}, []string{"/s/temp"}},
+		{[]string{"rt=temp*"}, []string{"/s/temp"}},
+		{[]string{"href=/s*"}, []string{"/s/temp", "/s/light"}},
+		{[]string{"href=/s*", "ct=0"}, []string{"/s/temp"}},
+		{[]string{"obs"}, []string{"/s/light"}},
+		{[]string{"if=core.a"}, []string{"/a"}},
+		{[]string{"rt=none"}, nil},
+	}
+
+	for _, test := range tests {
+		var targets []string
+		for _, r := range FilterCoreResources(resources, test.queries) {
+			targets = append(targets, r.Target)
+		}
+
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("FilterCoreResources(%q) = %q, want %q", test.queries, targets, test.targets)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package coap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultEchoFreshness is how long Echo values and verified client addresses remain fresh
+const DefaultEchoFreshness = 60 * time.Second
+
+// DefaultMaxAmplification is the factor by which a response to an unverified client may exceed
+// the size of its request (RFC 9175 Section 2.4)
+const DefaultMaxAmplification = 3
+
+// Lengths of the issue time and of the authentication code making up an Echo value
+const (
+	echoTimeLength = 8
+	echoMACLength  = 8
+)
+
+// EchoPolicy decides which requests a server challenges with an Echo option before responding
+// to them (RFC 9175 Section 2). Challenged clients repeat their request echoing the value, which
+// proves that they receive messages sent to their address and that their request is fresh
+type EchoPolicy struct {
+	// Challenges the requests of clients whose address hasn't been verified
+	VerifyClients bool
+
+	// Challenges requests with unsafe methods (e.g. POST, PUT, DELETE and PATCH) which don't echo
+	// a fresh value, so that delayed or replayed requests don't act on resources
+	RequireFreshness bool
+
+	// Unverified clients are challenged instead of being sent responses exceeding the size of
+	// their request by this factor. Zero disables the limit. As the response is only known once
+	// the request was handled, unsafe requests should be challenged with RequireFreshness instead
+	MaxAmplification int
+
+	// How long Echo values and verified client addresses remain fresh
+	Freshness time.Duration
+
+	key      []byte
+	verified map[string]time.Time
+	mu       sync.Mutex
+}
+
+// Instantiates an Echo policy limiting the amplification of responses to unverified clients
+func NewEchoPolicy() *EchoPolicy {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+
+	return &EchoPolicy{
+		MaxAmplification: DefaultMaxAmplification,
+		Freshness:        DefaultEchoFreshness,
+		key:              key,
+		verified:         make(map[string]time.Time),
+	}
+}
+
+// Returns a new Echo value for a client. Values carry the time they were issued and are
+// authenticated for the client's address, so that they are verified without keeping state
+func (p *EchoPolicy) NewEchoValue(addr *net.UDPAddr) []byte {
+	value := make([]byte, echoTimeLength, echoTimeLength+echoMACLength)
+	binary.BigEndian.PutUint64(value, uint64(time.Now().UnixNano()))
+
+	return append(value, p.echoMAC(value, addr)...)
+}
+
+// Verifies a value echoed by a client. Fresh values issued to the client's address verify it
+func (p *EchoPolicy) VerifyEcho(value []byte, addr *net.UDPAddr) bool {
+	if len(value) != echoTimeLength+echoMACLength {
+		return false
+	}
+
+	if !hmac.Equal(value[echoTimeLength:], p.echoMAC(value[:echoTimeLength], addr)) {
+		return false
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	if age := time.Since(issued); age < 0 || age > p.Freshness {
+		return false
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for k, t := range p.verified {
+		if now.Sub(t) > p.Freshness {
+			delete(p.verified, k)
+		}
+	}
+	p.verified[addr.String()] = now
+	p.mu.Unlock()
+
+	return true
+}
+
+// Determines if a client's address was recently verified by echoing a value
+func (p *EchoPolicy) IsVerified(addr *net.UDPAddr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.verified[addr.String()]
+	return ok && time.Since(t) <= p.Freshness
+}
+
+// Determines if a request must be challenged before it is handled. A fresh value echoed by the
+// request verifies the client
+func (p *EchoPolicy) mustChallenge(msg *Message, addr *net.UDPAddr) bool {
+	if opt := msg.GetOption(OptionEcho); opt != nil {
+		if value, err := opt.GetOpaque(); err == nil && p.VerifyEcho(value, addr) {
+			return false
+		}
+	}
+
+	if p.RequireFreshness && !IsSafeMethod(msg.Code) {
+		return true
+	}
+	return p.VerifyClients && !p.IsVerified(addr)
+}
+
+// Determines if a response to an unverified client exceeds the amplification limit
+func (p *EchoPolicy) exceedsAmplification(req, resp *Message, addr *net.UDPAddr) bool {
+	if p.MaxAmplification <= 0 || p.IsVerified(addr) {
+		return false
+	}
+	return messageSize(resp) > p.MaxAmplification*messageSize(req)
+}
+
+// Creates a 4.01 Unauthorized response challenging a request with a new Echo value
+func (p *EchoPolicy) challengeMessage(msg *Message, addr *net.UDPAddr) *Message {
+	ret := UnauthorizedMessage(msg.MessageID, MessageAcknowledgment)
+	ret.AddOption(OptionEcho, p.NewEchoValue(addr))
+
+	return ret
+}
+
+// Returns the authentication code of the issue time of an Echo value for an address
+func (p *EchoPolicy) echoMAC(issued []byte, addr *net.UDPAddr) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(issued)
+	mac.Write([]byte(addr.String()))
+
+	return mac.Sum(nil)[:echoMACLength]
+}
+
+// Returns the encoded size of a message
+func messageSize(msg *Message) int {
+	buf := getMessageBuffer()
+	defer putMessageBuffer(buf)
+
+	b, _ := msg.MarshalTo((*buf)[:0])
+	return len(b)
+}
@@ -0,0 +1,180 @@
+package coap
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyEcho(t *testing.T) {
+	p := NewEchoPolicy()
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5684}
+
+	// Returns a value issued at a given time for an address
+	issue := func(issued time.Time, addr *net.UDPAddr) []byte {
+		value := make([]byte, echoTimeLength)
+		binary.BigEndian.PutUint64(value, uint64(issued.UnixNano()))
+
+		return append(value, p.echoMAC(value, addr)...)
+	}
+
+	value := p.NewEchoValue(addr)
+	if len(value) != echoTimeLength+echoMACLength {
+		t.Fatalf("Echo value of %d bytes", len(value))
+	}
+
+	tampered := append([]byte(nil), value...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	backdated := append([]byte(nil), value...)
+	backdated[echoTimeLength-1] ^= 0x01
+
+	tests := []struct {
+		name  string
+		value []byte
+		addr  *net.UDPAddr
+		valid bool
+	}{
+		{"fresh value", value, addr, true},
+		{"value of another address", value, other, false},
+		{"tampered MAC", tampered, addr, false},
+		{"tampered issue time", backdated, addr, false},
+		{"truncated value", value[:len(value)-1], addr, false},
+		{"extended value", append(append([]byte(nil), value...), 0), addr, false},
+		{"empty value", nil, addr, false},
+		{"expired value", issue(time.Now().Add(-p.Freshness-time.Second), addr), addr, false},
+		{"value issued in the future", issue(time.Now().Add(time.Minute), addr), addr, false},
+		{"value about to expire", issue(time.Now().Add(-p.Freshness+time.Second), addr), addr, true},
+	}
+
+	for _, test := range tests {
+		if valid := p.VerifyEcho(test.value, test.addr); valid != test.valid {
+			t.Errorf("%s: VerifyEcho = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+
+	// Values verify the address of the client echoing them
+	if !p.IsVerified(addr) || p.IsVerified(other) {
+		t.Errorf("verified: %v, other address %v", p.IsVerified(addr), p.IsVerified(other))
+	}
+
+	// Values of another policy aren't valid
+	if NewEchoPolicy().VerifyEcho(value, addr) {
+		t.Error("the value of another policy was verified")
+	}
+}
+
+func TestEchoMustChallenge(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+
+	request := func(code CoapCode, echo []byte) *Message {
+		msg := NewMessage(MessageConfirmable, code, 1)
+		if echo != nil {
+			msg.AddOption(OptionEcho, echo)
+		}
+		return msg
+	}
+
+	// Requests with unsafe methods must be fresh
+	p := NewEchoPolicy()
+	p.RequireFreshness = true
+
+	for _, code := range []CoapCode{Get, Fetch} {
+		if p.mustChallenge(request(code, nil), addr) {
+			t.Errorf("request with safe method %d was challenged", code)
+		}
+	}
+
+	for _, code := range []CoapCode{Post, Put, Delete, Patch, IPatch} {
+		if !p.mustChallenge(request(code, nil), addr) {
+			t.Errorf("request with unsafe method %d wasn't challenged", code)
+		}
+
+		if p.mustChallenge(request(code, p.NewEchoValue(addr)), addr) {
+			t.Errorf("request with unsafe method %d echoing a fresh value was challenged", code)
+		}
+	}
+
+	// Verified clients aren't exempted from freshness
+	if !p.mustChallenge(request(Post, nil), addr) {
+		t.Error("request of a verified client wasn't challenged")
+	}
+
+	// Unverified clients are challenged until they echo a value
+	p = NewEchoPolicy()
+	p.VerifyClients = true
+
+	if !p.mustChallenge(request(Get, nil), addr) {
+		t.Error("request of an unverified client wasn't challenged")
+	}
+
+	if !p.mustChallenge(request(Get, []byte("invalid")), addr) {
+		t.Error("request echoing an invalid value wasn't challenged")
+	}
+
+	if p.mustChallenge(request(Get, p.NewEchoValue(addr)), addr) || p.mustChallenge(request(Post, nil), addr) {
+		t.Error("request of a verified client was challenged")
+	}
+
+	// Challenges carry a new value in a 4.01 Unauthorized response
+	challenge := p.challengeMessage(request(Get, nil), addr)
+	if challenge.Code != CoapCodeUnauthorized || challenge.MessageType != MessageAcknowledgment {
+		t.Errorf("challenge = %s", CoapCodeToString(challenge.Code))
+	}
+
+	if value, err := challenge.GetOption(OptionEcho).GetOpaque(); err != nil || !p.VerifyEcho(value, addr) {
+		t.Errorf("challenge Echo value %x (%v) doesn't verify", value, err)
+	}
+}
+
+func TestEchoExceedsAmplification(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+
+	req := NewMessage(MessageConfirmable, Get, 1)
+	req.Token = []byte("t")
+	req.AddOption(OptionURIPath, "a")
+	size := messageSize(req)
+
+	response := func(payloadSize int) *Message {
+		resp := ContentMessage(1, MessageAcknowledgment)
+		resp.Token = []byte("t")
+
+		// The header, token and payload marker make up 6 bytes of the response
+		resp.SetStringPayload(strings.Repeat("x", payloadSize-6))
+		return resp
+	}
+
+	p := NewEchoPolicy()
+
+	if messageSize(response(3*size)) != 3*size {
+		t.Fatalf("response size = %d, want %d", messageSize(response(3*size)), 3*size)
+	}
+
+	if p.exceedsAmplification(req, response(3*size), addr) {
+		t.Error("a response of 3 times the request's size exceeds the limit")
+	}
+
+	if !p.exceedsAmplification(req, response(3*size+1), addr) {
+		t.Error("a response over 3 times the request's size doesn't exceed the limit")
+	}
+
+	// Verified clients aren't limited
+	if !p.VerifyEcho(p.NewEchoValue(addr), addr) {
+		t.Fatal("the value wasn't verified")
+	}
+
+	if p.exceedsAmplification(req, response(10*size), addr) {
+		t.Error("the response to a verified client exceeds the limit")
+	}
+
+	// Zero disables the limit
+	p = NewEchoPolicy()
+	p.MaxAmplification = 0
+
+	if p.exceedsAmplification(req, response(10*size), addr) {
+		t.Error("the response exceeds a disabled limit")
+	}
+}
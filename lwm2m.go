@@ -0,0 +1,709 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifier types of LwM2M TLV records (OMA LwM2M 1.0 Section 6.4.3)
+type LwM2MTLVType uint8
+
+const (
+	LwM2MTLVObjectInstance   LwM2MTLVType = 0
+	LwM2MTLVResourceInstance LwM2MTLVType = 1
+	LwM2MTLVMultipleResource LwM2MTLVType = 2
+	LwM2MTLVResource         LwM2MTLVType = 3
+)
+
+// LwM2MObjectLink is an Objlnk value referencing an object instance
+type LwM2MObjectLink struct {
+	ObjectID   uint16
+	InstanceID uint16
+}
+
+func (l LwM2MObjectLink) String() string {
+	return strconv.Itoa(int(l.ObjectID)) + ":" + strconv.Itoa(int(l.InstanceID))
+}
+
+// Parses an Objlnk value in the form ObjectID:InstanceID
+func ParseLwM2MObjectLink(s string) (LwM2MObjectLink, error) {
+	ps := strings.Split(s, ":")
+	if len(ps) != 2 {
+		return LwM2MObjectLink{}, ErrLwM2MValueType
+	}
+
+	obj, err := strconv.ParseUint(ps[0], 10, 16)
+	if err != nil {
+		return LwM2MObjectLink{}, ErrLwM2MValueType
+	}
+
+	inst, err := strconv.ParseUint(ps[1], 10, 16)
+	if err != nil {
+		return LwM2MObjectLink{}, ErrLwM2MValueType
+	}
+	return LwM2MObjectLink{ObjectID: uint16(obj), InstanceID: uint16(inst)}, nil
+}
+
+// LwM2MTLV is a record of the LwM2M TLV format. Object instances and multiple resources contain
+// resources and resource instances, while resources and resource instances hold a value
+type LwM2MTLV struct {
+	Type     LwM2MTLVType
+	ID       uint16
+	Value    []byte
+	Children []*LwM2MTLV
+}
+
+// Instantiates a new TLV object instance containing resources
+func NewLwM2MTLVObjectInstance(id uint16, resources ...*LwM2MTLV) *LwM2MTLV {
+	return &LwM2MTLV{Type: LwM2MTLVObjectInstance, ID: id, Children: resources}
+}
+
+// Instantiates a new TLV multiple resource containing resource instances
+func NewLwM2MTLVMultipleResource(id uint16, instances ...*LwM2MTLV) *LwM2MTLV {
+	return &LwM2MTLV{Type: LwM2MTLVMultipleResource, ID: id, Children: instances}
+}
+
+// Instantiates a new TLV resource with a typed value. Supported values are strings, integers,
+// floats, booleans, byte slices (opaque), times and object links
+func NewLwM2MTLVResource(id uint16, v interface{}) (*LwM2MTLV, error) {
+	b, err := encodeLwM2MTLVValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &LwM2MTLV{Type: LwM2MTLVResource, ID: id, Value: b}, nil
+}
+
+// Instantiates a new TLV resource instance with a typed value
+func NewLwM2MTLVResourceInstance(id uint16, v interface{}) (*LwM2MTLV, error) {
+	b, err := encodeLwM2MTLVValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &LwM2MTLV{Type: LwM2MTLVResourceInstance, ID: id, Value: b}, nil
+}
+
+// Returns the child record with the given identifier, or nil if there is none
+func (t *LwM2MTLV) GetChild(id uint16) *LwM2MTLV {
+	for _, c := range t.Children {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Checks if the record contains other records rather than a value
+func (t *LwM2MTLV) IsContainer() bool {
+	return t.Type == LwM2MTLVObjectInstance || t.Type == LwM2MTLVMultipleResource
+}
+
+func (t *LwM2MTLV) GetString() string {
+	return string(t.Value)
+}
+
+func (t *LwM2MTLV) GetOpaque() []byte {
+	return t.Value
+}
+
+// Returns the value as an integer, which is encoded in 1, 2, 4 or 8 bytes
+func (t *LwM2MTLV) GetInt() (int64, error) {
+	switch len(t.Value) {
+	case 1:
+		return int64(int8(t.Value[0])), nil
+
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(t.Value))), nil
+
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(t.Value))), nil
+
+	case 8:
+		return int64(binary.BigEndian.Uint64(t.Value)), nil
+	}
+	return 0, ErrLwM2MValueType
+}
+
+// Returns the value as a float, which is encoded in 4 or 8 bytes
+func (t *LwM2MTLV) GetFloat() (float64, error) {
+	switch len(t.Value) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(t.Value))), nil
+
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(t.Value)), nil
+	}
+	return 0, ErrLwM2MValueType
+}
+
+func (t *LwM2MTLV) GetBool() (bool, error) {
+	if len(t.Value) != 1 || t.Value[0] > 1 {
+		return false, ErrLwM2MValueType
+	}
+	return t.Value[0] == 1, nil
+}
+
+// Returns the value as a time, which is encoded as an integer of seconds since the Unix epoch
+func (t *LwM2MTLV) GetTime() (time.Time, error) {
+	sec, err := t.GetInt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+func (t *LwM2MTLV) GetObjectLink() (LwM2MObjectLink, error) {
+	if len(t.Value) != 4 {
+		return LwM2MObjectLink{}, ErrLwM2MValueType
+	}
+
+	return LwM2MObjectLink{
+		ObjectID:   binary.BigEndian.Uint16(t.Value[:2]),
+		InstanceID: binary.BigEndian.Uint16(t.Value[2:]),
+	}, nil
+}
+
+// Encodes a typed value as the value of a TLV resource
+func encodeLwM2MTLVValue(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		return []byte(t), nil
+
+	case []byte:
+		return t, nil
+
+	case bool:
+		if t {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+
+	case int:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case int8:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case int16:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case int32:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case int64:
+		return encodeLwM2MTLVInt(t), nil
+
+	case uint8:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case uint16:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case uint32:
+		return encodeLwM2MTLVInt(int64(t)), nil
+
+	case float32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(t))
+		return b, nil
+
+	case float64:
+		if float64(float32(t)) == t {
+			return encodeLwM2MTLVValue(float32(t))
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(t))
+		return b, nil
+
+	case time.Time:
+		return encodeLwM2MTLVInt(t.Unix()), nil
+
+	case LwM2MObjectLink:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint16(b[:2], t.ObjectID)
+		binary.BigEndian.PutUint16(b[2:], t.InstanceID)
+		return b, nil
+	}
+	return nil, ErrLwM2MValueType
+}
+
+// Encodes an integer in the shortest of 1, 2, 4 or 8 bytes
+func encodeLwM2MTLVInt(i int64) []byte {
+	switch {
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return []byte{byte(i)}
+
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(i))
+		return b
+
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(i))
+		return b
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+// EncodeLwM2MTLV encodes records in the LwM2M TLV format
+func EncodeLwM2MTLV(records []*LwM2MTLV) []byte {
+	buf := new(bytes.Buffer)
+	for _, r := range records {
+		writeLwM2MTLV(buf, r)
+	}
+	return buf.Bytes()
+}
+
+func writeLwM2MTLV(buf *bytes.Buffer, r *LwM2MTLV) {
+	value := r.Value
+	if r.IsContainer() {
+		value = EncodeLwM2MTLV(r.Children)
+	}
+
+	typ := byte(r.Type) << 6
+	if r.ID > math.MaxUint8 {
+		typ |= 0x20
+	}
+
+	l := len(value)
+	switch {
+	case l < 8:
+		typ |= byte(l)
+
+	case l <= math.MaxUint8:
+		typ |= 0x08
+
+	case l <= math.MaxUint16:
+		typ |= 0x10
+
+	default:
+		typ |= 0x18
+	}
+	buf.WriteByte(typ)
+
+	if r.ID > math.MaxUint8 {
+		buf.WriteByte(byte(r.ID >> 8))
+	}
+	buf.WriteByte(byte(r.ID))
+
+	switch typ & 0x18 {
+	case 0x18:
+		buf.WriteByte(byte(l >> 16))
+		fallthrough
+
+	case 0x10:
+		buf.WriteByte(byte(l >> 8))
+		fallthrough
+
+	case 0x08:
+		buf.WriteByte(byte(l))
+	}
+	buf.Write(value)
+}
+
+// DecodeLwM2MTLV decodes records in the LwM2M TLV format
+func DecodeLwM2MTLV(data []byte) ([]*LwM2MTLV, error) {
+	return decodeLwM2MTLV(data, nil)
+}
+
+// Decodes the records contained in a parent record, or top level records if parent is nil
+func decodeLwM2MTLV(data []byte, parent *LwM2MTLV) ([]*LwM2MTLV, error) {
+	var records []*LwM2MTLV
+	for len(data) > 0 {
+		typ := data[0]
+		data = data[1:]
+
+		idLen := 1
+		if typ&0x20 != 0 {
+			idLen = 2
+		}
+		lenLen := int(typ>>3) & 0x03
+
+		if len(data) < idLen+lenLen {
+			return nil, ErrInvalidLwM2MTLV
+		}
+
+		r := &LwM2MTLV{Type: LwM2MTLVType(typ >> 6)}
+		if idLen == 2 {
+			r.ID = binary.BigEndian.Uint16(data)
+		} else {
+			r.ID = uint16(data[0])
+		}
+		data = data[idLen:]
+
+		l := int(typ & 0x07)
+		if lenLen > 0 {
+			l = 0
+			for _, b := range data[:lenLen] {
+				l = l<<8 | int(b)
+			}
+		}
+		data = data[lenLen:]
+
+		if len(data) < l {
+			return nil, ErrInvalidLwM2MTLV
+		}
+		value := data[:l]
+		data = data[l:]
+
+		if parent != nil && !isLwM2MTLVChild(parent.Type, r.Type) {
+			return nil, ErrInvalidLwM2MTLV
+		}
+
+		if r.IsContainer() {
+			children, err := decodeLwM2MTLV(value, r)
+			if err != nil {
+				return nil, err
+			}
+			r.Children = children
+		} else {
+			r.Value = append([]byte(nil), value...)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Object instances contain resources and multiple resources contain resource instances
+func isLwM2MTLVChild(parent LwM2MTLVType, child LwM2MTLVType) bool {
+	switch parent {
+	case LwM2MTLVObjectInstance:
+		return child == LwM2MTLVResource || child == LwM2MTLVMultipleResource
+
+	case LwM2MTLVMultipleResource:
+		return child == LwM2MTLVResourceInstance
+	}
+	return false
+}
+
+// LwM2MJSON is a payload in the LwM2M JSON format (OMA LwM2M 1.0 Section 6.4.4)
+type LwM2MJSON struct {
+	BaseName string           `json:"bn,omitempty"`
+	BaseTime float64          `json:"bt,omitempty"`
+	Entries  []LwM2MJSONEntry `json:"e"`
+}
+
+// LwM2MJSONEntry is a resource or resource instance of a LwM2M JSON payload, named by its path
+// relative to the base name
+type LwM2MJSONEntry struct {
+	Name            string   `json:"n,omitempty"`
+	Value           *float64 `json:"v,omitempty"`
+	StringValue     *string  `json:"sv,omitempty"`
+	BoolValue       *bool    `json:"bv,omitempty"`
+	ObjectLinkValue *string  `json:"ov,omitempty"`
+	Time            float64  `json:"t,omitempty"`
+}
+
+// Instantiates a new LwM2M JSON entry with a typed value. Supported values are strings,
+// integers, floats, booleans, byte slices (opaque, base64 encoded), times and object links
+func NewLwM2MJSONEntry(name string, v interface{}) (LwM2MJSONEntry, error) {
+	e := LwM2MJSONEntry{Name: name}
+
+	switch t := v.(type) {
+	case string:
+		e.StringValue = &t
+
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(t)
+		e.StringValue = &s
+
+	case bool:
+		e.BoolValue = &t
+
+	case time.Time:
+		f := float64(t.Unix())
+		e.Value = &f
+
+	case LwM2MObjectLink:
+		s := t.String()
+		e.ObjectLinkValue = &s
+
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, float32, float64:
+		f, _ := strconv.ParseFloat(fmt.Sprint(t), 64)
+		e.Value = &f
+
+	default:
+		return e, ErrLwM2MValueType
+	}
+	return e, nil
+}
+
+// Returns the entry with the given path (base name and entry name), or nil if there is none
+func (j *LwM2MJSON) GetEntry(path string) *LwM2MJSONEntry {
+	for i, e := range j.Entries {
+		if j.BaseName+e.Name == path {
+			return &j.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Returns the absolute time of an entry
+func (j *LwM2MJSON) GetTime(e *LwM2MJSONEntry) time.Time {
+	sec, frac := math.Modf(j.BaseTime + e.Time)
+
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func (e *LwM2MJSONEntry) GetString() (string, error) {
+	if e.StringValue == nil {
+		return "", ErrLwM2MValueType
+	}
+	return *e.StringValue, nil
+}
+
+// Returns an opaque value, which is carried base64 encoded in a string value
+func (e *LwM2MJSONEntry) GetOpaque() ([]byte, error) {
+	if e.StringValue == nil {
+		return nil, ErrLwM2MValueType
+	}
+	return base64.StdEncoding.DecodeString(*e.StringValue)
+}
+
+func (e *LwM2MJSONEntry) GetFloat() (float64, error) {
+	if e.Value == nil {
+		return 0, ErrLwM2MValueType
+	}
+	return *e.Value, nil
+}
+
+func (e *LwM2MJSONEntry) GetInt() (int64, error) {
+	if e.Value == nil || *e.Value != math.Trunc(*e.Value) {
+		return 0, ErrLwM2MValueType
+	}
+	return int64(*e.Value), nil
+}
+
+func (e *LwM2MJSONEntry) GetBool() (bool, error) {
+	if e.BoolValue == nil {
+		return false, ErrLwM2MValueType
+	}
+	return *e.BoolValue, nil
+}
+
+func (e *LwM2MJSONEntry) GetObjectLink() (LwM2MObjectLink, error) {
+	if e.ObjectLinkValue == nil {
+		return LwM2MObjectLink{}, ErrLwM2MValueType
+	}
+	return ParseLwM2MObjectLink(*e.ObjectLinkValue)
+}
+
+// EncodeLwM2MJSON encodes a payload in the LwM2M JSON format
+func EncodeLwM2MJSON(j *LwM2MJSON) ([]byte, error) {
+	if j.Entries == nil {
+		j = &LwM2MJSON{BaseName: j.BaseName, BaseTime: j.BaseTime, Entries: []LwM2MJSONEntry{}}
+	}
+	return json.Marshal(j)
+}
+
+// DecodeLwM2MJSON decodes a payload in the LwM2M JSON format
+func DecodeLwM2MJSON(data []byte) (*LwM2MJSON, error) {
+	j := &LwM2MJSON{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, ErrInvalidLwM2MJSON
+	}
+	return j, nil
+}
+
+func init() {
+	RegisterRepresentationEncoder(MediaTypeTlvVndOmaLwm2m, func(v interface{}) ([]byte, error) {
+		switch t := v.(type) {
+		case []*LwM2MTLV:
+			return EncodeLwM2MTLV(t), nil
+
+		case *LwM2MTLV:
+			return EncodeLwM2MTLV([]*LwM2MTLV{t}), nil
+		}
+		return nil, ErrUnsupportedRepresentation
+	})
+
+	RegisterRepresentationEncoder(MediaTypeJSONVndOmaLwm2m, func(v interface{}) ([]byte, error) {
+		switch t := v.(type) {
+		case *LwM2MJSON:
+			return EncodeLwM2MJSON(t)
+
+		case LwM2MJSON:
+			return EncodeLwM2MJSON(&t)
+		}
+		return nil, ErrUnsupportedRepresentation
+	})
+
+	RegisterRepresentationEncoder(MediaTypeTextPlainVndOmaLwm2m, EncodeText)
+	RegisterRepresentationEncoder(MediaTypeOpaqueVndOmaLwm2m, EncodeOctetStream)
+
+	RegisterRepresentationDecoder(MediaTypeTlvVndOmaLwm2m, func(data []byte, v interface{}) error {
+		t, ok := v.(*[]*LwM2MTLV)
+		if !ok {
+			return ErrUnsupportedRepresentation
+		}
+
+		records, err := DecodeLwM2MTLV(data)
+		if err != nil {
+			return err
+		}
+		*t = records
+
+		return nil
+	})
+
+	RegisterRepresentationDecoder(MediaTypeJSONVndOmaLwm2m, func(data []byte, v interface{}) error {
+		t, ok := v.(*LwM2MJSON)
+		if !ok {
+			return ErrUnsupportedRepresentation
+		}
+
+		j, err := DecodeLwM2MJSON(data)
+		if err != nil {
+			return err
+		}
+		*t = *j
+
+		return nil
+	})
+
+	RegisterRepresentationDecoder(MediaTypeTextPlainVndOmaLwm2m, DecodeText)
+	RegisterRepresentationDecoder(MediaTypeOpaqueVndOmaLwm2m, DecodeText)
+}
+
+// DecodeLwM2MTLVPayload decodes the records of a message in application/vnd.oma.lwm2m+tlv
+func DecodeLwM2MTLVPayload(msg *Message) ([]*LwM2MTLV, error) {
+	if mt, _ := msg.GetContentFormat(); mt != MediaTypeTlvVndOmaLwm2m {
+		return nil, ErrUnsupportedPayloadFormat
+	}
+
+	var records []*LwM2MTLV
+	if err := DecodeMessagePayload(msg, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DecodeLwM2MJSONPayload decodes the payload of a message in application/vnd.oma.lwm2m+json
+func DecodeLwM2MJSONPayload(msg *Message) (*LwM2MJSON, error) {
+	if mt, _ := msg.GetContentFormat(); mt != MediaTypeJSONVndOmaLwm2m {
+		return nil, ErrUnsupportedPayloadFormat
+	}
+
+	j := &LwM2MJSON{}
+	if err := DecodeMessagePayload(msg, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Instantiates a new message payload containing records in application/vnd.oma.lwm2m+tlv
+func NewLwM2MTLVPayload(records ...*LwM2MTLV) MessagePayload {
+	return &LwM2MTLVPayload{
+		Records: records,
+	}
+}
+
+// Represents a message payload containing records in application/vnd.oma.lwm2m+tlv
+type LwM2MTLVPayload struct {
+	Records []*LwM2MTLV
+}
+
+func (p *LwM2MTLVPayload) GetBytes() []byte {
+	return EncodeLwM2MTLV(p.Records)
+}
+
+func (p *LwM2MTLVPayload) Length() int {
+	return len(p.GetBytes())
+}
+
+func (p *LwM2MTLVPayload) String() string {
+	var s []string
+	for _, r := range p.Records {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// Returns the record in a readable form, e.g. 0:[3=8]
+func (t *LwM2MTLV) String() string {
+	if !t.IsContainer() {
+		return fmt.Sprintf("%d=%x", t.ID, t.Value)
+	}
+
+	var s []string
+	for _, c := range t.Children {
+		s = append(s, c.String())
+	}
+	return fmt.Sprintf("%d:[%s]", t.ID, strings.Join(s, " "))
+}
+
+// Instantiates a new message payload in application/vnd.oma.lwm2m+json
+func NewLwM2MJSONPayload(j *LwM2MJSON) MessagePayload {
+	return &LwM2MJSONPayload{
+		Content: j,
+	}
+}
+
+// Represents a message payload in application/vnd.oma.lwm2m+json
+type LwM2MJSONPayload struct {
+	Content *LwM2MJSON
+}
+
+func (p *LwM2MJSONPayload) GetBytes() []byte {
+	b, err := EncodeLwM2MJSON(p.Content)
+
+	if err != nil {
+		log.Println(err)
+
+		return []byte{}
+	}
+
+	return b
+}
+
+func (p *LwM2MJSONPayload) Length() int {
+	return len(p.GetBytes())
+}
+
+func (p *LwM2MJSONPayload) String() string {
+	return string(p.GetBytes())
+}
+
+// ParseLwM2MPath parses a path such as /3/0/1 into its object, instance, resource and resource
+// instance identifiers
+func ParseLwM2MPath(path string) ([]uint16, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+
+	ps := strings.Split(path, "/")
+	if len(ps) > 4 {
+		return nil, ErrInvalidLwM2MPath
+	}
+
+	ids := make([]uint16, len(ps))
+	for i, p := range ps {
+		id, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, ErrInvalidLwM2MPath
+		}
+		ids[i] = uint16(id)
+	}
+	return ids, nil
+}
+
+// Returns the path of object, instance, resource and resource instance identifiers
+func lwm2mPath(ids []uint16) string {
+	var ps []string
+	for _, id := range ids {
+		ps = append(ps, strconv.Itoa(int(id)))
+	}
+	return "/" + strings.Join(ps, "/")
+}
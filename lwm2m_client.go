@@ -0,0 +1,1215 @@
+package coap
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LwM2MVersion is the version of the LwM2M enabler registered by clients
+const LwM2MVersion = "1.1"
+
+// LwM2M registration parameters sent along with the Resource Directory parameters
+const (
+	LwM2MParamVersion = "lwm2m"
+	LwM2MParamBinding = "b"
+)
+
+// LwM2MBindingUDP is the binding mode of clients reachable over UDP
+const LwM2MBindingUDP = "U"
+
+// Data types of LwM2M resources
+type LwM2MResourceType int
+
+const (
+	LwM2MTypeString LwM2MResourceType = iota
+	LwM2MTypeInteger
+	LwM2MTypeFloat
+	LwM2MTypeBoolean
+	LwM2MTypeOpaque
+	LwM2MTypeTime
+	LwM2MTypeObjectLink
+	LwM2MTypeNone
+)
+
+// Operations a server may perform on a LwM2M resource
+type LwM2MOperations uint8
+
+const (
+	LwM2MOperationRead LwM2MOperations = 1 << iota
+	LwM2MOperationWrite
+	LwM2MOperationExecute
+)
+
+// Instantiates a new single-instance resource. Values are strings, int64s, float64s, bools,
+// byte slices, times or object links according to the resource's type
+func NewLwM2MResource(id uint16, typ LwM2MResourceType, ops LwM2MOperations, v interface{}) *LwM2MResource {
+	return &LwM2MResource{
+		ID:         id,
+		Type:       typ,
+		Operations: ops,
+		Value:      v,
+	}
+}
+
+// Instantiates a new multiple-instance resource with values by resource instance id
+func NewLwM2MMultipleResource(id uint16, typ LwM2MResourceType, ops LwM2MOperations, values map[uint16]interface{}) *LwM2MResource {
+	if values == nil {
+		values = make(map[uint16]interface{})
+	}
+
+	return &LwM2MResource{
+		ID:         id,
+		Type:       typ,
+		Operations: ops,
+		Multiple:   true,
+		Instances:  values,
+	}
+}
+
+// Instantiates a new executable resource
+func NewLwM2MExecutableResource(id uint16, fn func(args string) error) *LwM2MResource {
+	return &LwM2MResource{
+		ID:         id,
+		Type:       LwM2MTypeNone,
+		Operations: LwM2MOperationExecute,
+		OnExecute:  fn,
+	}
+}
+
+// LwM2MResource is a resource of a LwM2M object instance holding a value, or a value per
+// resource instance for multiple-instance resources
+type LwM2MResource struct {
+	ID         uint16
+	Type       LwM2MResourceType
+	Operations LwM2MOperations
+	Multiple   bool
+	Value      interface{}
+	Instances  map[uint16]interface{}
+
+	// OnExecute is called when a server executes the resource with the arguments of the request
+	OnExecute func(args string) error
+
+	// OnWrite is called after a server wrote the resource
+	OnWrite func(r *LwM2MResource)
+}
+
+// Checks if the resource allows an operation
+func (r *LwM2MResource) Allows(op LwM2MOperations) bool {
+	return r.Operations&op != 0
+}
+
+// Returns the ids of the resource's instances in ascending order
+func (r *LwM2MResource) GetInstanceIDs() []uint16 {
+	ids := make([]uint16, 0, len(r.Instances))
+	for id := range r.Instances {
+		ids = append(ids, id)
+	}
+	return sortLwM2MIDs(ids)
+}
+
+// Returns the resource, or one of its instances, as a TLV record
+func (r *LwM2MResource) tlv(instance []uint16) (*LwM2MTLV, error) {
+	if len(instance) > 0 {
+		v, ok := r.Instances[instance[0]]
+		if !r.Multiple || !ok {
+			return nil, ErrLwM2MNotFound
+		}
+		return NewLwM2MTLVResourceInstance(instance[0], v)
+	}
+
+	if !r.Multiple {
+		return NewLwM2MTLVResource(r.ID, r.Value)
+	}
+
+	record := NewLwM2MTLVMultipleResource(r.ID)
+	for _, id := range r.GetInstanceIDs() {
+		ri, err := NewLwM2MTLVResourceInstance(id, r.Instances[id])
+		if err != nil {
+			return nil, err
+		}
+		record.Children = append(record.Children, ri)
+	}
+	return record, nil
+}
+
+// Returns the resource, or one of its instances, as LwM2M JSON entries named relative to name
+func (r *LwM2MResource) jsonEntries(name string, instance []uint16) ([]LwM2MJSONEntry, error) {
+	if len(instance) > 0 {
+		v, ok := r.Instances[instance[0]]
+		if !r.Multiple || !ok {
+			return nil, ErrLwM2MNotFound
+		}
+
+		e, err := NewLwM2MJSONEntry(name, v)
+		return []LwM2MJSONEntry{e}, err
+	}
+
+	if !r.Multiple {
+		e, err := NewLwM2MJSONEntry(name, r.Value)
+		return []LwM2MJSONEntry{e}, err
+	}
+
+	var entries []LwM2MJSONEntry
+	for _, id := range r.GetInstanceIDs() {
+		e, err := NewLwM2MJSONEntry(joinLwM2MName(name, id), r.Instances[id])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Instantiates a new object instance with resources
+func NewLwM2MObjectInstance(id uint16, resources ...*LwM2MResource) *LwM2MObjectInstance {
+	inst := &LwM2MObjectInstance{
+		ID:        id,
+		Resources: make(map[uint16]*LwM2MResource),
+	}
+
+	for _, r := range resources {
+		inst.Resources[r.ID] = r
+	}
+	return inst
+}
+
+// LwM2MObjectInstance is an instance of a LwM2M object
+type LwM2MObjectInstance struct {
+	ID        uint16
+	Resources map[uint16]*LwM2MResource
+}
+
+// Returns the ids of the instance's resources in ascending order
+func (i *LwM2MObjectInstance) GetResourceIDs() []uint16 {
+	ids := make([]uint16, 0, len(i.Resources))
+	for id := range i.Resources {
+		ids = append(ids, id)
+	}
+	return sortLwM2MIDs(ids)
+}
+
+// Returns the readable resources of the instance as TLV records
+func (i *LwM2MObjectInstance) tlvs() ([]*LwM2MTLV, error) {
+	var records []*LwM2MTLV
+	for _, id := range i.GetResourceIDs() {
+		r := i.Resources[id]
+		if !r.Allows(LwM2MOperationRead) {
+			continue
+		}
+
+		record, err := r.tlv(nil)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Returns the readable resources of the instance as LwM2M JSON entries named relative to name
+func (i *LwM2MObjectInstance) jsonEntries(name string) ([]LwM2MJSONEntry, error) {
+	var entries []LwM2MJSONEntry
+	for _, id := range i.GetResourceIDs() {
+		r := i.Resources[id]
+		if !r.Allows(LwM2MOperationRead) {
+			continue
+		}
+
+		e, err := r.jsonEntries(joinLwM2MName(name, id), nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+	return entries, nil
+}
+
+// Instantiates a new LwM2M object with instances
+func NewLwM2MObject(id uint16, instances ...*LwM2MObjectInstance) *LwM2MObject {
+	obj := &LwM2MObject{
+		ID:        id,
+		Instances: make(map[uint16]*LwM2MObjectInstance),
+	}
+
+	for _, inst := range instances {
+		obj.Instances[inst.ID] = inst
+	}
+	return obj
+}
+
+// LwM2MObject is a LwM2M object and its instances
+type LwM2MObject struct {
+	ID        uint16
+	Instances map[uint16]*LwM2MObjectInstance
+
+	// NewInstance creates an instance with default values for a server's Create request. Servers
+	// can't create or delete instances of objects without it
+	NewInstance func(id uint16) *LwM2MObjectInstance
+}
+
+// Returns the ids of the object's instances in ascending order
+func (o *LwM2MObject) GetInstanceIDs() []uint16 {
+	ids := make([]uint16, 0, len(o.Instances))
+	for id := range o.Instances {
+		ids = append(ids, id)
+	}
+	return sortLwM2MIDs(ids)
+}
+
+// Returns the lowest id which isn't used by an instance
+func (o *LwM2MObject) nextInstanceID() uint16 {
+	var id uint16
+	for o.Instances[id] != nil {
+		id++
+	}
+	return id
+}
+
+func sortLwM2MIDs(ids []uint16) []uint16 {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func joinLwM2MName(name string, id uint16) string {
+	if name == "" {
+		return strconv.Itoa(int(id))
+	}
+	return name + "/" + strconv.Itoa(int(id))
+}
+
+// Instantiates a new LwM2M client serving its objects through a CoAP server and registering
+// with the LwM2M server at serverAddress (e.g. "lwm2m.example.com:5683"). Representations
+// larger than a datagram require block-wise transfers to be enabled with SetBlockSize
+func NewLwM2MClient(s CoapServer, serverAddress, endpoint string) (*LwM2MClient, error) {
+	c := &LwM2MClient{
+		server:  s,
+		objects: make(map[uint16]*LwM2MObject),
+	}
+
+	rd, err := NewRDClient(s, serverAddress, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	rd.Attributes = map[string]string{
+		LwM2MParamVersion: LwM2MVersion,
+		LwM2MParamBinding: LwM2MBindingUDP,
+	}
+	rd.Links = c.GetLinks
+	c.RD = rd
+
+	return c, nil
+}
+
+// LwM2MClient serves LwM2M objects to a LwM2M server: Read, Write, Execute, Create, Delete,
+// Discover and Observe requests on /objectID/instanceID/resourceID are answered from the object
+// model, and the client registers with the server through its Resource Directory interface
+type LwM2MClient struct {
+	sync.RWMutex
+
+	server  CoapServer
+	objects map[uint16]*LwM2MObject
+
+	// RD registers the client with the LwM2M server and keeps the registration alive
+	RD *RDClient
+}
+
+// AddObject adds an object to the client and routes requests for it to the client
+func (c *LwM2MClient) AddObject(obj *LwM2MObject) {
+	c.Lock()
+	_, exists := c.objects[obj.ID]
+	c.objects[obj.ID] = obj
+	c.Unlock()
+
+	if exists {
+		return
+	}
+
+	prefix := "/" + strconv.Itoa(int(obj.ID))
+	for _, path := range []string{prefix, prefix + "/:path*"} {
+		r := c.server.Get(path, c.handle)
+		r.Observable = true
+
+		c.server.Put(path, c.handle)
+		c.server.Post(path, c.handle)
+		c.server.Delete(path, c.handle)
+	}
+}
+
+// Returns the object with the given id, or nil if the client has none
+func (c *LwM2MClient) GetObject(id uint16) *LwM2MObject {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.objects[id]
+}
+
+// GetLinks returns the links registered with the server: object instances, and objects
+// without instances
+func (c *LwM2MClient) GetLinks() []*CoreResource {
+	c.RLock()
+	defer c.RUnlock()
+
+	var links []*CoreResource
+	for _, obj := range c.sortedObjects() {
+		if len(obj.Instances) == 0 {
+			links = append(links, newLwM2MLink(obj.ID))
+		}
+
+		for _, id := range obj.GetInstanceIDs() {
+			links = append(links, newLwM2MLink(obj.ID, id))
+		}
+	}
+	return links
+}
+
+func (c *LwM2MClient) sortedObjects() []*LwM2MObject {
+	ids := make([]uint16, 0, len(c.objects))
+	for id := range c.objects {
+		ids = append(ids, id)
+	}
+
+	var objects []*LwM2MObject
+	for _, id := range sortLwM2MIDs(ids) {
+		objects = append(objects, c.objects[id])
+	}
+	return objects
+}
+
+func newLwM2MLink(ids ...uint16) *CoreResource {
+	link := NewCoreResource()
+	link.Target = lwm2mPath(ids)
+
+	return link
+}
+
+// Register registers the client with the LwM2M server
+func (c *LwM2MClient) Register() error {
+	return c.RD.Register()
+}
+
+// Update refreshes the client's registration
+func (c *LwM2MClient) Update() error {
+	return c.RD.Update()
+}
+
+// Deregister removes the client's registration
+func (c *LwM2MClient) Deregister() error {
+	return c.RD.Deregister()
+}
+
+// Start registers with the LwM2M server and refreshes the registration until Stop is called
+func (c *LwM2MClient) Start() error {
+	return c.RD.Start()
+}
+
+// Stop ends refreshing the registration and deregisters from the LwM2M server
+func (c *LwM2MClient) Stop() error {
+	return c.RD.Stop()
+}
+
+// Returns the value of a resource or resource instance (e.g. /3/0/9 or /3/0/7/0)
+func (c *LwM2MClient) GetResourceValue(path string) (interface{}, error) {
+	ids, err := ParseLwM2MPath(path)
+	if err != nil || len(ids) < 3 {
+		return nil, ErrInvalidLwM2MPath
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	_, _, r, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		return nil, ErrLwM2MNotFound
+	}
+
+	if len(ids) == 4 {
+		v, ok := r.Instances[ids[3]]
+		if !ok {
+			return nil, ErrLwM2MNotFound
+		}
+		return v, nil
+	}
+	return r.Value, nil
+}
+
+// Sets the value of a resource or resource instance (e.g. /3/0/9 or /3/0/7/0) and notifies
+// the observers of the resource, its instance and object
+func (c *LwM2MClient) SetResourceValue(path string, v interface{}) error {
+	ids, err := ParseLwM2MPath(path)
+	if err != nil || len(ids) < 3 {
+		return ErrInvalidLwM2MPath
+	}
+
+	c.Lock()
+	_, _, r, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		c.Unlock()
+		return ErrLwM2MNotFound
+	}
+
+	if len(ids) == 4 {
+		if !r.Multiple {
+			c.Unlock()
+			return ErrLwM2MNotFound
+		}
+		r.Instances[ids[3]] = v
+	} else {
+		r.Value = v
+	}
+	c.Unlock()
+
+	c.notify(ids[:3])
+
+	return nil
+}
+
+// Notifies the observers of a resource, its instance and object with their TLV representations
+func (c *LwM2MClient) notify(ids []uint16) {
+	for n := len(ids); n > 0; n-- {
+		c.notifyPath(ids[:n])
+	}
+}
+
+// Notifies the observers of a path with its TLV representation
+func (c *LwM2MClient) notifyPath(ids []uint16) {
+	c.RLock()
+	records, err := c.readTLV(ids)
+	c.RUnlock()
+
+	if err != nil {
+		c.server.GetEvents().Error(err)
+		return
+	}
+	c.server.NotifyChangePayload(lwm2mPath(ids), NewLwM2MTLVPayload(records...), MediaTypeTlvVndOmaLwm2m, false)
+}
+
+// Looks up the object, instance and resource of a path. 4.04 Not Found is returned if any of
+// them doesn't exist
+func (c *LwM2MClient) lookup(ids []uint16) (*LwM2MObject, *LwM2MObjectInstance, *LwM2MResource, CoapCode) {
+	var obj *LwM2MObject
+	var inst *LwM2MObjectInstance
+	var r *LwM2MResource
+
+	if len(ids) > 0 {
+		if obj = c.objects[ids[0]]; obj == nil {
+			return nil, nil, nil, CoapCodeNotFound
+		}
+	}
+
+	if len(ids) > 1 {
+		if inst = obj.Instances[ids[1]]; inst == nil {
+			return nil, nil, nil, CoapCodeNotFound
+		}
+	}
+
+	if len(ids) > 2 {
+		if r = inst.Resources[ids[2]]; r == nil {
+			return nil, nil, nil, CoapCodeNotFound
+		}
+	}
+
+	if len(ids) > 3 {
+		if _, ok := r.Instances[ids[3]]; !r.Multiple || !ok {
+			return nil, nil, nil, CoapCodeNotFound
+		}
+	}
+	return obj, inst, r, CoapCodeEmpty
+}
+
+// Handles the requests of LwM2M servers
+func (c *LwM2MClient) handle(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	ids, err := ParseLwM2MPath(msg.GetURIPath())
+	if err != nil || len(ids) == 0 {
+		return newLwM2MResponse(msg, CoapCodeNotFound)
+	}
+
+	switch msg.Code {
+	case Get:
+		if accept, ok := msg.GetAccept(); ok && accept == MediaTypeApplicationLinkFormat {
+			return c.handleDiscover(msg, ids)
+		}
+		return c.handleRead(req, ids)
+
+	case Put:
+		if len(ids) < 2 {
+			return newLwM2MResponse(msg, CoapCodeMethodNotAllowed)
+		}
+		return c.handleWrite(msg, ids, true)
+
+	case Post:
+		switch len(ids) {
+		case 1:
+			return c.handleCreate(msg, ids)
+
+		case 2:
+			return c.handleWrite(msg, ids, false)
+
+		case 3:
+			return c.handleExecute(msg, ids)
+		}
+
+	case Delete:
+		if len(ids) == 2 {
+			return c.handleDelete(msg, ids)
+		}
+	}
+	return newLwM2MResponse(msg, CoapCodeMethodNotAllowed)
+}
+
+func (c *LwM2MClient) handleRead(req CoapRequest, ids []uint16) CoapResponse {
+	msg := req.GetMessage()
+
+	accept, ok := msg.GetAccept()
+	if !ok {
+		accept = MediaTypeTlvVndOmaLwm2m
+	}
+
+	c.RLock()
+	_, _, r, code := c.lookup(ids)
+	if code == CoapCodeEmpty && r != nil && !r.Allows(LwM2MOperationRead) {
+		code = CoapCodeMethodNotAllowed
+	}
+
+	var payload MessagePayload
+	if code == CoapCodeEmpty {
+		payload, code = c.readPayload(ids, r, accept)
+	}
+	c.RUnlock()
+
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+
+	resp := newLwM2MResponse(msg, CoapCodeContent)
+	resp.GetMessage().AddOption(OptionContentFormat, accept)
+	resp.GetMessage().Payload = payload
+
+	// Responses registering an observation carry the Observe option
+	if msg.GetOption(OptionObserve) != nil && c.server.HasObservation(msg.GetURIPath(), req.GetAddress()) {
+		resp.GetMessage().AddOption(OptionObserve, 0)
+	}
+	return resp
+}
+
+// Returns the payload of a read in the requested format, or the code of the error response
+func (c *LwM2MClient) readPayload(ids []uint16, r *LwM2MResource, accept MediaType) (MessagePayload, CoapCode) {
+	switch accept {
+	case MediaTypeTlvVndOmaLwm2m:
+		records, err := c.readTLV(ids)
+		if err != nil {
+			return nil, CoapCodeInternalServerError
+		}
+		return NewLwM2MTLVPayload(records...), CoapCodeEmpty
+
+	case MediaTypeJSONVndOmaLwm2m:
+		j, err := c.readJSON(ids)
+		if err != nil {
+			return nil, CoapCodeInternalServerError
+		}
+		return NewLwM2MJSONPayload(j), CoapCodeEmpty
+
+	case MediaTypeTextPlainVndOmaLwm2m, MediaTypeTextPlain:
+		if r == nil || (r.Multiple && len(ids) < 4) || r.Type == LwM2MTypeOpaque {
+			return nil, CoapCodeNotAcceptable
+		}
+		return NewPlainTextPayload(lwm2mText(lwm2mResourceValue(r, ids))), CoapCodeEmpty
+
+	case MediaTypeOpaqueVndOmaLwm2m, MediaTypeApplicationOctetStream:
+		if r == nil || (r.Multiple && len(ids) < 4) || r.Type != LwM2MTypeOpaque {
+			return nil, CoapCodeNotAcceptable
+		}
+		b, _ := lwm2mResourceValue(r, ids).([]byte)
+		return NewBytesPayload(b), CoapCodeEmpty
+	}
+	return nil, CoapCodeNotAcceptable
+}
+
+func lwm2mResourceValue(r *LwM2MResource, ids []uint16) interface{} {
+	if len(ids) == 4 {
+		return r.Instances[ids[3]]
+	}
+	return r.Value
+}
+
+// Reads an object, instance, resource or resource instance as TLV records. Objects are read as
+// object instances, while instances are read as their resources
+func (c *LwM2MClient) readTLV(ids []uint16) ([]*LwM2MTLV, error) {
+	obj, inst, r, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		return nil, ErrLwM2MNotFound
+	}
+
+	switch len(ids) {
+	case 1:
+		var records []*LwM2MTLV
+		for _, id := range obj.GetInstanceIDs() {
+			resources, err := obj.Instances[id].tlvs()
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, NewLwM2MTLVObjectInstance(id, resources...))
+		}
+		return records, nil
+
+	case 2:
+		return inst.tlvs()
+	}
+
+	record, err := r.tlv(ids[3:])
+	if err != nil {
+		return nil, err
+	}
+	return []*LwM2MTLV{record}, nil
+}
+
+// Reads an object, instance, resource or resource instance as LwM2M JSON
+func (c *LwM2MClient) readJSON(ids []uint16) (*LwM2MJSON, error) {
+	obj, inst, r, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		return nil, ErrLwM2MNotFound
+	}
+
+	j := &LwM2MJSON{BaseName: lwm2mPath(ids) + "/"}
+
+	var err error
+	switch len(ids) {
+	case 1:
+		for _, id := range obj.GetInstanceIDs() {
+			entries, err := obj.Instances[id].jsonEntries(strconv.Itoa(int(id)))
+			if err != nil {
+				return nil, err
+			}
+			j.Entries = append(j.Entries, entries...)
+		}
+
+	case 2:
+		j.Entries, err = inst.jsonEntries("")
+
+	default:
+		if !r.Multiple || len(ids) == 4 {
+			// Single values are named by the base name
+			j.BaseName = lwm2mPath(ids)
+		}
+		j.Entries, err = r.jsonEntries("", ids[3:])
+	}
+	return j, err
+}
+
+func (c *LwM2MClient) handleDiscover(msg *Message, ids []uint16) CoapResponse {
+	c.RLock()
+	obj, inst, r, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		c.RUnlock()
+		return newLwM2MResponse(msg, code)
+	}
+
+	var links []*CoreResource
+	switch len(ids) {
+	case 1:
+		links = append(links, newLwM2MLink(obj.ID))
+		for _, id := range obj.GetInstanceIDs() {
+			links = append(links, lwm2mInstanceLinks(obj.ID, obj.Instances[id])...)
+		}
+
+	case 2:
+		links = lwm2mInstanceLinks(obj.ID, inst)
+
+	case 3:
+		links = append(links, lwm2mResourceLink(ids, r))
+
+	default:
+		c.RUnlock()
+		return newLwM2MResponse(msg, CoapCodeMethodNotAllowed)
+	}
+	c.RUnlock()
+
+	resp := newLwM2MResponse(msg, CoapCodeContent)
+	resp.GetMessage().AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
+	resp.GetMessage().Payload = NewCoreLinkFormatPayload(links)
+
+	return resp
+}
+
+// Returns the links of an instance and its resources
+func lwm2mInstanceLinks(objectID uint16, inst *LwM2MObjectInstance) []*CoreResource {
+	links := []*CoreResource{newLwM2MLink(objectID, inst.ID)}
+	for _, id := range inst.GetResourceIDs() {
+		links = append(links, lwm2mResourceLink([]uint16{objectID, inst.ID, id}, inst.Resources[id]))
+	}
+	return links
+}
+
+// Returns the link of a resource. Links of multiple resources carry their number of instances
+func lwm2mResourceLink(ids []uint16, r *LwM2MResource) *CoreResource {
+	link := newLwM2MLink(ids...)
+	if r.Multiple {
+		link.AddAttribute("dim", len(r.Instances))
+	}
+	return link
+}
+
+// Handles Write requests. PUT replaces the written resources, while POST on an instance
+// updates the resources in the payload
+func (c *LwM2MClient) handleWrite(msg *Message, ids []uint16, replace bool) CoapResponse {
+	writes, code := lwm2mWritesFromMessage(msg, ids)
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+
+	if len(writes) == 0 {
+		return newLwM2MResponse(msg, CoapCodeBadRequest)
+	}
+
+	for _, w := range writes {
+		if !lwm2mHasPrefix(w.path, ids) {
+			return newLwM2MResponse(msg, CoapCodeBadRequest)
+		}
+	}
+
+	c.Lock()
+	obj, _, _, code := c.lookup(ids)
+	var written map[uint16][]*LwM2MResource
+	if code == CoapCodeEmpty {
+		written, code = applyLwM2MWrites(obj, writes, replace, true)
+	}
+	c.Unlock()
+
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+	c.written(obj.ID, written)
+
+	return newLwM2MResponse(msg, CoapCodeChanged)
+}
+
+// Fires the write callbacks of resources written by a server and notifies the observers of
+// the resources, their instances and object
+func (c *LwM2MClient) written(objectID uint16, resources map[uint16][]*LwM2MResource) {
+	for instanceID, rs := range resources {
+		for _, r := range rs {
+			if r.OnWrite != nil {
+				r.OnWrite(r)
+			}
+			c.notifyPath([]uint16{objectID, instanceID, r.ID})
+		}
+		c.notifyPath([]uint16{objectID, instanceID})
+	}
+
+	if len(resources) > 0 {
+		c.notifyPath([]uint16{objectID})
+	}
+}
+
+func (c *LwM2MClient) handleCreate(msg *Message, ids []uint16) CoapResponse {
+	c.Lock()
+	obj, _, _, code := c.lookup(ids)
+	if code != CoapCodeEmpty {
+		c.Unlock()
+		return newLwM2MResponse(msg, code)
+	}
+
+	if obj.NewInstance == nil {
+		c.Unlock()
+		return newLwM2MResponse(msg, CoapCodeMethodNotAllowed)
+	}
+
+	// TLV payloads either contain an object instance or the resources of a new instance
+	writes, code := lwm2mWritesFromMessage(msg, []uint16{obj.ID, obj.nextInstanceID()})
+	if code != CoapCodeEmpty {
+		c.Unlock()
+		return newLwM2MResponse(msg, code)
+	}
+
+	id := obj.nextInstanceID()
+	if len(writes) > 0 {
+		id = writes[0].path[1]
+	}
+
+	for _, w := range writes {
+		if w.path[0] != obj.ID || w.path[1] != id {
+			c.Unlock()
+			return newLwM2MResponse(msg, CoapCodeBadRequest)
+		}
+	}
+
+	inst := obj.NewInstance(id)
+	if obj.Instances[id] != nil || inst == nil {
+		c.Unlock()
+		return newLwM2MResponse(msg, CoapCodeBadRequest)
+	}
+	inst.ID = id
+	obj.Instances[id] = inst
+
+	written, code := applyLwM2MWrites(obj, writes, true, false)
+	if code != CoapCodeEmpty {
+		delete(obj.Instances, id)
+	}
+	c.Unlock()
+
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+	c.written(obj.ID, written)
+	if len(written) == 0 {
+		c.notifyPath(ids)
+	}
+	go c.updateLinks()
+
+	resp := newLwM2MResponse(msg, CoapCodeCreated)
+	resp.GetMessage().AddOption(OptionLocationPath, strconv.Itoa(int(obj.ID)))
+	resp.GetMessage().AddOption(OptionLocationPath, strconv.Itoa(int(id)))
+
+	return resp
+}
+
+func (c *LwM2MClient) handleDelete(msg *Message, ids []uint16) CoapResponse {
+	c.Lock()
+	obj, _, _, code := c.lookup(ids)
+	if code == CoapCodeEmpty && obj.NewInstance == nil {
+		code = CoapCodeMethodNotAllowed
+	}
+
+	if code == CoapCodeEmpty {
+		delete(obj.Instances, ids[1])
+	}
+	c.Unlock()
+
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+	c.notify(ids[:1])
+	go c.updateLinks()
+
+	return newLwM2MResponse(msg, CoapCodeDeleted)
+}
+
+func (c *LwM2MClient) handleExecute(msg *Message, ids []uint16) CoapResponse {
+	c.RLock()
+	_, _, r, code := c.lookup(ids)
+	if code == CoapCodeEmpty && (!r.Allows(LwM2MOperationExecute) || r.OnExecute == nil) {
+		code = CoapCodeMethodNotAllowed
+	}
+	c.RUnlock()
+
+	if code != CoapCodeEmpty {
+		return newLwM2MResponse(msg, code)
+	}
+
+	if err := r.OnExecute(PayloadAsString(msg.Payload)); err != nil {
+		c.server.GetEvents().Error(err)
+		return newLwM2MResponse(msg, CoapCodeInternalServerError)
+	}
+	return newLwM2MResponse(msg, CoapCodeChanged)
+}
+
+// Sends the changed object instances to the server if the client is registered
+func (c *LwM2MClient) updateLinks() {
+	if c.RD.GetLocation() == "" {
+		return
+	}
+
+	if err := c.RD.UpdateLinks(); err != nil {
+		c.server.GetEvents().Error(err)
+	}
+}
+
+// A value written to a resource or resource instance, which is decoded according to the type
+// of the resource
+type lwm2mWrite struct {
+	path  []uint16
+	value func(typ LwM2MResourceType) (interface{}, error)
+}
+
+// Decodes the writes of a request payload for a path. TLV records are relative to the path
+func lwm2mWritesFromMessage(msg *Message, ids []uint16) ([]lwm2mWrite, CoapCode) {
+	var data []byte
+	if msg.Payload != nil {
+		data = msg.Payload.GetBytes()
+	}
+
+	if len(data) == 0 {
+		return nil, CoapCodeEmpty
+	}
+
+	var writes []lwm2mWrite
+	mt, _ := msg.GetContentFormat()
+	switch mt {
+	case MediaTypeTlvVndOmaLwm2m:
+		records, err := DecodeLwM2MTLV(data)
+		if err != nil || len(records) == 0 {
+			return nil, CoapCodeBadRequest
+		}
+
+		// The type of the first record determines the level the records are at
+		depth := 3
+		switch records[0].Type {
+		case LwM2MTLVObjectInstance:
+			depth = 1
+
+		case LwM2MTLVResource, LwM2MTLVMultipleResource:
+			depth = 2
+		}
+
+		if len(ids) < depth {
+			return nil, CoapCodeBadRequest
+		}
+		writes = lwm2mTLVWrites(ids[:depth], records)
+
+	case MediaTypeJSONVndOmaLwm2m:
+		j, err := DecodeLwM2MJSON(data)
+		if err != nil {
+			return nil, CoapCodeBadRequest
+		}
+
+		for i := range j.Entries {
+			e := &j.Entries[i]
+			path, err := ParseLwM2MPath(j.BaseName + e.Name)
+			if err != nil {
+				return nil, CoapCodeBadRequest
+			}
+
+			writes = append(writes, lwm2mWrite{path: path, value: func(typ LwM2MResourceType) (interface{}, error) {
+				return lwm2mJSONValue(typ, e)
+			}})
+		}
+
+	case MediaTypeTextPlainVndOmaLwm2m, MediaTypeTextPlain:
+		writes = append(writes, lwm2mWrite{path: ids, value: func(typ LwM2MResourceType) (interface{}, error) {
+			return lwm2mTextValue(typ, string(data))
+		}})
+
+	case MediaTypeOpaqueVndOmaLwm2m, MediaTypeApplicationOctetStream:
+		writes = append(writes, lwm2mWrite{path: ids, value: func(typ LwM2MResourceType) (interface{}, error) {
+			if typ != LwM2MTypeOpaque {
+				return nil, ErrLwM2MValueType
+			}
+			return data, nil
+		}})
+
+	default:
+		return nil, CoapCodeUnsupportedContentFormat
+	}
+
+	for _, w := range writes {
+		if len(w.path) < 3 {
+			return nil, CoapCodeBadRequest
+		}
+	}
+	return writes, CoapCodeEmpty
+}
+
+// Returns the writes of TLV records below a path
+func lwm2mTLVWrites(prefix []uint16, records []*LwM2MTLV) []lwm2mWrite {
+	var writes []lwm2mWrite
+	for _, r := range records {
+		path := append(append([]uint16{}, prefix...), r.ID)
+		if r.IsContainer() {
+			writes = append(writes, lwm2mTLVWrites(path, r.Children)...)
+			continue
+		}
+
+		record := r
+		writes = append(writes, lwm2mWrite{path: path, value: func(typ LwM2MResourceType) (interface{}, error) {
+			return lwm2mTLVValue(typ, record)
+		}})
+	}
+	return writes
+}
+
+// Applies writes to the instances of an object. All values are decoded before any is written,
+// so that invalid payloads leave the resources unchanged. With replace, multiple resources only
+// keep the written instances. The written resources are returned by instance id
+func applyLwM2MWrites(obj *LwM2MObject, writes []lwm2mWrite, replace bool, checkWrite bool) (map[uint16][]*LwM2MResource, CoapCode) {
+	type decoded struct {
+		path  []uint16
+		r     *LwM2MResource
+		value interface{}
+	}
+
+	var values []decoded
+	for _, w := range writes {
+		inst := obj.Instances[w.path[1]]
+		if inst == nil {
+			return nil, CoapCodeNotFound
+		}
+
+		r := inst.Resources[w.path[2]]
+		if r == nil {
+			return nil, CoapCodeNotFound
+		}
+
+		if checkWrite && !r.Allows(LwM2MOperationWrite) {
+			return nil, CoapCodeMethodNotAllowed
+		}
+
+		if r.Multiple != (len(w.path) == 4) {
+			return nil, CoapCodeBadRequest
+		}
+
+		v, err := w.value(r.Type)
+		if err != nil {
+			return nil, CoapCodeBadRequest
+		}
+		values = append(values, decoded{path: w.path, r: r, value: v})
+	}
+
+	written := make(map[uint16][]*LwM2MResource)
+	cleared := make(map[*LwM2MResource]bool)
+	for _, d := range values {
+		if !cleared[d.r] {
+			cleared[d.r] = true
+			written[d.path[1]] = append(written[d.path[1]], d.r)
+
+			if replace && d.r.Multiple {
+				d.r.Instances = make(map[uint16]interface{})
+			}
+		}
+
+		if d.r.Multiple {
+			d.r.Instances[d.path[3]] = d.value
+		} else {
+			d.r.Value = d.value
+		}
+	}
+	return written, CoapCodeEmpty
+}
+
+func lwm2mHasPrefix(path []uint16, prefix []uint16) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+
+	for i, id := range prefix {
+		if path[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// Decodes the value of a TLV record according to a resource type
+func lwm2mTLVValue(typ LwM2MResourceType, t *LwM2MTLV) (interface{}, error) {
+	switch typ {
+	case LwM2MTypeString:
+		return t.GetString(), nil
+
+	case LwM2MTypeInteger:
+		return t.GetInt()
+
+	case LwM2MTypeFloat:
+		return t.GetFloat()
+
+	case LwM2MTypeBoolean:
+		return t.GetBool()
+
+	case LwM2MTypeOpaque:
+		return t.GetOpaque(), nil
+
+	case LwM2MTypeTime:
+		return t.GetTime()
+
+	case LwM2MTypeObjectLink:
+		return t.GetObjectLink()
+	}
+	return nil, ErrLwM2MValueType
+}
+
+// Decodes the value of a LwM2M JSON entry according to a resource type
+func lwm2mJSONValue(typ LwM2MResourceType, e *LwM2MJSONEntry) (interface{}, error) {
+	switch typ {
+	case LwM2MTypeString:
+		return e.GetString()
+
+	case LwM2MTypeInteger:
+		return e.GetInt()
+
+	case LwM2MTypeFloat:
+		return e.GetFloat()
+
+	case LwM2MTypeBoolean:
+		return e.GetBool()
+
+	case LwM2MTypeOpaque:
+		return e.GetOpaque()
+
+	case LwM2MTypeTime:
+		sec, err := e.GetInt()
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(sec, 0), nil
+
+	case LwM2MTypeObjectLink:
+		return e.GetObjectLink()
+	}
+	return nil, ErrLwM2MValueType
+}
+
+// Decodes a value in the LwM2M plain text format according to a resource type
+func lwm2mTextValue(typ LwM2MResourceType, s string) (interface{}, error) {
+	switch typ {
+	case LwM2MTypeString:
+		return s, nil
+
+	case LwM2MTypeInteger:
+		return strconv.ParseInt(s, 10, 64)
+
+	case LwM2MTypeFloat:
+		return strconv.ParseFloat(s, 64)
+
+	case LwM2MTypeBoolean:
+		switch s {
+		case "0":
+			return false, nil
+
+		case "1":
+			return true, nil
+		}
+
+	case LwM2MTypeTime:
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(sec, 0), nil
+
+	case LwM2MTypeObjectLink:
+		return ParseLwM2MObjectLink(s)
+	}
+	return nil, ErrLwM2MValueType
+}
+
+// Encodes a value in the LwM2M plain text format
+func lwm2mText(v interface{}) string {
+	switch t := v.(type) {
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+
+	case float32:
+		return strconv.FormatFloat(float64(t), 'g', -1, 32)
+
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+
+	case time.Time:
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	s, _ := EncodeText(v)
+
+	return string(s)
+}
+
+// Creates a response to a request handled by a LwM2M client
+func newLwM2MResponse(msg *Message, code CoapCode) CoapResponse {
+	return newRDResponse(msg, code)
+}
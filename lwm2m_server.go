@@ -0,0 +1,277 @@
+package coap
+
+import (
+	"sync"
+	"time"
+)
+
+// LwM2MServerTimeout defines the number of seconds to wait for a response from a LwM2M client
+const LwM2MServerTimeout = 5
+
+type FnLwM2MNotify func(endpoint, path string, msg *Message)
+
+// Instantiates a new LwM2M server tracking the clients registering through the Resource
+// Directory interface of a CoAP server. The server must be started so that it can receive the
+// clients' responses
+func NewLwM2MServer(s CoapServer) *LwM2MServer {
+	l := &LwM2MServer{
+		server:       s,
+		Directory:    NewResourceDirectory(),
+		Timeout:      LwM2MServerTimeout * time.Second,
+		observations: make(map[string]*lwm2mObservation),
+	}
+
+	l.Directory.Attach(s)
+	l.Directory.OnUnregister(l.handleDeregister)
+	s.OnNotify(l.handleNotification)
+
+	return l
+}
+
+// An observation of a client's object, instance or resource
+type lwm2mObservation struct {
+	endpoint string
+	path     string
+	token    []byte
+	fn       FnLwM2MNotify
+}
+
+// LwM2MServer manages registered LwM2M clients: it performs Read, Write, Execute, Create,
+// Delete, Discover and Observe operations on their objects
+type LwM2MServer struct {
+	sync.Mutex
+
+	server  CoapServer
+	Timeout time.Duration
+
+	// Directory holds the registrations of the clients
+	Directory *ResourceDirectory
+
+	// Observations by token
+	observations map[string]*lwm2mObservation
+}
+
+// Returns the registrations of all registered clients
+func (l *LwM2MServer) GetClients() []*RDRegistration {
+	return l.Directory.GetRegistrations()
+}
+
+// Returns the registration of a client, or nil if the client isn't registered
+func (l *LwM2MServer) GetClient(endpoint string) *RDRegistration {
+	return l.Directory.GetRegistrationByEndpoint(endpoint)
+}
+
+// Fired when a client registers
+func (l *LwM2MServer) OnRegister(fn FnRDRegistration) {
+	l.Directory.OnRegister(fn)
+}
+
+// Fired when a client updates its registration
+func (l *LwM2MServer) OnUpdate(fn FnRDRegistration) {
+	l.Directory.OnUpdate(fn)
+}
+
+// Fired when a client deregisters or its registration expires
+func (l *LwM2MServer) OnDeregister(fn FnRDRegistration) {
+	l.Directory.OnUnregister(fn)
+}
+
+// Read reads an object, instance or resource of a client in the accepted format. Block-wise
+// transferred responses are returned with their full payload
+func (l *LwM2MServer) Read(endpoint, path string, accept MediaType) (*Message, error) {
+	req, err := newLwM2MRequest(Get, path)
+	if err != nil {
+		return nil, err
+	}
+	req.GetMessage().AddOption(OptionAccept, accept)
+
+	return l.send(endpoint, req)
+}
+
+// ReadTLV reads an object, instance or resource of a client as TLV records
+func (l *LwM2MServer) ReadTLV(endpoint, path string) ([]*LwM2MTLV, error) {
+	resp, err := l.Read(endpoint, path, MediaTypeTlvVndOmaLwm2m)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Code != CoapCodeContent {
+		return nil, ErrUnexpectedResponse
+	}
+	return DecodeLwM2MTLVPayload(resp)
+}
+
+// Write replaces an instance or resource of a client
+func (l *LwM2MServer) Write(endpoint, path string, payload MessagePayload, mt MediaType) (*Message, error) {
+	return l.sendPayload(endpoint, Put, path, payload, mt)
+}
+
+// WriteUpdate updates the resources of an instance of a client given in the payload
+func (l *LwM2MServer) WriteUpdate(endpoint, path string, payload MessagePayload, mt MediaType) (*Message, error) {
+	return l.sendPayload(endpoint, Post, path, payload, mt)
+}
+
+// Create creates an instance of an object of a client
+func (l *LwM2MServer) Create(endpoint, path string, payload MessagePayload, mt MediaType) (*Message, error) {
+	return l.sendPayload(endpoint, Post, path, payload, mt)
+}
+
+// Execute executes a resource of a client with optional arguments
+func (l *LwM2MServer) Execute(endpoint, path, args string) (*Message, error) {
+	req, err := newLwM2MRequest(Post, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if args != "" {
+		req.SetStringPayload(args)
+	}
+	return l.send(endpoint, req)
+}
+
+// Delete deletes an object instance of a client
+func (l *LwM2MServer) Delete(endpoint, path string) (*Message, error) {
+	req, err := newLwM2MRequest(Delete, path)
+	if err != nil {
+		return nil, err
+	}
+	return l.send(endpoint, req)
+}
+
+// Discover returns the links of an object, instance or resource of a client
+func (l *LwM2MServer) Discover(endpoint, path string) ([]*CoreResource, error) {
+	resp, err := l.Read(endpoint, path, MediaTypeApplicationLinkFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Code != CoapCodeContent {
+		return nil, ErrUnexpectedResponse
+	}
+	return CoreResourcesFromString(PayloadAsString(resp.Payload)), nil
+}
+
+// Observe observes an object, instance or resource of a client in the accepted format. The
+// initial response is returned, and notifications are passed to fn until the observation is
+// cancelled or the client deregisters
+func (l *LwM2MServer) Observe(endpoint, path string, accept MediaType, fn FnLwM2MNotify) (*Message, error) {
+	req, err := newLwM2MRequest(Get, path)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := req.GetMessage()
+	msg.AddOption(OptionObserve, 0)
+	msg.AddOption(OptionAccept, accept)
+
+	// Notifications may arrive before the response has been handled
+	obs := &lwm2mObservation{
+		endpoint: endpoint,
+		path:     msg.GetURIPath(),
+		token:    msg.Token,
+		fn:       fn,
+	}
+
+	l.Lock()
+	l.observations[string(msg.Token)] = obs
+	l.Unlock()
+
+	resp, err := l.send(endpoint, req)
+	if err != nil || !IsSuccessCode(resp.Code) || resp.GetOption(OptionObserve) == nil {
+		l.Lock()
+		delete(l.observations, string(msg.Token))
+		l.Unlock()
+	}
+	return resp, err
+}
+
+// CancelObserve cancels the observation of an object, instance or resource of a client
+func (l *LwM2MServer) CancelObserve(endpoint, path string) error {
+	req, err := newLwM2MRequest(Get, path)
+	if err != nil {
+		return err
+	}
+	msg := req.GetMessage()
+
+	l.Lock()
+	var obs *lwm2mObservation
+	for token, o := range l.observations {
+		if o.endpoint == endpoint && o.path == msg.GetURIPath() {
+			obs = o
+			delete(l.observations, token)
+			break
+		}
+	}
+	l.Unlock()
+
+	if obs == nil {
+		return nil
+	}
+
+	msg.Token = obs.token
+	msg.AddOption(OptionObserve, 1)
+
+	_, err = l.send(endpoint, req)
+
+	return err
+}
+
+// Sends a request with a payload
+func (l *LwM2MServer) sendPayload(endpoint string, method CoapCode, path string, payload MessagePayload, mt MediaType) (*Message, error) {
+	req, err := newLwM2MRequest(method, path)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetMediaType(mt)
+	req.GetMessage().Payload = payload
+
+	return l.send(endpoint, req)
+}
+
+// Sends a request to a registered client
+func (l *LwM2MServer) send(endpoint string, req CoapRequest) (*Message, error) {
+	reg := l.GetClient(endpoint)
+	if reg == nil || reg.Addr == nil {
+		return nil, ErrLwM2MUnknownClient
+	}
+	return SendAndWaitForBlockwiseResponse(l.server, req, reg.Addr, l.Timeout)
+}
+
+// Passes notifications to the handlers of their observations
+func (l *LwM2MServer) handleNotification(resource string, value interface{}, msg *Message) {
+	l.Lock()
+	obs, ok := l.observations[string(msg.Token)]
+	if ok && (!IsSuccessCode(msg.Code) || msg.GetOption(OptionObserve) == nil) {
+		// Error responses and responses without Observe end the observation
+		delete(l.observations, string(msg.Token))
+	}
+	l.Unlock()
+
+	if ok && obs.fn != nil {
+		obs.fn(obs.endpoint, obs.path, msg)
+	}
+}
+
+// Removes the observations of a client which deregistered
+func (l *LwM2MServer) handleDeregister(reg *RDRegistration) {
+	l.Lock()
+	for token, obs := range l.observations {
+		if obs.endpoint == reg.Endpoint {
+			delete(l.observations, token)
+		}
+	}
+	l.Unlock()
+}
+
+// Creates a confirmable request for a LwM2M path
+func newLwM2MRequest(method CoapCode, path string) (CoapRequest, error) {
+	if _, err := ParseLwM2MPath(path); err != nil {
+		return nil, err
+	}
+
+	req := NewRequest(MessageConfirmable, method, GenerateMessageID())
+	req.SetRequestURI(path)
+
+	return req, nil
+}
@@ -0,0 +1,173 @@
+package coap
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Creates a server on a free loopback port, and returns it with the address it is reached at
+func newTestServer(t *testing.T) (CoapServer, string) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("loopback unavailable:", err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	return NewCoapServer(strconv.Itoa(port)), "127.0.0.1:" + strconv.Itoa(port)
+}
+
+// Starts a server and stops it at the end of the test. Routes must be added before the server
+// is started
+func startTestServer(t *testing.T, s CoapServer) {
+	started := make(chan bool)
+	s.OnStart(func(CoapServer) {
+		close(started)
+	})
+
+	go s.Start()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't start")
+	}
+
+	t.Cleanup(s.Stop)
+}
+
+func TestLwM2MRegistration(t *testing.T) {
+	server, serverAddr := newTestServer(t)
+	lwm2m := NewLwM2MServer(server)
+	lwm2m.Timeout = 2 * time.Second
+
+	events := make(chan string, 3)
+	lwm2m.OnRegister(func(reg *RDRegistration) { events <- "register " + reg.Endpoint })
+	lwm2m.OnUpdate(func(reg *RDRegistration) { events <- "update " + reg.Endpoint })
+	lwm2m.OnDeregister(func(reg *RDRegistration) { events <- "deregister " + reg.Endpoint })
+
+	expectEvent := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("event = %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %q event", want)
+		}
+	}
+
+	clientServer, _ := newTestServer(t)
+	client, err := NewLwM2MClient(clientServer, serverAddr, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RD.Timeout = 2 * time.Second
+
+	client.AddObject(NewLwM2MObject(3, NewLwM2MObjectInstance(0,
+		NewLwM2MResource(0, LwM2MTypeString, LwM2MOperationRead, "Manufacturer"),
+		NewLwM2MResource(9, LwM2MTypeInteger, LwM2MOperationRead, int64(80)),
+	)))
+
+	startTestServer(t, server)
+	startTestServer(t, clientServer)
+
+	if err := client.Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	expectEvent("register node-1")
+
+	reg := lwm2m.GetClient("node-1")
+	if reg == nil {
+		t.Fatal("the client isn't registered")
+	}
+
+	if reg.GetLocation() != client.RD.GetLocation() {
+		t.Errorf("location = %q, the client got %q", reg.GetLocation(), client.RD.GetLocation())
+	}
+
+	if reg.Attributes[LwM2MParamVersion] != LwM2MVersion {
+		t.Errorf("attributes = %v", reg.Attributes)
+	}
+
+	if len(reg.Resources) != 1 || reg.Resources[0].Target != "/3/0" {
+		t.Errorf("resources = %v", CoreResourcesToString(reg.Resources))
+	}
+
+	// The server reaches the client at the address it registered from
+	records, err := lwm2m.ReadTLV("node-1", "/3/0/9")
+	if err != nil {
+		t.Fatalf("ReadTLV failed: %v", err)
+	}
+
+	if v, err := records[0].GetInt(); err != nil || v != 80 {
+		t.Errorf("/3/0/9 = %d (%v)", v, err)
+	}
+
+	if err := client.Update(); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	expectEvent("update node-1")
+
+	if err := client.Deregister(); err != nil {
+		t.Fatalf("Deregister failed: %v", err)
+	}
+	expectEvent("deregister node-1")
+
+	if lwm2m.GetClient("node-1") != nil {
+		t.Error("the client is still registered")
+	}
+
+	if _, err := lwm2m.ReadTLV("node-1", "/3/0/9"); err != ErrLwM2MUnknownClient {
+		t.Errorf("ReadTLV of a deregistered client = %v, want %v", err, ErrLwM2MUnknownClient)
+	}
+
+	// Updating without a registration fails without contacting the server
+	if err := client.Update(); err != ErrRDNotRegistered {
+		t.Errorf("Update after Deregister = %v, want %v", err, ErrRDNotRegistered)
+	}
+}
+
+// Opens a loopback socket exchanging raw messages with a test server. It is closed at the end
+// of the test
+func newTestConn(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("loopback unavailable:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Sends a message to a test server
+func sendTestMessage(t *testing.T, conn *net.UDPConn, msg *Message, addr string) {
+	b, err := MessageToBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+	if _, err := conn.WriteToUDP(b, udpAddr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the next message received from a test server, or nil if none is received in time
+func receiveTestMessage(t *testing.T, conn *net.UDPConn, timeout time.Duration) *Message {
+	buf := make([]byte, MaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil
+	}
+
+	msg, err := BytesToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
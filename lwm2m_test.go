@@ -0,0 +1,251 @@
+package coap
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Device object example of OMA LwM2M 1.0 Section 6.4.3.1
+func TestLwM2MTLVEncode(t *testing.T) {
+	manufacturer, _ := NewLwM2MTLVResource(0, "Open Mobile Alliance")
+	power0, _ := NewLwM2MTLVResourceInstance(0, 1)
+	power1, _ := NewLwM2MTLVResourceInstance(1, 5)
+	time13, _ := NewLwM2MTLVResource(13, time.Unix(0x5182428f, 0))
+
+	b := EncodeLwM2MTLV([]*LwM2MTLV{
+		manufacturer,
+		NewLwM2MTLVMultipleResource(6, power0, power1),
+		time13,
+	})
+
+	want := "c800144f70656e204d6f62696c6520416c6c69616e6365" + "8606410001410105" + "c40d5182428f"
+	if got := hex.EncodeToString(b); got != want {
+		t.Fatalf("EncodeLwM2MTLV = %s, want %s", got, want)
+	}
+}
+
+func TestLwM2MTLVRoundTrip(t *testing.T) {
+	values := []interface{}{
+		"text", []byte{0, 1, 2}, true, false, 0, -1, 127, 128, -32769, int64(1) << 40,
+		1.5, 1.1, time.Unix(1500000000, 0), LwM2MObjectLink{ObjectID: 3, InstanceID: 65535},
+	}
+
+	var resources []*LwM2MTLV
+	for i, v := range values {
+		r, err := NewLwM2MTLVResource(uint16(i), v)
+		if err != nil {
+			t.Fatalf("NewLwM2MTLVResource(%#v) failed: %v", v, err)
+		}
+		resources = append(resources, r)
+	}
+
+	// Identifiers above 255 and values of 8 bytes and more use the long forms
+	long, _ := NewLwM2MTLVResource(300, string(make([]byte, 70000)))
+	resources = append(resources, long)
+
+	in := []*LwM2MTLV{NewLwM2MTLVObjectInstance(1, resources...)}
+
+	out, err := DecodeLwM2MTLV(EncodeLwM2MTLV(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("round trip changed the records: %v != %v", out, in)
+	}
+
+	inst := out[0]
+	if s := inst.GetChild(0).GetString(); s != "text" {
+		t.Errorf("string = %q", s)
+	}
+
+	if v, err := inst.GetChild(2).GetBool(); err != nil || !v {
+		t.Errorf("bool = %v (%v)", v, err)
+	}
+
+	for id, want := range map[uint16]int64{5: -1, 7: 128, 8: -32769, 9: 1 << 40} {
+		if v, err := inst.GetChild(id).GetInt(); err != nil || v != want {
+			t.Errorf("int %d = %d (%v), want %d", id, v, err, want)
+		}
+	}
+
+	if v, err := inst.GetChild(11).GetFloat(); err != nil || v != 1.1 {
+		t.Errorf("float = %v (%v)", v, err)
+	}
+
+	if v, err := inst.GetChild(12).GetTime(); err != nil || v.Unix() != 1500000000 {
+		t.Errorf("time = %v (%v)", v, err)
+	}
+
+	if v, err := inst.GetChild(13).GetObjectLink(); err != nil || v.String() != "3:65535" {
+		t.Errorf("object link = %v (%v)", v, err)
+	}
+
+	if _, err := inst.GetChild(1).GetInt(); err != ErrLwM2MValueType {
+		t.Errorf("GetInt of 3 bytes = %v, want %v", err, ErrLwM2MValueType)
+	}
+
+	if _, err := NewLwM2MTLVResource(0, struct{}{}); err != ErrLwM2MValueType {
+		t.Errorf("NewLwM2MTLVResource(struct) = %v, want %v", err, ErrLwM2MValueType)
+	}
+}
+
+func TestLwM2MTLVDecodeInvalid(t *testing.T) {
+	tests := []string{
+		// Truncated identifier, length and value
+		"c8",
+		"e800",
+		"c80014",
+		"c3000102",
+
+		// Resources in resources, and resource instances in object instances
+		"c402c30001",
+		"0403410001",
+		"8603c30001",
+	}
+
+	for _, data := range tests {
+		b, _ := hex.DecodeString(data)
+		if _, err := DecodeLwM2MTLV(b); err != ErrInvalidLwM2MTLV {
+			t.Errorf("DecodeLwM2MTLV(%s) = %v, want %v", data, err, ErrInvalidLwM2MTLV)
+		}
+	}
+}
+
+func TestLwM2MJSONRoundTrip(t *testing.T) {
+	j := &LwM2MJSON{BaseName: "/3/0/", BaseTime: 1500000000}
+	for _, e := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"0", "Open Mobile Alliance"},
+		{"6/0", 1},
+		{"6/1", 5},
+		{"9", 2.5},
+		{"10", true},
+		{"11", []byte{0xfb, 0xff}},
+		{"12", LwM2MObjectLink{ObjectID: 1, InstanceID: 0}},
+	} {
+		entry, err := NewLwM2MJSONEntry(e.name, e.v)
+		if err != nil {
+			t.Fatalf("NewLwM2MJSONEntry(%#v) failed: %v", e.v, err)
+		}
+		j.Entries = append(j.Entries, entry)
+	}
+	j.Entries[1].Time = -5
+
+	b, err := EncodeLwM2MJSON(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := DecodeLwM2MJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out, j) {
+		t.Fatalf("round trip changed the payload: %s", b)
+	}
+
+	if v, err := out.GetEntry("/3/0/6/1").GetInt(); err != nil || v != 5 {
+		t.Errorf("int = %d (%v)", v, err)
+	}
+
+	if _, err := out.GetEntry("/3/0/9").GetInt(); err != ErrLwM2MValueType {
+		t.Errorf("GetInt of 2.5 = %v, want %v", err, ErrLwM2MValueType)
+	}
+
+	if v, err := out.GetEntry("/3/0/11").GetOpaque(); err != nil || !reflect.DeepEqual(v, []byte{0xfb, 0xff}) {
+		t.Errorf("opaque = %x (%v)", v, err)
+	}
+
+	if v, err := out.GetEntry("/3/0/12").GetObjectLink(); err != nil || v.String() != "1:0" {
+		t.Errorf("object link = %v (%v)", v, err)
+	}
+
+	if v := out.GetTime(out.GetEntry("/3/0/6/0")); v.Unix() != 1499999995 {
+		t.Errorf("time = %v", v)
+	}
+
+	if out.GetEntry("/3/0/1") != nil {
+		t.Errorf("found an entry which doesn't exist")
+	}
+
+	// Payloads without entries still carry the entry array
+	if b, _ := EncodeLwM2MJSON(&LwM2MJSON{}); string(b) != `{"e":[]}` {
+		t.Errorf("EncodeLwM2MJSON(empty) = %s", b)
+	}
+}
+
+func TestLwM2MJSONDecodeInvalid(t *testing.T) {
+	for _, data := range []string{``, `[]`, `{"e":{}}`, `{"e":[{"v":"x"}]}`, `{"bn":1}`} {
+		if _, err := DecodeLwM2MJSON([]byte(data)); err != ErrInvalidLwM2MJSON {
+			t.Errorf("DecodeLwM2MJSON(%s) = %v, want %v", data, err, ErrInvalidLwM2MJSON)
+		}
+	}
+}
+
+func TestLwM2MPayloads(t *testing.T) {
+	r, _ := NewLwM2MTLVResource(1, "x")
+	msg := NewMessage(MessageConfirmable, Put, 1)
+	msg.Payload = NewLwM2MTLVPayload(r)
+	msg.AddOption(OptionContentFormat, MediaTypeTlvVndOmaLwm2m)
+
+	records, err := DecodeLwM2MTLVPayload(msg)
+	if err != nil || !reflect.DeepEqual(records, []*LwM2MTLV{r}) {
+		t.Errorf("DecodeLwM2MTLVPayload = %v (%v)", records, err)
+	}
+
+	if _, err := DecodeLwM2MJSONPayload(msg); err != ErrUnsupportedPayloadFormat {
+		t.Errorf("DecodeLwM2MJSONPayload(TLV) = %v, want %v", err, ErrUnsupportedPayloadFormat)
+	}
+
+	e, _ := NewLwM2MJSONEntry("1", "x")
+	msg.Payload = NewLwM2MJSONPayload(&LwM2MJSON{BaseName: "/1/0/", Entries: []LwM2MJSONEntry{e}})
+	msg.RemoveOptions(OptionContentFormat)
+	msg.AddOption(OptionContentFormat, MediaTypeJSONVndOmaLwm2m)
+
+	j, err := DecodeLwM2MJSONPayload(msg)
+	if err != nil || j.GetEntry("/1/0/1") == nil {
+		t.Errorf("DecodeLwM2MJSONPayload = %v (%v)", j, err)
+	}
+
+	if _, err := DecodeLwM2MTLVPayload(msg); err != ErrUnsupportedPayloadFormat {
+		t.Errorf("DecodeLwM2MTLVPayload(JSON) = %v, want %v", err, ErrUnsupportedPayloadFormat)
+	}
+}
+
+func TestParseLwM2MObjectLink(t *testing.T) {
+	for _, s := range []string{"", "1", "1:x", "1:2:3", "70000:1"} {
+		if _, err := ParseLwM2MObjectLink(s); err != ErrLwM2MValueType {
+			t.Errorf("ParseLwM2MObjectLink(%q) = %v, want %v", s, err, ErrLwM2MValueType)
+		}
+	}
+}
+
+func TestParseLwM2MPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ids  []uint16
+		err  error
+	}{
+		{"", nil, nil},
+		{"/", nil, nil},
+		{"/3", []uint16{3}, nil},
+		{"/3/0/6/1", []uint16{3, 0, 6, 1}, nil},
+		{"3/0/", []uint16{3, 0}, nil},
+		{"/3/0/6/1/2", nil, ErrInvalidLwM2MPath},
+		{"/3/x", nil, ErrInvalidLwM2MPath},
+		{"/65536", nil, ErrInvalidLwM2MPath},
+	}
+
+	for _, test := range tests {
+		ids, err := ParseLwM2MPath(test.path)
+		if err != test.err || !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("ParseLwM2MPath(%q) = %v, %v, want %v, %v", test.path, ids, err, test.ids, test.err)
+		}
+	}
+}
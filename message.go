@@ -1,13 +1,12 @@
 package coap
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
 	"log"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Instantiates a new message object
@@ -43,6 +42,8 @@ func NewMessageOfType(t uint8, id uint16) *Message {
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
    |Ver| T |  TKL  |      Code     |          Message ID           |
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   | TKL (extended, 0-2 bytes, RFC 8974) ...
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
    |   Token (if any, TKL bytes) ...
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
    |   Options (if any) ...
@@ -52,32 +53,50 @@ func NewMessageOfType(t uint8, id uint16) *Message {
 */
 
 // Converts an array of bytes to a Mesasge object.
-// An error is returned if a parsing error occurs
+// An error is returned if a parsing error occurs. Messages whose header could be parsed are
+// returned along with format errors, so that malformed requests can be responded to
 func BytesToMessage(data []byte) (*Message, error) {
 	msg := &Message{}
 
-	dataLen := len(data)
-	if dataLen < 4 {
-		return msg, ErrPacketLengthLessThan4
+	err := msg.Unmarshal(data)
+	if err == ErrPacketLengthLessThan4 || err == ErrInvalidCoapVersion {
+		return nil, err
+	}
+	return msg, err
+}
+
+// Unmarshal decodes a message from its wire format into m. The storage of the token and payload
+// of m is reused, so the decoded message doesn't reference src, which may be reused once Unmarshal
+// returns. Options are allocated anew, as the previous ones may be shared with other messages
+func (m *Message) Unmarshal(src []byte) error {
+	if len(src) < 4 {
+		return ErrPacketLengthLessThan4
 	}
 
-	ver := data[DataHeader] >> 6
+	ver := src[DataHeader] >> 6
 	if ver != 1 {
-		return nil, ErrInvalidCoapVersion
+		return ErrInvalidCoapVersion
 	}
 
-	msg.MessageType = data[DataHeader] >> 4 & 0x03
-	tokenLength := data[DataHeader] & 0x0f
-	msg.Code = CoapCode(data[DataCode])
+	m.MessageType = src[DataHeader] >> 4 & 0x03
+	tokenLength := int(src[DataHeader] & 0x0f)
+	m.Code = CoapCode(src[DataCode])
 
-	msg.MessageID = binary.BigEndian.Uint16(data[DataMsgIDStart:DataMsgIDEnd])
+	m.MessageID = binary.BigEndian.Uint16(src[DataMsgIDStart:DataMsgIDEnd])
+	m.Token = m.Token[:0]
+	m.Options = nil
 
-	// Token
-	if tokenLength > 0 {
-		msg.Token = make([]byte, tokenLength)
-		token := data[DataTokenStart : DataTokenStart+tokenLength]
-		copy(msg.Token, token)
+	// Token, whose length is extended like option deltas and lengths (RFC 8974 Section 2.1)
+	if tokenLength == 15 {
+		return ErrInvalidTokenLength
+	}
+
+	tmp := src[DataTokenStart:]
+	tokenLength, tmp, ok := decodeOptionExtended(tokenLength, tmp)
+	if !ok || len(tmp) < tokenLength {
+		return ErrTruncatedToken
 	}
+	m.Token = append(m.Token, tmp[:tokenLength]...)
 
 	/*
 	    0   1   2   3   4   5   6   7
@@ -103,86 +122,129 @@ func BytesToMessage(data []byte) (*Message, error) {
 	   \                               \
 	   +-------------------------------+
 	*/
-	tmp := data[DataTokenStart+msg.GetTokenLength():]
+	var payload []byte
+	var err error
+	m.Options, payload, err = unmarshalOptions(m.Options, tmp[tokenLength:])
+	if err != nil && err != ErrUnknownCriticalOption {
+		return err
+	}
+
+	if p, ok := m.Payload.(*BytesPayload); ok {
+		p.content = append(p.content[:0], payload...)
+	} else {
+		m.Payload = NewBytesPayload(append([]byte(nil), payload...))
+	}
+
+	if err != nil {
+		return err
+	}
+	return ValidateMessage(m)
+}
+
+// Decodes the options following the token and appends them to opts. The payload following the
+// options is returned. Messages with an invalid critical option are decoded completely, so that
+// the options of the rejected message (e.g. No-Response) are known, before ErrUnknownCriticalOption
+// is returned
+func unmarshalOptions(opts []*Option, tmp []byte) ([]*Option, []byte, error) {
+	var criticalErr error
 
 	lastOptionID := 0
 	for len(tmp) > 0 {
 		if tmp[0] == PayloadMarker {
-			tmp = tmp[1:]
-			break
+			if len(tmp) == 1 {
+				return opts, nil, ErrEmptyPayload
+			}
+			return opts, tmp[1:], criticalErr
 		}
 
 		optionDelta := int(tmp[0] >> 4)
 		optionLength := int(tmp[0] & 0x0f)
-
 		tmp = tmp[1:]
-		switch optionDelta {
-		case 13:
-			optionDeltaExtended := int(tmp[0])
-			optionDelta += optionDeltaExtended
-			tmp = tmp[1:]
-			break
 
-		case 14:
-			optionDeltaExtended := decodeInt(tmp[:1])
-			optionDelta += int(optionDeltaExtended - uint32(269))
-			tmp = tmp[2:]
-			break
+		if optionDelta == 15 {
+			return opts, nil, ErrOptionDeltaUsesValue15
+		}
 
-		case 15:
-			return msg, ErrOptionDeltaUsesValue15
+		if optionLength == 15 {
+			return opts, nil, ErrOptionLengthUsesValue15
 		}
-		lastOptionID += optionDelta
 
-		switch optionLength {
-		case 13:
-			optionLengthExtended := int(tmp[0])
-			optionLength += optionLengthExtended
-			tmp = tmp[1:]
-			break
+		var ok bool
+		if optionDelta, tmp, ok = decodeOptionExtended(optionDelta, tmp); !ok {
+			return opts, nil, ErrOptionOverflow
+		}
 
-		case 14:
-			optionLengthExtended := decodeInt(tmp[:1])
-			optionLength += int(optionLengthExtended - uint32(269))
-			tmp = tmp[2:]
-			break
+		if optionLength, tmp, ok = decodeOptionExtended(optionLength, tmp); !ok {
+			return opts, nil, ErrOptionOverflow
+		}
+
+		lastOptionID += optionDelta
+		if lastOptionID > 0xffff {
+			return opts, nil, ErrOptionNumberOverflow
+		}
 
-		case 15:
-			return msg, ErrOptionLengthUsesValue15
+		if optionLength > len(tmp) {
+			return opts, nil, ErrOptionOverflow
 		}
 
 		optCode := OptionCode(lastOptionID)
-		if optionLength > 0 {
-			optionValue := tmp[:optionLength]
-
-			switch optCode {
-			case OptionURIPort, OptionContentFormat, OptionMaxAge, OptionAccept, OptionSize1,
-				OptionSize2, OptionBlock1, OptionBlock2:
-				msg.Options = append(msg.Options, NewOption(optCode, decodeInt(optionValue)))
-				break
-
-			case OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
-				OptionLocationQuery, OptionProxyURI, OptionProxyScheme, OptionObserve:
-				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
-				break
-
-			default:
-				if lastOptionID&0x01 == 1 {
-					log.Println("Unknown Critical Option id " + strconv.Itoa(lastOptionID))
-					return msg, ErrUnknownCriticalOption
-				}
-				log.Println("Unknown Option id " + strconv.Itoa(lastOptionID))
-				break
+		optionValue := tmp[:optionLength]
+		tmp = tmp[optionLength:]
+
+		// Unrecognized options are kept as raw values, so that endpoints can reject unrecognized
+		// critical options and proxies can forward Safe-to-Forward ones. Registered options with a
+		// value outside of their length limits are ignored if elective, and rejected if critical
+		def := GetOptionDefinition(optCode)
+		if def != nil && !def.IsValidLength(optionLength) {
+			if lastOptionID&0x01 == 1 {
+				log.Println("Invalid Critical Option id " + strconv.Itoa(lastOptionID))
+				criticalErr = ErrUnknownCriticalOption
 			}
-			tmp = tmp[optionLength:]
-		} else {
-			msg.Options = append(msg.Options, NewOption(optCode, nil))
+			continue
 		}
+		opts = append(opts, NewOption(optCode, decodeOptionValue(def, optionValue)))
 	}
-	msg.Payload = NewBytesPayload(tmp)
-	err := ValidateMessage(msg)
+	return opts, nil, criticalErr
+}
 
-	return msg, err
+// Decodes the raw value of an option. Values of unregistered options are kept as raw values
+func decodeOptionValue(def *OptionDefinition, raw []byte) interface{} {
+	if def == nil {
+		value := make(OptionValue, len(raw))
+		copy(value, raw)
+		return value
+	}
+	return def.DecodeValue(raw)
+}
+
+// Decodes the extended option delta, option length or token length indicated by a 4-bit value
+// of the header. False is returned if the extended value exceeds the data
+func decodeOptionExtended(value int, data []byte) (int, []byte, bool) {
+	switch value {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, false
+		}
+		return int(data[0]) + 13, data[1:], true
+
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(data[:2])) + 269, data[2:], true
+	}
+	return value, data, true
+}
+
+// Determines if an error returned by BytesToMessage is caused by a malformed message
+func IsMessageFormatError(err error) bool {
+	switch err {
+	case ErrPacketLengthLessThan4, ErrInvalidCoapVersion, ErrInvalidTokenLength, ErrTruncatedToken,
+		ErrOptionDeltaUsesValue15, ErrOptionLengthUsesValue15, ErrOptionOverflow, ErrOptionNumberOverflow,
+		ErrEmptyPayload:
+		return true
+	}
+	return false
 }
 
 // type to sort the coap options list (which is mandatory) prior to transmission
@@ -202,73 +264,136 @@ func (opts SortOptions) Less(i, j int) bool {
 
 // Converts a message object to a byte array. Typically done prior to transmission
 func MessageToBytes(msg *Message) ([]byte, error) {
-	messageID := []byte{0, 0}
-	binary.BigEndian.PutUint16(messageID, msg.MessageID)
+	b, err := msg.MarshalTo(make([]byte, 0, 64))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-	buf := bytes.Buffer{}
-	buf.Write([]byte{(1 << 6) | (msg.MessageType << 4) | 0x0f&msg.GetTokenLength()})
-	buf.Write([]byte{byte(msg.Code)})
-	buf.Write([]byte{messageID[0]})
-	buf.Write([]byte{messageID[1]})
-	buf.Write(msg.Token)
+// MarshalTo appends the wire format of the message to dst and returns the extended buffer.
+// Options are written in ascending order without reordering m.Options. No memory is allocated
+// if dst has enough capacity and the options are already sorted
+func (m *Message) MarshalTo(dst []byte) ([]byte, error) {
+	if m.MessageType > 3 {
+		return dst, ErrUnknownMessageType
+	}
+
+	if len(m.Token) > MaxTokenLength {
+		return dst, ErrInvalidTokenLength
+	}
 
-	// Sort Options
-	sort.Sort(SortOptions(msg.Options))
+	start := len(dst)
+	tkl, ext, extLen := encodeOptionExtended(len(m.Token))
+	dst = append(dst, 1<<6|m.MessageType<<4|tkl, byte(m.Code), byte(m.MessageID>>8), byte(m.MessageID))
+	dst = append(dst, ext[:extLen]...)
+	dst = append(dst, m.Token...)
+
+	// Unsorted options are sorted on a copy. Repeated options keep their order
+	opts := m.Options
+	for i := 1; i < len(opts); i++ {
+		if opts[i].Code < opts[i-1].Code {
+			opts = append([]*Option(nil), m.Options...)
+			sort.Stable(SortOptions(opts))
+			break
+		}
+	}
 
+	var err error
 	lastOptionCode := 0
-	for _, opt := range msg.Options {
-		optCode := int(opt.Code)
-		optDelta := optCode - lastOptionCode
-		optDeltaValue, _ := getOptionHeaderValue(optDelta)
-
-		byteValue := valueToBytes(opt.Value)
-		valueLength := len(byteValue)
-		optLength := valueLength
-		optLengthValue, _ := getOptionHeaderValue(optLength)
-
-		buf.Write([]byte{byte(optDeltaValue<<4 | optLengthValue)})
-
-		if optDeltaValue == 13 {
-			buf.Write([]byte{byte(optDelta - 13)})
-		} else if optDeltaValue == 14 {
-			tmpBuf := new(bytes.Buffer)
-			binary.Write(tmpBuf, binary.BigEndian, uint16(optDelta-269))
-			buf.Write(tmpBuf.Bytes())
+	for _, opt := range opts {
+		if dst, err = appendOption(dst, opt, int(opt.Code)-lastOptionCode); err != nil {
+			return dst[:start], err
 		}
+		lastOptionCode = int(opt.Code)
+	}
 
-		if optLengthValue == 13 {
-			buf.Write([]byte{byte(optLength - 13)})
-		} else if optLengthValue == 14 {
-			tmpBuf := new(bytes.Buffer)
-			binary.Write(tmpBuf, binary.BigEndian, uint16(optLength-269))
-			buf.Write(tmpBuf.Bytes())
+	switch p := m.Payload.(type) {
+	case nil:
+		break
+
+	case *PlainTextPayload:
+		if len(p.content) > 0 {
+			dst = append(dst, PayloadMarker)
+			dst = append(dst, p.content...)
 		}
 
-		buf.Write(byteValue)
-		lastOptionCode = int(optCode)
+	default:
+		if b := p.GetBytes(); len(b) > 0 {
+			dst = append(dst, PayloadMarker)
+			dst = append(dst, b...)
+		}
 	}
+	return dst, nil
+}
 
-	if msg.Payload != nil {
-		if msg.Payload.Length() > 0 {
-			buf.Write([]byte{PayloadMarker})
-		}
-		buf.Write(msg.Payload.GetBytes())
+// Appends an option with the given delta to its preceding option. The value is appended after
+// room for the longest option header, and moved next to the header once its length is known.
+// Option numbers are 16 bits, which keeps the deltas of sorted options within their encoding
+func appendOption(dst []byte, opt *Option, delta int) ([]byte, error) {
+	if opt.Code < 0 || opt.Code > 0xffff {
+		return dst, ErrOptionNumberOverflow
+	}
+
+	pos := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+
+	dst, err := opt.appendValue(dst)
+	if err != nil {
+		return dst[:pos], err
 	}
-	return buf.Bytes(), nil
+
+	length := len(dst) - pos - 5
+	if length > 0xffff+269 {
+		return dst[:pos], ErrInvalidOptionLength
+	}
+
+	deltaValue, deltaExtended, deltaSize := encodeOptionExtended(delta)
+	lengthValue, lengthExtended, lengthSize := encodeOptionExtended(length)
+
+	dst[pos] = deltaValue<<4 | lengthValue
+	copy(dst[pos+1:], deltaExtended[:deltaSize])
+	copy(dst[pos+1+deltaSize:], lengthExtended[:lengthSize])
+
+	headerSize := 1 + deltaSize + lengthSize
+	copy(dst[pos+headerSize:], dst[pos+5:])
+
+	return dst[:pos+headerSize+length], nil
 }
 
-func getOptionHeaderValue(optValue int) (int, error) {
-	switch true {
-	case optValue <= 12:
-		return optValue, nil
+// Returns the 4-bit value of an option delta, option length or token length and its extended bytes
+func encodeOptionExtended(v int) (byte, [2]byte, int) {
+	var ext [2]byte
 
-	case optValue <= 268:
-		return 13, nil
+	switch {
+	case v < 13:
+		return byte(v), ext, 0
 
-	case optValue <= 65804:
-		return 14, nil
+	case v < 269:
+		ext[0] = byte(v - 13)
+		return 13, ext, 1
 	}
-	return 0, errors.New("Invalid Option Delta")
+
+	binary.BigEndian.PutUint16(ext[:], uint16(v-269))
+	return 14, ext, 2
+}
+
+// Pool of datagram sized buffers used to read and write messages
+var messageBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxPacketSize)
+		return &b
+	},
+}
+
+// Returns a buffer of MaxPacketSize bytes from the pool
+func getMessageBuffer() *[]byte {
+	return messageBufferPool.Get().(*[]byte)
+}
+
+// Returns a buffer to the pool. The buffer must not be used afterwards
+func putMessageBuffer(b *[]byte) {
+	messageBufferPool.Put(b)
 }
 
 // Validates a message object and returns any error upon validation failure
@@ -277,19 +402,20 @@ func ValidateMessage(msg *Message) error {
 		return ErrUnknownMessageType
 	}
 
-	if msg.GetTokenLength() > 8 {
+	if msg.GetExtendedTokenLength() > MaxTokenLength {
 		return ErrInvalidTokenLength
 	}
 
-	// Repeated Unrecognized Options
-	for _, opt := range msg.Options {
-		opts := msg.GetOptions(opt.Code)
+	// Repeated critical options which aren't repeatable. Unrecognized options are checked by the
+	// endpoint or proxy handling the message
+	for i, opt := range msg.Options {
+		if opt.Code&0x01 == 0 || !IsValidOption(opt) || IsRepeatableOption(opt) {
+			continue
+		}
 
-		if len(opts) > 1 {
-			if !IsRepeatableOption(opts[0]) {
-				if opts[0].Code&0x01 == 1 {
-					return ErrUnknownCriticalOption
-				}
+		for _, prev := range msg.Options[:i] {
+			if prev.Code == opt.Code {
+				return ErrUnknownCriticalOption
 			}
 		}
 	}
@@ -307,10 +433,33 @@ type Message struct {
 	Options     []*Option
 }
 
+// Returns the media type accepted by a request, or MediaTypeTextPlain if it has no Accept option
 func (m *Message) GetAcceptedContent() MediaType {
-	mediaTypeCode := m.GetOption(OptionAccept).IntValue()
+	mt, _ := m.GetAccept()
+
+	return mt
+}
+
+// Returns the media type of the Accept option, if any
+func (m *Message) GetAccept() (MediaType, bool) {
+	opt := m.GetOption(OptionAccept)
+	if opt == nil {
+		return MediaTypeTextPlain, false
+	}
+	mt, _ := optionUintValue(opt)
+
+	return MediaType(mt), true
+}
 
-	return MediaType(mediaTypeCode)
+// Returns the media type of the Content-Format option, if any
+func (m *Message) GetContentFormat() (MediaType, bool) {
+	opt := m.GetOption(OptionContentFormat)
+	if opt == nil {
+		return MediaTypeTextPlain, false
+	}
+	mt, _ := optionUintValue(opt)
+
+	return MediaType(mt), true
 }
 
 func (m *Message) GetCodeString() string {
@@ -328,6 +477,11 @@ func (m *Message) GetTokenLength() uint8 {
 	return uint8(len(m.Token))
 }
 
+// Returns the length of the token, including tokens longer than 255 bytes (RFC 8974)
+func (m *Message) GetExtendedTokenLength() int {
+	return len(m.Token)
+}
+
 func (m *Message) GetTokenString() string {
 	return string(m.Token[:len(m.Token)])
 }
@@ -353,14 +507,27 @@ func (m Message) GetOption(id OptionCode) *Option {
 	return nil
 }
 
+// Determines if a request opted out of responses of the class of a response code with the
+// No-Response option (RFC 7967)
+func (m *Message) SuppressesResponse(code CoapCode) bool {
+	opt := m.GetOption(OptionNoResponse)
+	if opt == nil {
+		return false
+	}
+
+	v, ok := optionUintValue(opt)
+	class := code >> 5
+	return ok && class >= 2 && class <= 5 && v&(1<<(class-1)) != 0
+}
+
 // Attempts to return the string value of an Option
 func (m Message) GetOptionsAsString(id OptionCode) []string {
 	opts := m.GetOptions(id)
 
 	var str []string
 	for _, o := range opts {
-		if o.Value != nil {
-			str = append(str, o.Value.(string))
+		if v, err := o.GetString(); err == nil && o.Value != nil {
+			str = append(str, v)
 		}
 	}
 	return str
@@ -373,6 +540,28 @@ func (m *Message) GetLocationPath() string {
 	return strings.Join(opts, "/")
 }
 
+// Decodes the payload of the message according to its Content-Format
+func (m *Message) DecodePayload(v interface{}) error {
+	return DecodeMessagePayload(m, v)
+}
+
+// Returns the entity-tags of a message. Requests may carry several, responses at most one
+func (m *Message) GetETags() [][]byte {
+	var etags [][]byte
+	for _, opt := range m.GetOptions(OptionEtag) {
+		etags = append(etags, optionBytesValue(opt))
+	}
+	return etags
+}
+
+// Returns the entity-tag of a response, or nil if it has none
+func (m *Message) GetETag() []byte {
+	if opt := m.GetOption(OptionEtag); opt != nil {
+		return optionBytesValue(opt)
+	}
+	return nil
+}
+
 // Returns the string value of the Uri Path Options by joining and defining a / separator
 func (m Message) GetURIPath() string {
 	opts := m.GetOptionsAsString(OptionURIPath)
@@ -423,6 +612,33 @@ func (m *Message) RemoveOptions(id OptionCode) {
 	m.Options = opts
 }
 
+// Returns a copy of the message. Options and payload are copied so that the copy can be
+// modified independently of the original
+func (m *Message) Clone() *Message {
+	c := &Message{
+		MessageType: m.MessageType,
+		Code:        m.Code,
+		MessageID:   m.MessageID,
+	}
+
+	if m.Token != nil {
+		c.Token = make([]byte, len(m.Token))
+		copy(c.Token, m.Token)
+	}
+
+	for _, opt := range m.Options {
+		c.Options = append(c.Options, NewOption(opt.Code, opt.Value))
+	}
+
+	if m.Payload != nil {
+		b := m.Payload.GetBytes()
+		payload := make([]byte, len(b))
+		copy(payload, b)
+		c.Payload = NewBytesPayload(payload)
+	}
+	return c
+}
+
 // Adds a string payload
 func (m *Message) SetStringPayload(s string) {
 	m.Payload = NewPlainTextPayload(s)
@@ -436,33 +652,6 @@ func IsProxyRequest(msg *Message) bool {
 	return false
 }
 
-func valueToBytes(value interface{}) []byte {
-	var v uint32
-
-	switch i := value.(type) {
-	case string:
-		return []byte(i)
-	case []byte:
-		return i
-	case MediaType:
-		v = uint32(i)
-	case byte:
-		v = uint32(i)
-	case int:
-		v = uint32(i)
-	case int32:
-		v = uint32(i)
-	case uint:
-		v = uint32(i)
-	case uint32:
-		v = i
-	default:
-		break
-	}
-
-	return encodeInt(v)
-}
-
 // Returns the string value for a Message Payload
 func PayloadAsString(p MessagePayload) string {
 	if p == nil {
@@ -471,44 +660,39 @@ func PayloadAsString(p MessagePayload) string {
 	return p.String()
 }
 
-func decodeInt(b []byte) uint32 {
+// Decodes a uint in network byte order. Values longer than 4 bytes are rejected
+func decodeInt(b []byte) (uint32, error) {
+	if len(b) > 4 {
+		return 0, ErrInvalidOptionValue
+	}
+
 	tmp := []byte{0, 0, 0, 0}
 	copy(tmp[4-len(b):], b)
 
-	return binary.BigEndian.Uint32(tmp)
+	return binary.BigEndian.Uint32(tmp), nil
 }
 
-func encodeInt(v uint32) []byte {
+// Appends a uint in network byte order without leading zero bytes. Zero is encoded as no bytes
+func appendInt(dst []byte, v uint32) []byte {
 	switch {
 	case v == 0:
-		return nil
-
-	case v < 256:
-		return []byte{byte(v)}
+		return dst
 
-	case v < 65536:
-		rv := []byte{0, 0}
-		binary.BigEndian.PutUint16(rv, uint16(v))
-		return rv
+	case v < 1<<8:
+		return append(dst, byte(v))
 
-	case v < 16777216:
-		rv := []byte{0, 0, 0, 0}
-		binary.BigEndian.PutUint32(rv, uint32(v))
-		return rv[1:]
+	case v < 1<<16:
+		return append(dst, byte(v>>8), byte(v))
 
-	default:
-		rv := []byte{0, 0, 0, 0}
-		binary.BigEndian.PutUint32(rv, uint32(v))
-		return rv
+	case v < 1<<24:
+		return append(dst, byte(v>>16), byte(v>>8), byte(v))
 	}
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
 
-// Determines if a message contains URI targeting a CoAP resource
-func IsCoapURI(uri string) bool {
-	if strings.HasPrefix(uri, "coap") || strings.HasPrefix(uri, "coaps") {
-		return true
-	}
-	return false
+// Determines if a code is a response code (classes 2, 4 and 5) rather than a method or empty message
+func IsResponseCode(code CoapCode) bool {
+	return code>>5 >= 2
 }
 
 // Determines if a message contains URI targeting an HTTP resource
@@ -538,6 +722,12 @@ func MethodString(c CoapCode) string {
 	return ""
 }
 
+// Determines if a method is safe, i.e. only retrieves a representation (RFC 7252 Section 5.8
+// and RFC 8132 Section 2)
+func IsSafeMethod(c CoapCode) bool {
+	return c == Get || c == Fetch
+}
+
 // Response Code Messages
 // Creates a Non-Confirmable Empty Message
 func EmptyMessage(messageID uint16, messageType uint8) *Message {
@@ -569,6 +759,11 @@ func ContentMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeContent, messageID)
 }
 
+// Creates a Non-Confirmable with CoAP Code 231 - Continue
+func ContinueMessage(messageID uint16, messageType uint8) *Message {
+	return NewMessage(messageType, CoapCodeContinue, messageID)
+}
+
 // Creates a Non-Confirmable with CoAP Code 400 - Bad Request
 func BadRequestMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeBadRequest, messageID)
@@ -604,6 +799,11 @@ func NotAcceptableMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeNotAcceptable, messageID)
 }
 
+// Creates a Non-Confirmable with CoAP Code 408 - Request Entity Incomplete
+func RequestEntityIncompleteMessage(messageID uint16, messageType uint8) *Message {
+	return NewMessage(messageType, CoapCodeRequestEntityIncomplete, messageID)
+}
+
 // Creates a Non-Confirmable with CoAP Code 409 - Conflict
 func ConflictMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeConflict, messageID)
@@ -624,6 +824,11 @@ func UnsupportedContentFormatMessage(messageID uint16, messageType uint8) *Messa
 	return NewMessage(messageType, CoapCodeUnsupportedContentFormat, messageID)
 }
 
+// Creates a Non-Confirmable with CoAP Code 429 - Too Many Requests
+func TooManyRequestsMessage(messageID uint16, messageType uint8) *Message {
+	return NewMessage(messageType, CoapCodeTooManyRequests, messageID)
+}
+
 // Creates a Non-Confirmable with CoAP Code 500 - Internal Server Error
 func InternalServerErrorMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeInternalServerError, messageID)
@@ -653,3 +858,8 @@ func GatewayTimeoutMessage(messageID uint16, messageType uint8) *Message {
 func ProxyingNotSupportedMessage(messageID uint16, messageType uint8) *Message {
 	return NewMessage(messageType, CoapCodeProxyingNotSupported, messageID)
 }
+
+// Creates a Non-Confirmable with CoAP Code 508 - Hop Limit Reached
+func HopLimitReachedMessage(messageID uint16, messageType uint8) *Message {
+	return NewMessage(messageType, CoapCodeHopLimitReached, messageID)
+}
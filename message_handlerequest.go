@@ -8,6 +8,14 @@ import (
 
 func handleRequest(s CoapServer, err error, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	if msg.MessageType != MessageReset {
+		// CoAP Ping (an empty Confirmable message) is answered with a Reset
+		if msg.Code == CoapCodeEmpty {
+			if msg.MessageType == MessageConfirmable {
+				handleReqPing(s, msg, conn, addr)
+			}
+			return
+		}
+
 		// Unsupported Method
 		if msg.Code != Get && msg.Code != Post && msg.Code != Put && msg.Code != Delete {
 			handleReqUnsupportedMethodRequest(s, msg, conn, addr)
@@ -17,14 +25,23 @@ func handleRequest(s CoapServer, err error, msg *Message, conn *net.UDPConn, add
 		if err != nil {
 			s.GetEvents().Error(err)
 			if err == ErrUnknownCriticalOption {
-				handleReqUnknownCriticalOption(msg, conn, addr)
+				handleReqUnknownCriticalOption(s, msg, conn, addr)
 				return
 			}
 		}
 
+		// Echo challenge of unverified clients and of requests which must be fresh (RFC 9175)
+		if policy := s.GetEchoPolicy(); policy != nil && policy.mustChallenge(msg, addr) {
+			handleReqResponse(s, msg, policy.challengeMessage(msg, addr), conn, addr)
+			return
+		}
+
 		// Proxy
 		if IsProxyRequest(msg) {
 			handleReqProxyRequest(s, msg, conn, addr)
+		} else if HasUnrecognizedCriticalOption(msg) {
+			s.GetEvents().Error(ErrUnknownCriticalOption)
+			handleReqUnknownCriticalOption(s, msg, conn, addr)
 		} else {
 			route, attrs, err := MatchingRoute(msg.GetURIPath(), MethodString(msg.Code), msg.GetOptions(OptionContentFormat), s.GetRoutes())
 			if err != nil {
@@ -59,12 +76,44 @@ func handleRequest(s CoapServer, err error, msg *Message, conn *net.UDPConn, add
 
 			s.UpdateMessageTS(msg)
 
+			// Block options with the reserved block size exponent 7 are rejected with 4.00 Bad Request
+			if msg.HasInvalidBlockOption(OptionBlock1) || msg.HasInvalidBlockOption(OptionBlock2) {
+				s.GetEvents().Error(ErrInvalidBlockOption)
+				handleReqResponse(s, msg, BadRequestMessage(msg.MessageID, MessageAcknowledgment), conn, addr)
+				return
+			}
+
+			// Blocks of a request body are collected until the last one is received
+			block1 := msg.GetBlockOption(OptionBlock1)
+			if block1 != nil {
+				body, ret := receiveBlock1(addr.String(), block1TransferKey(s.GetLocalAddress(), addr, msg), msg, block1)
+				if ret != nil {
+					handleReqResponse(s, msg, ret, conn, addr)
+					return
+				}
+				msg.Payload = NewBytesPayload(body)
+			}
+
+			// Conditional Request, evaluated before the request is acknowledged or observed
+			req := NewClientRequestFromMessage(msg, attrs, conn, addr)
+			if ret := checkPreconditions(route, req); ret != nil {
+				handleReqResponse(s, msg, ret, conn, addr)
+				return
+			}
+
 			// Auto acknowledge
 			if msg.MessageType == MessageConfirmable && route.AutoAck {
 				handleRequestAutoAcknowledge(s, msg, conn, addr)
 			}
 
-			req := NewClientRequestFromMessage(msg, attrs, conn, addr)
+			// Content Negotiation
+			representation, err := negotiateRepresentation(route, msg)
+			if err != nil {
+				s.GetEvents().Error(err)
+				handleReqResponse(s, msg, NotAcceptableMessage(msg.MessageID, MessageAcknowledgment), conn, addr)
+				return
+			}
+
 			if msg.MessageType == MessageConfirmable {
 
 				// Observation Request
@@ -80,12 +129,44 @@ func handleRequest(s CoapServer, err error, msg *Message, conn *net.UDPConn, add
 				respMsg := resp.GetMessage()
 				respMsg.Token = req.GetMessage().Token
 
+				// Representations of resources with an entity-tag carry it
+				if route.ETag != nil && respMsg.Code == CoapCodeContent && respMsg.GetOption(OptionEtag) == nil {
+					if etag := route.ETag(req); etag != nil {
+						respMsg.AddOption(OptionEtag, etag)
+					}
+				}
+
+				if err := encodeRepresentation(representation, respMsg); err != nil {
+					s.GetEvents().Error(err)
+					handleReqResponse(s, msg, InternalServerErrorMessage(msg.MessageID, MessageAcknowledgment), conn, addr)
+					return
+				}
+
+				// Block-wise transfer of representations larger than a block, if enabled
+				if size := s.GetBlockSize(); size > 0 && respMsg.Code == CoapCodeContent && respMsg.Payload != nil && respMsg.GetOption(OptionBlock2) == nil {
+					if !SetBlock2Payload(respMsg, respMsg.Payload.GetBytes(), msg.GetBlockOption(OptionBlock2), size) {
+						handleReqResponse(s, msg, BadOptionMessage(msg.MessageID, MessageAcknowledgment), conn, addr)
+						return
+					}
+				}
+
+				// The last block of a request body is acknowledged with its Block1 option
+				if block1 != nil && respMsg.GetOption(OptionBlock1) == nil {
+					respMsg.SetBlockOption(OptionBlock1, block1)
+				}
+
+				// Responses to unverified clients mustn't amplify their requests too much
+				if policy := s.GetEchoPolicy(); policy != nil && policy.exceedsAmplification(msg, respMsg, addr) {
+					handleReqResponse(s, msg, policy.challengeMessage(msg, addr), conn, addr)
+					return
+				}
+
 				// TODO: Validate Message before sending (e.g missing messageId)
 				err := ValidateMessage(respMsg)
 				if err == nil {
 					s.GetEvents().Message(respMsg, false)
 
-					SendMessageTo(respMsg, NewUDPConnection(conn), addr)
+					sendReqResponse(msg, respMsg, conn, addr)
 				} else {
 					fmt.Println("MESSAGE IS NOT VALID: ", err)
 				}
@@ -94,33 +175,120 @@ func handleRequest(s CoapServer, err error, msg *Message, conn *net.UDPConn, add
 	}
 }
 
-func handleReqUnknownCriticalOption(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+// Sends a response generated by the server rather than a route handler
+func handleReqResponse(s CoapServer, msg *Message, ret *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	if msg.MessageType != MessageConfirmable {
+		ret.MessageType = MessageNonConfirmable
+		ret.MessageID = GenerateMessageID()
+	}
+	ret.Token = msg.Token
+
+	s.GetEvents().Message(ret, false)
+	sendReqResponse(msg, ret, conn, addr)
+}
+
+// Sends a response to a request, unless the request opted out of responses of its class with the
+// No-Response option (RFC 7967). Confirmable requests are then acknowledged with an empty ACK
+func sendReqResponse(msg *Message, ret *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	if msg.SuppressesResponse(ret.Code) {
+		if msg.MessageType == MessageConfirmable && ret.MessageType == MessageAcknowledgment {
+			SendMessageTo(EmptyMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
+		}
+		return
+	}
+	SendMessageTo(ret, NewUDPConnection(conn), addr)
+}
+
+func handleReqPing(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	rst := NewMessageOfType(MessageReset, msg.MessageID)
+
+	s.GetEvents().Message(rst, false)
+	SendMessageTo(rst, NewUDPConnection(conn), addr)
+}
+
+// Malformed Confirmable requests are answered with 4.00 Bad Request carrying the format error as
+// diagnostic payload. Other malformed messages are silently ignored
+func handleReqMalformedMessage(s CoapServer, err error, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	if msg == nil || msg.MessageType != MessageConfirmable || msg.Code == CoapCodeEmpty || IsResponseCode(msg.Code) {
+		return
+	}
+
+	ret := BadRequestMessage(msg.MessageID, MessageAcknowledgment)
+	ret.Token = msg.Token
+	ret.SetStringPayload(err.Error())
+
+	s.GetEvents().Message(ret, false)
+	SendMessageTo(ret, NewUDPConnection(conn), addr)
+}
+
+// Messages with tokens longer than the server accepts are rejected with a Reset if the server
+// doesn't support extended token lengths, as their token length is a format error to it. Servers
+// supporting extended token lengths answer such requests with 4.00 Bad Request instead, since a
+// Reset tells clients extended token lengths aren't supported at all (RFC 8974 Section 2.2.2)
+func handleReqTokenTooLong(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	if s.GetMaxTokenLength() <= DefaultMaxTokenLength || msg.Code == CoapCodeEmpty || IsResponseCode(msg.Code) {
+		if msg.MessageType == MessageConfirmable || msg.MessageType == MessageNonConfirmable {
+			rst := NewMessageOfType(MessageReset, msg.MessageID)
+
+			s.GetEvents().Message(rst, false)
+			SendMessageTo(rst, NewUDPConnection(conn), addr)
+		}
+		return
+	}
+
+	if msg.MessageType != MessageConfirmable && msg.MessageType != MessageNonConfirmable {
+		return
+	}
+
+	ret := BadRequestMessage(msg.MessageID, MessageAcknowledgment)
+	ret.SetStringPayload(ErrTokenTooLong.Error())
+	handleReqResponse(s, msg, ret, conn, addr)
+}
+
+// Rejects a Confirmable request with an unrecognized or invalid critical option with 4.02 Bad
+// Option, unless the request opted out of client error responses
+func handleReqUnknownCriticalOption(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	if msg.MessageType == MessageConfirmable {
-		SendMessageTo(BadOptionMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
+		handleReqResponse(s, msg, BadOptionMessage(msg.MessageID, MessageAcknowledgment), conn, addr)
 	}
-	return
 }
 
 func handleReqUnsupportedMethodRequest(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	ret := NotImplementedMessage(msg.MessageID, MessageAcknowledgment)
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
+	ret.Token = msg.Token
 
 	s.GetEvents().Message(ret, false)
-	SendMessageTo(ret, NewUDPConnection(conn), addr)
+	sendReqResponse(msg, ret, conn, addr)
 }
 
 func handleReqProxyRequest(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	if !s.AllowProxyForwarding(msg, addr) {
-		SendMessageTo(ForbiddenMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
+	if result := s.FilterProxyRequest(msg, addr); !result.Allowed {
+		ret := NewMessage(MessageAcknowledgment, result.GetCode(), msg.MessageID)
+		ret.Token = msg.Token
+
+		sendReqResponse(msg, ret, conn, addr)
+		return
 	}
 
-	proxyURI := msg.GetOption(OptionProxyURI).StringValue()
-	if IsCoapURI(proxyURI) {
+	target, err := ProxyTargetURI(msg)
+	if err != nil {
+		ret := BadOptionMessage(msg.MessageID, MessageAcknowledgment)
+		ret.Token = msg.Token
+
+		sendReqResponse(msg, ret, conn, addr)
+		return
+	}
+
+	switch target.Scheme {
+	case "coap", "coaps":
 		s.ForwardCoap(msg, conn, addr)
-	} else if IsHTTPURI(proxyURI) {
+
+	case "http", "https":
 		s.ForwardHTTP(msg, conn, addr)
-	} else {
-		//
+
+	default:
+		NullProxyHandler(msg, conn, addr)
 	}
 }
 
@@ -129,23 +297,25 @@ func handleReqNoMatchingRoute(s CoapServer, msg *Message, conn *net.UDPConn, add
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
 	ret.Token = msg.Token
 
-	SendMessageTo(ret, NewUDPConnection(conn), addr)
+	sendReqResponse(msg, ret, conn, addr)
 }
 
 func handleReqNoMatchingMethod(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	ret := MethodNotAllowedMessage(msg.MessageID, MessageAcknowledgment)
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
+	ret.Token = msg.Token
 
 	s.GetEvents().Message(ret, false)
-	SendMessageTo(ret, NewUDPConnection(conn), addr)
+	sendReqResponse(msg, ret, conn, addr)
 }
 
 func handleReqUnsupportedContentFormat(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	ret := UnsupportedContentFormatMessage(msg.MessageID, MessageAcknowledgment)
 	ret.CloneOptions(msg, OptionURIPath, OptionContentFormat)
+	ret.Token = msg.Token
 
 	s.GetEvents().Message(ret, false)
-	SendMessageTo(ret, NewUDPConnection(conn), addr)
+	sendReqResponse(msg, ret, conn, addr)
 }
 
 func handleReqDuplicateMessageID(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
@@ -166,15 +336,23 @@ func handleRequestAutoAcknowledge(s CoapServer, msg *Message, conn *net.UDPConn,
 func handleReqObserve(s CoapServer, req CoapRequest, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
 	// TODO: if server doesn't allow observing, return error
 
-	// TODO: Check if observation has been registered, if yes, remove it (observation == cancel)
+	// Observe 1 deregisters the client, any other value registers it
 	resource := msg.GetURIPath()
-	if s.HasObservation(resource, addr) {
+	obs, _ := optionUintValue(msg.GetOption(OptionObserve))
+	if obs == 1 {
+		if !s.HasObservation(resource, addr) {
+			return
+		}
+
 		// Remove observation of client
 		s.RemoveObservation(resource, addr)
 
 		// Observe Cancel Request & Fire OnObserveCancel Event
 		s.GetEvents().ObserveCancelled(resource, msg)
 	} else {
+		// A client registering again replaces its observation, e.g. with a new token
+		s.RemoveObservation(resource, addr)
+
 		// Register observation of client
 		s.AddObservation(msg.GetURIPath(), string(msg.Token), addr)
 
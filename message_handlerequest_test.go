@@ -0,0 +1,84 @@
+package coap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNoResponse(t *testing.T) {
+	server, serverAddr := newTestServer(t)
+	server.Get("/ok", func(req CoapRequest) CoapResponse {
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment))
+	})
+	server.Get("/err", func(req CoapRequest) CoapResponse {
+		return NewResponseWithMessage(InternalServerErrorMessage(req.GetMessage().MessageID, MessageAcknowledgment))
+	})
+
+	startTestServer(t, server)
+	conn := newTestConn(t)
+
+	tests := []struct {
+		path     string
+		classes  uint8
+		critical bool
+		code     CoapCode
+	}{
+		// Responses of other classes than those opted out of are sent
+		{"ok", 0, false, CoapCodeContent},
+		{"ok", NoResponseClientError | NoResponseServerError, false, CoapCodeContent},
+		{"missing", NoResponseSuccess, false, CoapCodeNotFound},
+		{"err", NoResponseSuccess | NoResponseClientError, false, CoapCodeInternalServerError},
+		{"ok", NoResponseSuccess, true, CoapCodeBadOption},
+		{"ok", 0, true, CoapCodeBadOption},
+
+		// Suppressed responses to Confirmable requests are replaced by an empty ACK
+		{"ok", NoResponseSuccess, false, CoapCodeEmpty},
+		{"missing", NoResponseClientError, false, CoapCodeEmpty},
+		{"err", NoResponseServerError, false, CoapCodeEmpty},
+		{"ok", NoResponseClientError, true, CoapCodeEmpty},
+
+		// Combined classes
+		{"ok", NoResponseSuccess | NoResponseClientError | NoResponseServerError, false, CoapCodeEmpty},
+		{"missing", NoResponseSuccess | NoResponseClientError | NoResponseServerError, false, CoapCodeEmpty},
+		{"err", NoResponseSuccess | NoResponseClientError | NoResponseServerError, false, CoapCodeEmpty},
+		{"ok", NoResponseSuccess | NoResponseClientError | NoResponseServerError, true, CoapCodeEmpty},
+	}
+
+	for _, test := range tests {
+		for _, confirmable := range []bool{true, false} {
+			msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+			if !confirmable {
+				msg.MessageType = MessageNonConfirmable
+			}
+			msg.Token = []byte("nr")
+			msg.AddOption(OptionURIPath, test.path)
+			msg.AddOption(OptionNoResponse, test.classes)
+			if test.critical {
+				msg.AddOption(65001, []byte{1})
+			}
+
+			sendTestMessage(t, conn, msg, serverAddr)
+			resp := receiveTestMessage(t, conn, 300*time.Millisecond)
+
+			switch {
+			case !confirmable && (test.code == CoapCodeEmpty || test.critical):
+				// Non-confirmable requests aren't acknowledged, nor rejected for critical options
+				if resp != nil {
+					t.Errorf("NON /%s with No-Response %d: %s received", test.path, test.classes, CoapCodeToString(resp.Code))
+				}
+
+			case resp == nil:
+				t.Errorf("/%s with No-Response %d: no response", test.path, test.classes)
+
+			case resp.Code != test.code || resp.MessageType == MessageReset:
+				t.Errorf("/%s with No-Response %d = %s, want %s", test.path, test.classes, CoapCodeToString(resp.Code), CoapCodeToString(test.code))
+
+			case confirmable && (resp.MessageType != MessageAcknowledgment || resp.MessageID != msg.MessageID):
+				t.Errorf("/%s with No-Response %d: response type %d with Message ID %d", test.path, test.classes, resp.MessageType, resp.MessageID)
+
+			case test.code != CoapCodeEmpty && string(resp.Token) != "nr":
+				t.Errorf("/%s with No-Response %d: response token %q", test.path, test.classes, resp.Token)
+			}
+		}
+	}
+}
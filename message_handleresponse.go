@@ -3,14 +3,21 @@ package coap
 import "net"
 
 func handleResponse(s CoapServer, msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	if msg.GetOption(OptionObserve) != nil {
-		handleAcknowledgeObserveRequest(s, msg)
-		return
+	// Confirmable responses (e.g. separate responses and notifications) are acknowledged
+	if msg.MessageType == MessageConfirmable {
+		ack := NewMessageOfType(MessageAcknowledgment, msg.MessageID)
+		SendMessageTo(ack, NewUDPConnection(conn), addr)
 	}
 
 	//responser := GetResponser()
 	//responser.Msg <- msg
-	RunAwaitResponseHandler(msg)
+	if RunAwaitResponseHandler(msg) {
+		return
+	}
+
+	if msg.GetOption(OptionObserve) != nil {
+		handleAcknowledgeObserveRequest(s, msg)
+	}
 }
 func handleAcknowledgeObserveRequest(s CoapServer, msg *Message) {
 	s.GetEvents().Notify(msg.GetURIPath(), msg.Payload, msg)
@@ -0,0 +1,375 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fuzzSeedMessages() [][]byte {
+	var seeds [][]byte
+
+	get := NewMessage(MessageConfirmable, Get, 12345)
+	get.Token = []byte("token")
+	get.AddOptions(NewPathOptions("/sensors/temp"))
+	get.AddOption(OptionURIQuery, "unit=c")
+	get.AddOption(OptionAccept, MediaTypeApplicationJSON)
+	get.AddOption(OptionObserve, 0)
+
+	put := NewMessage(MessageNonConfirmable, Put, 1)
+	put.AddOption(OptionContentFormat, MediaTypeApplicationCBOR)
+	put.AddOption(OptionIfMatch, []byte{1, 2, 3, 4})
+	put.AddOption(OptionProxyURI, "coap://example.com/"+string(bytes.Repeat([]byte("a"), 300)))
+	put.SetStringPayload("payload")
+
+	content := ContentMessage(2, MessageAcknowledgment)
+	content.AddOption(OptionEtag, []byte{9})
+	content.AddOption(OptionMaxAge, 3600)
+	content.AddOption(OptionSize2, 70000)
+	content.AddOption(65000, []byte("vendor"))
+	content.SetStringPayload("{}")
+
+	extended := NewMessage(MessageConfirmable, Post, 2)
+	extended.Token = bytes.Repeat([]byte{0xa5}, 300)
+
+	for _, msg := range []*Message{get, put, content, extended, NewEmptyMessage(3)} {
+		b, err := MessageToBytes(msg)
+		if err == nil {
+			seeds = append(seeds, b)
+		}
+	}
+
+	return append(seeds,
+		[]byte{0x40},
+		[]byte{0x48, 0x01, 0x00, 0x01},
+		[]byte{0x40, 0x01, 0x00, 0x01, 0xff},
+		[]byte{0x40, 0x01, 0x00, 0x01, 0xe0, 0x01},
+		[]byte{0x40, 0x01, 0x00, 0x01, 0x1d},
+		[]byte{0x40, 0x01, 0x00, 0x01, 0xf0},
+	)
+}
+
+// Decoding arbitrary data must not panic, and decoded messages must survive an encode/decode
+// round trip unchanged
+func FuzzBytesToMessage(f *testing.F) {
+	for _, seed := range fuzzSeedMessages() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := BytesToMessage(data)
+		if err != nil {
+			return
+		}
+
+		b, err := MessageToBytes(msg)
+		if err != nil {
+			t.Fatalf("encoding a decoded message failed: %v", err)
+		}
+
+		decoded, err := BytesToMessage(b)
+		if err != nil {
+			t.Fatalf("decoding an encoded message failed: %v", err)
+		}
+
+		b2, err := MessageToBytes(decoded)
+		if err != nil {
+			t.Fatalf("encoding a decoded message failed: %v", err)
+		}
+
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("round trip changed the message: %x != %x", b, b2)
+		}
+
+		// Decoding into a message reusing the storage of a decoded message gives the same message
+		if err := decoded.Unmarshal(data); err != nil {
+			t.Fatalf("decoding into a reused message failed: %v", err)
+		}
+
+		if b3, err := MessageToBytes(decoded); err != nil || !bytes.Equal(b, b3) {
+			t.Fatalf("decoding into a reused message changed the message: %x != %x", b, b3)
+		}
+	})
+}
+
+// Encoded messages must decode to the same header, token, options and payload
+func FuzzMessageToBytes(f *testing.F) {
+	f.Add(uint8(MessageConfirmable), uint8(Get), uint16(1), []byte("tk"), "/a/b", "q=1", uint32(50), []byte("payload"))
+	f.Add(uint8(MessageNonConfirmable), uint8(CoapCodeContent), uint16(65535), []byte{}, "", "", uint32(0), []byte{})
+
+	f.Fuzz(func(t *testing.T, msgType, code uint8, messageID uint16, token []byte, path, query string, cf uint32, payload []byte) {
+		msg := NewMessage(msgType&0x03, CoapCode(code), messageID)
+		if len(token) > MaxTokenLength {
+			token = token[:MaxTokenLength]
+		}
+		msg.Token = token
+		msg.AddOptions(NewPathOptions(path))
+		if query != "" && len(query) <= 255 {
+			msg.AddOption(OptionURIQuery, query)
+		}
+		if cf <= 0xffff {
+			msg.AddOption(OptionContentFormat, cf)
+		}
+		msg.Payload = NewBytesPayload(payload)
+
+		b, err := MessageToBytes(msg)
+		if err != nil {
+			// Path segments may exceed the length limit of Uri-Path
+			return
+		}
+
+		decoded, err := BytesToMessage(b)
+		if err != nil {
+			t.Fatalf("decoding an encoded message failed: %v", err)
+		}
+
+		if decoded.MessageType != msg.MessageType || decoded.Code != msg.Code || decoded.MessageID != msg.MessageID {
+			t.Fatalf("header mismatch")
+		}
+
+		if !bytes.Equal(decoded.Token, msg.Token) {
+			t.Fatalf("token mismatch: %x != %x", decoded.Token, msg.Token)
+		}
+
+		if decoded.GetURIPath() != msg.GetURIPath() {
+			t.Fatalf("path mismatch: %q != %q", decoded.GetURIPath(), msg.GetURIPath())
+		}
+
+		if !bytes.Equal(decoded.Payload.GetBytes(), payload) {
+			t.Fatalf("payload mismatch")
+		}
+	})
+}
+
+// Unrecognized options, critical or not, are kept so that proxies can forward them unchanged
+func TestUnknownOptionsRoundTrip(t *testing.T) {
+	data := []byte{0x42, 0x01, 0x00, 0x01, 0xaa, 0xbb}
+
+	// Options 9 (critical), 9 repeated and empty, 10 (elective, unsafe), 13 with an extended
+	// length, and 2049 with an extended delta
+	data = append(data, 0x91, 'a', 0x00, 0x11, 'x', 0x3d, 0x01)
+	data = append(data, bytes.Repeat([]byte{0x5a}, 14)...)
+	data = append(data, 0xe0, 0x06, 0xe7, 0xff, 'p')
+
+	msg, err := BytesToMessage(data)
+	if err != nil {
+		t.Fatalf("decoding unknown options failed: %v", err)
+	}
+
+	var codes []OptionCode
+	for _, opt := range msg.Options {
+		codes = append(codes, opt.Code)
+	}
+	if len(codes) != 5 || codes[0] != 9 || codes[1] != 9 || codes[2] != 10 || codes[3] != 13 || codes[4] != 2049 {
+		t.Errorf("decoded options = %v", codes)
+	}
+
+	if !HasUnrecognizedCriticalOption(msg) {
+		t.Error("the unrecognized critical options weren't detected")
+	}
+
+	if !HasUnsafeUnrecognizedOption(msg) {
+		t.Error("the unrecognized unsafe option wasn't detected")
+	}
+
+	b, err := MessageToBytes(msg)
+	if err != nil {
+		t.Fatalf("encoding unknown options failed: %v", err)
+	}
+
+	if !bytes.Equal(b, data) {
+		t.Errorf("round trip = %x, want %x", b, data)
+	}
+
+	// A vendor option with a large number and value
+	vendor := NewMessage(MessageConfirmable, Post, 2)
+	vendor.AddOption(65001, bytes.Repeat([]byte{0x01}, 300))
+	vendor.AddOption(65000, []byte("vendor"))
+
+	b, err = MessageToBytes(vendor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := BytesToMessage(b)
+	if err != nil {
+		t.Fatalf("decoding vendor options failed: %v", err)
+	}
+
+	if b2, _ := MessageToBytes(decoded); !bytes.Equal(b, b2) {
+		t.Errorf("round trip = %x, want %x", b2, b)
+	}
+
+	if HasUnsafeUnrecognizedOption(decoded) || !HasUnrecognizedCriticalOption(decoded) {
+		t.Error("the Safe-to-Forward critical option was misclassified")
+	}
+}
+
+// Decoding into a message doesn't modify options shared with other messages
+func TestUnmarshalSharedOptions(t *testing.T) {
+	msg := benchmarkGetMessage()
+	shared := &Message{Options: msg.Options}
+
+	data, err := MessageToBytes(benchmarkContentMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := msg.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := shared.GetOptionsAsString(OptionURIPath); len(got) != 2 || got[0] != "sensors" || got[1] != "temp" {
+		t.Errorf("shared Uri-Path options = %q", got)
+	}
+
+	if msg.GetOption(OptionURIPath) != nil || msg.GetOption(OptionMaxAge) == nil {
+		t.Errorf("decoded options = %v", msg.Options)
+	}
+}
+
+// Options are encoded in ascending order, without reordering the message's options
+func TestMarshalUnsortedOptions(t *testing.T) {
+	msg := NewMessage(MessageConfirmable, Get, 1)
+	msg.AddOption(OptionAccept, MediaTypeApplicationJSON)
+	msg.AddOption(OptionURIPath, "a")
+	msg.AddOption(OptionURIHost, "h")
+	msg.AddOption(OptionURIPath, "b")
+
+	b, err := MessageToBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x40, 0x01, 0x00, 0x01, 0x31, 'h', 0x81, 'a', 0x01, 'b', 0x61, 50}
+	if !bytes.Equal(b, want) {
+		t.Errorf("MessageToBytes = %x, want %x", b, want)
+	}
+
+	if msg.Options[0].Code != OptionAccept || msg.Options[2].Code != OptionURIHost {
+		t.Error("the message's options were reordered")
+	}
+}
+
+// Option numbers and lengths beyond their encoding are rejected instead of being truncated
+func TestMarshalOptionRange(t *testing.T) {
+	tests := []struct {
+		code   OptionCode
+		length int
+		err    error
+	}{
+		{0xffff, 0, nil},
+		{0xffff, 0xffff + 269, nil},
+		{0xffff + 1, 0, ErrOptionNumberOverflow},
+		{0xffff + 270, 0, ErrOptionNumberOverflow},
+		{-1, 0, ErrOptionNumberOverflow},
+		{65000, 0xffff + 270, ErrInvalidOptionLength},
+	}
+
+	for _, test := range tests {
+		msg := NewMessage(MessageConfirmable, Post, 1)
+		msg.AddOption(OptionURIPath, "a")
+		msg.AddOption(test.code, bytes.Repeat([]byte{0x01}, test.length))
+
+		b, err := msg.MarshalTo([]byte("prefix"))
+		if err != test.err {
+			t.Errorf("option %d of %d bytes: MarshalTo = %v, want %v", test.code, test.length, err, test.err)
+			continue
+		}
+
+		if err != nil {
+			if string(b) != "prefix" {
+				t.Errorf("option %d of %d bytes: MarshalTo = %x", test.code, test.length, b)
+			}
+			continue
+		}
+
+		decoded, err := BytesToMessage(b[len("prefix"):])
+		if err != nil {
+			t.Errorf("option %d of %d bytes: %v", test.code, test.length, err)
+			continue
+		}
+
+		if b2, _ := MessageToBytes(decoded); decoded.GetOption(test.code) == nil || !bytes.Equal(b2, b[len("prefix"):]) {
+			t.Errorf("option %d of %d bytes wasn't decoded", test.code, test.length)
+		}
+	}
+}
+
+func benchmarkGetMessage() *Message {
+	msg := NewMessage(MessageConfirmable, Get, 12345)
+	msg.Token = []byte{1, 2, 3, 4}
+	msg.AddOptions(NewPathOptions("/sensors/temp"))
+	msg.AddOption(OptionAccept, MediaTypeApplicationJSON)
+
+	return msg
+}
+
+func benchmarkContentMessage() *Message {
+	msg := ContentMessage(12345, MessageAcknowledgment)
+	msg.Token = []byte{1, 2, 3, 4}
+	msg.AddOption(OptionContentFormat, MediaTypeApplicationJSON)
+	msg.AddOption(OptionMaxAge, 30)
+	msg.Payload = NewBytesPayload([]byte(`{"temp":21.5,"unit":"C"}`))
+
+	return msg
+}
+
+func benchmarkMarshal(b *testing.B, msg *Message) {
+	buf := make([]byte, 0, MaxPacketSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.MarshalTo(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, msg *Message) {
+	data, err := MessageToBytes(msg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	decoded := &Message{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := decoded.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalGet(b *testing.B) {
+	benchmarkMarshal(b, benchmarkGetMessage())
+}
+
+func BenchmarkUnmarshalGet(b *testing.B) {
+	benchmarkUnmarshal(b, benchmarkGetMessage())
+}
+
+func BenchmarkMarshalContent(b *testing.B) {
+	benchmarkMarshal(b, benchmarkContentMessage())
+}
+
+func BenchmarkUnmarshalContent(b *testing.B) {
+	benchmarkUnmarshal(b, benchmarkContentMessage())
+}
+
+// Messages with an invalid critical option are decoded completely, so that they can be rejected
+// according to their other options
+func TestUnmarshalInvalidCriticalOption(t *testing.T) {
+	// An empty Uri-Host followed by No-Response 2 and a payload
+	data := []byte{0x40, 0x01, 0x00, 0x01, 0x30, 0xd1, 0xf2, 0x02, 0xff, 'p'}
+
+	msg, err := BytesToMessage(data)
+	if err != ErrUnknownCriticalOption {
+		t.Fatalf("BytesToMessage = %v, want %v", err, ErrUnknownCriticalOption)
+	}
+
+	if msg.GetOption(OptionURIHost) != nil || !msg.SuppressesResponse(CoapCodeContent) || msg.Payload.String() != "p" {
+		t.Errorf("options %q with payload %q", uriTestOptions(msg.Options), msg.Payload.String())
+	}
+}
@@ -0,0 +1,152 @@
+package coap
+
+import (
+	"sort"
+	"sync"
+)
+
+// OptionFormat defines the format of an option's value (RFC 7252 Section 3.2)
+type OptionFormat uint8
+
+const (
+	// OptionFormatEmpty is a zero-length value
+	OptionFormatEmpty OptionFormat = iota
+
+	// OptionFormatOpaque is an opaque sequence of bytes
+	OptionFormatOpaque
+
+	// OptionFormatUint is a non-negative integer in network byte order, without leading zero bytes
+	OptionFormatUint
+
+	// OptionFormatString is a UTF-8 string
+	OptionFormatString
+)
+
+// OptionDefinition describes an option: its number, name, value format, the range of lengths
+// its value may have, whether it may occur more than once in a message and its default value
+type OptionDefinition struct {
+	Code       OptionCode
+	Name       string
+	Format     OptionFormat
+	MinLength  int
+	MaxLength  int
+	Repeatable bool
+	Default    interface{}
+}
+
+// Determines if the length of a value is within the limits of the option
+func (d *OptionDefinition) IsValidLength(length int) bool {
+	return length >= d.MinLength && length <= d.MaxLength
+}
+
+// Decodes the raw value of the option according to its format. Empty values are nil, and values
+// too long for a uint are kept as raw values
+func (d *OptionDefinition) DecodeValue(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+
+	switch d.Format {
+	case OptionFormatUint:
+		if n, err := decodeInt(b); err == nil {
+			return n
+		}
+
+		value := make(OptionValue, len(b))
+		copy(value, b)
+		return value
+
+	case OptionFormatString:
+		return string(b)
+
+	case OptionFormatOpaque:
+		value := make([]byte, len(b))
+		copy(value, b)
+		return value
+	}
+	return nil
+}
+
+var optionDefinitions = map[OptionCode]*OptionDefinition{}
+var optionDefinitionsMutex sync.RWMutex
+
+func init() {
+	defs := []*OptionDefinition{
+		{Code: OptionIfMatch, Name: "If-Match", Format: OptionFormatOpaque, MinLength: 0, MaxLength: 8, Repeatable: true},
+		{Code: OptionURIHost, Name: "Uri-Host", Format: OptionFormatString, MinLength: 1, MaxLength: 255},
+		{Code: OptionEtag, Name: "ETag", Format: OptionFormatOpaque, MinLength: 1, MaxLength: 8, Repeatable: true},
+		{Code: OptionIfNoneMatch, Name: "If-None-Match", Format: OptionFormatEmpty, MinLength: 0, MaxLength: 0},
+		{Code: OptionObserve, Name: "Observe", Format: OptionFormatUint, MinLength: 0, MaxLength: 3},
+		{Code: OptionURIPort, Name: "Uri-Port", Format: OptionFormatUint, MinLength: 0, MaxLength: 2},
+		{Code: OptionLocationPath, Name: "Location-Path", Format: OptionFormatString, MinLength: 0, MaxLength: 255, Repeatable: true},
+		{Code: OptionURIPath, Name: "Uri-Path", Format: OptionFormatString, MinLength: 0, MaxLength: 255, Repeatable: true},
+		{Code: OptionContentFormat, Name: "Content-Format", Format: OptionFormatUint, MinLength: 0, MaxLength: 2},
+		{Code: OptionMaxAge, Name: "Max-Age", Format: OptionFormatUint, MinLength: 0, MaxLength: 4, Default: uint32(60)},
+		{Code: OptionURIQuery, Name: "Uri-Query", Format: OptionFormatString, MinLength: 0, MaxLength: 255, Repeatable: true},
+		{Code: OptionHopLimit, Name: "Hop-Limit", Format: OptionFormatUint, MinLength: 1, MaxLength: 1, Default: uint32(16)},
+		{Code: OptionAccept, Name: "Accept", Format: OptionFormatUint, MinLength: 0, MaxLength: 2},
+		{Code: OptionLocationQuery, Name: "Location-Query", Format: OptionFormatString, MinLength: 0, MaxLength: 255, Repeatable: true},
+		{Code: OptionBlock2, Name: "Block2", Format: OptionFormatUint, MinLength: 0, MaxLength: 3},
+		{Code: OptionBlock1, Name: "Block1", Format: OptionFormatUint, MinLength: 0, MaxLength: 3},
+		{Code: OptionSize2, Name: "Size2", Format: OptionFormatUint, MinLength: 0, MaxLength: 4},
+		{Code: OptionProxyURI, Name: "Proxy-Uri", Format: OptionFormatString, MinLength: 1, MaxLength: 1034},
+		{Code: OptionProxyScheme, Name: "Proxy-Scheme", Format: OptionFormatString, MinLength: 1, MaxLength: 255},
+		{Code: OptionSize1, Name: "Size1", Format: OptionFormatUint, MinLength: 0, MaxLength: 4},
+		{Code: OptionEcho, Name: "Echo", Format: OptionFormatOpaque, MinLength: 1, MaxLength: 40},
+		{Code: OptionNoResponse, Name: "No-Response", Format: OptionFormatUint, MinLength: 0, MaxLength: 1},
+		{Code: OptionRequestTag, Name: "Request-Tag", Format: OptionFormatOpaque, MinLength: 0, MaxLength: 8, Repeatable: true},
+	}
+
+	for _, def := range defs {
+		optionDefinitions[def.Code] = def
+	}
+}
+
+// Registers the definition of an option, e.g. a vendor specific option. Option numbers which are
+// already registered are rejected
+func RegisterOption(def *OptionDefinition) error {
+	if def == nil || def.Code == 0 || def.Name == "" || def.MinLength < 0 || def.MinLength > def.MaxLength {
+		return ErrInvalidOptionDefinition
+	}
+
+	if def.Format == OptionFormatEmpty && def.MaxLength != 0 {
+		return ErrInvalidOptionDefinition
+	}
+
+	if def.Format == OptionFormatUint && def.MaxLength > 4 {
+		return ErrInvalidOptionDefinition
+	}
+
+	optionDefinitionsMutex.Lock()
+	defer optionDefinitionsMutex.Unlock()
+
+	if _, ok := optionDefinitions[def.Code]; ok {
+		return ErrOptionAlreadyRegistered
+	}
+	optionDefinitions[def.Code] = def
+
+	return nil
+}
+
+// Returns the definition of an option, or nil if the option isn't registered
+func GetOptionDefinition(code OptionCode) *OptionDefinition {
+	optionDefinitionsMutex.RLock()
+	defer optionDefinitionsMutex.RUnlock()
+
+	return optionDefinitions[code]
+}
+
+// Returns the definitions of all registered options ordered by option number
+func GetOptionDefinitions() []*OptionDefinition {
+	optionDefinitionsMutex.RLock()
+	defs := make([]*OptionDefinition, 0, len(optionDefinitions))
+	for _, def := range optionDefinitions {
+		defs = append(defs, def)
+	}
+	optionDefinitionsMutex.RUnlock()
+
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Code < defs[j].Code
+	})
+	return defs
+}
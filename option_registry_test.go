@@ -0,0 +1,142 @@
+package coap
+
+import "testing"
+
+func TestOptionDefinitions(t *testing.T) {
+	tests := []struct {
+		code                         OptionCode
+		name                         string
+		format                       OptionFormat
+		min, max                     int
+		repeatable                   bool
+		critical, unsafe, noCacheKey bool
+	}{
+		{OptionIfMatch, "If-Match", OptionFormatOpaque, 0, 8, true, true, false, false},
+		{OptionURIHost, "Uri-Host", OptionFormatString, 1, 255, false, true, true, false},
+		{OptionEtag, "ETag", OptionFormatOpaque, 1, 8, true, false, false, false},
+		{OptionIfNoneMatch, "If-None-Match", OptionFormatEmpty, 0, 0, false, true, false, false},
+		{OptionObserve, "Observe", OptionFormatUint, 0, 3, false, false, true, false},
+		{OptionURIPort, "Uri-Port", OptionFormatUint, 0, 2, false, true, true, false},
+		{OptionLocationPath, "Location-Path", OptionFormatString, 0, 255, true, false, false, false},
+		{OptionURIPath, "Uri-Path", OptionFormatString, 0, 255, true, true, true, false},
+		{OptionContentFormat, "Content-Format", OptionFormatUint, 0, 2, false, false, false, false},
+		{OptionMaxAge, "Max-Age", OptionFormatUint, 0, 4, false, false, true, false},
+		{OptionURIQuery, "Uri-Query", OptionFormatString, 0, 255, true, true, true, false},
+		{OptionHopLimit, "Hop-Limit", OptionFormatUint, 1, 1, false, false, false, false},
+		{OptionAccept, "Accept", OptionFormatUint, 0, 2, false, true, false, false},
+		{OptionLocationQuery, "Location-Query", OptionFormatString, 0, 255, true, false, false, false},
+		{OptionBlock2, "Block2", OptionFormatUint, 0, 3, false, true, true, false},
+		{OptionBlock1, "Block1", OptionFormatUint, 0, 3, false, true, true, false},
+		{OptionSize2, "Size2", OptionFormatUint, 0, 4, false, false, false, true},
+		{OptionProxyURI, "Proxy-Uri", OptionFormatString, 1, 1034, false, true, true, false},
+		{OptionProxyScheme, "Proxy-Scheme", OptionFormatString, 1, 255, false, true, true, false},
+		{OptionSize1, "Size1", OptionFormatUint, 0, 4, false, false, false, true},
+		{OptionEcho, "Echo", OptionFormatOpaque, 1, 40, false, false, false, true},
+		{OptionNoResponse, "No-Response", OptionFormatUint, 0, 1, false, false, true, false},
+		{OptionRequestTag, "Request-Tag", OptionFormatOpaque, 0, 8, true, false, false, false},
+	}
+
+	if n := len(GetOptionDefinitions()); n != len(tests) {
+		t.Errorf("%d registered options, want %d", n, len(tests))
+	}
+
+	for _, test := range tests {
+		def := GetOptionDefinition(test.code)
+		if def == nil {
+			t.Errorf("option %d isn't registered", test.code)
+			continue
+		}
+
+		if def.Name != test.name || def.Format != test.format || def.MinLength != test.min || def.MaxLength != test.max || def.Repeatable != test.repeatable {
+			t.Errorf("definition of option %d = %+v", test.code, def)
+		}
+
+		opt := NewOption(test.code, nil)
+		if IsCriticalOption(opt) != test.critical || IsUnsafeOption(test.code) != test.unsafe || IsNoCacheKeyOption(test.code) != test.noCacheKey {
+			t.Errorf("%s: critical %v, unsafe %v, NoCacheKey %v", test.name, IsCriticalOption(opt), IsUnsafeOption(test.code), IsNoCacheKeyOption(test.code))
+		}
+
+		if IsRepeatableOption(opt) != test.repeatable || !IsValidOption(opt) || OptionNumberToString(test.code) != test.name {
+			t.Errorf("%s: repeatable %v, valid %v, name %s", test.name, IsRepeatableOption(opt), IsValidOption(opt), OptionNumberToString(test.code))
+		}
+
+		if !def.IsValidLength(test.min) || !def.IsValidLength(test.max) || def.IsValidLength(test.max+1) || (test.min > 0 && def.IsValidLength(test.min-1)) {
+			t.Errorf("%s: lengths %d to %d aren't enforced", test.name, test.min, test.max)
+		}
+	}
+}
+
+func TestRegisterOption(t *testing.T) {
+	const vendorOption OptionCode = 65001
+
+	defer func() {
+		optionDefinitionsMutex.Lock()
+		delete(optionDefinitions, vendorOption)
+		optionDefinitionsMutex.Unlock()
+	}()
+
+	tests := []struct {
+		def  *OptionDefinition
+		want error
+	}{
+		{nil, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: 0, Name: "Zero", Format: OptionFormatOpaque, MaxLength: 8}, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: vendorOption, Format: OptionFormatOpaque, MaxLength: 8}, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatOpaque, MinLength: -1, MaxLength: 8}, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatOpaque, MinLength: 4, MaxLength: 2}, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatEmpty, MaxLength: 1}, ErrInvalidOptionDefinition},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatUint, MaxLength: 5}, ErrInvalidOptionDefinition},
+
+		// Built-in and registered option numbers can't be registered again
+		{&OptionDefinition{Code: OptionURIPath, Name: "Uri-Path", Format: OptionFormatString, MaxLength: 255}, ErrOptionAlreadyRegistered},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatUint, MaxLength: 4}, nil},
+		{&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatOpaque, MaxLength: 8}, ErrOptionAlreadyRegistered},
+	}
+
+	for i, test := range tests {
+		if err := RegisterOption(test.def); err != test.want {
+			t.Errorf("RegisterOption %d = %v, want %v", i, err, test.want)
+		}
+	}
+
+	if def := GetOptionDefinition(vendorOption); def == nil || def.Format != OptionFormatUint || OptionNumberToString(vendorOption) != "Vendor" {
+		t.Errorf("registered definition = %+v", def)
+	}
+
+	if def := GetOptionDefinition(OptionURIPath); def.Format != OptionFormatString || def.MaxLength != 255 {
+		t.Errorf("Uri-Path definition after registering it again = %+v", def)
+	}
+}
+
+func TestValidateMessageRepeatedOptions(t *testing.T) {
+	tests := []struct {
+		codes []OptionCode
+		want  error
+	}{
+		// Repeatable options
+		{[]OptionCode{OptionURIPath, OptionURIPath}, nil},
+		{[]OptionCode{OptionIfMatch, OptionIfMatch}, nil},
+
+		// Non-repeatable critical options
+		{[]OptionCode{OptionURIHost, OptionURIHost}, ErrUnknownCriticalOption},
+		{[]OptionCode{OptionAccept, OptionURIPath, OptionAccept}, ErrUnknownCriticalOption},
+		{[]OptionCode{OptionBlock2, OptionBlock2}, ErrUnknownCriticalOption},
+
+		// Non-repeatable elective options are ignored when repeated
+		{[]OptionCode{OptionContentFormat, OptionContentFormat}, nil},
+
+		// Unrecognized options are checked by the endpoint or proxy handling the message
+		{[]OptionCode{65001, 65001}, nil},
+	}
+
+	for _, test := range tests {
+		msg := NewMessage(MessageConfirmable, Get, 1)
+		for _, code := range test.codes {
+			msg.Options = append(msg.Options, NewOption(code, []byte{1}))
+		}
+
+		if err := ValidateMessage(msg); err != test.want {
+			t.Errorf("ValidateMessage with options %v = %v, want %v", test.codes, err, test.want)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package coap
 
 import (
+	"math"
+	"net/url"
 	"strings"
+	"unicode/utf8"
 )
 
 // Represents an Option for a CoAP Message
@@ -10,8 +13,9 @@ type Option struct {
 	Value interface{}
 }
 
+// Returns the registered name of the option, or an empty string for unregistered options
 func (o *Option) Name() string {
-	return "Name of option"
+	return OptionNumberToString(o.Code)
 }
 
 // Determines if an option is elective
@@ -30,13 +34,110 @@ func (o *Option) IsCritical() bool {
 	return false
 }
 
-// Returns the string value of an option
+// Returns the string value of an option, or an empty string if the option doesn't hold a string
 func (o *Option) StringValue() string {
-	return o.Value.(string)
+	v, _ := o.GetString()
+	return v
 }
 
+// Returns the integer value of an option, or zero if the option doesn't hold an integer
 func (o *Option) IntValue() int {
-	return o.Value.(int)
+	v, _ := o.GetUint()
+	return int(v)
+}
+
+// Returns the raw value of the option encoded according to its registered format. The format of
+// unregistered options is determined by the type of their value
+func (o *Option) RawValue() (OptionValue, error) {
+	v, err := o.appendValue(nil)
+	if err != nil {
+		return nil, err
+	}
+	return OptionValue(v), nil
+}
+
+// Appends the raw value of the option to dst, validated against the option's definition
+func (o *Option) appendValue(dst []byte) ([]byte, error) {
+	def := GetOptionDefinition(o.Code)
+	if def == nil {
+		return appendOptionValue(dst, optionValueFormat(o.Value), o.Value)
+	}
+
+	start := len(dst)
+	dst, err := appendOptionValue(dst, def.Format, o.Value)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	// Zero is encoded as an empty uint, which options with a minimum length pad with leading zeros
+	if n := len(dst) - start; def.Format == OptionFormatUint && n < def.MinLength {
+		pad := def.MinLength - n
+		for i := 0; i < pad; i++ {
+			dst = append(dst, 0)
+		}
+		copy(dst[start+pad:], dst[start:start+n])
+		for i := 0; i < pad; i++ {
+			dst[start+i] = 0
+		}
+	}
+
+	if !def.IsValidLength(len(dst) - start) {
+		return dst[:start], ErrInvalidOptionLength
+	}
+	return dst, nil
+}
+
+// Returns the value of an option of the uint format
+func (o *Option) GetUint() (uint32, error) {
+	if !o.hasFormat(OptionFormatUint) {
+		return 0, ErrInvalidOptionValue
+	}
+
+	v, err := o.RawValue()
+	if err != nil {
+		return 0, err
+	}
+	return v.GetUint()
+}
+
+// Returns the value of an option of the string format
+func (o *Option) GetString() (string, error) {
+	if !o.hasFormat(OptionFormatString) {
+		return "", ErrInvalidOptionValue
+	}
+
+	v, err := o.RawValue()
+	if err != nil {
+		return "", err
+	}
+	return v.GetString()
+}
+
+// Returns the value of an option of the opaque format
+func (o *Option) GetOpaque() ([]byte, error) {
+	if !o.hasFormat(OptionFormatOpaque) {
+		return nil, ErrInvalidOptionValue
+	}
+
+	v, err := o.RawValue()
+	if err != nil {
+		return nil, err
+	}
+	return v.GetOpaque(), nil
+}
+
+// Determines if the value of an option is empty
+func (o *Option) IsEmpty() bool {
+	v, err := o.RawValue()
+
+	return err == nil && v.IsEmpty()
+}
+
+// Determines if the option is registered with a format, or is unregistered
+func (o *Option) hasFormat(format OptionFormat) bool {
+	def := GetOptionDefinition(o.Code)
+
+	return def == nil || def.Format == format
 }
 
 // Instantiates a New Option
@@ -47,13 +148,17 @@ func NewOption(optionNumber OptionCode, optionValue interface{}) *Option {
 	}
 }
 
-// Creates an array of options decomposed from a given path
+// Creates an array of options decomposed from a given path. Percent-encoded characters of the
+// segments are decoded, and segments which aren't validly encoded are kept as they are
 func NewPathOptions(path string) []*Option {
 	opts := []*Option{}
 	ps := strings.Split(path, "/")
 
 	for _, p := range ps {
 		if p != "" {
+			if s, err := url.PathUnescape(p); err == nil {
+				p = s
+			}
 			opt := NewOption(OptionURIPath, p)
 			opts = append(opts, opt)
 		}
@@ -63,30 +168,30 @@ func NewPathOptions(path string) []*Option {
 
 // Checks if an option is repeatable
 func IsRepeatableOption(opt *Option) bool {
-	switch opt.Code {
+	def := GetOptionDefinition(opt.Code)
 
-	case OptionIfMatch, OptionEtag, OptionURIPort, OptionLocationPath, OptionURIPath, OptionURIQuery, OptionLocationQuery,
-		OptionBlock2, OptionBlock1:
-		return true
-
-	default:
-		return false
-	}
+	return def != nil && def.Repeatable
 }
 
 // Checks if an option/option code is recognizable/valid
 func IsValidOption(opt *Option) bool {
-	switch opt.Code {
+	return GetOptionDefinition(opt.Code) != nil
+}
 
-	case OptionIfNoneMatch, OptionURIHost,
-		OptionEtag, OptionIfMatch, OptionObserve, OptionURIPort, OptionLocationPath,
-		OptionURIPath, OptionContentFormat, OptionMaxAge, OptionURIQuery, OptionAccept,
-		OptionLocationQuery, OptionBlock2, OptionBlock1, OptionProxyURI, OptionProxyScheme, OptionSize1:
-		return true
+// Determines if an option is excluded from the cache key of a request (RFC 7252 Section 5.4.6)
+func IsNoCacheKeyOption(code OptionCode) bool {
+	return int(code)&0x1e == 0x1c
+}
 
-	default:
-		return false
-	}
+// Determines if an option is Unsafe to forward by a proxy which doesn't recognize it
+// (RFC 7252 Section 5.4.2)
+func IsUnsafeOption(code OptionCode) bool {
+	return int(code)&0x02 != 0
+}
+
+// Determines if an option may be forwarded by a proxy which doesn't recognize it
+func IsSafeToForwardOption(code OptionCode) bool {
+	return !IsUnsafeOption(code)
 }
 
 // Determines if an option is elective
@@ -103,3 +208,179 @@ func IsElectiveOption(opt *Option) bool {
 func IsCriticalOption(opt *Option) bool {
 	return !IsElectiveOption(opt)
 }
+
+// Determines if a message carries a critical option which isn't recognized. Endpoints reject such
+// requests with 4.02 Bad Option (RFC 7252 Section 5.4.1), while proxies forward them if they are
+// Safe-to-Forward
+func HasUnrecognizedCriticalOption(msg *Message) bool {
+	for _, opt := range msg.Options {
+		if IsCriticalOption(opt) && !IsValidOption(opt) {
+			return true
+		}
+	}
+	return false
+}
+
+// OptionValue is the raw value of an option as it is encoded in a message. Its typed views
+// interpret the bytes in one of the option value formats
+type OptionValue []byte
+
+// Encodes a value in an option value format. Integers are encoded in the uint format, strings and
+// byte slices in the string and opaque formats, and nil in any format as an empty value
+func NewOptionValue(format OptionFormat, v interface{}) (OptionValue, error) {
+	b, err := appendOptionValue(nil, format, v)
+	if err != nil {
+		return nil, err
+	}
+	return OptionValue(b), nil
+}
+
+// Appends a value encoded in an option value format to dst
+func appendOptionValue(dst []byte, format OptionFormat, v interface{}) ([]byte, error) {
+	if v == nil {
+		return dst, nil
+	}
+
+	switch format {
+	case OptionFormatEmpty:
+		if b, ok := optionBytes(v); ok && len(b) == 0 {
+			return dst, nil
+		}
+
+	case OptionFormatUint:
+		if n, ok := optionUint(v); ok {
+			return appendInt(dst, n), nil
+		}
+
+	case OptionFormatString, OptionFormatOpaque:
+		switch b := v.(type) {
+		case string:
+			return append(dst, b...), nil
+		case []byte:
+			return append(dst, b...), nil
+		case OptionValue:
+			return append(dst, b...), nil
+		}
+	}
+	return dst, ErrInvalidOptionValue
+}
+
+// Determines if the value is empty
+func (v OptionValue) IsEmpty() bool {
+	return len(v) == 0
+}
+
+// Returns the value as a non-negative integer
+func (v OptionValue) GetUint() (uint32, error) {
+	return decodeInt(v)
+}
+
+// Returns the value as a UTF-8 string
+func (v OptionValue) GetString() (string, error) {
+	if !utf8.Valid(v) {
+		return "", ErrInvalidOptionValue
+	}
+	return string(v), nil
+}
+
+// Returns the value as an opaque sequence of bytes
+func (v OptionValue) GetOpaque() []byte {
+	return []byte(v)
+}
+
+// Returns the format of an unregistered option based on the type of its value
+func optionValueFormat(v interface{}) OptionFormat {
+	switch v.(type) {
+	case nil:
+		return OptionFormatEmpty
+
+	case string, []byte, OptionValue:
+		return OptionFormatOpaque
+	}
+	return OptionFormatUint
+}
+
+// Returns a value holding any integer type, or raw bytes of at most 4 bytes, as a uint
+func optionUint(v interface{}) (uint32, bool) {
+	var n int64
+
+	switch i := v.(type) {
+	case nil:
+		return 0, true
+	case uint32:
+		return i, true
+	case uint16:
+		return uint32(i), true
+	case uint8:
+		return uint32(i), true
+	case uint:
+		if uint64(i) > math.MaxUint32 {
+			return 0, false
+		}
+		return uint32(i), true
+	case uint64:
+		if i > math.MaxUint32 {
+			return 0, false
+		}
+		return uint32(i), true
+	case MediaType:
+		return uint32(i), true
+	case int:
+		n = int64(i)
+	case int8:
+		n = int64(i)
+	case int16:
+		n = int64(i)
+	case int32:
+		n = int64(i)
+	case int64:
+		n = i
+	case []byte:
+		return OptionValue(i).uint()
+	case OptionValue:
+		return i.uint()
+	default:
+		return 0, false
+	}
+
+	if n < 0 || n > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func (v OptionValue) uint() (uint32, bool) {
+	n, err := v.GetUint()
+	return n, err == nil
+}
+
+// Returns a value holding a string or byte slice as raw bytes
+func optionBytes(v interface{}) ([]byte, bool) {
+	switch b := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []byte(b), true
+	case []byte:
+		return b, true
+	case OptionValue:
+		return b, true
+	}
+	return nil, false
+}
+
+// Returns the numeric value of an option regardless of the integer type it was
+// created with. Options with an empty value are zero
+func optionUintValue(opt *Option) (uint32, bool) {
+	return optionUint(opt.Value)
+}
+
+// Returns the raw value of an option holding a string or opaque value
+func optionBytesValue(opt *Option) []byte {
+	switch opt.Value.(type) {
+	case string, []byte, OptionValue:
+		b, _ := optionBytes(opt.Value)
+		return b
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOptionRawValue(t *testing.T) {
+	const vendorOption OptionCode = 65004
+
+	if err := RegisterOption(&OptionDefinition{Code: vendorOption, Name: "Vendor", Format: OptionFormatUint, MinLength: 2, MaxLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		optionDefinitionsMutex.Lock()
+		delete(optionDefinitions, vendorOption)
+		optionDefinitionsMutex.Unlock()
+	}()
+
+	tests := []struct {
+		code  OptionCode
+		value interface{}
+		raw   []byte
+		err   error
+	}{
+		// Zero is encoded as an empty uint, padded to the minimum length of the option
+		{OptionObserve, 0, []byte{}, nil},
+		{OptionContentFormat, nil, []byte{}, nil},
+		{OptionHopLimit, 0, []byte{0}, nil},
+		{vendorOption, 0, []byte{0, 0}, nil},
+		{vendorOption, 5, []byte{0, 5}, nil},
+		{vendorOption, 0x10203, []byte{1, 2, 3}, nil},
+
+		// Uints without leading zero bytes
+		{OptionURIPort, 5683, []byte{0x16, 0x33}, nil},
+		{OptionMaxAge, uint32(1 << 24), []byte{1, 0, 0, 0}, nil},
+		{OptionBlock2, []byte{0, 0, 0x16}, []byte{0x16}, nil},
+
+		// Length bounds
+		{OptionURIPort, 70000, nil, ErrInvalidOptionLength},
+		{OptionObserve, 1 << 24, nil, ErrInvalidOptionLength},
+		{OptionHopLimit, 256, nil, ErrInvalidOptionLength},
+		{OptionEtag, []byte{}, nil, ErrInvalidOptionLength},
+		{OptionEtag, []byte("123456789"), nil, ErrInvalidOptionLength},
+		{OptionURIHost, "", nil, ErrInvalidOptionLength},
+		{OptionIfMatch, []byte("12345678"), []byte("12345678"), nil},
+
+		// Values which don't match the format of the option
+		{OptionIfNoneMatch, []byte{1}, nil, ErrInvalidOptionValue},
+		{OptionURIPort, "5683", nil, ErrInvalidOptionValue},
+		{OptionURIPort, -1, nil, ErrInvalidOptionValue},
+		{OptionURIPath, 1, nil, ErrInvalidOptionValue},
+
+		// Unregistered options are encoded according to the type of their value
+		{65000, 0x0102, []byte{1, 2}, nil},
+		{65000, "a", []byte("a"), nil},
+	}
+
+	for _, test := range tests {
+		raw, err := NewOption(test.code, test.value).RawValue()
+		if err != test.err || !bytes.Equal(raw, test.raw) {
+			t.Errorf("raw value of %s %v = %v (%v), want %v (%v)", OptionNumberToString(test.code), test.value, []byte(raw), err, test.raw, test.err)
+		}
+
+		// Values are appended after existing data, which is kept if the value is invalid
+		dst, err := NewOption(test.code, test.value).appendValue([]byte{0xff})
+		if err != test.err || !bytes.Equal(dst, append([]byte{0xff}, test.raw...)) {
+			t.Errorf("appendValue of %s %v = %v (%v)", OptionNumberToString(test.code), test.value, dst, err)
+		}
+	}
+}
+
+func TestOptionGetters(t *testing.T) {
+	uintOpt := NewOption(OptionContentFormat, MediaTypeApplicationJSON)
+	stringOpt := NewOption(OptionURIPath, "temp")
+	opaqueOpt := NewOption(OptionEtag, []byte{1, 2})
+
+	if v, err := uintOpt.GetUint(); err != nil || v != uint32(MediaTypeApplicationJSON) {
+		t.Errorf("GetUint = %d (%v)", v, err)
+	}
+
+	if v, err := stringOpt.GetString(); err != nil || v != "temp" {
+		t.Errorf("GetString = %q (%v)", v, err)
+	}
+
+	if v, err := opaqueOpt.GetOpaque(); err != nil || !bytes.Equal(v, []byte{1, 2}) {
+		t.Errorf("GetOpaque = %v (%v)", v, err)
+	}
+
+	// Getters of another format than the option's fail
+	for _, opt := range []*Option{stringOpt, opaqueOpt} {
+		if _, err := opt.GetUint(); err != ErrInvalidOptionValue {
+			t.Errorf("GetUint of %s = %v, want %v", opt.Name(), err, ErrInvalidOptionValue)
+		}
+	}
+
+	for _, opt := range []*Option{uintOpt, opaqueOpt} {
+		if _, err := opt.GetString(); err != ErrInvalidOptionValue {
+			t.Errorf("GetString of %s = %v, want %v", opt.Name(), err, ErrInvalidOptionValue)
+		}
+	}
+
+	for _, opt := range []*Option{uintOpt, stringOpt} {
+		if _, err := opt.GetOpaque(); err != ErrInvalidOptionValue {
+			t.Errorf("GetOpaque of %s = %v, want %v", opt.Name(), err, ErrInvalidOptionValue)
+		}
+	}
+
+	if v := stringOpt.IntValue(); v != 0 {
+		t.Errorf("IntValue of a string option = %d", v)
+	}
+
+	// Strings which aren't valid UTF-8 are rejected
+	if _, err := NewOption(OptionURIPath, []byte{0xff}).GetString(); err != ErrInvalidOptionValue {
+		t.Errorf("GetString of invalid UTF-8 = %v, want %v", err, ErrInvalidOptionValue)
+	}
+
+	// Unregistered options are read in any format
+	unregistered := NewOption(65000, []byte{1, 2})
+	if v, err := unregistered.GetUint(); err != nil || v != 0x0102 {
+		t.Errorf("GetUint of an unregistered option = %d (%v)", v, err)
+	}
+
+	if v, err := unregistered.GetOpaque(); err != nil || !bytes.Equal(v, []byte{1, 2}) {
+		t.Errorf("GetOpaque of an unregistered option = %v (%v)", v, err)
+	}
+}
+
+func TestDecodeInt(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		v   uint32
+		err error
+	}{
+		{nil, 0, nil},
+		{[]byte{1}, 1, nil},
+		{[]byte{0, 1}, 1, nil},
+		{[]byte{1, 2, 3, 4}, 0x01020304, nil},
+		{[]byte{1, 2, 3, 4, 5}, 0, ErrInvalidOptionValue},
+	}
+
+	for _, test := range tests {
+		if v, err := decodeInt(test.b); v != test.v || err != test.err {
+			t.Errorf("decodeInt(%v) = %d (%v), want %d (%v)", test.b, v, err, test.v, test.err)
+		}
+	}
+
+	// Registered uint options too long for a uint are kept as raw values
+	def := GetOptionDefinition(OptionMaxAge)
+	if v, ok := def.DecodeValue([]byte{1, 2, 3, 4, 5}).(OptionValue); !ok || !bytes.Equal(v, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("DecodeValue of 5 bytes = %v", v)
+	}
+
+	if _, err := OptionValue([]byte{1, 2, 3, 4, 5}).GetUint(); err != ErrInvalidOptionValue {
+		t.Errorf("GetUint of 5 bytes = %v, want %v", err, ErrInvalidOptionValue)
+	}
+}
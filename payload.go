@@ -37,20 +37,28 @@ func (p *PlainTextPayload) String() string {
 	return p.content
 }
 
+// Instantiates a new message payload containing a list of CoRE Resources
+func NewCoreLinkFormatPayload(resources []*CoreResource) MessagePayload {
+	return &CoreLinkFormatPayload{
+		Resources: resources,
+	}
+}
+
 // Represents a message payload containing core-link format values
 type CoreLinkFormatPayload struct {
+	Resources []*CoreResource
 }
 
 func (p *CoreLinkFormatPayload) GetBytes() []byte {
-	return make([]byte, 0)
+	return []byte(p.String())
 }
 
 func (p *CoreLinkFormatPayload) Length() int {
-	return 0
+	return len(p.String())
 }
 
 func (p *CoreLinkFormatPayload) String() string {
-	return ""
+	return CoreResourcesToString(p.Resources)
 }
 
 // Represents a message payload containing an array of bytes
@@ -124,7 +132,7 @@ func (p *JSONPayload) GetBytes() []byte {
 }
 
 func (p *JSONPayload) Length() int {
-	return 0
+	return len(p.GetBytes())
 }
 
 func (p *JSONPayload) String() string {
@@ -132,3 +140,36 @@ func (p *JSONPayload) String() string {
 
 	return string(o)
 }
+
+// Instantiates a new message payload containing a value encoded as CBOR
+func NewCBORPayload(obj interface{}) MessagePayload {
+	return &CBORPayload{
+		obj: obj,
+	}
+}
+
+// Represents a message payload containing CBOR data
+type CBORPayload struct {
+	obj interface{}
+}
+
+func (p *CBORPayload) GetBytes() []byte {
+	b, err := CBORMarshal(p.obj)
+
+	if err != nil {
+		log.Println(err)
+
+		return []byte{}
+	}
+
+	return b
+}
+
+func (p *CBORPayload) Length() int {
+	return len(p.GetBytes())
+}
+
+// Returns the payload in CBOR diagnostic notation
+func (p *CBORPayload) String() string {
+	return CBORDiagnostic(p.GetBytes())
+}
@@ -1,13 +1,18 @@
 package coap
 
 import (
-	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
-	"net/url"
+	"os"
 )
 
+// DefaultHopLimit is the Hop-Limit inserted by proxies into requests without one (RFC 8768)
+const DefaultHopLimit = 16
+
+// ProxyIdentity identifies the proxies of this process in the diagnostic payload of
+// 5.08 Hop Limit Reached responses. It defaults to the host name
+var ProxyIdentity, _ = os.Hostname()
+
 // Proxy Filter
 type ProxyFilter func(*Message, *net.UDPAddr) bool
 
@@ -17,98 +22,84 @@ func NullProxyFilter(*Message, *net.UDPAddr) bool {
 
 type ProxyHandler func(msg *Message, conn *net.UDPConn, addr *net.UDPAddr)
 
-// The default handler when proxying is disabled
-func NullProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	SendMessageTo(ProxyingNotSupportedMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-}
-
-func COAPProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	proxyURI := msg.GetOption(OptionProxyURI).StringValue()
-
-	parsedURL, err := url.Parse(proxyURI)
-	if err != nil {
-		log.Println("Error parsing proxy URI")
-		SendMessageTo(BadGatewayMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-		return
-	}
-
-	client := NewCoapClient()
-	client.OnStart(func(server CoapServer) {
-		client.Dial(parsedURL.Host)
-
-		msg.RemoveOptions(OptionProxyURI)
-		req := NewRequestFromMessage(msg)
-		req.SetRequestURI(parsedURL.RequestURI())
-
-		response, err := client.Send(req)
-		if err != nil {
-			SendMessageTo(BadGatewayMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-			client.Stop()
+// ProxyForwarder performs the upstream leg of a proxied request and returns the response
+// to relay to the requesting client
+type ProxyForwarder func(msg *Message) *Message
+
+// NewProxyHandler creates a ProxyHandler which relays the responses of a ProxyForwarder. The
+// response is matched to the client's request by its token, and is piggybacked in the
+// acknowledgement of Confirmable requests
+func NewProxyHandler(fwd ProxyForwarder) ProxyHandler {
+	return func(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+		respMsg := fwd(msg)
+		if respMsg == nil {
 			return
 		}
 
-		_, err = SendMessageTo(response.GetMessage(), NewUDPConnection(conn), addr)
+		if msg.MessageType == MessageConfirmable {
+			respMsg.MessageType = MessageAcknowledgment
+			respMsg.MessageID = msg.MessageID
+		} else {
+			respMsg.MessageType = MessageNonConfirmable
+			respMsg.MessageID = GenerateMessageID()
+		}
+		respMsg.Token = msg.Token
+
+		_, err := SendMessageTo(respMsg, NewUDPConnection(conn), addr)
 		if err != nil {
 			log.Println("Error occured responding to proxy request")
-			client.Stop()
-			return
 		}
-		client.Stop()
-
-	})
-	client.Start()
+	}
 }
 
-// Handles requests for proxying from CoAP to HTTP
-func HTTPProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	proxyURI := msg.GetOption(OptionProxyURI).StringValue()
-	requestMethod := msg.Code
+// The default handler when proxying is disabled
+func NullProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	ret := ProxyingNotSupportedMessage(msg.MessageID, MessageAcknowledgment)
+	ret.Token = msg.Token
 
-	client := &http.Client{}
-	req, err := http.NewRequest(MethodString(CoapCode(msg.GetMethod())), proxyURI, nil)
-	if err != nil {
-		SendMessageTo(BadGatewayMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-		return
-	}
+	SendMessageTo(ret, NewUDPConnection(conn), addr)
+}
 
-	etag := msg.GetOption(OptionEtag)
-	if etag != nil {
-		req.Header.Add("ETag", etag.StringValue())
+// DecrementHopLimit decrements the Hop-Limit of a request about to be forwarded by a proxy,
+// inserting the default Hop-Limit first if the request has none. False is returned once the
+// Hop-Limit reaches zero, in which case the request must not be forwarded (RFC 8768). Hop-Limits
+// which don't fit in a single byte are ignored, like invalid elective options of received messages
+func DecrementHopLimit(msg *Message) bool {
+	hopLimit := uint32(DefaultHopLimit)
+	if opt := msg.GetOption(OptionHopLimit); opt != nil {
+		if v, err := opt.GetUint(); err == nil {
+			hopLimit = v
+		}
 	}
 
-	// TODO: Set timeout handler, and on timeout return 5.04
-	resp, err := client.Do(req)
-	if err != nil {
-		SendMessageTo(BadGatewayMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-		return
+	if hopLimit <= 1 {
+		return false
 	}
 
-	defer resp.Body.Close()
-
-	contents, _ := ioutil.ReadAll(resp.Body)
-	msg.Payload = NewBytesPayload(contents)
-	respMsg := NewRequestFromMessage(msg)
+	msg.RemoveOptions(OptionHopLimit)
+	msg.AddOption(OptionHopLimit, hopLimit-1)
 
-	if requestMethod == Get {
-		etag := resp.Header.Get("ETag")
-		if etag != "" {
-			msg.AddOption(OptionEtag, etag)
-		}
-	}
+	return true
+}
 
-	// TODO: Check payload length against Size1 options
-	if len(respMsg.GetMessage().Payload.String()) > MaxPacketSize {
-		SendMessageTo(BadGatewayMessage(msg.MessageID, MessageAcknowledgment), NewUDPConnection(conn), addr)
-		return
+// Creates a 5.08 Hop Limit Reached response carrying the identity of the proxy as diagnostic payload
+func HopLimitReachedResponse(msg *Message) *Message {
+	resp := HopLimitReachedMessage(msg.MessageID, MessageAcknowledgment)
+	resp.Token = msg.Token
+	if ProxyIdentity != "" {
+		resp.SetStringPayload(ProxyIdentity)
 	}
 
-	_, err = SendMessageTo(respMsg.GetMessage(), NewUDPConnection(conn), addr)
-	if err != nil {
-		println(err.Error())
-	}
+	return resp
 }
 
-// Handles requests for proxying from HTTP to CoAP
-func HTTPCOAPProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
-	log.Println("HttpCoapProxyHandler Proxy Handler")
+// Determines if a request carries an option which isn't recognized by the proxy and is Unsafe to
+// forward. Such requests are answered with 5.02 Bad Gateway (RFC 7252 Section 5.7.1)
+func HasUnsafeUnrecognizedOption(msg *Message) bool {
+	for _, opt := range msg.Options {
+		if IsUnsafeOption(opt.Code) && !IsValidOption(opt) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,289 @@
+package coap
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge is the freshness lifetime in seconds of responses without a Max-Age option
+const DefaultMaxAge = 60
+
+// Instantiates a new proxy cache holding at most maxEntries responses. A MaxSize in bytes
+// can additionally be set to bound the total size of cached payloads
+func NewProxyCache(maxEntries int) *ProxyCache {
+	return &ProxyCache{
+		MaxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// ProxyCacheStats holds the counters of a proxy cache
+type ProxyCacheStats struct {
+	Hits          int
+	Misses        int
+	Revalidations int
+	Evictions     int
+	Entries       int
+	Size          int
+}
+
+type proxyCacheEntry struct {
+	key     string
+	resp    *Message
+	etag    []byte
+	expires time.Time
+	size    int
+}
+
+// Returns the number of seconds the entry remains fresh
+func (e *proxyCacheEntry) maxAge() int {
+	remaining := time.Until(e.expires)
+	if remaining <= 0 {
+		return 0
+	}
+	return int((remaining + time.Second - 1) / time.Second)
+}
+
+// ProxyCache caches 2.05 Content responses of proxied GET requests (RFC 7252 Sections 5.6 and 5.7).
+// Fresh responses are served until their Max-Age expires, after which responses carrying an ETag
+// are revalidated with the origin. The least recently used entries are evicted once the cache is full
+type ProxyCache struct {
+	sync.Mutex
+
+	MaxEntries int
+	MaxSize    int
+
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   ProxyCacheStats
+}
+
+// Returns a snapshot of the cache's counters
+func (c *ProxyCache) Stats() ProxyCacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+
+	return stats
+}
+
+// Removes all cached responses
+func (c *ProxyCache) Purge() {
+	c.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.stats.Size = 0
+	c.Unlock()
+}
+
+// Handler creates a ProxyHandler serving responses from the cache, falling back to the forwarder
+func (c *ProxyCache) Handler(fwd ProxyForwarder) ProxyHandler {
+	return NewProxyHandler(c.Forward(fwd))
+}
+
+// Forward wraps a ProxyForwarder so that cacheable requests are answered from the cache
+func (c *ProxyCache) Forward(fwd ProxyForwarder) ProxyForwarder {
+	return func(msg *Message) *Message {
+		if msg.Code != Get || msg.GetOption(OptionObserve) != nil {
+			return fwd(msg)
+		}
+
+		key := CacheKey(msg)
+		entry, fresh := c.get(key)
+
+		if entry != nil && fresh {
+			c.count(&c.stats.Hits)
+			return c.serve(msg, entry)
+		}
+		c.count(&c.stats.Misses)
+
+		upstream := msg
+		if entry != nil && entry.etag != nil {
+			// Validate the stale entry with the origin
+			upstream = msg.Clone()
+			upstream.RemoveOptions(OptionEtag)
+			upstream.AddOption(OptionEtag, entry.etag)
+		}
+
+		resp := fwd(upstream)
+		if resp == nil {
+			return nil
+		}
+
+		switch resp.Code {
+		case CoapCodeValid:
+			if entry == nil || entry.etag == nil {
+				return resp
+			}
+			c.count(&c.stats.Revalidations)
+			entry = c.refresh(entry, resp)
+
+			return c.serve(msg, entry)
+
+		case CoapCodeContent:
+			c.put(key, resp)
+		}
+		return resp
+	}
+}
+
+// Answers a request from a cache entry. Requests validating the cached ETag receive 2.03 Valid
+func (c *ProxyCache) serve(msg *Message, entry *proxyCacheEntry) *Message {
+	var resp *Message
+	if entry.etag != nil && hasETag(msg, entry.etag) {
+		resp = NewMessage(MessageAcknowledgment, CoapCodeValid, msg.MessageID)
+		resp.AddOption(OptionEtag, entry.etag)
+	} else {
+		resp = entry.resp.Clone()
+	}
+	resp.AddOption(OptionMaxAge, entry.maxAge())
+
+	return resp
+}
+
+func (c *ProxyCache) count(counter *int) {
+	c.Lock()
+	*counter++
+	c.Unlock()
+}
+
+// Returns a copy of the entry for a key and whether it is still fresh. The copy is served
+// without holding the lock while the cached entry is refreshed
+func (c *ProxyCache) get(key string) (*proxyCacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	entry := *el.Value.(*proxyCacheEntry)
+
+	return &entry, time.Now().Before(entry.expires)
+}
+
+// Stores a 2.05 Content response. Responses which can't be validated once stale are only
+// stored while fresh
+func (c *ProxyCache) put(key string, resp *Message) {
+	entry := &proxyCacheEntry{
+		key:     key,
+		resp:    resp.Clone(),
+		expires: time.Now().Add(time.Duration(responseMaxAge(resp)) * time.Second),
+	}
+	entry.resp.RemoveOptions(OptionMaxAge)
+
+	if etag := resp.GetOption(OptionEtag); etag != nil {
+		entry.etag = optionBytesValue(etag)
+	}
+
+	if entry.etag == nil && responseMaxAge(resp) == 0 {
+		return
+	}
+
+	if resp.Payload != nil {
+		entry.size = resp.Payload.Length()
+	}
+
+	if c.MaxSize > 0 && entry.size > c.MaxSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Size += entry.size
+
+	for c.lru.Len() > 0 && ((c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries) || (c.MaxSize > 0 && c.stats.Size > c.MaxSize)) {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Extends the freshness of an entry after a 2.03 Valid response from the origin. The cached
+// entry is only refreshed if it wasn't replaced by a response with another ETag meanwhile
+func (c *ProxyCache) refresh(entry *proxyCacheEntry, valid *Message) *proxyCacheEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	entry.expires = time.Now().Add(time.Duration(responseMaxAge(valid)) * time.Second)
+
+	if el, ok := c.entries[entry.key]; ok {
+		if cached := el.Value.(*proxyCacheEntry); bytes.Equal(cached.etag, entry.etag) {
+			cached.expires = entry.expires
+		}
+	}
+	return entry
+}
+
+func (c *ProxyCache) removeElement(el *list.Element) {
+	entry := el.Value.(*proxyCacheEntry)
+
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.stats.Size -= entry.size
+}
+
+// CacheKey returns the cache key of a request: its method and all options which are not
+// marked NoCacheKey. ETags are excluded since they are used to validate cached responses,
+// and the Hop-Limit since it only depends on the path a request took to the proxy
+func CacheKey(msg *Message) string {
+	var opts []*Option
+	for _, opt := range msg.Options {
+		if opt.Code == OptionEtag || opt.Code == OptionHopLimit || IsNoCacheKeyOption(opt.Code) {
+			continue
+		}
+		opts = append(opts, opt)
+	}
+
+	// Options of the same number keep their order, as it is significant for e.g. Uri-Path
+	sort.SliceStable(opts, func(i, j int) bool {
+		return opts[i].Code < opts[j].Code
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(int(msg.Code)))
+	for _, opt := range opts {
+		v, _ := opt.RawValue()
+
+		buf.WriteString("|")
+		buf.WriteString(strconv.Itoa(int(opt.Code)))
+		buf.WriteString(":")
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteString(":")
+		buf.Write(v)
+	}
+	return buf.String()
+}
+
+// Returns the Max-Age of a response, or the default of 60 seconds if none is given
+func responseMaxAge(resp *Message) int {
+	opt := resp.GetOption(OptionMaxAge)
+	if opt == nil {
+		return DefaultMaxAge
+	}
+
+	v, _ := optionUintValue(opt)
+	return int(v)
+}
+
+// Checks if a request carries a given ETag
+func hasETag(msg *Message, etag []byte) bool {
+	for _, opt := range msg.GetOptions(OptionEtag) {
+		if bytes.Equal(optionBytesValue(opt), etag) {
+			return true
+		}
+	}
+	return false
+}
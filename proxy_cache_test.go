@@ -0,0 +1,73 @@
+package coap
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestProxyCacheRevalidation(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+
+	// The origin answers the first request with a representation which is stale at once, and
+	// validates its ETag afterwards
+	origin := func(msg *Message) *Message {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+
+		if first {
+			resp := ContentMessage(msg.MessageID, MessageAcknowledgment)
+			resp.AddOption(OptionEtag, []byte{1})
+			resp.AddOption(OptionMaxAge, 0)
+			resp.SetStringPayload("representation")
+
+			return resp
+		}
+
+		if !hasETag(msg, []byte{1}) {
+			t.Errorf("the stale entry wasn't validated")
+		}
+
+		resp := NewMessage(MessageAcknowledgment, CoapCodeValid, msg.MessageID)
+		resp.AddOption(OptionEtag, []byte{1})
+		resp.AddOption(OptionMaxAge, 0)
+
+		return resp
+	}
+
+	cache := NewProxyCache(10)
+	fwd := cache.Forward(origin)
+
+	get := func(messageID uint16) *Message {
+		req := NewMessage(MessageConfirmable, Get, messageID)
+		req.AddOptions(NewPathOptions("/a"))
+
+		return fwd(req)
+	}
+	get(0)
+
+	// Concurrent revalidations refresh the entry while it is served
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(messageID uint16) {
+			defer wg.Done()
+
+			resp := get(messageID)
+			if resp.Code != CoapCodeContent || resp.Payload.String() != "representation" {
+				t.Errorf("response = %s %v", CoapCodeToString(resp.Code), resp.Payload)
+			}
+
+			if resp.GetOption(OptionMaxAge) == nil {
+				t.Error("response without Max-Age")
+			}
+		}(uint16(i + 1))
+	}
+	wg.Wait()
+
+	if stats := cache.Stats(); stats.Revalidations != 20 || stats.Entries != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,297 @@
+package coap
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoapProxyTimeout defines the number of seconds to wait for a response from a CoAP origin
+const CoapProxyTimeout = 10
+
+var defaultCoapProxy *CoapProxy
+var defaultCoapProxyOnce sync.Once
+
+// DefaultCoapProxy returns the CoAP-CoAP proxy used by COAPProxyHandler. Its client
+// endpoint is started on first use and shared by all proxied requests
+func DefaultCoapProxy() *CoapProxy {
+	defaultCoapProxyOnce.Do(func() {
+		client := NewCoapClient()
+
+		started := make(chan bool)
+		client.OnStart(func(server CoapServer) {
+			close(started)
+		})
+		go client.Start()
+		<-started
+
+		defaultCoapProxy = NewCoapProxy(client)
+	})
+	return defaultCoapProxy
+}
+
+// Handles requests for proxying from CoAP to CoAP
+func COAPProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	DefaultCoapProxy().Handle(msg, conn, addr)
+}
+
+// COAPProxyForward sends a proxied request to its CoAP origin and returns the response
+func COAPProxyForward(msg *Message) *Message {
+	return DefaultCoapProxy().Forward(msg)
+}
+
+// Instantiates a new CoAP-CoAP forward proxy sending requests through a client endpoint.
+// The client must be started so that it can receive responses from origins
+func NewCoapProxy(client CoapServer) *CoapProxy {
+	p := &CoapProxy{
+		client:       client,
+		Timeout:      CoapProxyTimeout * time.Second,
+		observations: make(map[string]*proxyObservation),
+	}
+	client.OnNotify(p.handleNotification)
+
+	return p
+}
+
+// An observation relationship relayed by the proxy
+type proxyObservation struct {
+	token         []byte
+	upstreamToken []byte
+	request       *Message
+	conn          *net.UDPConn
+	addr          *net.UDPAddr
+}
+
+// CoapProxy forwards requests targeting coap URIs to their origin through a shared client
+// endpoint. Tokens and message ids are translated between the client and origin legs, and
+// Observe relationships are relayed to the client
+type CoapProxy struct {
+	sync.Mutex
+
+	client  CoapServer
+	Timeout time.Duration
+
+	// Relayed observations by upstream token
+	observations map[string]*proxyObservation
+}
+
+// Handle is a ProxyHandler forwarding requests and relaying Observe notifications
+func (p *CoapProxy) Handle(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	if msg.Code == Get && msg.GetOption(OptionObserve) != nil {
+		p.handleObserve(msg, conn, addr)
+		return
+	}
+	NewProxyHandler(p.Forward)(msg, conn, addr)
+}
+
+// Forward sends a proxied request to its CoAP origin and returns the origin's response
+func (p *CoapProxy) Forward(msg *Message) *Message {
+	resp, _ := p.exchange(msg, []byte(GenerateToken(8)))
+
+	return resp
+}
+
+// Forwards a request using the given upstream token. The returned bool is true if the
+// origin responded, as opposed to a 5.xx response generated by the proxy
+func (p *CoapProxy) exchange(msg *Message, upstreamToken []byte) (*Message, bool) {
+	if HasUnsafeUnrecognizedOption(msg) {
+		return BadGatewayMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	target, err := ProxyTargetURI(msg)
+	if err != nil {
+		return BadOptionMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	if target.Scheme != "coap" {
+		return ProxyingNotSupportedMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	remoteAddr, err := resolveCoapURIAddr(target)
+	if err != nil {
+		return BadGatewayMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	fwdMsg := msg.Clone()
+	if !DecrementHopLimit(fwdMsg) {
+		return HopLimitReachedResponse(msg), false
+	}
+
+	fwdMsg.MessageType = MessageConfirmable
+	fwdMsg.MessageID = GenerateMessageID()
+	fwdMsg.Token = upstreamToken
+	fwdMsg.RemoveOptions(OptionProxyURI)
+	fwdMsg.RemoveOptions(OptionProxyScheme)
+	fwdMsg.RemoveOptions(OptionURIHost)
+	fwdMsg.RemoveOptions(OptionURIPort)
+	fwdMsg.RemoveOptions(OptionURIPath)
+	fwdMsg.RemoveOptions(OptionURIQuery)
+	if err := setCoapURIOptions(fwdMsg, target); err != nil {
+		return BadOptionMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	resp, err := SendAndWaitForResponse(p.client, NewRequestFromMessage(fwdMsg), remoteAddr, p.Timeout)
+	if err == ErrResponseTimeout {
+		return GatewayTimeoutMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+
+	if err != nil || resp.MessageType == MessageReset {
+		return BadGatewayMessage(msg.MessageID, MessageAcknowledgment), false
+	}
+	return resp, true
+}
+
+// Registers or cancels an observation with the origin on behalf of a client
+func (p *CoapProxy) handleObserve(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	obs, _ := optionUintValue(msg.GetOption(OptionObserve))
+
+	// A client registering again or deregistering reuses the relationship's upstream token
+	p.Lock()
+	existing := p.findObservation(msg.Token, addr)
+
+	upstreamToken := []byte(GenerateToken(8))
+	if existing != nil {
+		upstreamToken = existing.upstreamToken
+	}
+
+	// Registrations are pending during the exchange, so that notifications sent by the origin
+	// right after its response are relayed
+	pending := &proxyObservation{
+		token:         msg.Token,
+		upstreamToken: upstreamToken,
+		request:       msg.Clone(),
+		conn:          conn,
+		addr:          addr,
+	}
+
+	if obs == 0 {
+		p.observations[string(upstreamToken)] = pending
+	}
+	p.Unlock()
+
+	resp, fromOrigin := p.exchange(msg, upstreamToken)
+
+	if obs != 0 || !fromOrigin || !IsSuccessCode(resp.Code) || resp.GetOption(OptionObserve) == nil {
+		p.Lock()
+		if current := p.observations[string(upstreamToken)]; current == pending || current == existing {
+			delete(p.observations, string(upstreamToken))
+		}
+		p.Unlock()
+	}
+
+	NewProxyHandler(func(*Message) *Message {
+		return resp
+	})(msg, conn, addr)
+}
+
+// Relays a notification from an origin to the observing client. Clients rejecting a notification
+// with a Reset end the relationship, which is then cancelled with the origin
+func (p *CoapProxy) handleNotification(resource string, value interface{}, msg *Message) {
+	p.Lock()
+	obs, ok := p.observations[string(msg.Token)]
+	if ok && (!IsSuccessCode(msg.Code) || msg.GetOption(OptionObserve) == nil) {
+		// Error responses and responses without Observe end the relationship
+		delete(p.observations, string(msg.Token))
+	}
+	p.Unlock()
+
+	if !ok {
+		return
+	}
+
+	notification := msg.Clone()
+	notification.Token = obs.token
+	notification.MessageID = GenerateMessageID()
+	if notification.MessageType != MessageConfirmable {
+		notification.MessageType = MessageNonConfirmable
+	}
+
+	messageID := notification.MessageID
+	RegisterAwaitResponseHandler(messageID, func(resp *Message) {
+		if resp.MessageType == MessageReset {
+			p.cancelObservation(obs)
+		}
+	})
+	time.AfterFunc(p.Timeout, func() {
+		UnregisterAwaitResponseHandler(messageID)
+	})
+
+	p.client.GetEvents().Message(notification, false)
+	SendMessageTo(notification, NewUDPConnection(obs.conn), obs.addr)
+}
+
+// Removes a relayed observation and deregisters it with the origin
+func (p *CoapProxy) cancelObservation(obs *proxyObservation) {
+	p.Lock()
+	if p.observations[string(obs.upstreamToken)] != obs {
+		p.Unlock()
+		return
+	}
+	delete(p.observations, string(obs.upstreamToken))
+	p.Unlock()
+
+	cancel := obs.request.Clone()
+	cancel.RemoveOptions(OptionObserve)
+	cancel.AddOption(OptionObserve, 1)
+
+	go p.exchange(cancel, obs.upstreamToken)
+}
+
+func (p *CoapProxy) findObservation(token []byte, addr *net.UDPAddr) *proxyObservation {
+	for _, obs := range p.observations {
+		if string(obs.token) == string(token) && obs.addr.String() == addr.String() {
+			return obs
+		}
+	}
+	return nil
+}
+
+// Determines if a code is a success response code (class 2)
+func IsSuccessCode(code CoapCode) bool {
+	return code>>5 == 2
+}
+
+// ProxyTargetURI returns the URI targeted by a proxied request, either given by its Proxy-Uri
+// option, or composed from its Proxy-Scheme, Uri-Host, Uri-Port, Uri-Path and Uri-Query options
+func ProxyTargetURI(msg *Message) (*url.URL, error) {
+	if opt := msg.GetOption(OptionProxyURI); opt != nil {
+		u, err := url.Parse(opt.StringValue())
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, ErrInvalidProxyURI
+		}
+		return u, nil
+	}
+
+	scheme := msg.GetOption(OptionProxyScheme)
+	host := msg.GetOption(OptionURIHost)
+	if scheme == nil || host == nil {
+		return nil, ErrInvalidProxyURI
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme.StringValue() + "://")
+
+	if h := host.StringValue(); strings.Contains(h, ":") {
+		b.WriteString("[" + strings.Replace(h, "%", "%25", -1) + "]")
+	} else {
+		b.WriteString(h)
+	}
+
+	if port := msg.GetOption(OptionURIPort); port != nil {
+		v, _ := optionUintValue(port)
+		b.WriteString(":" + strconv.Itoa(int(v)))
+	}
+
+	// Path segments and query arguments are percent-encoded, so that delimiters within them
+	// aren't taken for separators
+	writeURIPathQuery(&b, msg.GetOptions(OptionURIPath), msg.GetOptions(OptionURIQuery))
+
+	u, err := url.Parse(b.String())
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidProxyURI
+	}
+	return u, nil
+}
@@ -0,0 +1,307 @@
+package coap
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCoapProxyObserve(t *testing.T) {
+	var proxy *CoapProxy
+	pending := make(chan bool, 1)
+
+	origin, originAddr := newTestServer(t)
+	origin.Get("/obs", func(req CoapRequest) CoapResponse {
+		// The relationship is registered before the origin responds
+		proxy.Lock()
+		pending <- len(proxy.observations) == 1
+		proxy.Unlock()
+
+		msg := ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment)
+		msg.AddOption(OptionObserve, 2)
+		msg.SetStringPayload("1")
+
+		return NewResponseWithMessage(msg)
+	})
+
+	client, _ := newTestServer(t)
+	proxy = NewCoapProxy(client)
+	proxy.Timeout = 2 * time.Second
+
+	startTestServer(t, origin)
+	startTestServer(t, client)
+
+	// Responses and notifications are relayed to the observer's socket
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("loopback unavailable:", err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	receive := func() *Message {
+		buf := make([]byte, MaxPacketSize)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := BytesToMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	observe := func(path string, obs int) *Message {
+		msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+		msg.Token = []byte("observer")
+		msg.AddOption(OptionObserve, obs)
+		msg.AddOption(OptionProxyURI, "coap://"+originAddr+path)
+
+		proxy.handleObserve(msg, conn, addr)
+
+		return receive()
+	}
+
+	resp := observe("/obs", 0)
+	if resp.Code != CoapCodeContent || string(resp.Token) != "observer" {
+		t.Fatalf("response = %s with token %q", CoapCodeToString(resp.Code), resp.Token)
+	}
+
+	if !<-pending {
+		t.Error("the observation wasn't registered during the exchange")
+	}
+
+	var upstreamToken []byte
+	proxy.Lock()
+	for _, obs := range proxy.observations {
+		upstreamToken = obs.upstreamToken
+	}
+	proxy.Unlock()
+
+	if upstreamToken == nil {
+		t.Fatal("the observation wasn't kept")
+	}
+
+	notification := ContentMessage(1, MessageNonConfirmable)
+	notification.Token = upstreamToken
+	notification.AddOption(OptionObserve, 3)
+	notification.SetStringPayload("2")
+	proxy.handleNotification("/obs", nil, notification)
+
+	if msg := receive(); string(msg.Token) != "observer" || msg.Payload.String() != "2" {
+		t.Errorf("notification with token %q and payload %v", msg.Token, msg.Payload)
+	}
+
+	// Registering again keeps the upstream token
+	observe("/obs", 0)
+	<-pending
+
+	proxy.Lock()
+	if obs := proxy.observations[string(upstreamToken)]; obs == nil || len(proxy.observations) != 1 {
+		t.Errorf("observations after registering again = %d", len(proxy.observations))
+	}
+	proxy.Unlock()
+
+	// Registrations the origin rejects are removed
+	if resp := observe("/missing", 0); resp.Code != CoapCodeNotFound {
+		t.Errorf("response = %s, want 4.04", CoapCodeToString(resp.Code))
+	}
+
+	proxy.Lock()
+	if len(proxy.observations) != 0 {
+		t.Errorf("%d observations after a rejected registration", len(proxy.observations))
+	}
+	proxy.Unlock()
+}
+
+func TestCoapProxyUnrecognizedOptions(t *testing.T) {
+	origin, originAddr := newTestServer(t)
+	origin.Get("/a", func(req CoapRequest) CoapResponse {
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment))
+	})
+
+	client, _ := newTestServer(t)
+	proxy := NewCoapProxy(client)
+	proxy.Timeout = 2 * time.Second
+
+	startTestServer(t, origin)
+	startTestServer(t, client)
+
+	forward := func(code OptionCode, messageID uint16) *Message {
+		msg := NewMessage(MessageConfirmable, Get, messageID)
+		msg.AddOption(OptionProxyURI, "coap://"+originAddr+"/a")
+		msg.AddOption(code, []byte("x"))
+
+		return proxy.Forward(msg)
+	}
+
+	// Safe-to-Forward critical options are forwarded, and rejected by the origin endpoint
+	if resp := forward(65001, 1); resp.Code != CoapCodeBadOption {
+		t.Errorf("response = %s, want 4.02", CoapCodeToString(resp.Code))
+	}
+
+	// Unsafe options are rejected by the proxy
+	if resp := forward(65003, 2); resp.Code != CoapCodeBadGateway {
+		t.Errorf("response = %s, want 5.02", CoapCodeToString(resp.Code))
+	}
+
+	// Elective options are ignored by the origin
+	if resp := forward(65000, 3); resp.Code != CoapCodeContent {
+		t.Errorf("response = %s, want 2.05", CoapCodeToString(resp.Code))
+	}
+}
+
+func TestProxyTargetURI(t *testing.T) {
+	target, err := url.Parse("coap://example.com:61616/a%2Fb/c+d?x%26y=1+2&z%3D")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encoded delimiters stay within their segment or argument
+	msg := NewMessage(MessageConfirmable, Get, 1)
+	if err := setCoapURIOptions(msg, target); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Uri-Host=example.com", "Uri-Path=a/b", "Uri-Path=c+d", "Uri-Query=x&y=1+2", "Uri-Query=z="}
+	if got := uriTestOptions(msg.Options); !reflect.DeepEqual(got, want) {
+		t.Errorf("setCoapURIOptions = %q, want %q", got, want)
+	}
+
+	// The target composed from the options is split into the same options again
+	msg.AddOption(OptionProxyScheme, "coap")
+	msg.AddOption(OptionURIPort, 61616)
+
+	u, err := ProxyTargetURI(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Host != "example.com:61616" || u.EscapedPath() != "/a%2Fb/c+d" {
+		t.Errorf("ProxyTargetURI = %s", u)
+	}
+
+	composed := NewMessage(MessageConfirmable, Get, 1)
+	if err := setCoapURIOptions(composed, u); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := uriTestOptions(composed.Options); !reflect.DeepEqual(got, want) {
+		t.Errorf("options of %s = %q, want %q", u, got, want)
+	}
+
+	if err := setCoapURIOptions(msg, &url.URL{Scheme: "coap", Host: "h", RawQuery: "%zz"}); err != ErrInvalidRequestURI {
+		t.Errorf("setCoapURIOptions with an invalid query = %v, want %v", err, ErrInvalidRequestURI)
+	}
+}
+
+func TestCoapProxyObserveCancel(t *testing.T) {
+	events := make(chan string, 4)
+
+	origin, originAddr := newTestServer(t)
+	origin.Get("/obs", func(req CoapRequest) CoapResponse {
+		msg := ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment)
+		msg.AddOption(OptionObserve, 2)
+
+		return NewResponseWithMessage(msg)
+	})
+	origin.OnObserve(func(string, *Message) { events <- "observe" })
+	origin.OnObserveCancel(func(string, *Message) { events <- "cancel" })
+
+	client, _ := newTestServer(t)
+	proxy := NewCoapProxy(client)
+	proxy.Timeout = 2 * time.Second
+
+	server, serverAddr := newTestServer(t)
+	server.SetProxyHandler(ProxyCOAP, proxy.Handle)
+
+	startTestServer(t, origin)
+	startTestServer(t, client)
+	startTestServer(t, server)
+
+	conn := newTestConn(t)
+
+	expectEvent := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("origin event = %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %q event at the origin", want)
+		}
+	}
+
+	// Registers an observation through the proxy and returns its upstream token
+	register := func() []byte {
+		msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+		msg.Token = []byte("observer")
+		msg.AddOption(OptionObserve, 0)
+		msg.AddOption(OptionProxyURI, "coap://"+originAddr+"/obs")
+		sendTestMessage(t, conn, msg, serverAddr)
+
+		if resp := receiveTestMessage(t, conn, 2*time.Second); resp == nil || resp.Code != CoapCodeContent {
+			t.Fatalf("registration response = %v", resp)
+		}
+		expectEvent("observe")
+
+		proxy.Lock()
+		defer proxy.Unlock()
+
+		for _, obs := range proxy.observations {
+			return obs.upstreamToken
+		}
+		t.Fatal("the observation wasn't kept")
+		return nil
+	}
+
+	observations := func() int {
+		proxy.Lock()
+		defer proxy.Unlock()
+
+		return len(proxy.observations)
+	}
+
+	// A client rejecting a notification with a Reset ends the relationship with the origin
+	upstreamToken := register()
+
+	notification := ContentMessage(1, MessageNonConfirmable)
+	notification.Token = upstreamToken
+	notification.AddOption(OptionObserve, 3)
+	proxy.handleNotification("/obs", nil, notification)
+
+	relayed := receiveTestMessage(t, conn, 2*time.Second)
+	if relayed == nil || string(relayed.Token) != "observer" {
+		t.Fatalf("relayed notification = %v", relayed)
+	}
+	sendTestMessage(t, conn, EmptyMessage(relayed.MessageID, MessageReset), serverAddr)
+
+	expectEvent("cancel")
+	if n := observations(); n != 0 {
+		t.Errorf("%d observations after a Reset", n)
+	}
+
+	// Clients deregistering end the relationship with the origin
+	register()
+
+	msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+	msg.Token = []byte("observer")
+	msg.AddOption(OptionObserve, 1)
+	msg.AddOption(OptionProxyURI, "coap://"+originAddr+"/obs")
+	sendTestMessage(t, conn, msg, serverAddr)
+
+	if resp := receiveTestMessage(t, conn, 2*time.Second); resp == nil || resp.Code != CoapCodeContent {
+		t.Fatalf("deregistration response = %v", resp)
+	}
+	expectEvent("cancel")
+
+	if n := observations(); n != 0 {
+		t.Errorf("%d observations after deregistering", n)
+	}
+}
@@ -0,0 +1,324 @@
+package coap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPProxyTimeout defines the number of seconds to wait for an HTTP response before answering 5.04
+const HTTPProxyTimeout = 10
+
+// HTTPProxyMaxBodySize limits the size of HTTP responses relayed by the proxy
+const HTTPProxyMaxBodySize = 1024 * 1024
+
+var defaultHTTPProxy = NewHTTPProxy(&http.Client{
+	Timeout: HTTPProxyTimeout * time.Second,
+})
+
+// Handles requests for proxying from CoAP to HTTP
+func HTTPProxyHandler(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	defaultHTTPProxy.Handle(msg, conn, addr)
+}
+
+// Instantiates a new CoAP-HTTP proxy sending requests with the given HTTP client. The client's
+// timeout determines when the proxy gives up on the origin and answers 5.04 Gateway Timeout
+func NewHTTPProxy(client *http.Client) *HTTPProxy {
+	return &HTTPProxy{
+		Client:      client,
+		BlockSize:   DefaultBlockSize,
+		MaxBodySize: HTTPProxyMaxBodySize,
+		transfers:   make(map[string]*block2Transfer),
+	}
+}
+
+// HTTPProxy forwards CoAP requests carrying an http(s) Proxy-Uri to their HTTP origin, mapping methods,
+// options, media types and status codes as defined by RFC 8075. Responses larger than BlockSize are
+// returned block-wise using Block2, with the HTTP body kept for the rest of the transfer
+type HTTPProxy struct {
+	sync.Mutex
+
+	Client      *http.Client
+	BlockSize   int
+	MaxBodySize int
+
+	// Bodies of responses transferred block-wise, by request
+	transfers map[string]*block2Transfer
+}
+
+// The body of a response transferred block-wise, along with the response without its payload
+type block2Transfer struct {
+	resp    *Message
+	etag    []byte
+	body    []byte
+	expires time.Time
+}
+
+// Handle is a ProxyHandler relaying the HTTP origin's response to the requesting client
+func (p *HTTPProxy) Handle(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+	NewProxyHandler(p.Forward)(msg, conn, addr)
+}
+
+// Forward sends a CoAP request to its HTTP origin and returns the response to relay to the client
+func (p *HTTPProxy) Forward(msg *Message) *Message {
+	target, err := ProxyTargetURI(msg)
+	if err != nil {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadOption, msg.MessageID)
+	}
+
+	// Unsafe options which aren't recognized can't be mapped to HTTP, and are rejected with 5.02
+	// Bad Gateway. Safe-to-Forward ones are dropped
+	if HasUnsafeUnrecognizedOption(msg) {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadGateway, msg.MessageID)
+	}
+
+	// The Hop-Limit can't be carried over HTTP, but requests which exhausted it are not forwarded
+	if !DecrementHopLimit(msg.Clone()) {
+		return HopLimitReachedResponse(msg)
+	}
+
+	method := MethodString(msg.Code)
+	if method == "" {
+		return NewMessage(MessageAcknowledgment, CoapCodeMethodNotAllowed, msg.MessageID)
+	}
+
+	if msg.HasInvalidBlockOption(OptionBlock2) {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadRequest, msg.MessageID)
+	}
+
+	// Later blocks of a response are served from the body fetched for the first block
+	block := msg.GetBlockOption(OptionBlock2)
+	if msg.Code == Get && block != nil && block.Num > 0 {
+		if resp := p.continueTransfer(msg, block); resp != nil {
+			return resp
+		}
+	}
+
+	var body io.Reader
+	if msg.Payload != nil && msg.Payload.Length() > 0 {
+		body = bytes.NewReader(msg.Payload.GetBytes())
+	}
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadGateway, msg.MessageID)
+	}
+
+	if code := p.mapRequestOptions(msg, req); code != CoapCodeEmpty {
+		return NewMessage(MessageAcknowledgment, code, msg.MessageID)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return NewMessage(MessageAcknowledgment, CoapCodeGatewayTimeout, msg.MessageID)
+		}
+		return NewMessage(MessageAcknowledgment, CoapCodeBadGateway, msg.MessageID)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(p.MaxBodySize)+1))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return NewMessage(MessageAcknowledgment, CoapCodeGatewayTimeout, msg.MessageID)
+		}
+		return NewMessage(MessageAcknowledgment, CoapCodeBadGateway, msg.MessageID)
+	}
+
+	if len(contents) > p.MaxBodySize {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadGateway, msg.MessageID)
+	}
+
+	respMsg := p.mapResponse(msg, resp, contents)
+	if msg.Code == Get && respMsg.Code == CoapCodeContent && len(contents) > p.BlockSize {
+		p.startTransfer(msg, respMsg, contents)
+	}
+	return respMsg
+}
+
+// Returns the key of the block-wise transfer of the response to a request: the request's cache
+// key without its Block2 option
+func block2TransferKey(msg *Message) string {
+	req := msg.Clone()
+	req.RemoveOptions(OptionBlock2)
+
+	return CacheKey(req)
+}
+
+// Keeps the body of a response returned block-wise. A transfer which is started again replaces
+// the previous one, along with its ETag
+func (p *HTTPProxy) startTransfer(msg *Message, resp *Message, body []byte) {
+	t := &block2Transfer{
+		resp:    resp.Clone(),
+		body:    body,
+		expires: time.Now().Add(Block2Lifetime),
+	}
+	t.resp.Payload = nil
+	t.resp.RemoveOptions(OptionBlock2)
+	t.resp.RemoveOptions(OptionSize2)
+
+	if etag := resp.GetOption(OptionEtag); etag != nil {
+		t.etag = optionBytesValue(etag)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.transfers == nil {
+		p.transfers = make(map[string]*block2Transfer)
+	}
+	p.transfers[block2TransferKey(msg)] = t
+}
+
+// Answers a request for a later block from the body of an ongoing transfer. Nil is returned if
+// there is no such transfer, or if the request validates an ETag other than the transfer's
+func (p *HTTPProxy) continueTransfer(msg *Message, block *BlockOption) *Message {
+	key := block2TransferKey(msg)
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for k, t := range p.transfers {
+		if now.After(t.expires) {
+			delete(p.transfers, k)
+		}
+	}
+
+	t := p.transfers[key]
+	if t == nil || (msg.GetOption(OptionEtag) != nil && !hasETag(msg, t.etag)) {
+		return nil
+	}
+
+	resp := t.resp.Clone()
+	resp.MessageID = msg.MessageID
+	if !SetBlock2Payload(resp, t.body, block, p.BlockSize) {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadOption, msg.MessageID)
+	}
+
+	// The transfer ends with its last block
+	if block.Offset()+block.Size() >= len(t.body) {
+		delete(p.transfers, key)
+	}
+	return resp
+}
+
+// Maps CoAP request options to HTTP headers. A non-empty CoAP code is returned if the
+// request can't be mapped
+func (p *HTTPProxy) mapRequestOptions(msg *Message, req *http.Request) CoapCode {
+	if cf := msg.GetOption(OptionContentFormat); cf != nil && req.Body != nil {
+		mt, _ := optionUintValue(cf)
+		ct := MediaTypeToContentType(MediaType(mt))
+		if ct == "" {
+			return CoapCodeUnsupportedContentFormat
+		}
+		req.Header.Set("Content-Type", ct)
+	}
+
+	if accept := msg.GetOption(OptionAccept); accept != nil {
+		mt, _ := optionUintValue(accept)
+		ct := MediaTypeToContentType(MediaType(mt))
+		if ct == "" {
+			return CoapCodeNotAcceptable
+		}
+		req.Header.Set("Accept", ct)
+	}
+
+	var ifMatch []string
+	for _, opt := range msg.GetOptions(OptionIfMatch) {
+		if v := optionBytesValue(opt); len(v) > 0 {
+			ifMatch = append(ifMatch, formatHTTPETag(v))
+		} else {
+			ifMatch = append(ifMatch, "*")
+		}
+	}
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", strings.Join(ifMatch, ", "))
+	}
+
+	if msg.GetOption(OptionIfNoneMatch) != nil {
+		req.Header.Set("If-None-Match", "*")
+	} else if msg.Code == Get {
+		// Cached representations are validated through the request's ETags
+		var etags []string
+		for _, opt := range msg.GetOptions(OptionEtag) {
+			etags = append(etags, formatHTTPETag(optionBytesValue(opt)))
+		}
+		if len(etags) > 0 {
+			req.Header.Set("If-None-Match", strings.Join(etags, ", "))
+		}
+	}
+	return CoapCodeEmpty
+}
+
+// Maps an HTTP response to the CoAP response returned to the client
+func (p *HTTPProxy) mapResponse(msg *Message, resp *http.Response, contents []byte) *Message {
+	code := HTTPStatusToCoapCode(resp.StatusCode, msg.Code)
+	respMsg := NewMessage(MessageAcknowledgment, code, msg.MessageID)
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" && len(contents) > 0 {
+		if mt, ok := ContentTypeToMediaType(ct); ok {
+			respMsg.AddOption(OptionContentFormat, mt)
+		} else {
+			respMsg.AddOption(OptionContentFormat, MediaTypeApplicationOctetStream)
+		}
+	}
+
+	if etag := httpETagToCoap(resp.Header.Get("ETag")); etag != nil {
+		respMsg.AddOption(OptionEtag, etag)
+	}
+
+	if maxAge, ok := httpMaxAge(resp.Header.Get("Cache-Control")); ok {
+		respMsg.AddOption(OptionMaxAge, maxAge)
+	}
+
+	if code == CoapCodeCreated {
+		if location, err := url.Parse(resp.Header.Get("Location")); err == nil && location.Path != "" {
+			ref := location.EscapedPath()
+			if location.RawQuery != "" {
+				ref += "?" + location.RawQuery
+			}
+			respMsg.SetLocation(ref)
+		}
+	}
+
+	if code == CoapCodeValid {
+		return respMsg
+	}
+
+	if !SetBlock2Payload(respMsg, contents, msg.GetBlockOption(OptionBlock2), p.BlockSize) {
+		return NewMessage(MessageAcknowledgment, CoapCodeBadOption, msg.MessageID)
+	}
+	return respMsg
+}
+
+// Returns the max-age directive of an HTTP Cache-Control header. Ages beyond the range of the
+// Max-Age option are clamped to its maximum
+func httpMaxAge(cacheControl string) (uint32, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+
+		switch {
+		case directive == "no-cache", directive == "no-store":
+			return 0, true
+
+		case strings.HasPrefix(directive, "max-age="):
+			v, err := strconv.ParseUint(strings.TrimPrefix(directive, "max-age="), 10, 32)
+			if err == nil {
+				return uint32(v), true
+			}
+			if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+				return math.MaxUint32, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package coap
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestHTTPProxyBlock2Transfer(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	body := bytes.Repeat([]byte("0123456789"), 5)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	proxy := NewHTTPProxy(origin.Client())
+	proxy.BlockSize = 16
+
+	get := func(num uint32) *Message {
+		msg := NewMessage(MessageConfirmable, Get, uint16(num+1))
+		msg.AddOption(OptionProxyURI, origin.URL+"/a")
+		if num > 0 {
+			msg.SetBlockOption(OptionBlock2, NewBlockOption(num, false, 16))
+		}
+		return proxy.Forward(msg)
+	}
+
+	var got []byte
+	for num := uint32(0); ; num++ {
+		resp := get(num)
+		if resp.Code != CoapCodeContent {
+			t.Fatalf("block %d: response = %s", num, CoapCodeToString(resp.Code))
+		}
+
+		if etag := resp.GetOption(OptionEtag); etag == nil || string(optionBytesValue(etag)) != "v1" {
+			t.Errorf("block %d without the representation's ETag", num)
+		}
+
+		got = append(got, resp.Payload.GetBytes()...)
+
+		block := resp.GetBlockOption(OptionBlock2)
+		if block == nil || block.Num != num {
+			t.Fatalf("block %d: Block2 = %v", num, block)
+		}
+		if !block.More {
+			break
+		}
+	}
+
+	if !bytes.Equal(got, body) {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+
+	if requests != 1 {
+		t.Errorf("%d HTTP requests for a single transfer", requests)
+	}
+
+	// The transfer ends with its last block, and later blocks are fetched again
+	if len(proxy.transfers) != 0 {
+		t.Errorf("%d transfers kept after the last block", len(proxy.transfers))
+	}
+
+	if resp := get(1); resp.Code != CoapCodeContent || requests != 2 {
+		t.Errorf("response = %s after %d HTTP requests", CoapCodeToString(resp.Code), requests)
+	}
+
+	// Unsafe options which aren't recognized are rejected
+	msg := NewMessage(MessageConfirmable, Get, 10)
+	msg.AddOption(OptionProxyURI, origin.URL+"/a")
+	msg.AddOption(65003, []byte("x"))
+	if resp := proxy.Forward(msg); resp.Code != CoapCodeBadGateway {
+		t.Errorf("response = %s, want 5.02", CoapCodeToString(resp.Code))
+	}
+}
+
+func TestHTTPMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		maxAge       uint32
+		ok           bool
+	}{
+		{"", 0, false},
+		{"public", 0, false},
+		{"max-age=60", 60, true},
+		{"public, max-age=0", 0, true},
+		{"no-cache, max-age=60", 0, true},
+		{"no-store", 0, true},
+		{"max-age=-1", 0, false},
+		{"max-age=x", 0, false},
+
+		// Ages beyond the range of Max-Age are clamped
+		{"max-age=4294967295", math.MaxUint32, true},
+		{"max-age=4294967296", math.MaxUint32, true},
+		{"max-age=99999999999999999999999", math.MaxUint32, true},
+	}
+
+	for _, test := range tests {
+		maxAge, ok := httpMaxAge(test.cacheControl)
+		if maxAge != test.maxAge || ok != test.ok {
+			t.Errorf("httpMaxAge(%q) = %d, %v, want %d, %v", test.cacheControl, maxAge, ok, test.maxAge, test.ok)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		// The age can be sent in a Max-Age option
+		msg := ContentMessage(1, MessageAcknowledgment)
+		msg.AddOption(OptionMaxAge, maxAge)
+
+		if _, err := MessageToBytes(msg); err != nil {
+			t.Errorf("Max-Age of %q: %v", test.cacheControl, err)
+		}
+	}
+}
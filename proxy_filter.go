@@ -0,0 +1,263 @@
+package coap
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyFilterResult is the verdict of a proxy filter on a request
+type ProxyFilterResult struct {
+	Allowed bool
+
+	// Code of the response rejecting the request. Defaults to 4.03 Forbidden
+	Code CoapCode
+}
+
+// Returns the code of the response rejecting a request
+func (r ProxyFilterResult) GetCode() CoapCode {
+	if r.Code == CoapCodeEmpty {
+		return CoapCodeForbidden
+	}
+	return r.Code
+}
+
+// Allows a request to be forwarded by the proxy
+func AllowProxyRequest() ProxyFilterResult {
+	return ProxyFilterResult{Allowed: true}
+}
+
+// Rejects a request with a given response code
+func RejectProxyRequest(code CoapCode) ProxyFilterResult {
+	return ProxyFilterResult{Allowed: false, Code: code}
+}
+
+// ProxyRequestFilter decides whether a request received from a client is forwarded by the proxy
+type ProxyRequestFilter func(msg *Message, addr *net.UDPAddr) ProxyFilterResult
+
+// ProxyFilterFunc adapts a ProxyFilter to a ProxyRequestFilter rejecting requests with 4.03 Forbidden
+func ProxyFilterFunc(fn ProxyFilter) ProxyRequestFilter {
+	return func(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+		if fn(msg, addr) {
+			return AllowProxyRequest()
+		}
+		return RejectProxyRequest(CoapCodeForbidden)
+	}
+}
+
+// Instantiates a new chain of proxy filters
+func NewProxyFilterChain(filters ...ProxyRequestFilter) *ProxyFilterChain {
+	return &ProxyFilterChain{
+		filters: filters,
+	}
+}
+
+// ProxyFilterChain applies filters to a request in order. The first filter rejecting the request
+// determines the response, and requests passing all filters are forwarded
+type ProxyFilterChain struct {
+	sync.RWMutex
+
+	filters []ProxyRequestFilter
+}
+
+// Appends filters to the chain
+func (c *ProxyFilterChain) Add(filters ...ProxyRequestFilter) *ProxyFilterChain {
+	c.Lock()
+	c.filters = append(c.filters, filters...)
+	c.Unlock()
+
+	return c
+}
+
+// Filter applies the chain's filters to a request
+func (c *ProxyFilterChain) Filter(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+	c.RLock()
+	filters := c.filters
+	c.RUnlock()
+
+	for _, filter := range filters {
+		if result := filter(msg, addr); !result.Allowed {
+			return result
+		}
+	}
+	return AllowProxyRequest()
+}
+
+// Parses a list of CIDRs (e.g. 10.0.0.0/8) or single IP addresses
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: cidr}
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClientCIDRFilter creates a filter rejecting clients with 4.03 Forbidden unless their address
+// is within one of the allowed CIDRs. Denied CIDRs take precedence, and an empty allow list
+// allows all clients which aren't denied
+func NewClientCIDRFilter(allow []string, deny []string) (ProxyRequestFilter, error) {
+	allowed, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+		if containsIP(denied, addr.IP) {
+			return RejectProxyRequest(CoapCodeForbidden)
+		}
+
+		if len(allowed) > 0 && !containsIP(allowed, addr.IP) {
+			return RejectProxyRequest(CoapCodeForbidden)
+		}
+		return AllowProxyRequest()
+	}, nil
+}
+
+// NewDestinationFilter creates a filter restricting the URIs requests are proxied to. Requests for
+// schemes which aren't allowed are rejected with 5.05 Proxying Not Supported, and requests for
+// hosts which aren't allowed with 4.03 Forbidden. Hosts may start with a wildcard label
+// (e.g. *.example.com), and empty lists allow any scheme or host
+func NewDestinationFilter(schemes []string, hosts []string) ProxyRequestFilter {
+	return func(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+		target, err := ProxyTargetURI(msg)
+		if err != nil {
+			return RejectProxyRequest(CoapCodeBadOption)
+		}
+
+		if len(schemes) > 0 && !matchesAny(schemes, target.Scheme, strings.EqualFold) {
+			return RejectProxyRequest(CoapCodeProxyingNotSupported)
+		}
+
+		if len(hosts) > 0 && !matchesAny(hosts, target.Hostname(), matchesHost) {
+			return RejectProxyRequest(CoapCodeForbidden)
+		}
+		return AllowProxyRequest()
+	}
+}
+
+func matchesAny(patterns []string, s string, match func(pattern, s string) bool) bool {
+	for _, pattern := range patterns {
+		if match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a host name matches a host pattern such as *.example.com
+func matchesHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// NewRateLimitFilter creates a filter limiting each client address to a number of requests per
+// second, with bursts of up to burst requests. Requests over the limit are rejected with
+// 4.29 Too Many Requests
+func NewRateLimitFilter(rate float64, burst int) ProxyRequestFilter {
+	limiter := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+
+	return func(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+		if !limiter.allow(addr.IP.String(), time.Now()) {
+			return RejectProxyRequest(CoapCodeTooManyRequests)
+		}
+		return AllowProxyRequest()
+	}
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket rate limiter per client
+type rateLimiter struct {
+	sync.Mutex
+
+	rate      float64
+	burst     float64
+	buckets   map[string]*rateBucket
+	lastPurge time.Time
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	l.purge(now)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// Removes the buckets of clients which have been idle long enough to have refilled
+func (l *rateLimiter) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < time.Minute {
+		return
+	}
+	l.lastPurge = now
+
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package coap
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyFilterResult(t *testing.T) {
+	if code := (ProxyFilterResult{}).GetCode(); code != CoapCodeForbidden {
+		t.Errorf("default code = %s, want 4.03", CoapCodeToString(code))
+	}
+
+	if code := RejectProxyRequest(CoapCodeTooManyRequests).GetCode(); code != CoapCodeTooManyRequests {
+		t.Errorf("code = %s, want 4.29", CoapCodeToString(code))
+	}
+
+	if result := AllowProxyRequest(); !result.Allowed {
+		t.Error("AllowProxyRequest doesn't allow the request")
+	}
+}
+
+func TestProxyFilterChain(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	msg := NewMessage(MessageConfirmable, Get, 1)
+
+	var calls []string
+	filter := func(name string, result ProxyFilterResult) ProxyRequestFilter {
+		return func(*Message, *net.UDPAddr) ProxyFilterResult {
+			calls = append(calls, name)
+			return result
+		}
+	}
+
+	if result := NewProxyFilterChain().Filter(msg, addr); !result.Allowed {
+		t.Error("an empty chain rejected the request")
+	}
+
+	// The first filter rejecting the request determines the response
+	chain := NewProxyFilterChain(filter("a", AllowProxyRequest()))
+	chain.Add(filter("b", RejectProxyRequest(CoapCodeTooManyRequests)), filter("c", RejectProxyRequest(CoapCodeForbidden)))
+
+	if result := chain.Filter(msg, addr); result.Allowed || result.GetCode() != CoapCodeTooManyRequests {
+		t.Errorf("result = %+v, want 4.29", result)
+	}
+
+	if len(calls) != 2 || calls[0] != "a" || calls[1] != "b" {
+		t.Errorf("filters called = %q", calls)
+	}
+
+	// ProxyFilter functions reject requests with 4.03 Forbidden
+	if result := ProxyFilterFunc(func(*Message, *net.UDPAddr) bool { return false })(msg, addr); result.Allowed || result.GetCode() != CoapCodeForbidden {
+		t.Errorf("result of a rejecting ProxyFilter = %+v", result)
+	}
+
+	if result := ProxyFilterFunc(NullProxyFilter)(msg, addr); !result.Allowed {
+		t.Error("NullProxyFilter rejected the request")
+	}
+}
+
+func TestClientCIDRFilter(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		ip          string
+		allowed     bool
+	}{
+		{nil, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{[]string{"192.0.2.1"}, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, nil, "192.0.2.1", false},
+
+		// Denied CIDRs take precedence over allowed ones
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.200", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.1", true},
+		{nil, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{nil, []string{"192.0.2.1"}, "192.0.2.2", true},
+	}
+
+	msg := NewMessage(MessageConfirmable, Get, 1)
+	for _, test := range tests {
+		filter, err := NewClientCIDRFilter(test.allow, test.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := filter(msg, &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 5683})
+		if result.Allowed != test.allowed || (!result.Allowed && result.GetCode() != CoapCodeForbidden) {
+			t.Errorf("%s with allowed %q and denied %q = %+v", test.ip, test.allow, test.deny, result)
+		}
+	}
+
+	for _, cidrs := range [][]string{{"192.0.2.0/33"}, {"192.0.2"}, {"example.com"}} {
+		if _, err := NewClientCIDRFilter(cidrs, nil); err == nil {
+			t.Errorf("allowed CIDRs %q were accepted", cidrs)
+		}
+
+		if _, err := NewClientCIDRFilter(nil, cidrs); err == nil {
+			t.Errorf("denied CIDRs %q were accepted", cidrs)
+		}
+	}
+}
+
+func TestDestinationFilter(t *testing.T) {
+	filter := NewDestinationFilter([]string{"coap"}, []string{"example.com", "*.example.org"})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+
+	tests := []struct {
+		uri     string
+		allowed bool
+		code    CoapCode
+	}{
+		{"coap://example.com/a", true, CoapCodeEmpty},
+		{"COAP://EXAMPLE.com/a", true, CoapCodeEmpty},
+		{"coap://sensors.example.org/a", true, CoapCodeEmpty},
+		{"coap://example.org/a", false, CoapCodeForbidden},
+		{"coap://example.net/a", false, CoapCodeForbidden},
+		{"coap://127.0.0.1/a", false, CoapCodeForbidden},
+		{"http://example.com/a", false, CoapCodeProxyingNotSupported},
+		{"example.com/a", false, CoapCodeBadOption},
+	}
+
+	for _, test := range tests {
+		msg := NewMessage(MessageConfirmable, Get, 1)
+		msg.AddOption(OptionProxyURI, test.uri)
+
+		result := filter(msg, addr)
+		if result.Allowed != test.allowed || (!result.Allowed && result.GetCode() != test.code) {
+			t.Errorf("%s = %+v", test.uri, result)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{
+		rate:    2,
+		burst:   3,
+		buckets: make(map[string]*rateBucket),
+	}
+	now := time.Now()
+
+	// Bursts of up to burst requests
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("a", now) {
+			t.Fatalf("request %d of the burst was rejected", i)
+		}
+	}
+
+	if limiter.allow("a", now) {
+		t.Error("the request exceeding the burst was allowed")
+	}
+
+	// Clients are limited independently
+	if !limiter.allow("b", now) {
+		t.Error("the request of another client was rejected")
+	}
+
+	// Tokens are refilled at the rate
+	if limiter.allow("a", now.Add(400*time.Millisecond)) {
+		t.Error("the request was allowed before a token was refilled")
+	}
+
+	if !limiter.allow("a", now.Add(500*time.Millisecond)) || limiter.allow("a", now.Add(500*time.Millisecond)) {
+		t.Error("one token wasn't refilled after half a second")
+	}
+
+	// The bucket holds at most burst tokens
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("a", later) {
+			t.Fatalf("request %d of the refilled burst was rejected", i)
+		}
+	}
+
+	if limiter.allow("a", later) {
+		t.Error("the bucket was refilled beyond the burst")
+	}
+
+	// Buckets of idle clients are removed
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Error("the bucket of an idle client was kept")
+	}
+
+	filter := NewRateLimitFilter(0, 1)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	msg := NewMessage(MessageConfirmable, Get, 1)
+
+	if result := filter(msg, addr); !result.Allowed {
+		t.Error("the first request was rejected")
+	}
+
+	if result := filter(msg, addr); result.Allowed || result.GetCode() != CoapCodeTooManyRequests {
+		t.Errorf("result over the limit = %+v, want 4.29", result)
+	}
+}
+
+func TestHTTPCoapProxyFilter(t *testing.T) {
+	client, _ := newTestServer(t)
+
+	clients, err := NewClientCIDRFilter(nil, []string{"198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetProxyFilterChain(NewProxyFilterChain(clients, NewDestinationFilter(nil, []string{"*.example.com"})))
+
+	proxy := NewHTTPCoapProxy(client)
+
+	tests := []struct {
+		remoteAddr, uri string
+		status          int
+	}{
+		// Requests rejected by the filters aren't sent
+		{"198.51.100.1:1234", "/hc/coap://sensors.example.com/temp", http.StatusForbidden},
+		{"192.0.2.1:1234", "/hc/coap://127.0.0.1:5683/temp", http.StatusForbidden},
+		{"192.0.2.1:1234", "/hc/coap%3A%2F%2F10.0.0.1%2Ftemp", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.uri, nil)
+		r.RemoteAddr = test.remoteAddr
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s from %s = %d, want %d", test.uri, test.remoteAddr, w.Code, test.status)
+		}
+	}
+}
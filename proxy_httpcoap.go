@@ -0,0 +1,382 @@
+package coap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPCoapProxyPrefix is the path prefix of the default HTTP-CoAP URI mapping (RFC 8075 Section 5.3),
+// e.g. /hc/coap://example.com/sensors/temp
+const HTTPCoapProxyPrefix = "/hc/"
+
+// HTTPCoapProxyTimeout defines the number of seconds to wait for a CoAP response
+const HTTPCoapProxyTimeout = 10
+
+// HTTPCoapProxyMaxBodySize limits the size of HTTP request bodies and block-wise retrieved CoAP responses
+const HTTPCoapProxyMaxBodySize = 1024 * 1024
+
+// Instantiates a new HTTP-CoAP reverse proxy which sends CoAP requests through a client.
+// The client must be started so that it can receive responses
+func NewHTTPCoapProxy(client CoapServer) *HTTPCoapProxy {
+	return &HTTPCoapProxy{
+		client:      client,
+		Prefix:      HTTPCoapProxyPrefix,
+		Timeout:     HTTPCoapProxyTimeout * time.Second,
+		MaxBodySize: HTTPCoapProxyMaxBodySize,
+	}
+}
+
+// HTTPCoapProxy is an http.Handler mapping HTTP requests to CoAP (RFC 8075). Requests are either in
+// the form of {Prefix}{coap-uri}, or are forwarded to DefaultTarget with their path and query appended.
+// Requests are only forwarded if they pass the proxy filter chain of the client, which sees the
+// target in a Proxy-Uri option and the address of the HTTP client
+type HTTPCoapProxy struct {
+	client CoapServer
+
+	Prefix        string
+	DefaultTarget string
+	Timeout       time.Duration
+	MaxBodySize   int
+}
+
+func (p *HTTPCoapProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, err := p.targetURI(r)
+	if err != nil {
+		http.Error(w, "Invalid CoAP target URI", http.StatusBadRequest)
+		return
+	}
+
+	if target.Scheme != "coap" {
+		http.Error(w, "Unsupported URI scheme "+target.Scheme, http.StatusNotImplemented)
+		return
+	}
+
+	method := httpMethodToCoapCode(r.Method)
+	if method == CoapCodeEmpty {
+		http.Error(w, "Unsupported method "+r.Method, http.StatusNotImplemented)
+		return
+	}
+
+	msg := NewMessage(MessageConfirmable, method, GenerateMessageID())
+	msg.Token = []byte(GenerateToken(8))
+	if err := setCoapURIOptions(msg, target); err != nil {
+		http.Error(w, "Invalid CoAP target URI", http.StatusBadRequest)
+		return
+	}
+	DecrementHopLimit(msg)
+
+	if result := p.filter(r, msg, target); !result.Allowed {
+		status := CoapCodeToHTTPStatus(result.GetCode())
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	addr, err := resolveCoapURIAddr(target)
+	if err != nil {
+		http.Error(w, "Unable to resolve "+target.Host, http.StatusBadGateway)
+		return
+	}
+
+	if status := p.mapRequestHeaders(r, msg); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(p.MaxBodySize)))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if len(body) > 0 {
+			msg.Payload = NewBytesPayload(body)
+		}
+	}
+
+	resp, body, err := p.exchange(msg, addr)
+	if err != nil {
+		if err == ErrResponseTimeout {
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return
+	}
+
+	p.writeResponse(w, resp, body)
+}
+
+// Returns the CoAP URI targeted by an HTTP request
+func (p *HTTPCoapProxy) targetURI(r *http.Request) (*url.URL, error) {
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+
+	if p.Prefix != "" && strings.HasPrefix(uri, p.Prefix) {
+		target := uri[len(p.Prefix):]
+
+		// The target URI may also be percent-encoded, e.g. /hc/coap%3A%2F%2Fexample.com%2F
+		if !strings.Contains(target, "://") {
+			unescaped, err := url.PathUnescape(target)
+			if err != nil {
+				return nil, err
+			}
+			target = unescaped
+		}
+		return url.Parse(target)
+	}
+
+	if p.DefaultTarget == "" {
+		return nil, ErrInvalidProxyURI
+	}
+
+	base, err := url.Parse(p.DefaultTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	// The escaped path is kept, so that encoded slashes aren't taken for segment delimiters
+	target := *base
+	target.Path = strings.TrimRight(base.Path, "/") + r.URL.Path
+	target.RawPath = strings.TrimRight(base.EscapedPath(), "/") + r.URL.EscapedPath()
+	target.RawQuery = r.URL.RawQuery
+
+	return &target, nil
+}
+
+// Applies the client's proxy filter chain to the CoAP request mapped from an HTTP request
+func (p *HTTPCoapProxy) filter(r *http.Request, msg *Message, target *url.URL) ProxyFilterResult {
+	filterMsg := msg.Clone()
+	filterMsg.AddOption(OptionProxyURI, target.String())
+
+	addr := &net.UDPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr.IP = net.ParseIP(host)
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return p.client.GetProxyFilterChain().Filter(filterMsg, addr)
+}
+
+// Maps HTTP request headers to CoAP options. A non-zero HTTP status is returned if the
+// request can't be mapped
+func (p *HTTPCoapProxy) mapRequestHeaders(r *http.Request, msg *Message) int {
+	if ct := r.Header.Get("Content-Type"); ct != "" && r.ContentLength != 0 {
+		mt, ok := ContentTypeToMediaType(ct)
+		if !ok {
+			return http.StatusUnsupportedMediaType
+		}
+		msg.AddOption(OptionContentFormat, mt)
+	}
+
+	if mt, ok := httpAcceptMediaType(r.Header.Get("Accept")); ok {
+		msg.AddOption(OptionAccept, mt)
+	}
+
+	for _, etag := range parseHTTPETags(r.Header.Get("If-Match")) {
+		msg.AddOption(OptionIfMatch, etag)
+	}
+
+	if r.Header.Get("If-None-Match") == "*" {
+		msg.AddOption(OptionIfNoneMatch, nil)
+	} else if r.Method == http.MethodGet {
+		// Entity-tags of cached representations are validated with the ETag option
+		for _, etag := range parseHTTPETags(r.Header.Get("If-None-Match")) {
+			msg.AddOption(OptionEtag, etag)
+		}
+	}
+	return 0
+}
+
+// Sends a CoAP request and retrieves the remaining blocks of block-wise transferred responses
+func (p *HTTPCoapProxy) exchange(msg *Message, addr *net.UDPAddr) (*Message, []byte, error) {
+	resp, err := SendAndWaitForResponse(p.client, NewRequestFromMessage(msg), addr, p.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.Code == CoapCodeEmpty {
+		return nil, nil, ErrUnexpectedResponse
+	}
+
+	var body bytes.Buffer
+	if resp.Payload != nil {
+		body.Write(resp.Payload.GetBytes())
+	}
+
+	if resp.HasInvalidBlockOption(OptionBlock2) {
+		return nil, nil, ErrInvalidBlockOption
+	}
+
+	block := resp.GetBlockOption(OptionBlock2)
+	for block != nil && block.More {
+		if body.Len() > p.MaxBodySize {
+			return nil, nil, ErrUnexpectedResponse
+		}
+
+		msg.MessageID = GenerateMessageID()
+		msg.Token = []byte(GenerateToken(8))
+		msg.RemoveOptions(OptionEtag)
+		msg.SetBlockOption(OptionBlock2, &BlockOption{Num: block.Num + 1, SZX: block.SZX})
+
+		next, err := SendAndWaitForResponse(p.client, NewRequestFromMessage(msg), addr, p.Timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if next.Code != CoapCodeContent {
+			return nil, nil, ErrUnexpectedResponse
+		}
+
+		if next.HasInvalidBlockOption(OptionBlock2) {
+			return nil, nil, ErrInvalidBlockOption
+		}
+
+		if next.Payload != nil {
+			body.Write(next.Payload.GetBytes())
+		}
+		block = next.GetBlockOption(OptionBlock2)
+	}
+	return resp, body.Bytes(), nil
+}
+
+// Maps a CoAP response to the HTTP response
+func (p *HTTPCoapProxy) writeResponse(w http.ResponseWriter, resp *Message, body []byte) {
+	status := CoapCodeToHTTPStatus(resp.Code)
+	header := w.Header()
+
+	if cf := resp.GetOption(OptionContentFormat); cf != nil && len(body) > 0 {
+		mt, _ := optionUintValue(cf)
+		ct := MediaTypeToContentType(MediaType(mt))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		header.Set("Content-Type", ct)
+	} else if len(body) > 0 && resp.Code >= CoapCodeBadRequest {
+		// Diagnostic payloads of error responses
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	if etag := resp.GetOption(OptionEtag); etag != nil {
+		header.Set("ETag", formatHTTPETag(optionBytesValue(etag)))
+	}
+
+	if resp.Code == CoapCodeContent || resp.Code == CoapCodeValid {
+		maxAge := uint32(60)
+		if opt := resp.GetOption(OptionMaxAge); opt != nil {
+			maxAge, _ = optionUintValue(opt)
+		}
+		header.Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge)))
+	}
+
+	if location := resp.GetLocation(); location != "" {
+		header.Set("Location", location)
+	}
+
+	// 2.02 Deleted and 2.04 Changed map to 200 OK when carrying a payload, otherwise 204 No Content
+	if resp.Code == CoapCodeChanged || resp.Code == CoapCodeDeleted {
+		status = http.StatusNoContent
+		if len(body) > 0 {
+			status = http.StatusOK
+		}
+	}
+
+	if status == http.StatusNotModified || status == http.StatusNoContent {
+		body = nil
+	}
+
+	if len(body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Returns the media type with a Content-Format which an HTTP Accept header prefers. Media types
+// are preferred by their q-value and then in order, and those with a q-value of 0 aren't accepted
+func httpAcceptMediaType(accept string) (MediaType, bool) {
+	var preferred MediaType
+	preferredQ := 0.0
+
+	for _, a := range strings.Split(accept, ",") {
+		mt, ok := ContentTypeToMediaType(strings.TrimSpace(a))
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if _, params, err := mime.ParseMediaType(a); err == nil && params["q"] != "" {
+			if q, err = strconv.ParseFloat(params["q"], 64); err != nil {
+				continue
+			}
+		}
+
+		if q > preferredQ {
+			preferred, preferredQ = mt, q
+		}
+	}
+	return preferred, preferredQ > 0
+}
+
+// Returns the CoAP method code of an HTTP method, or CoapCodeEmpty if the method has no equivalent
+func httpMethodToCoapCode(method string) CoapCode {
+	switch method {
+	case http.MethodGet:
+		return Get
+
+	case http.MethodPost:
+		return Post
+
+	case http.MethodPut:
+		return Put
+
+	case http.MethodDelete:
+		return Delete
+	}
+	return CoapCodeEmpty
+}
+
+// Resolves the UDP address of the host targeted by a CoAP URI
+func resolveCoapURIAddr(u *url.URL) (*net.UDPAddr, error) {
+	port := u.Port()
+	if port == "" {
+		port = strconv.Itoa(CoapDefaultPort)
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), port))
+}
+
+// Sets the Uri-Host, Uri-Path and Uri-Query options of a request targeting a CoAP URI. Path
+// segments and query arguments are split before being percent-decoded, so that encoded
+// delimiters such as %2F and %26 stay within their option
+func setCoapURIOptions(msg *Message, u *url.URL) error {
+	segments, err := splitURIPath(u.EscapedPath())
+	if err != nil {
+		return ErrInvalidRequestURI
+	}
+
+	queries, err := splitURIQuery(u.RawQuery)
+	if err != nil {
+		return ErrInvalidRequestURI
+	}
+
+	if host := u.Hostname(); host != "" && net.ParseIP(host) == nil {
+		msg.AddOption(OptionURIHost, host)
+	}
+
+	for _, segment := range segments {
+		msg.AddOption(OptionURIPath, segment)
+	}
+
+	for _, q := range queries {
+		msg.AddOption(OptionURIQuery, q)
+	}
+	return nil
+}
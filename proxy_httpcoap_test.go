@@ -0,0 +1,97 @@
+package coap
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPAcceptMediaType(t *testing.T) {
+	tests := []struct {
+		accept string
+		mt     MediaType
+		ok     bool
+	}{
+		{"", 0, false},
+		{"*/*", 0, false},
+		{"application/json", MediaTypeApplicationJSON, true},
+		{"text/css, application/json", MediaTypeApplicationJSON, true},
+		{"text/plain, application/json", MediaTypeTextPlain, true},
+
+		// Media types are preferred by their q-value
+		{"text/plain;q=0.5, application/json", MediaTypeApplicationJSON, true},
+		{"text/plain; q=0.9, application/json;q=0.8", MediaTypeTextPlain, true},
+		{"application/json;q=0.5, application/cbor;q=0.5", MediaTypeApplicationJSON, true},
+		{"application/json;q=0, text/plain;q=0.1", MediaTypeTextPlain, true},
+		{"application/json;q=0", 0, false},
+		{"application/json;q=x, text/plain;q=0.1", MediaTypeTextPlain, true},
+	}
+
+	for _, test := range tests {
+		if mt, ok := httpAcceptMediaType(test.accept); mt != test.mt || ok != test.ok {
+			t.Errorf("httpAcceptMediaType(%q) = %d, %v, want %d, %v", test.accept, mt, ok, test.mt, test.ok)
+		}
+	}
+}
+
+func TestHTTPCoapProxyBlock2Transfer(t *testing.T) {
+	var mu sync.Mutex
+	tokens := make(map[string]bool)
+	requests := 0
+	var accept []MediaType
+	body := strings.Repeat("0123456789", 10)
+
+	origin, originAddr := newTestServer(t)
+	origin.SetBlockSize(16)
+	origin.Get("/a", func(req CoapRequest) CoapResponse {
+		msg := req.GetMessage()
+
+		mu.Lock()
+		tokens[string(msg.Token)] = true
+		requests++
+		if mt, ok := msg.GetAccept(); ok {
+			accept = append(accept, mt)
+		}
+		mu.Unlock()
+
+		resp := ContentMessage(msg.MessageID, MessageAcknowledgment)
+		resp.AddOption(OptionContentFormat, MediaTypeTextPlain)
+		resp.SetStringPayload(body)
+
+		return NewResponseWithMessage(resp)
+	})
+
+	client, _ := newTestServer(t)
+
+	startTestServer(t, origin)
+	startTestServer(t, client)
+
+	proxy := NewHTTPCoapProxy(client)
+	proxy.Timeout = 2 * time.Second
+
+	r := httptest.NewRequest(http.MethodGet, "/hc/coap://"+originAddr+"/a", nil)
+	r.Header.Set("Accept", "application/json;q=0.5, text/plain")
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte(body)) {
+		t.Fatalf("response = %d %q", w.Code, w.Body.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Each block is requested with a fresh token
+	if requests != 7 || len(tokens) != requests {
+		t.Errorf("%d tokens for %d requests", len(tokens), requests)
+	}
+
+	if len(accept) == 0 || accept[0] != MediaTypeTextPlain {
+		t.Errorf("Accept = %v", accept)
+	}
+}
@@ -0,0 +1,281 @@
+package coap
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Internet media types of the CoAP Content-Formats
+var mediaTypeContentTypes = map[MediaType]string{
+	MediaTypeTextPlain:                  "text/plain; charset=utf-8",
+	MediaTypeTextXML:                    "text/xml",
+	MediaTypeTextCsv:                    "text/csv",
+	MediaTypeTextHTML:                   "text/html",
+	MediaTypeImageGif:                   "image/gif",
+	MediaTypeImageJpeg:                  "image/jpeg",
+	MediaTypeImagePng:                   "image/png",
+	MediaTypeImageTiff:                  "image/tiff",
+	MediaTypeAudioRaw:                   "audio/raw",
+	MediaTypeVideoRaw:                   "video/raw",
+	MediaTypeApplicationLinkFormat:      "application/link-format",
+	MediaTypeApplicationXML:             "application/xml",
+	MediaTypeApplicationOctetStream:     "application/octet-stream",
+	MediaTypeApplicationRdfXML:          "application/rdf+xml",
+	MediaTypeApplicationSoapXML:         "application/soap+xml",
+	MediaTypeApplicationAtomXML:         "application/atom+xml",
+	MediaTypeApplicationXmppXML:         "application/xmpp+xml",
+	MediaTypeApplicationExi:             "application/exi",
+	MediaTypeApplicationFastInfoSet:     "application/fastinfoset",
+	MediaTypeApplicationSoapFastInfoSet: "application/soap+fastinfoset",
+	MediaTypeApplicationJSON:            "application/json",
+	MediaTypeApplicationXObitBinary:     "application/x-obix-binary",
+	MediaTypeApplicationCBOR:            "application/cbor",
+	MediaTypeApplicationCBORSeq:         "application/cbor-seq",
+	MediaTypeApplicationSenMLJSON:       "application/senml+json",
+	MediaTypeApplicationSenMLCBOR:       "application/senml+cbor",
+	MediaTypeTextPlainVndOmaLwm2m:       "application/vnd.oma.lwm2m+text",
+	MediaTypeTlvVndOmaLwm2m:             "application/vnd.oma.lwm2m+tlv",
+	MediaTypeJSONVndOmaLwm2m:            "application/vnd.oma.lwm2m+json",
+	MediaTypeOpaqueVndOmaLwm2m:          "application/vnd.oma.lwm2m+opaque",
+}
+
+// MediaTypeToContentType returns the HTTP Content-Type of a CoAP Content-Format,
+// or an empty string if the Content-Format has no known equivalent
+func MediaTypeToContentType(mt MediaType) string {
+	return mediaTypeContentTypes[mt]
+}
+
+// ContentTypeToMediaType returns the CoAP Content-Format of an HTTP Content-Type
+// (e.g. "application/json; charset=utf-8")
+func ContentTypeToMediaType(ct string) (MediaType, bool) {
+	base, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return 0, false
+	}
+
+	// text/plain is only defined for UTF-8 (or US-ASCII) content
+	if base == "text/plain" {
+		charset := strings.ToLower(params["charset"])
+		if charset != "" && charset != "utf-8" && charset != "us-ascii" {
+			return 0, false
+		}
+		return MediaTypeTextPlain, true
+	}
+
+	for mt, t := range mediaTypeContentTypes {
+		if t == base {
+			return mt, true
+		}
+	}
+	return 0, false
+}
+
+// CoapCodeToHTTPStatus maps a CoAP response code to an HTTP status code (RFC 8075 Section 7)
+func CoapCodeToHTTPStatus(code CoapCode) int {
+	switch code {
+	case CoapCodeCreated:
+		return http.StatusCreated
+
+	case CoapCodeDeleted, CoapCodeContent:
+		return http.StatusOK
+
+	case CoapCodeChanged:
+		return http.StatusNoContent
+
+	case CoapCodeValid:
+		return http.StatusNotModified
+
+	case CoapCodeBadRequest, CoapCodeBadOption, CoapCodeRequestEntityIncomplete:
+		return http.StatusBadRequest
+
+	case CoapCodeUnauthorized, CoapCodeForbidden:
+		return http.StatusForbidden
+
+	case CoapCodeNotFound:
+		return http.StatusNotFound
+
+	case CoapCodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+
+	case CoapCodeNotAcceptable:
+		return http.StatusNotAcceptable
+
+	case CoapCodeConflict:
+		return http.StatusConflict
+
+	case CoapCodePreconditionFailed:
+		return http.StatusPreconditionFailed
+
+	case CoapCodeRequestEntityTooLarge:
+		return http.StatusRequestEntityTooLarge
+
+	case CoapCodeUnsupportedContentFormat:
+		return http.StatusUnsupportedMediaType
+
+	case CoapCodeTooManyRequests:
+		return http.StatusTooManyRequests
+
+	case CoapCodeInternalServerError:
+		return http.StatusInternalServerError
+
+	case CoapCodeNotImplemented:
+		return http.StatusNotImplemented
+
+	case CoapCodeBadGateway, CoapCodeProxyingNotSupported:
+		return http.StatusBadGateway
+
+	case CoapCodeServiceUnavailable:
+		return http.StatusServiceUnavailable
+
+	case CoapCodeGatewayTimeout:
+		return http.StatusGatewayTimeout
+
+	case CoapCodeHopLimitReached:
+		return http.StatusLoopDetected
+	}
+
+	switch code >> 5 {
+	case 2:
+		return http.StatusOK
+
+	case 4:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// Formats a CoAP ETag as an HTTP entity-tag
+func formatHTTPETag(etag []byte) string {
+	return "\"" + hex.EncodeToString(etag) + "\""
+}
+
+// Parses an HTTP entity-tag list (e.g. If-Match: "a1b2", W/"c3") into CoAP ETags. Tags
+// that were not hex encoded by the proxy are used as is
+func parseHTTPETags(header string) [][]byte {
+	var etags [][]byte
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		tag = strings.TrimPrefix(tag, "W/")
+		tag = strings.Trim(tag, "\"")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		if b, err := hex.DecodeString(tag); err == nil {
+			etags = append(etags, b)
+		} else {
+			etags = append(etags, []byte(tag))
+		}
+	}
+	return etags
+}
+
+// HTTPStatusToCoapCode maps an HTTP status code to a CoAP response code for a request
+// with the given method (RFC 8075 Section 7, applied in reverse)
+func HTTPStatusToCoapCode(status int, method CoapCode) CoapCode {
+	switch status {
+	case http.StatusOK:
+		switch method {
+		case Get:
+			return CoapCodeContent
+
+		case Delete:
+			return CoapCodeDeleted
+		}
+		return CoapCodeChanged
+
+	case http.StatusCreated:
+		return CoapCodeCreated
+
+	case http.StatusNoContent:
+		if method == Delete {
+			return CoapCodeDeleted
+		}
+		return CoapCodeChanged
+
+	case http.StatusNotModified:
+		return CoapCodeValid
+
+	case http.StatusBadRequest:
+		return CoapCodeBadRequest
+
+	case http.StatusUnauthorized:
+		return CoapCodeUnauthorized
+
+	case http.StatusForbidden:
+		return CoapCodeForbidden
+
+	case http.StatusNotFound, http.StatusGone:
+		return CoapCodeNotFound
+
+	case http.StatusMethodNotAllowed:
+		return CoapCodeMethodNotAllowed
+
+	case http.StatusNotAcceptable:
+		return CoapCodeNotAcceptable
+
+	case http.StatusConflict:
+		return CoapCodeConflict
+
+	case http.StatusPreconditionFailed:
+		return CoapCodePreconditionFailed
+
+	case http.StatusRequestEntityTooLarge:
+		return CoapCodeRequestEntityTooLarge
+
+	case http.StatusUnsupportedMediaType:
+		return CoapCodeUnsupportedContentFormat
+
+	case http.StatusTooManyRequests:
+		return CoapCodeTooManyRequests
+
+	case http.StatusNotImplemented:
+		return CoapCodeNotImplemented
+
+	case http.StatusBadGateway:
+		return CoapCodeBadGateway
+
+	case http.StatusServiceUnavailable:
+		return CoapCodeServiceUnavailable
+
+	case http.StatusGatewayTimeout:
+		return CoapCodeGatewayTimeout
+
+	case http.StatusLoopDetected:
+		return CoapCodeHopLimitReached
+	}
+
+	switch {
+	case status >= 200 && status < 300:
+		return HTTPStatusToCoapCode(http.StatusOK, method)
+
+	case status >= 400 && status < 500:
+		return CoapCodeBadRequest
+
+	case status >= 500:
+		return CoapCodeInternalServerError
+	}
+
+	// Redirects and informational responses aren't followed through by the proxy
+	return CoapCodeBadGateway
+}
+
+// Converts an HTTP entity-tag to a CoAP ETag. Tags issued by the HTTP-CoAP proxy are hex
+// decoded, any others longer than the 8 bytes allowed by CoAP are hashed
+func httpETagToCoap(tag string) []byte {
+	etags := parseHTTPETags(tag)
+	if len(etags) == 0 {
+		return nil
+	}
+
+	etag := etags[0]
+	if len(etag) > 8 {
+		h := fnv.New64a()
+		h.Write(etag)
+		etag = h.Sum(nil)
+	}
+	return etag
+}
@@ -0,0 +1,359 @@
+package coap
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReverseProxyTimeout defines the number of seconds to wait for a response from an upstream
+const ReverseProxyTimeout = 10
+
+// HealthCheckInterval defines the number of seconds between health checks of upstreams
+const HealthCheckInterval = 10
+
+// HealthCheckTimeout defines the number of seconds to wait for the reply to a CoAP ping
+const HealthCheckTimeout = 2
+
+// BalanceStrategy determines how an UpstreamPool selects the upstream for a request
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin selects healthy upstreams in turn
+	BalanceRoundRobin BalanceStrategy = 0
+
+	// BalanceLeastPending selects the healthy upstream with the fewest requests in flight
+	BalanceLeastPending BalanceStrategy = 1
+)
+
+// Instantiates a new upstream for a CoAP backend address (e.g. 10.0.0.1:5683)
+func NewUpstream(address string) (*Upstream, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		Addr:    addr,
+		healthy: true,
+	}, nil
+}
+
+// Upstream represents a backend of a reverse proxy
+type Upstream struct {
+	Addr *net.UDPAddr
+
+	pending int
+	healthy bool
+}
+
+// Instantiates a new pool of upstreams selected using the given strategy
+func NewUpstreamPool(strategy BalanceStrategy, addresses ...string) (*UpstreamPool, error) {
+	pool := &UpstreamPool{
+		Strategy:            strategy,
+		HealthCheckInterval: HealthCheckInterval * time.Second,
+		HealthCheckTimeout:  HealthCheckTimeout * time.Second,
+	}
+
+	for _, address := range addresses {
+		upstream, err := NewUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		pool.upstreams = append(pool.upstreams, upstream)
+	}
+	return pool, nil
+}
+
+// UpstreamPool balances requests over a set of upstreams. Upstreams failing a health check
+// (a CoAP ping, i.e. an empty Confirmable message answered with a Reset) or a request are
+// skipped until they pass a health check again
+type UpstreamPool struct {
+	sync.Mutex
+
+	Strategy            BalanceStrategy
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	upstreams []*Upstream
+	next      int
+	stop      chan bool
+}
+
+// Adds an upstream to the pool
+func (p *UpstreamPool) Add(upstream *Upstream) {
+	p.Lock()
+	p.upstreams = append(p.upstreams, upstream)
+	p.Unlock()
+}
+
+// Removes the upstream with the given address from the pool
+func (p *UpstreamPool) Remove(addr *net.UDPAddr) {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, upstream := range p.upstreams {
+		if upstream.Addr.String() == addr.String() {
+			p.upstreams = append(p.upstreams[:i], p.upstreams[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the upstreams of the pool
+func (p *UpstreamPool) GetUpstreams() []*Upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	upstreams := make([]*Upstream, len(p.upstreams))
+	copy(upstreams, p.upstreams)
+
+	return upstreams
+}
+
+// Checks if an upstream passed its last health check
+func (p *UpstreamPool) IsHealthy(upstream *Upstream) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return upstream.healthy
+}
+
+// Returns the number of requests in flight to an upstream
+func (p *UpstreamPool) GetPending(upstream *Upstream) int {
+	p.Lock()
+	defer p.Unlock()
+
+	return upstream.pending
+}
+
+// Acquire selects a healthy upstream for a request, or returns nil if none is available.
+// The upstream must be handed back using Release once the request completes
+func (p *UpstreamPool) Acquire() *Upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	var selected *Upstream
+	n := len(p.upstreams)
+
+	switch p.Strategy {
+	case BalanceLeastPending:
+		for i := 0; i < n; i++ {
+			// Ties are broken in round robin order
+			upstream := p.upstreams[(p.next+i)%n]
+			if upstream.healthy && (selected == nil || upstream.pending < selected.pending) {
+				selected = upstream
+			}
+		}
+
+	default:
+		for i := 0; i < n; i++ {
+			upstream := p.upstreams[(p.next+i)%n]
+			if upstream.healthy {
+				selected = upstream
+				break
+			}
+		}
+	}
+
+	if selected == nil {
+		return nil
+	}
+
+	for i, upstream := range p.upstreams {
+		if upstream == selected {
+			p.next = i + 1
+		}
+	}
+	selected.pending++
+
+	return selected
+}
+
+// Release hands back an upstream acquired for a request. Upstreams which failed to respond
+// are marked unhealthy until they pass a health check
+func (p *UpstreamPool) Release(upstream *Upstream, ok bool) {
+	p.Lock()
+	upstream.pending--
+	if !ok {
+		upstream.healthy = false
+	}
+	p.Unlock()
+}
+
+// Ping sends a CoAP ping to an upstream through a started server and reports whether it replied
+func (p *UpstreamPool) Ping(s CoapServer, upstream *Upstream) bool {
+	ping := NewMessageOfType(MessageConfirmable, GenerateMessageID())
+
+	_, err := SendAndWaitForResponse(s, NewRequestFromMessage(ping), upstream.Addr, p.HealthCheckTimeout)
+
+	return err == nil
+}
+
+// Checks the health of all upstreams once
+func (p *UpstreamPool) CheckHealth(s CoapServer) {
+	var wg sync.WaitGroup
+	for _, upstream := range p.GetUpstreams() {
+		wg.Add(1)
+		go func(upstream *Upstream) {
+			defer wg.Done()
+
+			healthy := p.Ping(s, upstream)
+
+			p.Lock()
+			upstream.healthy = healthy
+			p.Unlock()
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+// Starts checking the health of all upstreams every HealthCheckInterval
+func (p *UpstreamPool) StartHealthCheck(s CoapServer) {
+	p.Lock()
+	if p.stop != nil || p.HealthCheckInterval <= 0 {
+		p.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	p.stop = stop
+	p.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(p.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.CheckHealth(s)
+
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops checking the health of upstreams
+func (p *UpstreamPool) StopHealthCheck() {
+	p.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.Unlock()
+}
+
+// Instantiates a new reverse proxy forwarding requests below a path prefix (e.g. /site-a) to a
+// pool of upstreams. Requests are sent upstream through the given server
+func NewReverseProxy(s CoapServer, prefix string, pool *UpstreamPool) *ReverseProxy {
+	return &ReverseProxy{
+		Prefix:  "/" + strings.Trim(prefix, "/"),
+		Pool:    pool,
+		Timeout: ReverseProxyTimeout * time.Second,
+		server:  s,
+	}
+}
+
+// ReverseProxy forwards requests for the resources below Prefix to an UpstreamPool. The Prefix
+// is replaced by UpstreamPrefix in the path of upstream requests, e.g. with a Prefix of /site-a
+// and an empty UpstreamPrefix, /site-a/sensors/temp is requested upstream as /sensors/temp
+type ReverseProxy struct {
+	Prefix         string
+	UpstreamPrefix string
+	Pool           *UpstreamPool
+	Timeout        time.Duration
+
+	server CoapServer
+}
+
+// Returns the route paths handled by the proxy
+func (p *ReverseProxy) GetRoutePaths() []string {
+	if p.Prefix == "/" {
+		return []string{"/", "/:path*"}
+	}
+	return []string{p.Prefix, p.Prefix + "/:path*"}
+}
+
+// Handle is a RouteHandler forwarding a request to an upstream and returning its response
+func (p *ReverseProxy) Handle(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	resp := p.Forward(msg)
+	if msg.MessageType == MessageConfirmable {
+		resp.MessageType = MessageAcknowledgment
+		resp.MessageID = msg.MessageID
+	} else {
+		resp.MessageType = MessageNonConfirmable
+		resp.MessageID = GenerateMessageID()
+	}
+	return NewResponseWithMessage(resp)
+}
+
+// Forward sends a request to an upstream and returns the upstream's response
+func (p *ReverseProxy) Forward(msg *Message) *Message {
+	if HasUnsafeUnrecognizedOption(msg) {
+		return BadGatewayMessage(msg.MessageID, MessageAcknowledgment)
+	}
+
+	fwdMsg := msg.Clone()
+	if !DecrementHopLimit(fwdMsg) {
+		return HopLimitReachedResponse(msg)
+	}
+
+	upstream := p.Pool.Acquire()
+	if upstream == nil {
+		return ServiceUnavailableMessage(msg.MessageID, MessageAcknowledgment)
+	}
+
+	path := p.rewritePath(fwdMsg.GetOptions(OptionURIPath))
+
+	fwdMsg.MessageType = MessageConfirmable
+	fwdMsg.MessageID = GenerateMessageID()
+	fwdMsg.Token = []byte(GenerateToken(8))
+	fwdMsg.RemoveOptions(OptionURIHost)
+	fwdMsg.RemoveOptions(OptionURIPort)
+	fwdMsg.RemoveOptions(OptionURIPath)
+	fwdMsg.RemoveOptions(OptionObserve)
+	fwdMsg.AddOptions(path)
+
+	resp, err := SendAndWaitForResponse(p.server, NewRequestFromMessage(fwdMsg), upstream.Addr, p.Timeout)
+	p.Pool.Release(upstream, err == nil && resp.MessageType != MessageReset)
+
+	if err == ErrResponseTimeout {
+		return GatewayTimeoutMessage(msg.MessageID, MessageAcknowledgment)
+	}
+
+	if err != nil || resp.MessageType == MessageReset {
+		return BadGatewayMessage(msg.MessageID, MessageAcknowledgment)
+	}
+	return resp
+}
+
+// Replaces the segments of the proxy's Prefix with those of the UpstreamPrefix in the Uri-Path
+// options of a request. The remaining segments are kept as they are, so that segments containing
+// a "/" or which are empty reach the upstream unchanged
+func (p *ReverseProxy) rewritePath(path []*Option) []*Option {
+	prefix := NewPathOptions(p.Prefix)
+	if len(path) >= len(prefix) {
+		matches := true
+		for i, opt := range prefix {
+			if path[i].StringValue() != opt.StringValue() {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			path = path[len(prefix):]
+		}
+	}
+	return append(NewPathOptions(p.UpstreamPrefix), path...)
+}
+
+// Stops checking the health of the proxy's upstreams
+func (p *ReverseProxy) Stop() {
+	p.Pool.StopHealthCheck()
+}
@@ -0,0 +1,195 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReverseProxyRewritePath(t *testing.T) {
+	tests := []struct {
+		prefix, upstreamPrefix string
+		path                   []string
+		want                   []string
+	}{
+		{"/site-a", "", []string{"site-a", "sensors", "temp"}, []string{"Uri-Path=sensors", "Uri-Path=temp"}},
+		{"/site-a", "/api/v1/", []string{"site-a", "temp"}, []string{"Uri-Path=api", "Uri-Path=v1", "Uri-Path=temp"}},
+		{"/site-a/b", "/x", []string{"site-a", "b"}, []string{"Uri-Path=x"}},
+		{"/", "/api", []string{"temp"}, []string{"Uri-Path=api", "Uri-Path=temp"}},
+
+		// Segments containing a "/" or a percent sign, and empty segments, are kept as they are
+		{"/site-a", "", []string{"site-a", "a/b", "c%2Fd", "", "e"}, []string{"Uri-Path=a/b", "Uri-Path=c%2Fd", "Uri-Path=", "Uri-Path=e"}},
+
+		// A segment merely starting with the prefix isn't stripped
+		{"/site-a", "/api", []string{"site-ab", "temp"}, []string{"Uri-Path=api", "Uri-Path=site-ab", "Uri-Path=temp"}},
+		{"/site-a", "/api", []string{"site-a/temp"}, []string{"Uri-Path=api", "Uri-Path=site-a/temp"}},
+	}
+
+	for _, test := range tests {
+		p := NewReverseProxy(nil, test.prefix, nil)
+		p.UpstreamPrefix = test.upstreamPrefix
+
+		var path []*Option
+		for _, segment := range test.path {
+			path = append(path, NewOption(OptionURIPath, segment))
+		}
+
+		if got := uriTestOptions(p.rewritePath(path)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("rewritePath(%q) with prefix %s and upstream prefix %s = %q, want %q", test.path, test.prefix, test.upstreamPrefix, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamPoolAcquire(t *testing.T) {
+	pool, err := NewUpstreamPool(BalanceRoundRobin, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams := pool.GetUpstreams()
+
+	// Healthy upstreams are selected in turn
+	for i := 0; i < 6; i++ {
+		upstream := pool.Acquire()
+		if upstream != upstreams[i%3] {
+			t.Errorf("round robin selection %d = %s", i, upstream.Addr)
+		}
+		pool.Release(upstream, true)
+	}
+
+	// Upstreams failing a request are skipped
+	pool.Release(pool.Acquire(), false)
+	if pool.IsHealthy(upstreams[0]) {
+		t.Error("the upstream failing a request is still healthy")
+	}
+
+	for i := 0; i < 4; i++ {
+		upstream := pool.Acquire()
+		if upstream == upstreams[0] {
+			t.Error("an unhealthy upstream was selected")
+		}
+		pool.Release(upstream, true)
+	}
+
+	// The upstream with the fewest requests in flight is selected
+	pool.Strategy = BalanceLeastPending
+	for _, upstream := range upstreams {
+		pool.Lock()
+		upstream.healthy = true
+		pool.Unlock()
+	}
+
+	busy := pool.Acquire()
+	for i := 0; i < 4; i++ {
+		upstream := pool.Acquire()
+		if upstream == busy {
+			t.Errorf("selected %s with %d requests in flight", upstream.Addr, pool.GetPending(upstream))
+		}
+		pool.Release(upstream, true)
+	}
+
+	// Without healthy upstreams, none is selected
+	pool.Release(busy, false)
+	for _, upstream := range upstreams {
+		pool.Lock()
+		upstream.healthy = false
+		pool.Unlock()
+	}
+
+	if upstream := pool.Acquire(); upstream != nil {
+		t.Errorf("selected unhealthy upstream %s", upstream.Addr)
+	}
+
+	pool.Remove(upstreams[1].Addr)
+	if n := len(pool.GetUpstreams()); n != 2 {
+		t.Errorf("%d upstreams after a removal", n)
+	}
+}
+
+func TestReverseProxyFailover(t *testing.T) {
+	paths := make(chan []string, 1)
+
+	backend, backendAddr := newTestServer(t)
+	backend.Get("/api/:path*", func(req CoapRequest) CoapResponse {
+		var path []string
+		for _, opt := range req.GetMessage().GetOptions(OptionURIPath) {
+			path = append(path, opt.StringValue())
+		}
+		paths <- path
+
+		return NewResponseWithMessage(ContentMessage(req.GetMessage().MessageID, MessageAcknowledgment))
+	})
+
+	// An upstream which doesn't respond
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("loopback unavailable:", err)
+	}
+	defer conn.Close()
+	deadAddr := "127.0.0.1:" + strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	pool, err := NewUpstreamPool(BalanceRoundRobin, deadAddr, backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.HealthCheckTimeout = 500 * time.Millisecond
+	dead, live := pool.GetUpstreams()[0], pool.GetUpstreams()[1]
+
+	server, _ := newTestServer(t)
+	proxy := NewReverseProxy(server, "/site-a", pool)
+	proxy.UpstreamPrefix = "/api"
+	proxy.Timeout = 500 * time.Millisecond
+
+	startTestServer(t, backend)
+	startTestServer(t, server)
+
+	forward := func() *Message {
+		msg := NewMessage(MessageConfirmable, Get, GenerateMessageID())
+		for _, segment := range []string{"site-a", "a/b", "c"} {
+			msg.AddOption(OptionURIPath, segment)
+		}
+		return proxy.Forward(msg)
+	}
+
+	// The request sent to the upstream which doesn't respond times out, and the next one fails
+	// over to the healthy upstream
+	if resp := forward(); resp.Code != CoapCodeGatewayTimeout {
+		t.Errorf("response of the unresponsive upstream = %s, want 5.04", CoapCodeToString(resp.Code))
+	}
+
+	if pool.IsHealthy(dead) {
+		t.Error("the unresponsive upstream is still healthy")
+	}
+
+	if resp := forward(); resp.Code != CoapCodeContent {
+		t.Fatalf("response = %s, want 2.05", CoapCodeToString(resp.Code))
+	}
+
+	if path := <-paths; !reflect.DeepEqual(path, []string{"api", "a/b", "c"}) {
+		t.Errorf("upstream path = %q", path)
+	}
+
+	// Health checks mark upstreams answering pings healthy again
+	pool.Lock()
+	live.healthy = false
+	pool.Unlock()
+
+	pool.CheckHealth(server)
+	if !pool.IsHealthy(live) || pool.IsHealthy(dead) {
+		t.Errorf("health after a check: live %v, unresponsive %v", pool.IsHealthy(live), pool.IsHealthy(dead))
+	}
+
+	if resp := forward(); resp.Code != CoapCodeContent {
+		t.Errorf("response after the health check = %s, want 2.05", CoapCodeToString(resp.Code))
+	}
+	<-paths
+
+	pool.Lock()
+	dead.healthy, live.healthy = false, false
+	pool.Unlock()
+
+	if resp := forward(); resp.Code != CoapCodeServiceUnavailable {
+		t.Errorf("response without healthy upstreams = %s, want 5.03", CoapCodeToString(resp.Code))
+	}
+}
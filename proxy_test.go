@@ -0,0 +1,109 @@
+package coap
+
+import "testing"
+
+func TestDecrementHopLimit(t *testing.T) {
+	tests := []struct {
+		value     interface{}
+		forwarded bool
+		want      uint32
+	}{
+		// The default Hop-Limit is inserted into requests without one
+		{nil, true, DefaultHopLimit - 1},
+
+		{10, true, 9},
+		{2, true, 1},
+		{255, true, 254},
+
+		// Requests must not be forwarded once the Hop-Limit reaches zero
+		{1, false, 1},
+		{0, false, 0},
+
+		// Hop-Limits of an invalid length are ignored
+		{300, true, DefaultHopLimit - 1},
+		{[]byte{1, 1}, true, DefaultHopLimit - 1},
+		{"x", true, DefaultHopLimit - 1},
+	}
+
+	for _, test := range tests {
+		msg := NewMessage(MessageConfirmable, Get, 1)
+		if test.value != nil {
+			msg.AddOption(OptionHopLimit, test.value)
+		}
+
+		if forwarded := DecrementHopLimit(msg); forwarded != test.forwarded {
+			t.Errorf("DecrementHopLimit with Hop-Limit %v = %v, want %v", test.value, forwarded, test.forwarded)
+		}
+
+		opts := msg.GetOptions(OptionHopLimit)
+		if !test.forwarded {
+			continue
+		}
+
+		if len(opts) != 1 {
+			t.Errorf("%d Hop-Limit options after decrementing %v", len(opts), test.value)
+		} else if v, err := opts[0].GetUint(); err != nil || v != test.want {
+			t.Errorf("Hop-Limit after decrementing %v = %d (%v), want %d", test.value, v, err, test.want)
+		}
+
+		if _, err := MessageToBytes(msg); err != nil {
+			t.Errorf("request with Hop-Limit %v can't be forwarded: %v", test.value, err)
+		}
+	}
+}
+
+func TestHopLimitReachedResponse(t *testing.T) {
+	identity := ProxyIdentity
+	defer func() { ProxyIdentity = identity }()
+
+	msg := NewMessage(MessageConfirmable, Get, 7)
+	msg.Token = []byte("hl")
+	msg.AddOption(OptionHopLimit, 1)
+
+	ProxyIdentity = "proxy.example.com"
+	resp := HopLimitReachedResponse(msg)
+
+	if resp.Code != CoapCodeHopLimitReached || resp.MessageType != MessageAcknowledgment || resp.MessageID != 7 || string(resp.Token) != "hl" {
+		t.Errorf("response = %s %d %d %q", CoapCodeToString(resp.Code), resp.MessageType, resp.MessageID, resp.Token)
+	}
+
+	if resp.Payload == nil || resp.Payload.String() != "proxy.example.com" {
+		t.Errorf("diagnostic payload = %v", resp.Payload)
+	}
+
+	// Proxies answer requests whose Hop-Limit would reach zero without forwarding them
+	for _, hopLimit := range []int{0, 1} {
+		msg.RemoveOptions(OptionHopLimit)
+		msg.AddOption(OptionHopLimit, hopLimit)
+
+		resp := NewReverseProxy(nil, "/", nil).Forward(msg)
+		if resp.Code != CoapCodeHopLimitReached || resp.Payload == nil || resp.Payload.String() != "proxy.example.com" {
+			t.Errorf("response of the reverse proxy to Hop-Limit %d = %s %v", hopLimit, CoapCodeToString(resp.Code), resp.Payload)
+		}
+	}
+
+	// Without an identity, the response has no payload
+	ProxyIdentity = ""
+	if resp := HopLimitReachedResponse(msg); resp.Payload != nil && resp.Payload.Length() > 0 {
+		t.Errorf("diagnostic payload without an identity = %q", resp.Payload.String())
+	}
+}
+
+// Hop-Limits of an invalid length are ignored on reception
+func TestUnmarshalInvalidHopLimit(t *testing.T) {
+	// Hop-Limit with an empty value and with a 2-byte value
+	for _, data := range [][]byte{{0x40, 0x01, 0x00, 0x01, 0xd0, 0x03}, {0x40, 0x01, 0x00, 0x01, 0xd2, 0x03, 0x01, 0x01}} {
+		msg, err := BytesToMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opt := msg.GetOption(OptionHopLimit); opt != nil {
+			t.Errorf("Hop-Limit %v of an invalid length was kept", opt.Value)
+		}
+
+		if !DecrementHopLimit(msg) || msg.GetOption(OptionHopLimit).IntValue() != DefaultHopLimit-1 {
+			t.Errorf("Hop-Limit = %v, want %d", msg.GetOption(OptionHopLimit).Value, DefaultHopLimit-1)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package coap
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resource Directory (RFC 9176) registration and lookup parameters
+const (
+	RDParamEndpoint     = "ep"
+	RDParamSector       = "d"
+	RDParamLifetime     = "lt"
+	RDParamBase         = "base"
+	RDParamEndpointType = "et"
+	RDParamPage         = "page"
+	RDParamCount        = "count"
+)
+
+// Resource types of the Resource Directory's interfaces
+const (
+	RDResourceTypeDirectory      = "core.rd"
+	RDResourceTypeLookupEndpoint = "core.rd-lookup-ep"
+	RDResourceTypeLookupResource = "core.rd-lookup-res"
+	RDResourceTypeEndpoint       = "core.rd-ep"
+)
+
+// RDDefaultLifetime is the registration lifetime in seconds used when 'lt' is not given
+const RDDefaultLifetime = 90000
+
+// RDPurgeInterval defines the number of seconds between purges of expired registrations
+const RDPurgeInterval = 10
+
+type FnRDRegistration func(*RDRegistration)
+
+// Instantiates a new Resource Directory. The directory is served by a CoAP server once attached
+func NewResourceDirectory() *ResourceDirectory {
+	return &ResourceDirectory{
+		registrations: make(map[string]*RDRegistration),
+		stopChannel:   make(chan int),
+	}
+}
+
+// RDRegistration represents a registered endpoint and the resources it advertised
+type RDRegistration struct {
+	ID           string
+	Endpoint     string
+	Sector       string
+	EndpointType string
+	Base         string
+	Lifetime     int
+	Expires      time.Time
+	Addr         *net.UDPAddr
+	Attributes   map[string]string
+	Resources    []*CoreResource
+}
+
+// GetLocation returns the path of the registration resource (e.g. /rd/4521)
+func (r *RDRegistration) GetLocation() string {
+	return "/rd/" + r.ID
+}
+
+// IsExpired checks if the registration's lifetime has elapsed
+func (r *RDRegistration) IsExpired() bool {
+	return time.Now().After(r.Expires)
+}
+
+// Returns the registration as a link for endpoint lookups
+func (r *RDRegistration) GetCoreResource() *CoreResource {
+	resource := NewCoreResource()
+	resource.Target = r.GetLocation()
+	resource.AddAttribute(RDParamEndpoint, r.Endpoint)
+
+	if r.Sector != "" {
+		resource.AddAttribute(RDParamSector, r.Sector)
+	}
+
+	if r.EndpointType != "" {
+		resource.AddAttribute(RDParamEndpointType, r.EndpointType)
+	}
+	resource.AddAttribute(RDParamBase, r.Base)
+	resource.AddAttribute(RDParamLifetime, r.Lifetime)
+	resource.AddAttribute(CoreAttributeResourceType, RDResourceTypeEndpoint)
+
+	keys := make([]string, 0, len(r.Attributes))
+	for k := range r.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if r.Attributes[k] == "" {
+			resource.AddAttribute(k, nil)
+		} else {
+			resource.AddAttribute(k, r.Attributes[k])
+		}
+	}
+	return resource
+}
+
+// Returns the registered resources with their targets and anchors resolved against the
+// registration's base
+func (r *RDRegistration) GetResolvedResources() []*CoreResource {
+	var resources []*CoreResource
+	for _, res := range r.Resources {
+		resolved := NewCoreResource()
+		resolved.Target = r.resolve(res.Target)
+
+		for _, attr := range res.Attributes {
+			if attr.Key == CoreAttributeAnchor {
+				attr = NewCoreAttribute(CoreAttributeAnchor, r.resolve(attr.StringValue()))
+			}
+			resolved.Attributes = append(resolved.Attributes, attr)
+		}
+		resources = append(resources, resolved)
+	}
+	return resources
+}
+
+// Resolves a relative reference against the registration's base
+func (r *RDRegistration) resolve(ref string) string {
+	if strings.Contains(ref, "://") {
+		return ref
+	}
+	return strings.TrimRight(r.Base, "/") + "/" + strings.TrimLeft(ref, "/")
+}
+
+// Returns a copy of the registration which can be read without holding the directory's lock.
+// Registered resources aren't modified once parsed, so the copy shares them
+func (r *RDRegistration) clone() *RDRegistration {
+	c := *r
+	c.Attributes = make(map[string]string, len(r.Attributes))
+	for k, v := range r.Attributes {
+		c.Attributes[k] = v
+	}
+	c.Resources = append([]*CoreResource(nil), r.Resources...)
+
+	return &c
+}
+
+// Checks if the registration matches an endpoint lookup query
+func (r *RDRegistration) matchesQuery(key, value string) bool {
+	switch key {
+	case RDParamPage, RDParamCount:
+		return true
+	}
+	return r.GetCoreResource().MatchesQuery(key, value)
+}
+
+// ResourceDirectory keeps track of endpoint registrations and serves the registration
+// and lookup interfaces of RFC 9176
+type ResourceDirectory struct {
+	sync.RWMutex
+
+	registrations map[string]*RDRegistration
+	lastID        int
+
+	fnRegister   []FnRDRegistration
+	fnUpdate     []FnRDRegistration
+	fnUnregister []FnRDRegistration
+
+	stopChannel chan int
+}
+
+// Attach registers the directory's registration and lookup routes with a CoAP server and
+// starts purging expired registrations
+func (rd *ResourceDirectory) Attach(s CoapServer) {
+	r := s.Post("/rd", rd.handleRegister)
+	r.ResourceTypes = []string{RDResourceTypeDirectory}
+
+	s.Get("/rd/:id", rd.handleRead)
+	s.Post("/rd/:id", rd.handleUpdate)
+	s.Delete("/rd/:id", rd.handleRemove)
+
+	r = s.Get("/rd-lookup/ep", rd.handleLookupEndpoints)
+	r.ResourceTypes = []string{RDResourceTypeLookupEndpoint}
+
+	r = s.Get("/rd-lookup/res", rd.handleLookupResources)
+	r.ResourceTypes = []string{RDResourceTypeLookupResource}
+
+	rd.handlePurge()
+}
+
+// Stops purging expired registrations
+func (rd *ResourceDirectory) Stop() {
+	close(rd.stopChannel)
+}
+
+// Fired when an endpoint registers
+func (rd *ResourceDirectory) OnRegister(fn FnRDRegistration) {
+	rd.fnRegister = append(rd.fnRegister, fn)
+}
+
+// Fired when an endpoint updates its registration
+func (rd *ResourceDirectory) OnUpdate(fn FnRDRegistration) {
+	rd.fnUpdate = append(rd.fnUpdate, fn)
+}
+
+// Fired when a registration is removed or expires
+func (rd *ResourceDirectory) OnUnregister(fn FnRDRegistration) {
+	rd.fnUnregister = append(rd.fnUnregister, fn)
+}
+
+// Returns a copy of the registration with the given id, or nil if none exists
+func (rd *ResourceDirectory) GetRegistration(id string) *RDRegistration {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	reg, ok := rd.registrations[id]
+	if !ok || reg.IsExpired() {
+		return nil
+	}
+	return reg.clone()
+}
+
+// Returns the registration of a given endpoint name, or nil if none exists
+func (rd *ResourceDirectory) GetRegistrationByEndpoint(ep string) *RDRegistration {
+	for _, reg := range rd.GetRegistrations() {
+		if reg.Endpoint == ep {
+			return reg
+		}
+	}
+	return nil
+}
+
+// Returns copies of all active registrations ordered by registration id. Updates received
+// meanwhile don't modify the returned registrations
+func (rd *ResourceDirectory) GetRegistrations() []*RDRegistration {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	var regs []*RDRegistration
+	for i := 1; i <= rd.lastID; i++ {
+		reg, ok := rd.registrations[strconv.Itoa(i)]
+		if ok && !reg.IsExpired() {
+			regs = append(regs, reg.clone())
+		}
+	}
+	return regs
+}
+
+// Removes registrations whose lifetime has elapsed
+func (rd *ResourceDirectory) PurgeExpired() {
+	var expired []*RDRegistration
+
+	rd.Lock()
+	for id, reg := range rd.registrations {
+		if reg.IsExpired() {
+			delete(rd.registrations, id)
+			expired = append(expired, reg)
+		}
+	}
+	rd.Unlock()
+
+	for _, reg := range expired {
+		rd.fireRegistrationEvent(rd.fnUnregister, reg)
+	}
+}
+
+func (rd *ResourceDirectory) handlePurge() {
+	ticker := time.NewTicker(RDPurgeInterval * time.Second)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				rd.PurgeExpired()
+
+			case <-rd.stopChannel:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (rd *ResourceDirectory) fireRegistrationEvent(fns []FnRDRegistration, reg *RDRegistration) {
+	for _, fn := range fns {
+		fn(reg)
+	}
+}
+
+func (rd *ResourceDirectory) handleRegister(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	ep := req.GetURIQuery(RDParamEndpoint)
+	if ep == "" {
+		return newRDResponse(msg, CoapCodeBadRequest)
+	}
+
+	lt, ok := parseRDLifetime(req)
+	if !ok {
+		return newRDResponse(msg, CoapCodeBadRequest)
+	}
+
+	base := req.GetURIQuery(RDParamBase)
+	if base == "" {
+		if req.GetAddress() == nil {
+			return newRDResponse(msg, CoapCodeBadRequest)
+		}
+		base = "coap://" + req.GetAddress().String()
+	}
+
+	reg := &RDRegistration{
+		Endpoint:     ep,
+		Sector:       req.GetURIQuery(RDParamSector),
+		EndpointType: req.GetURIQuery(RDParamEndpointType),
+		Base:         base,
+		Lifetime:     lt,
+		Expires:      time.Now().Add(time.Duration(lt) * time.Second),
+		Addr:         req.GetAddress(),
+		Attributes:   rdExtraAttributes(msg),
+		Resources:    CoreResourcesFromString(PayloadAsString(msg.Payload)),
+	}
+
+	rd.Lock()
+	// An endpoint registering again with the same name and sector replaces its registration
+	for id, existing := range rd.registrations {
+		if existing.Endpoint == reg.Endpoint && existing.Sector == reg.Sector {
+			reg.ID = id
+			break
+		}
+	}
+
+	if reg.ID == "" {
+		rd.lastID++
+		reg.ID = strconv.Itoa(rd.lastID)
+	}
+	rd.registrations[reg.ID] = reg
+	registered := reg.clone()
+	rd.Unlock()
+
+	rd.fireRegistrationEvent(rd.fnRegister, registered)
+
+	resp := newRDResponse(msg, CoapCodeCreated)
+	resp.GetMessage().AddOption(OptionLocationPath, "rd")
+	resp.GetMessage().AddOption(OptionLocationPath, reg.ID)
+
+	return resp
+}
+
+func (rd *ResourceDirectory) handleRead(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	reg := rd.GetRegistration(req.GetAttribute("id"))
+	if reg == nil {
+		return newRDResponse(msg, CoapCodeNotFound)
+	}
+
+	resp := newRDResponse(msg, CoapCodeContent)
+	resp.GetMessage().AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
+	resp.GetMessage().Payload = NewCoreLinkFormatPayload(reg.Resources)
+
+	return resp
+}
+
+func (rd *ResourceDirectory) handleUpdate(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	lt, ok := parseRDLifetime(req)
+	if !ok {
+		return newRDResponse(msg, CoapCodeBadRequest)
+	}
+
+	rd.Lock()
+	reg, found := rd.registrations[req.GetAttribute("id")]
+	if !found || reg.IsExpired() {
+		rd.Unlock()
+		return newRDResponse(msg, CoapCodeNotFound)
+	}
+
+	if req.GetURIQuery(RDParamLifetime) != "" {
+		reg.Lifetime = lt
+	}
+	reg.Expires = time.Now().Add(time.Duration(reg.Lifetime) * time.Second)
+
+	if base := req.GetURIQuery(RDParamBase); base != "" {
+		reg.Base = base
+	}
+
+	for k, v := range rdExtraAttributes(msg) {
+		reg.Attributes[k] = v
+	}
+
+	if req.GetAddress() != nil {
+		reg.Addr = req.GetAddress()
+	}
+
+	if msg.Payload != nil && msg.Payload.Length() > 0 {
+		reg.Resources = CoreResourcesFromString(msg.Payload.String())
+	}
+	updated := reg.clone()
+	rd.Unlock()
+
+	rd.fireRegistrationEvent(rd.fnUpdate, updated)
+
+	return newRDResponse(msg, CoapCodeChanged)
+}
+
+func (rd *ResourceDirectory) handleRemove(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+	id := req.GetAttribute("id")
+
+	rd.Lock()
+	reg, found := rd.registrations[id]
+	if found {
+		delete(rd.registrations, id)
+	}
+	rd.Unlock()
+
+	if !found {
+		return newRDResponse(msg, CoapCodeNotFound)
+	}
+	rd.fireRegistrationEvent(rd.fnUnregister, reg)
+
+	return newRDResponse(msg, CoapCodeDeleted)
+}
+
+func (rd *ResourceDirectory) handleLookupEndpoints(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+	queries := msg.GetOptionsAsString(OptionURIQuery)
+
+	var resources []*CoreResource
+	for _, reg := range rd.GetRegistrations() {
+		if rdMatchesQueries(queries, reg.matchesQuery) {
+			resources = append(resources, reg.GetCoreResource())
+		}
+	}
+
+	return newRDLookupResponse(req, resources)
+}
+
+func (rd *ResourceDirectory) handleLookupResources(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+
+	// Endpoint parameters filter registrations, any others filter the registered resources
+	var epQueries, resQueries []string
+	for _, q := range msg.GetOptionsAsString(OptionURIQuery) {
+		key := strings.SplitN(q, "=", 2)[0]
+		switch key {
+		case RDParamEndpoint, RDParamSector, RDParamEndpointType, RDParamBase:
+			epQueries = append(epQueries, q)
+
+		case RDParamPage, RDParamCount:
+
+		default:
+			resQueries = append(resQueries, q)
+		}
+	}
+
+	var resources []*CoreResource
+	for _, reg := range rd.GetRegistrations() {
+		if !rdMatchesQueries(epQueries, reg.matchesQuery) {
+			continue
+		}
+
+		for _, res := range FilterCoreResources(reg.GetResolvedResources(), resQueries) {
+			// Resources registered with an anchor keep it
+			if res.GetAttribute(CoreAttributeAnchor) == nil && strings.HasPrefix(res.Target, reg.Base) {
+				res.AddAttribute(CoreAttributeAnchor, reg.Base)
+			}
+			resources = append(resources, res)
+		}
+	}
+
+	return newRDLookupResponse(req, resources)
+}
+
+// Creates a response to a request handled by the directory
+func newRDResponse(msg *Message, code CoapCode) CoapResponse {
+	var respMsg *Message
+	if msg.MessageType == MessageConfirmable {
+		respMsg = NewMessage(MessageAcknowledgment, code, msg.MessageID)
+	} else {
+		respMsg = NewMessage(MessageNonConfirmable, code, GenerateMessageID())
+	}
+
+	return NewResponseWithMessage(respMsg)
+}
+
+// Creates a lookup response, applying 'page' and 'count' pagination if requested
+func newRDLookupResponse(req CoapRequest, resources []*CoreResource) CoapResponse {
+	if count := req.GetURIQuery(RDParamCount); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return newRDResponse(req.GetMessage(), CoapCodeBadRequest)
+		}
+
+		page, _ := strconv.Atoi(req.GetURIQuery(RDParamPage))
+
+		start := page * n
+		if start > len(resources) {
+			start = len(resources)
+		}
+
+		end := start + n
+		if end > len(resources) {
+			end = len(resources)
+		}
+		resources = resources[start:end]
+	}
+
+	resp := newRDResponse(req.GetMessage(), CoapCodeContent)
+	resp.GetMessage().AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
+	resp.GetMessage().Payload = NewCoreLinkFormatPayload(resources)
+
+	return resp
+}
+
+func rdMatchesQueries(queries []string, fn func(key, value string) bool) bool {
+	for _, q := range queries {
+		key, value := q, ""
+		if idx := strings.Index(q, "="); idx >= 0 {
+			key, value = q[:idx], q[idx+1:]
+		}
+
+		if !fn(key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseRDLifetime(req CoapRequest) (int, bool) {
+	lt := req.GetURIQuery(RDParamLifetime)
+	if lt == "" {
+		return RDDefaultLifetime, true
+	}
+
+	v, err := strconv.Atoi(lt)
+	if err != nil || v < 1 {
+		return 0, false
+	}
+	return v, true
+}
+
+// Returns the endpoint attributes given as query parameters which aren't defined by RFC 9176
+func rdExtraAttributes(msg *Message) map[string]string {
+	attrs := make(map[string]string)
+	for _, q := range msg.GetOptionsAsString(OptionURIQuery) {
+		ps := strings.SplitN(q, "=", 2)
+
+		switch ps[0] {
+		case RDParamEndpoint, RDParamSector, RDParamLifetime, RDParamBase, RDParamEndpointType:
+			continue
+		}
+
+		if len(ps) == 2 {
+			attrs[ps[0]] = ps[1]
+		} else {
+			attrs[ps[0]] = ""
+		}
+	}
+	return attrs
+}
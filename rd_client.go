@@ -0,0 +1,286 @@
+package coap
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RDClientTimeout defines the number of seconds to wait for a response from the Resource Directory
+const RDClientTimeout = 5
+
+// RDClientRetryInterval defines the number of seconds before a failed refresh is retried. The
+// interval doubles with every failure
+const RDClientRetryInterval = 5
+
+// RDClientMinRetryInterval is the shortest delay between refreshes retried before the registration expires
+const RDClientMinRetryInterval = 100 * time.Millisecond
+
+// Instantiates a new Resource Directory client which registers the routes of a server
+// with the Resource Directory at rdAddress (e.g. "rd.example.com:5683")
+func NewRDClient(s CoapServer, rdAddress, endpoint string) (*RDClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", rdAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RDClient{
+		server:   s,
+		rdAddr:   addr,
+		Endpoint: endpoint,
+		Lifetime: RDDefaultLifetime,
+		Timeout:  RDClientTimeout * time.Second,
+	}, nil
+}
+
+// RDClient registers a server's resources with a Resource Directory (RFC 9176) and keeps
+// the registration alive by refreshing it before its lifetime ends. The server must be
+// started so that it can receive the directory's responses
+type RDClient struct {
+	sync.Mutex
+
+	server CoapServer
+	rdAddr *net.UDPAddr
+
+	Endpoint     string
+	Sector       string
+	EndpointType string
+	Base         string
+	Lifetime     int
+	Timeout      time.Duration
+
+	// Additional registration parameters (e.g. lwm2m=1.1). Empty values are sent as flags
+	Attributes map[string]string
+
+	// Links returns the resources to register. Defaults to the server's routes
+	Links func() []*CoreResource
+
+	location    string
+	stopChannel chan int
+}
+
+// Returns the location of the registration resource, or an empty string if not registered
+func (c *RDClient) GetLocation() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.location
+}
+
+// Register registers the server's routes with the Resource Directory
+func (c *RDClient) Register() error {
+	req := NewRequest(MessageConfirmable, Post, GenerateMessageID())
+	req.SetRequestURI("rd")
+	req.SetURIQuery(RDParamEndpoint, c.Endpoint)
+	req.SetURIQuery(RDParamLifetime, strconv.Itoa(c.Lifetime))
+
+	if c.Sector != "" {
+		req.SetURIQuery(RDParamSector, c.Sector)
+	}
+
+	if c.EndpointType != "" {
+		req.SetURIQuery(RDParamEndpointType, c.EndpointType)
+	}
+
+	if c.Base != "" {
+		req.SetURIQuery(RDParamBase, c.Base)
+	}
+
+	keys := make([]string, 0, len(c.Attributes))
+	for k := range c.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if c.Attributes[k] == "" {
+			req.GetMessage().AddOption(OptionURIQuery, k)
+		} else {
+			req.SetURIQuery(k, c.Attributes[k])
+		}
+	}
+
+	req.SetMediaType(MediaTypeApplicationLinkFormat)
+	req.GetMessage().Payload = NewCoreLinkFormatPayload(c.getLinks())
+
+	resp, err := SendAndWaitForResponse(c.server, req, c.rdAddr, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if resp.Code != CoapCodeCreated {
+		return ErrRDRequestFailed
+	}
+
+	location := resp.GetLocationPath()
+	if location == "" {
+		return ErrRDRequestFailed
+	}
+
+	c.Lock()
+	c.location = "/" + location
+	c.Unlock()
+
+	return nil
+}
+
+func (c *RDClient) getLinks() []*CoreResource {
+	if c.Links != nil {
+		return c.Links()
+	}
+	return CoreResourcesFromRoutes(c.server.GetRoutes())
+}
+
+// Update refreshes the registration's lifetime. If the registration has expired on the
+// Resource Directory, the endpoint registers again
+func (c *RDClient) Update() error {
+	return c.update(false)
+}
+
+// UpdateLinks refreshes the registration and replaces the registered resources with the current links
+func (c *RDClient) UpdateLinks() error {
+	return c.update(true)
+}
+
+func (c *RDClient) update(links bool) error {
+	location := c.GetLocation()
+	if location == "" {
+		return ErrRDNotRegistered
+	}
+
+	req := NewRequest(MessageConfirmable, Post, GenerateMessageID())
+	req.SetRequestURI(location)
+
+	if links {
+		req.SetMediaType(MediaTypeApplicationLinkFormat)
+		req.GetMessage().Payload = NewCoreLinkFormatPayload(c.getLinks())
+	}
+
+	resp, err := SendAndWaitForResponse(c.server, req, c.rdAddr, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	switch resp.Code {
+	case CoapCodeChanged:
+		return nil
+
+	case CoapCodeNotFound:
+		return c.Register()
+	}
+	return ErrRDRequestFailed
+}
+
+// Deregister removes the registration from the Resource Directory
+func (c *RDClient) Deregister() error {
+	location := c.GetLocation()
+	if location == "" {
+		return ErrRDNotRegistered
+	}
+
+	req := NewRequest(MessageConfirmable, Delete, GenerateMessageID())
+	req.SetRequestURI(location)
+
+	resp, err := SendAndWaitForResponse(c.server, req, c.rdAddr, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.location = ""
+	c.Unlock()
+
+	if resp.Code != CoapCodeDeleted && resp.Code != CoapCodeNotFound {
+		return ErrRDRequestFailed
+	}
+	return nil
+}
+
+// Start registers with the Resource Directory and refreshes the registration before
+// its lifetime ends until Stop is called
+func (c *RDClient) Start() error {
+	if err := c.Register(); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.stopChannel = make(chan int)
+	stop := c.stopChannel
+	c.Unlock()
+
+	go c.refresh(stop)
+
+	return nil
+}
+
+// Stop ends refreshing the registration and removes it from the Resource Directory
+func (c *RDClient) Stop() error {
+	c.Lock()
+	if c.stopChannel != nil {
+		close(c.stopChannel)
+		c.stopChannel = nil
+	}
+	c.Unlock()
+
+	return c.Deregister()
+}
+
+func (c *RDClient) refresh(stop chan int) {
+	refreshed := time.Now()
+	failures := 0
+
+	for {
+		select {
+		case <-time.After(c.refreshDelay(refreshed, failures)):
+		case <-stop:
+			return
+		}
+
+		// Registrations which expired while refreshes failed are registered again
+		var err error
+		if time.Since(refreshed) >= time.Duration(c.Lifetime)*time.Second {
+			err = c.Register()
+		} else {
+			err = c.Update()
+		}
+
+		if err != nil {
+			c.server.GetEvents().Error(err)
+			failures++
+			continue
+		}
+		refreshed = time.Now()
+		failures = 0
+	}
+}
+
+// Returns how long to wait before refreshing a registration last refreshed at the given time.
+// Refreshes are scheduled at 90% of the lifetime to allow for retransmissions. Failed refreshes
+// are retried with an exponential backoff starting at RDClientRetryInterval, but at least twice
+// before the registration expires
+func (c *RDClient) refreshDelay(refreshed time.Time, failures int) time.Duration {
+	lt := time.Duration(c.Lifetime) * time.Second
+	if failures == 0 {
+		return lt - lt/10 - time.Since(refreshed)
+	}
+
+	if failures > 16 {
+		failures = 16
+	}
+
+	delay := RDClientRetryInterval * time.Second << uint(failures-1)
+	if delay > lt-lt/10 {
+		delay = lt - lt/10
+	}
+
+	if remaining := lt - time.Since(refreshed); remaining > 0 && delay > remaining/2 {
+		delay = remaining / 2
+	}
+
+	if delay < RDClientMinRetryInterval {
+		delay = RDClientMinRetryInterval
+	}
+	return delay
+}
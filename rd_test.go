@@ -0,0 +1,258 @@
+package coap
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResourceDirectory(t *testing.T) {
+	server, serverAddr := newTestServer(t)
+	rd := NewResourceDirectory()
+	rd.Attach(server)
+	t.Cleanup(rd.Stop)
+
+	events := make(chan string, 3)
+	rd.OnRegister(func(reg *RDRegistration) { events <- "register " + reg.Endpoint })
+	rd.OnUpdate(func(reg *RDRegistration) { events <- "update " + reg.Endpoint })
+	rd.OnUnregister(func(reg *RDRegistration) { events <- "unregister " + reg.Endpoint })
+
+	expectEvent := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("event = %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %q event", want)
+		}
+	}
+
+	client, clientAddr := newTestServer(t)
+
+	startTestServer(t, server)
+	startTestServer(t, client)
+
+	links := `</temp>;rt="temperature";ct=0,</hum>;rt="humidity",</x>;rt="anchored";anchor="/dev"`
+
+	rdClient, err := NewRDClient(client, serverAddr, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdClient.Lifetime = 60
+	rdClient.Timeout = 2 * time.Second
+	rdClient.Attributes = map[string]string{"lwm2m": "1.1"}
+	rdClient.Links = func() []*CoreResource {
+		return CoreResourcesFromString(links)
+	}
+
+	if err := rdClient.Register(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("register node1")
+
+	if location := rdClient.GetLocation(); location != "/rd/1" {
+		t.Errorf("location = %s, want /rd/1", location)
+	}
+
+	reg := rd.GetRegistration("1")
+	if reg == nil {
+		t.Fatal("the registration wasn't kept")
+	}
+
+	if reg.Endpoint != "node1" || reg.Lifetime != 60 || reg.Base != "coap://"+clientAddr || reg.Attributes["lwm2m"] != "1.1" || len(reg.Resources) != 3 {
+		t.Errorf("registration = %+v", reg)
+	}
+
+	lookup := func(path string, queries ...string) []*CoreResource {
+		req := NewRequest(MessageConfirmable, Get, GenerateMessageID())
+		req.SetRequestURI(path)
+		for _, q := range queries {
+			req.GetMessage().AddOption(OptionURIQuery, q)
+		}
+
+		udpAddr, _ := net.ResolveUDPAddr("udp", serverAddr)
+		resp, err := SendAndWaitForResponse(client, req, udpAddr, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != CoapCodeContent {
+			t.Fatalf("lookup of %s = %s", path, CoapCodeToString(resp.Code))
+		}
+		return CoreResourcesFromString(resp.Payload.String())
+	}
+
+	if eps := lookup("rd-lookup/ep", "ep=node1"); len(eps) != 1 || eps[0].Target != "/rd/1" {
+		t.Errorf("endpoint lookup = %v", eps)
+	} else if attr := eps[0].GetAttribute("lwm2m"); attr == nil || attr.StringValue() != "1.1" {
+		t.Errorf("endpoint lookup without the lwm2m attribute: %s", eps[0])
+	}
+
+	if eps := lookup("rd-lookup/ep", "ep=node2"); len(eps) != 0 {
+		t.Errorf("lookup of an unknown endpoint = %v", eps)
+	}
+
+	res := lookup("rd-lookup/res", "rt=temperature")
+	if len(res) != 1 || res[0].Target != "coap://"+clientAddr+"/temp" {
+		t.Fatalf("resource lookup = %v", res)
+	}
+
+	if anchors := res[0].GetAttributeValues(CoreAttributeAnchor); len(anchors) != 1 || anchors[0] != "coap://"+clientAddr {
+		t.Errorf("anchors = %q", anchors)
+	}
+
+	// Resources registered with an anchor keep it, resolved against the base
+	res = lookup("rd-lookup/res", "rt=anchored")
+	if len(res) != 1 {
+		t.Fatalf("resource lookup = %v", res)
+	}
+
+	if anchors := res[0].GetAttributeValues(CoreAttributeAnchor); len(anchors) != 1 || anchors[0] != "coap://"+clientAddr+"/dev" {
+		t.Errorf("anchors = %q", anchors)
+	}
+
+	// Updates replace the registered resources
+	links = `</temp>;rt="temperature"`
+	if err := rdClient.UpdateLinks(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("update node1")
+
+	if reg := rd.GetRegistration("1"); reg == nil || len(reg.Resources) != 1 {
+		t.Errorf("registration after the update = %+v", reg)
+	}
+
+	if res := lookup("rd-lookup/res", "rt=humidity"); len(res) != 0 {
+		t.Errorf("lookup of a removed resource = %v", res)
+	}
+
+	// Endpoints whose registration is gone register again when updating
+	req := NewRequest(MessageConfirmable, Delete, GenerateMessageID())
+	req.SetRequestURI("rd/1")
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", serverAddr)
+	if resp, err := SendAndWaitForResponse(client, req, udpAddr, 2*time.Second); err != nil || resp.Code != CoapCodeDeleted {
+		t.Fatalf("removal = %v (%v)", resp, err)
+	}
+	expectEvent("unregister node1")
+
+	if err := rdClient.Update(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("register node1")
+
+	if location := rdClient.GetLocation(); location != "/rd/2" {
+		t.Errorf("location after registering again = %s, want /rd/2", location)
+	}
+
+	// Removal
+	if err := rdClient.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("unregister node1")
+
+	if reg := rd.GetRegistration("2"); reg != nil {
+		t.Errorf("registration after removal = %+v", reg)
+	}
+
+	if eps := lookup("rd-lookup/ep"); len(eps) != 0 {
+		t.Errorf("endpoint lookup after removal = %v", eps)
+	}
+
+	if err := rdClient.Update(); err != ErrRDNotRegistered {
+		t.Errorf("Update after removal = %v, want %v", err, ErrRDNotRegistered)
+	}
+}
+
+func TestRDClientRefreshDelay(t *testing.T) {
+	c := &RDClient{Lifetime: 100}
+	now := time.Now()
+
+	tests := []struct {
+		refreshed time.Duration
+		failures  int
+		min, max  time.Duration
+	}{
+		// Refreshes at 90% of the lifetime
+		{0, 0, 89 * time.Second, 90 * time.Second},
+
+		// Exponential backoff
+		{0, 1, 5 * time.Second, 5 * time.Second},
+		{0, 3, 20 * time.Second, 20 * time.Second},
+		{0, 100, 49 * time.Second, 50 * time.Second},
+
+		// Failed refreshes are retried at least twice before the registration expires
+		{90 * time.Second, 1, 4 * time.Second, 5 * time.Second},
+		{95 * time.Second, 1, 2 * time.Second, 2500 * time.Millisecond},
+		{99990 * time.Millisecond, 1, RDClientMinRetryInterval, RDClientMinRetryInterval},
+
+		// Expired registrations are registered again with the backoff
+		{101 * time.Second, 2, 10 * time.Second, 10 * time.Second},
+		{101 * time.Second, 100, 90 * time.Second, 90 * time.Second},
+	}
+
+	for _, test := range tests {
+		delay := c.refreshDelay(now.Add(-test.refreshed), test.failures)
+		if delay < test.min || delay > test.max {
+			t.Errorf("refreshDelay(-%s, %d) = %s, want %s to %s", test.refreshed, test.failures, delay, test.min, test.max)
+		}
+	}
+}
+
+// Lookups read registrations while updates modify them
+func TestResourceDirectoryConcurrentUpdate(t *testing.T) {
+	rd := NewResourceDirectory()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+
+	request := func(code CoapCode, id string, queries []string, payload string) CoapRequest {
+		msg := NewMessage(MessageConfirmable, code, 1)
+		for _, q := range queries {
+			msg.AddOption(OptionURIQuery, q)
+		}
+
+		if payload != "" {
+			msg.SetStringPayload(payload)
+		}
+		return NewClientRequestFromMessage(msg, map[string]string{"id": id}, nil, addr)
+	}
+
+	resp := rd.handleRegister(request(Post, "", []string{"ep=node", "a=0"}, `</temp>;rt="temperature"`))
+	if code := resp.GetMessage().Code; code != CoapCodeCreated {
+		t.Fatalf("registration = %s", CoapCodeToString(code))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			n := strconv.Itoa(i)
+			rd.handleUpdate(request(Post, "1", []string{"a" + n + "=" + n}, `</r`+n+`>;rt="temperature"`))
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			for _, resp := range []CoapResponse{
+				rd.handleLookupEndpoints(request(Get, "", []string{"ep=node"}, "")),
+				rd.handleLookupResources(request(Get, "", []string{"rt=temperature"}, "")),
+				rd.handleRead(request(Get, "1", nil, "")),
+			} {
+				if resp.GetMessage().Payload.Length() == 0 {
+					t.Error("empty lookup response")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	reg := rd.GetRegistration("1")
+	if reg == nil || len(reg.Attributes) != 51 || len(reg.Resources) != 1 {
+		t.Errorf("registration after the updates = %+v", reg)
+	}
+}
@@ -0,0 +1,258 @@
+package coap
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// RepresentationEncoder encodes a value returned by a route handler as a payload of a media type
+type RepresentationEncoder func(v interface{}) ([]byte, error)
+
+// RepresentationDecoder decodes a payload of a media type into the value pointed to by v
+type RepresentationDecoder func(data []byte, v interface{}) error
+
+// Representation is a media type a route's resource can be represented in
+type Representation struct {
+	MediaType MediaType
+	Encoder   RepresentationEncoder
+}
+
+var representationEncoders = map[MediaType]RepresentationEncoder{
+	MediaTypeTextPlain:              EncodeText,
+	MediaTypeApplicationJSON:        json.Marshal,
+	MediaTypeApplicationXML:         xml.Marshal,
+	MediaTypeTextXML:                xml.Marshal,
+	MediaTypeApplicationOctetStream: EncodeOctetStream,
+	MediaTypeApplicationCBOR:        CBORMarshal,
+	MediaTypeApplicationCBORSeq:     EncodeCBORSequence,
+}
+var representationEncodersMutex sync.RWMutex
+
+var representationDecoders = map[MediaType]RepresentationDecoder{
+	MediaTypeTextPlain:              DecodeText,
+	MediaTypeApplicationJSON:        json.Unmarshal,
+	MediaTypeApplicationXML:         xml.Unmarshal,
+	MediaTypeTextXML:                xml.Unmarshal,
+	MediaTypeApplicationOctetStream: DecodeText,
+	MediaTypeApplicationCBOR:        CBORUnmarshal,
+	MediaTypeApplicationCBORSeq:     DecodeCBORSequence,
+}
+var representationDecodersMutex sync.RWMutex
+
+// Registers the default encoder of a media type, used by representations added without an encoder
+func RegisterRepresentationEncoder(mt MediaType, enc RepresentationEncoder) {
+	representationEncodersMutex.Lock()
+	representationEncoders[mt] = enc
+	representationEncodersMutex.Unlock()
+}
+
+// Returns the default encoder of a media type, or nil if none is registered
+func GetRepresentationEncoder(mt MediaType) RepresentationEncoder {
+	representationEncodersMutex.RLock()
+	defer representationEncodersMutex.RUnlock()
+
+	return representationEncoders[mt]
+}
+
+// Registers the decoder of a media type used to decode message payloads
+func RegisterRepresentationDecoder(mt MediaType, dec RepresentationDecoder) {
+	representationDecodersMutex.Lock()
+	representationDecoders[mt] = dec
+	representationDecodersMutex.Unlock()
+}
+
+// Returns the decoder of a media type, or nil if none is registered
+func GetRepresentationDecoder(mt MediaType) RepresentationDecoder {
+	representationDecodersMutex.RLock()
+	defer representationDecodersMutex.RUnlock()
+
+	return representationDecoders[mt]
+}
+
+// DecodeMessagePayload decodes the payload of a message into the value pointed to by v, using the
+// decoder of the message's Content-Format. Payloads without a Content-Format are decoded as text
+func DecodeMessagePayload(msg *Message, v interface{}) error {
+	if msg == nil {
+		return ErrNilMessage
+	}
+
+	var data []byte
+	if msg.Payload != nil {
+		data = msg.Payload.GetBytes()
+	}
+
+	mt, _ := msg.GetContentFormat()
+	dec := GetRepresentationDecoder(mt)
+	if dec == nil {
+		return ErrUnsupportedPayloadFormat
+	}
+	return dec(data, v)
+}
+
+// DecodeText decodes a payload into a string, byte slice or interface value (as a string)
+func DecodeText(data []byte, v interface{}) error {
+	switch t := v.(type) {
+	case *string:
+		*t = string(data)
+
+	case *[]byte:
+		*t = append([]byte(nil), data...)
+
+	case *interface{}:
+		*t = string(data)
+
+	default:
+		return ErrUnsupportedRepresentation
+	}
+	return nil
+}
+
+// EncodeCBORSequence encodes the elements of a slice as a CBOR sequence, and any other value as
+// a sequence of one data item
+func EncodeCBORSequence(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return CBORMarshal(v)
+	}
+
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		values[i] = rv.Index(i).Interface()
+	}
+	return CBORMarshalSequence(values...)
+}
+
+// DecodeCBORSequence decodes the data items of a CBOR sequence into the slice pointed to by v
+func DecodeCBORSequence(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return ErrCBORInvalidTarget
+	}
+
+	s := rv.Elem()
+	s.SetLen(0)
+
+	d := NewCBORDecoder(data)
+	for d.More() {
+		item := reflect.New(s.Type().Elem())
+		if err := d.Decode(item.Interface()); err != nil {
+			return err
+		}
+		s.Set(reflect.Append(s, item.Elem()))
+	}
+	return nil
+}
+
+// EncodeText encodes a value in its default string format
+func EncodeText(v interface{}) ([]byte, error) {
+	switch s := v.(type) {
+	case string:
+		return []byte(s), nil
+
+	case []byte:
+		return s, nil
+	}
+	return []byte(fmt.Sprint(v)), nil
+}
+
+// EncodeOctetStream encodes byte slices and strings as is
+func EncodeOctetStream(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+
+	case string:
+		return []byte(b), nil
+	}
+	return nil, ErrUnsupportedRepresentation
+}
+
+// Instantiates a new payload holding a value which is encoded in the representation negotiated
+// with the client when the response is sent
+func NewValuePayload(v interface{}) MessagePayload {
+	return &ValuePayload{
+		Value: v,
+	}
+}
+
+// Represents a message payload containing a value which has yet to be encoded
+type ValuePayload struct {
+	Value interface{}
+}
+
+func (p *ValuePayload) GetBytes() []byte {
+	b, _ := EncodeText(p.Value)
+
+	return b
+}
+
+func (p *ValuePayload) Length() int {
+	return len(p.GetBytes())
+}
+
+func (p *ValuePayload) String() string {
+	return string(p.GetBytes())
+}
+
+// Selects the representation of a route to respond with based on the Accept option of a
+// request. Without an Accept option, the first representation is selected
+func negotiateRepresentation(route *Route, msg *Message) (*Representation, error) {
+	if len(route.Representations) == 0 {
+		return nil, nil
+	}
+
+	accept, ok := msg.GetAccept()
+	if !ok {
+		return route.Representations[0], nil
+	}
+
+	for _, r := range route.Representations {
+		if r.MediaType == accept {
+			return r, nil
+		}
+	}
+	return nil, ErrNotAcceptable
+}
+
+// Encodes the value payload of a response in the negotiated representation, and sets the
+// Content-Format of the response. Without a negotiated representation, values are encoded
+// in the Content-Format set by the handler
+func encodeRepresentation(representation *Representation, resp *Message) error {
+	if resp.Payload == nil || !IsSuccessCode(resp.Code) {
+		return nil
+	}
+
+	if representation == nil {
+		mt, ok := resp.GetContentFormat()
+		if !ok {
+			return nil
+		}
+		representation = &Representation{MediaType: mt, Encoder: GetRepresentationEncoder(mt)}
+	}
+
+	value, ok := resp.Payload.(*ValuePayload)
+	if !ok {
+		if resp.GetOption(OptionContentFormat) == nil {
+			resp.AddOption(OptionContentFormat, representation.MediaType)
+		}
+		return nil
+	}
+
+	if representation.Encoder == nil {
+		return ErrUnsupportedRepresentation
+	}
+
+	b, err := representation.Encoder(value.Value)
+	if err != nil {
+		return err
+	}
+	resp.Payload = NewBytesPayload(b)
+
+	resp.RemoveOptions(OptionContentFormat)
+	resp.AddOption(OptionContentFormat, representation.MediaType)
+
+	return nil
+}
@@ -83,6 +83,11 @@ type CoapRequest interface {
 	SetToken(t string)
 	GetURIQuery(q string) string
 	SetURIQuery(k string, v string)
+	AddETag(etag []byte)
+	SetIfMatch(etags ...[]byte)
+	SetIfNoneMatch()
+	SetNoResponse(classes uint8)
+	DecodePayload(v interface{}) error
 }
 
 // Wraps a CoAP Message as a Request
@@ -134,8 +139,25 @@ func (c *DefaultCoapRequest) SetStringPayload(s string) {
 	c.msg.Payload = NewPlainTextPayload(s)
 }
 
+// Sets the Uri-Path and Uri-Query options from a path with an optional query (e.g. "/a/b?c=d"),
+// or from an absolute coap URI which may also set the Uri-Host and Uri-Port options
 func (c *DefaultCoapRequest) SetRequestURI(uri string) {
-	c.msg.AddOptions(NewPathOptions(uri))
+	if _, opts, err := coapURIOptions(uri); err == nil {
+		c.msg.AddOptions(opts)
+		return
+	}
+
+	path, query := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		path, query = uri[:i], uri[i+1:]
+	}
+	c.msg.AddOptions(NewPathOptions(path))
+
+	for _, q := range strings.Split(query, "&") {
+		if q != "" {
+			c.msg.AddOption(OptionURIQuery, q)
+		}
+	}
 }
 
 func (c *DefaultCoapRequest) SetConfirmable(con bool) {
@@ -167,3 +189,38 @@ func (c *DefaultCoapRequest) GetURIQuery(q string) string {
 func (c *DefaultCoapRequest) SetURIQuery(k string, v string) {
 	c.GetMessage().AddOption(OptionURIQuery, k+"="+v)
 }
+
+// Adds an entity-tag of a stored representation, which the server answers with 2.03 Valid if
+// it is still current
+func (c *DefaultCoapRequest) AddETag(etag []byte) {
+	c.msg.AddOption(OptionEtag, etag)
+}
+
+// Makes the request conditional on the resource's current entity-tag being one of the given
+// ones. Without any entity-tags, the request is conditional on the resource existing
+func (c *DefaultCoapRequest) SetIfMatch(etags ...[]byte) {
+	c.msg.RemoveOptions(OptionIfMatch)
+	if len(etags) == 0 {
+		c.msg.AddOption(OptionIfMatch, nil)
+	}
+
+	for _, etag := range etags {
+		c.msg.AddOption(OptionIfMatch, etag)
+	}
+}
+
+// Makes the request conditional on the resource not existing
+func (c *DefaultCoapRequest) SetIfNoneMatch() {
+	c.msg.AddOption(OptionIfNoneMatch, nil)
+}
+
+// Opts out of responses of the given classes, e.g. NoResponseSuccess|NoResponseClientError.
+// Zero asks for responses of all classes (RFC 7967)
+func (c *DefaultCoapRequest) SetNoResponse(classes uint8) {
+	c.msg.AddOption(OptionNoResponse, classes)
+}
+
+// Decodes the payload of the request according to its Content-Format
+func (c *DefaultCoapRequest) DecodePayload(v interface{}) error {
+	return DecodeMessagePayload(c.msg, v)
+}
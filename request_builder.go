@@ -0,0 +1,206 @@
+package coap
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Instantiates a new builder of a request with the given method. Requests are Confirmable and
+// carry a new message id and a random 8 byte token unless set otherwise
+func NewRequestBuilder(method CoapCode) *RequestBuilder {
+	msg := NewMessage(MessageConfirmable, method, GenerateMessageID())
+	msg.Token = []byte(GenerateToken(8))
+
+	return &RequestBuilder{
+		msg: msg,
+	}
+}
+
+// RequestBuilder builds a request message through chained calls. The first error encountered,
+// e.g. an invalid URI, is returned by Build
+type RequestBuilder struct {
+	msg  *Message
+	host string
+	port int
+	err  error
+}
+
+// Sets the target of the request from an absolute CoAP URI, which is split into the Uri-Host,
+// Uri-Port, Uri-Path and Uri-Query options (RFC 7252 Section 6.4)
+func (b *RequestBuilder) URI(uri string) *RequestBuilder {
+	u, opts, err := coapURIOptions(uri)
+	if err != nil {
+		return b.fail(err)
+	}
+
+	b.host = u.Hostname()
+	b.port = coapURIPort(u)
+
+	b.msg.RemoveOptions(OptionURIHost)
+	b.msg.RemoveOptions(OptionURIPort)
+	b.msg.RemoveOptions(OptionURIPath)
+	b.msg.RemoveOptions(OptionURIQuery)
+	b.msg.AddOptions(opts)
+
+	return b
+}
+
+// Sets the path of the request. Percent-encoded characters of the segments are decoded
+func (b *RequestBuilder) Path(path string) *RequestBuilder {
+	b.msg.RemoveOptions(OptionURIPath)
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return b.fail(ErrInvalidRequestURI)
+		}
+		b.msg.AddOption(OptionURIPath, s)
+	}
+	return b
+}
+
+// Adds a query parameter to the request
+func (b *RequestBuilder) Query(k, v string) *RequestBuilder {
+	b.msg.AddOption(OptionURIQuery, k+"="+v)
+
+	return b
+}
+
+// Sets whether the request is Confirmable or Non-Confirmable
+func (b *RequestBuilder) Confirmable(con bool) *RequestBuilder {
+	if con {
+		b.msg.MessageType = MessageConfirmable
+	} else {
+		b.msg.MessageType = MessageNonConfirmable
+	}
+	return b
+}
+
+// Sets the message type of the request
+func (b *RequestBuilder) Type(messageType uint8) *RequestBuilder {
+	b.msg.MessageType = messageType
+
+	return b
+}
+
+// Sets the message id of the request
+func (b *RequestBuilder) MessageID(messageID uint16) *RequestBuilder {
+	b.msg.MessageID = messageID
+
+	return b
+}
+
+// Sets the token of the request
+func (b *RequestBuilder) Token(token []byte) *RequestBuilder {
+	b.msg.Token = token
+
+	return b
+}
+
+// Sets the Content-Format of the request's payload
+func (b *RequestBuilder) ContentFormat(mt MediaType) *RequestBuilder {
+	b.msg.AddOption(OptionContentFormat, mt)
+
+	return b
+}
+
+// Sets the media type accepted in the response
+func (b *RequestBuilder) Accept(mt MediaType) *RequestBuilder {
+	b.msg.AddOption(OptionAccept, mt)
+
+	return b
+}
+
+// Registers an observation of the target resource, or cancels it (RFC 7641)
+func (b *RequestBuilder) Observe(register bool) *RequestBuilder {
+	if register {
+		b.msg.AddOption(OptionObserve, 0)
+	} else {
+		b.msg.AddOption(OptionObserve, 1)
+	}
+	return b
+}
+
+// Opts out of responses of the given classes, e.g. NoResponseSuccess (RFC 7967)
+func (b *RequestBuilder) NoResponse(classes uint8) *RequestBuilder {
+	b.msg.AddOption(OptionNoResponse, classes)
+
+	return b
+}
+
+// Adds an option to the request. Non-repeatable options replace any previous value
+func (b *RequestBuilder) Option(code OptionCode, value interface{}) *RequestBuilder {
+	b.msg.AddOption(code, value)
+
+	return b
+}
+
+// Sets the payload of the request
+func (b *RequestBuilder) Payload(payload MessagePayload) *RequestBuilder {
+	b.msg.Payload = payload
+
+	return b
+}
+
+// Sets a string payload
+func (b *RequestBuilder) StringPayload(s string) *RequestBuilder {
+	b.msg.Payload = NewPlainTextPayload(s)
+
+	return b
+}
+
+// Returns the address of the host targeted by the URI of the request
+func (b *RequestBuilder) Address() (*net.UDPAddr, error) {
+	if b.host == "" {
+		return nil, ErrInvalidRequestURI
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(b.host, strconv.Itoa(b.port)))
+}
+
+// Validates and returns the request message
+func (b *RequestBuilder) Build() (*Message, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if MethodString(b.msg.Code) == "" {
+		return nil, ErrUnsupportedMethod
+	}
+
+	if b.msg.MessageType != MessageConfirmable && b.msg.MessageType != MessageNonConfirmable {
+		return nil, ErrInvalidRequestType
+	}
+
+	if err := ValidateMessage(b.msg); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range b.msg.Options {
+		if _, err := opt.RawValue(); err != nil {
+			return nil, err
+		}
+	}
+	return b.msg, nil
+}
+
+// Validates the request message and wraps it as a request
+func (b *RequestBuilder) BuildRequest() (CoapRequest, error) {
+	msg, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return NewRequestFromMessage(msg), nil
+}
+
+// Keeps the first error encountered while building
+func (b *RequestBuilder) fail(err error) *RequestBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+package coap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestBuilder(t *testing.T) {
+	b := NewRequestBuilder(Put).
+		URI("coap://Example.com:5684/sensors/temp%2Fc?unit=c").
+		Query("format", "json").
+		Confirmable(false).
+		MessageID(42).
+		Token([]byte{1, 2}).
+		ContentFormat(MediaTypeApplicationJSON).
+		Accept(MediaTypeApplicationCBOR).
+		NoResponse(NoResponseSuccess).
+		Option(OptionIfMatch, []byte{9}).
+		StringPayload(`{"v":1}`)
+
+	msg, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.MessageType != MessageNonConfirmable || msg.MessageID != 42 || !reflect.DeepEqual(msg.Token, []byte{1, 2}) {
+		t.Errorf("header = %d %d %x", msg.MessageType, msg.MessageID, msg.Token)
+	}
+
+	if got := msg.GetOptionsAsString(OptionURIPath); !reflect.DeepEqual(got, []string{"sensors", "temp/c"}) {
+		t.Errorf("Uri-Path = %q", got)
+	}
+
+	if got := msg.GetOptionsAsString(OptionURIQuery); !reflect.DeepEqual(got, []string{"unit=c", "format=json"}) {
+		t.Errorf("Uri-Query = %q", got)
+	}
+
+	if got := msg.GetOption(OptionURIHost).StringValue(); got != "example.com" {
+		t.Errorf("Uri-Host = %q", got)
+	}
+
+	if got := msg.GetOption(OptionURIPort).IntValue(); got != 5684 {
+		t.Errorf("Uri-Port = %d", got)
+	}
+
+	if mt, ok := msg.GetContentFormat(); !ok || mt != MediaTypeApplicationJSON {
+		t.Errorf("Content-Format = %d", mt)
+	}
+
+	if !msg.SuppressesResponse(CoapCodeContent) || msg.SuppressesResponse(CoapCodeNotFound) {
+		t.Error("No-Response doesn't suppress only success responses")
+	}
+
+	if got := msg.Payload.String(); got != `{"v":1}` {
+		t.Errorf("payload = %s", got)
+	}
+
+	// The address defaults to the port of the scheme
+	addr, err := NewRequestBuilder(Get).URI("coaps://127.0.0.1/a").Address()
+	if err != nil || addr.String() != "127.0.0.1:5684" {
+		t.Errorf("Address = %v (%v)", addr, err)
+	}
+
+	// The request survives encoding
+	data, err := MessageToBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := BytesToMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.GetOption(OptionIfMatch) == nil || decoded.GetOption(OptionAccept).IntValue() != int(MediaTypeApplicationCBOR) {
+		t.Errorf("decoded options = %v", decoded.Options)
+	}
+}
+
+func TestRequestBuilderDefaults(t *testing.T) {
+	b := NewRequestBuilder(Get).Path("/a/b%20c/").Observe(true)
+
+	req, err := b.BuildRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := req.GetMessage()
+	if msg.MessageType != MessageConfirmable || len(msg.Token) != 8 {
+		t.Errorf("type %d, token %x", msg.MessageType, msg.Token)
+	}
+
+	if got := msg.GetOptionsAsString(OptionURIPath); !reflect.DeepEqual(got, []string{"a", "b c"}) {
+		t.Errorf("Uri-Path = %q", got)
+	}
+
+	if got := msg.GetOption(OptionObserve).IntValue(); got != 0 {
+		t.Errorf("Observe = %d", got)
+	}
+
+	// Without a URI, the builder doesn't know where to send the request
+	if _, err := b.Address(); err != ErrInvalidRequestURI {
+		t.Errorf("Address = %v, want %v", err, ErrInvalidRequestURI)
+	}
+
+	// Setting the URI replaces the path
+	msg, err = NewRequestBuilder(Get).Path("/x").URI("coap://[::1]/y").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.GetOptionsAsString(OptionURIPath); !reflect.DeepEqual(got, []string{"y"}) {
+		t.Errorf("Uri-Path = %q", got)
+	}
+
+	if msg.GetOption(OptionURIHost) != nil || msg.GetOption(OptionURIPort) != nil {
+		t.Errorf("options = %v, want no Uri-Host and Uri-Port", msg.Options)
+	}
+}
+
+func TestRequestBuilderInvalid(t *testing.T) {
+	tests := []struct {
+		b   *RequestBuilder
+		err error
+	}{
+		{NewRequestBuilder(Get).URI("http://example.com/"), ErrInvalidRequestURI},
+		{NewRequestBuilder(Get).URI("/relative"), ErrInvalidRequestURI},
+		{NewRequestBuilder(Get).URI("coap://example.com:99999/"), ErrInvalidRequestURI},
+		{NewRequestBuilder(Get).Path("/a%zz"), ErrInvalidRequestURI},
+
+		// The first error is kept
+		{NewRequestBuilder(Get).Path("/a%zz").URI("http://x/"), ErrInvalidRequestURI},
+
+		{NewRequestBuilder(CoapCodeContent), ErrUnsupportedMethod},
+		{NewRequestBuilder(Get).Type(MessageAcknowledgment), ErrInvalidRequestType},
+		{NewRequestBuilder(Get).Option(OptionIfMatch, make([]byte, 9)), ErrInvalidOptionLength},
+	}
+
+	for i, test := range tests {
+		if _, err := test.b.Build(); err != test.err {
+			t.Errorf("%d: Build = %v, want %v", i, err, test.err)
+		}
+
+		if _, err := test.b.BuildRequest(); err != test.err {
+			t.Errorf("%d: BuildRequest = %v, want %v", i, err, test.err)
+		}
+	}
+}
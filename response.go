@@ -11,6 +11,7 @@ type CoapResponse interface {
 	GetError() error
 	GetPayload() []byte
 	GetURIQuery(q string) string
+	DecodePayload(v interface{}) error
 }
 
 type NilResponse struct {
@@ -32,6 +33,10 @@ func (c NilResponse) GetURIQuery(q string) string {
 	return ""
 }
 
+func (c NilResponse) DecodePayload(v interface{}) error {
+	return ErrNilMessage
+}
+
 // Creates a new Response object with a Message object and any error messages
 func NewResponse(msg *Message, err error) CoapResponse {
 	resp := &DefaultResponse{
@@ -81,3 +86,8 @@ func (c *DefaultResponse) GetURIQuery(q string) string {
 	}
 	return ""
 }
+
+// Decodes the payload of the response according to its Content-Format
+func (c *DefaultResponse) DecodePayload(v interface{}) error {
+	return DecodeMessagePayload(c.msg, v)
+}
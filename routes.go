@@ -3,6 +3,8 @@ package coap
 import (
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // CreateCompilableRoutePath creates a RegEx for a valid route path
@@ -74,35 +76,157 @@ type Route struct {
 	RegEx      *regexp.Regexp
 	AutoAck    bool
 	MediaTypes []MediaType
+
+	// Representations the route's resource can be returned in, selected by the Accept option
+	Representations []*Representation
+
+	// ETag returns the current entity-tag of the route's resource, or nil if the resource doesn't
+	// exist. When set, conditional requests are answered with 2.03 Valid or 4.12 Precondition Failed
+	ETag func(req CoapRequest) []byte
+
+	// CoRE Link Format attributes advertised through /.well-known/core
+	ResourceTypes []string
+	Interfaces    []string
+	MaxSize       int
+	Observable    bool
+	Title         string
+	Anchor        string
+	Rel           string
+}
+
+// IsTemplated checks if the route path contains variables (e.g. /users/:id)
+func (r *Route) IsTemplated() bool {
+	_, isStatic := CreateCompilableRoutePath(r.Path)
+
+	return !isStatic
+}
+
+// AddRepresentation adds a media type the route's resource can be returned in. Values of
+// ValuePayload responses are encoded using the encoder, or the media type's registered
+// encoder if enc is nil
+func (r *Route) AddRepresentation(mt MediaType, enc RepresentationEncoder) *Route {
+	if enc == nil {
+		enc = GetRepresentationEncoder(mt)
+	}
+
+	r.Representations = append(r.Representations, &Representation{
+		MediaType: mt,
+		Encoder:   enc,
+	})
+	return r
+}
+
+// Checks if the route accepts request payloads of a Content-Format
+func (r *Route) AcceptsContentFormat(mt MediaType) bool {
+	for _, o := range r.MediaTypes {
+		if o == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCoreResource returns the CoRE Resource describing the route for discovery
+func (r *Route) GetCoreResource() *CoreResource {
+	resource := NewCoreResource()
+	resource.Target = "/" + strings.TrimLeft(r.Path, "/")
+
+	mediaTypes := r.MediaTypes
+	if len(r.Representations) > 0 {
+		mediaTypes = nil
+		for _, representation := range r.Representations {
+			mediaTypes = append(mediaTypes, representation.MediaType)
+		}
+	}
+
+	if len(mediaTypes) > 0 {
+		var cts []string
+		for _, mt := range mediaTypes {
+			cts = append(cts, strconv.Itoa(int(mt)))
+		}
+		resource.AddAttribute(CoreAttributeContentType, strings.Join(cts, " "))
+	}
+
+	if len(r.ResourceTypes) > 0 {
+		resource.AddAttribute(CoreAttributeResourceType, strings.Join(r.ResourceTypes, " "))
+	}
+
+	if len(r.Interfaces) > 0 {
+		resource.AddAttribute(CoreAttributeInterface, strings.Join(r.Interfaces, " "))
+	}
+
+	if r.MaxSize > 0 {
+		resource.AddAttribute(CoreAttributeMaxSize, r.MaxSize)
+	}
+
+	if r.Observable {
+		resource.AddAttribute(CoreAttributeObservable, nil)
+	}
+
+	if r.Title != "" {
+		resource.AddAttribute(CoreAttributeTitle, r.Title)
+	}
+
+	if r.Anchor != "" {
+		resource.AddAttribute(CoreAttributeAnchor, r.Anchor)
+	}
+
+	if r.Rel != "" {
+		resource.AddAttribute(CoreAttributeRelation, r.Rel)
+	}
+
+	return resource
 }
 
-// MatchingRoute checks if a given path matches any defined routes/resources
+// MatchingRoute checks if a given path matches any defined routes/resources. Routes of the same
+// path and method which don't accept the request's Content-Format are skipped, and the first of
+// them is returned along with ErrUnsupportedContentFormat if no other route matches
 func MatchingRoute(path string, method string, cf interface{}, routes []*Route) (*Route, map[string]string, error) {
+	var unsupported *Route
+	var unsupportedAttrs map[string]string
+
 	for _, route := range routes {
 		if method == route.Method {
 			match, attrs := MatchesRoutePath(path, route.RegEx)
 
 			if match {
 				if len(route.MediaTypes) > 0 {
-					if cf == nil {
-						return route, attrs, ErrUnsupportedContentFormat
-					}
-
-					foundMediaType := false
-					for _, o := range route.MediaTypes {
-						if uint32(o) == cf {
-							foundMediaType = true
-							break
+					if mt, ok := contentFormatValue(cf); ok && !route.AcceptsContentFormat(mt) {
+						if unsupported == nil {
+							unsupported, unsupportedAttrs = route, attrs
 						}
-					}
-
-					if !foundMediaType {
-						return route, attrs, ErrUnsupportedContentFormat
+						continue
 					}
 				}
 				return route, attrs, nil
 			}
 		}
 	}
+
+	if unsupported != nil {
+		return unsupported, unsupportedAttrs, ErrUnsupportedContentFormat
+	}
 	return nil, nil, ErrNoMatchingRoute
 }
+
+// Returns the media type of a Content-Format given as an option, a list of options or a MediaType
+func contentFormatValue(cf interface{}) (MediaType, bool) {
+	switch v := cf.(type) {
+	case MediaType:
+		return v, true
+
+	case *Option:
+		if v == nil {
+			return 0, false
+		}
+		mt, _ := optionUintValue(v)
+		return MediaType(mt), true
+
+	case []*Option:
+		if len(v) == 0 {
+			return 0, false
+		}
+		return contentFormatValue(v[0])
+	}
+	return 0, false
+}
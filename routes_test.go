@@ -0,0 +1,39 @@
+package coap
+
+import "testing"
+
+func TestMatchingRouteContentFormat(t *testing.T) {
+	json := CreateNewRoute("/data", MethodPost, nil)
+	json.MediaTypes = []MediaType{MediaTypeApplicationJSON}
+
+	cbor := CreateNewRoute("/data", MethodPost, nil)
+	cbor.MediaTypes = []MediaType{MediaTypeApplicationCBOR}
+
+	plain := CreateNewRoute("/any", MethodPost, nil)
+	routes := []*Route{json, cbor, plain}
+
+	// Routes of the same path and method are tried until one accepts the Content-Format
+	if route, _, err := MatchingRoute("/data", MethodPost, MediaTypeApplicationCBOR, routes); err != nil || route != cbor {
+		t.Errorf("CBOR request matched %v (%v)", route, err)
+	}
+
+	if route, _, err := MatchingRoute("/data", MethodPost, MediaTypeApplicationJSON, routes); err != nil || route != json {
+		t.Errorf("JSON request matched %v (%v)", route, err)
+	}
+
+	if route, _, err := MatchingRoute("/data", MethodPost, nil, routes); err != nil || route != json {
+		t.Errorf("request without Content-Format matched %v (%v)", route, err)
+	}
+
+	if _, _, err := MatchingRoute("/data", MethodPost, MediaTypeTextPlain, routes); err != ErrUnsupportedContentFormat {
+		t.Errorf("text request = %v, want %v", err, ErrUnsupportedContentFormat)
+	}
+
+	if route, _, err := MatchingRoute("/any", MethodPost, MediaTypeTextPlain, routes); err != nil || route != plain {
+		t.Errorf("request to a route without media types matched %v (%v)", route, err)
+	}
+
+	if _, _, err := MatchingRoute("/data", MethodGet, nil, routes); err != ErrNoMatchingRoute {
+		t.Errorf("GET request = %v, want %v", err, ErrNoMatchingRoute)
+	}
+}
@@ -0,0 +1,420 @@
+package coap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// SenMLVersion is the SenML version implemented, which is assumed when records have no base version
+const SenMLVersion = 10
+
+// Times below 2**28 are relative to the current time (RFC 8428 Section 4.5.3)
+const senmlRelativeTimeThreshold = 1 << 28
+
+// SenMLRecord is a SenML record (RFC 8428). Base fields apply to the record and all following
+// records of a pack until they are changed
+type SenMLRecord struct {
+	BaseVersion int     `json:"bver,omitempty" cbor:"-1,omitempty"`
+	BaseName    string  `json:"bn,omitempty" cbor:"-2,omitempty"`
+	BaseTime    float64 `json:"bt,omitempty" cbor:"-3,omitempty"`
+	BaseUnit    string  `json:"bu,omitempty" cbor:"-4,omitempty"`
+	BaseValue   float64 `json:"bv,omitempty" cbor:"-5,omitempty"`
+	BaseSum     float64 `json:"bs,omitempty" cbor:"-6,omitempty"`
+
+	Name        string   `json:"n,omitempty" cbor:"0,omitempty"`
+	Unit        string   `json:"u,omitempty" cbor:"1,omitempty"`
+	Value       *float64 `json:"v,omitempty" cbor:"2,omitempty"`
+	StringValue *string  `json:"vs,omitempty" cbor:"3,omitempty"`
+	BoolValue   *bool    `json:"vb,omitempty" cbor:"4,omitempty"`
+	Sum         *float64 `json:"s,omitempty" cbor:"5,omitempty"`
+	Time        float64  `json:"t,omitempty" cbor:"6,omitempty"`
+	UpdateTime  float64  `json:"ut,omitempty" cbor:"7,omitempty"`
+	DataValue   []byte   `json:"-" cbor:"8,omitempty"`
+}
+
+// Instantiates a new SenML record with a numeric value
+func NewSenMLValue(name string, unit string, v float64) SenMLRecord {
+	return SenMLRecord{Name: name, Unit: unit, Value: &v}
+}
+
+// Instantiates a new SenML record with a string value
+func NewSenMLStringValue(name string, v string) SenMLRecord {
+	return SenMLRecord{Name: name, StringValue: &v}
+}
+
+// Instantiates a new SenML record with a boolean value
+func NewSenMLBoolValue(name string, v bool) SenMLRecord {
+	return SenMLRecord{Name: name, BoolValue: &v}
+}
+
+// Instantiates a new SenML record with a data value
+func NewSenMLDataValue(name string, v []byte) SenMLRecord {
+	return SenMLRecord{Name: name, DataValue: v}
+}
+
+// senmlJSONRecord adds the data value, which JSON carries in base64url without padding
+type senmlJSONRecord struct {
+	senmlRecordFields
+	DataValue *string `json:"vd,omitempty"`
+}
+
+// An alias of SenMLRecord without its JSON methods
+type senmlRecordFields SenMLRecord
+
+func (r SenMLRecord) MarshalJSON() ([]byte, error) {
+	rec := senmlJSONRecord{senmlRecordFields: senmlRecordFields(r)}
+	if r.DataValue != nil {
+		vd := base64.RawURLEncoding.EncodeToString(r.DataValue)
+		rec.DataValue = &vd
+	}
+	return json.Marshal(rec)
+}
+
+func (r *SenMLRecord) UnmarshalJSON(data []byte) error {
+	var rec senmlJSONRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	*r = SenMLRecord(rec.senmlRecordFields)
+
+	if rec.DataValue != nil {
+		// Padding is tolerated although senders must not use it
+		vd, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*rec.DataValue, "="))
+		if err != nil {
+			return ErrInvalidSenML
+		}
+		r.DataValue = vd
+	}
+	return nil
+}
+
+// Checks if the record has a value of any type or a sum
+func (r SenMLRecord) HasValue() bool {
+	return r.Value != nil || r.StringValue != nil || r.BoolValue != nil || r.DataValue != nil || r.Sum != nil
+}
+
+// Returns the absolute time of a resolved record
+func (r SenMLRecord) GetTime() time.Time {
+	sec, frac := math.Modf(r.Time)
+
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// SenMLPack is a list of SenML records
+type SenMLPack []SenMLRecord
+
+// Resolve returns the resolved records of the pack (RFC 8428 Section 4.6): base fields are
+// applied to each record and removed, and relative times are made absolute using the current time
+func (p SenMLPack) Resolve() (SenMLPack, error) {
+	return p.ResolveAt(time.Now())
+}
+
+// ResolveAt resolves the records of the pack, making relative times absolute using the given time
+func (p SenMLPack) ResolveAt(now time.Time) (SenMLPack, error) {
+	var base SenMLRecord
+	resolved := make(SenMLPack, 0, len(p))
+
+	nowSec := float64(now.UnixNano()) / 1e9
+	for _, r := range p {
+		if r.BaseVersion > SenMLVersion {
+			return nil, ErrUnsupportedSenMLVersion
+		}
+
+		if r.BaseName != "" {
+			base.BaseName = r.BaseName
+		}
+		if r.BaseTime != 0 {
+			base.BaseTime = r.BaseTime
+		}
+		if r.BaseUnit != "" {
+			base.BaseUnit = r.BaseUnit
+		}
+		if r.BaseValue != 0 {
+			base.BaseValue = r.BaseValue
+		}
+		if r.BaseSum != 0 {
+			base.BaseSum = r.BaseSum
+		}
+
+		if !r.HasValue() {
+			return nil, ErrInvalidSenML
+		}
+
+		rec := SenMLRecord{
+			Name:        base.BaseName + r.Name,
+			Unit:        r.Unit,
+			StringValue: r.StringValue,
+			BoolValue:   r.BoolValue,
+			DataValue:   r.DataValue,
+			Time:        base.BaseTime + r.Time,
+			UpdateTime:  r.UpdateTime,
+		}
+
+		if !IsValidSenMLName(rec.Name) {
+			return nil, ErrInvalidSenML
+		}
+
+		if rec.Unit == "" {
+			rec.Unit = base.BaseUnit
+		}
+
+		if r.Value != nil {
+			v := base.BaseValue + *r.Value
+			rec.Value = &v
+		}
+
+		if r.Sum != nil {
+			s := base.BaseSum + *r.Sum
+			rec.Sum = &s
+		}
+
+		if rec.Time < senmlRelativeTimeThreshold {
+			rec.Time += nowSec
+		}
+		resolved = append(resolved, rec)
+	}
+	return resolved, nil
+}
+
+// IsValidSenMLName checks if a resolved name only contains the characters allowed by SenML
+// and starts with a letter or digit
+func IsValidSenMLName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+
+		case i > 0 && strings.ContainsRune("-:./_", c):
+
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeSenMLJSON encodes a pack as application/senml+json
+func EncodeSenMLJSON(pack SenMLPack) ([]byte, error) {
+	if pack == nil {
+		pack = SenMLPack{}
+	}
+	return json.Marshal(pack)
+}
+
+// DecodeSenMLJSON decodes an application/senml+json pack
+func DecodeSenMLJSON(data []byte) (SenMLPack, error) {
+	var pack SenMLPack
+	if err := json.Unmarshal(data, &pack); err != nil {
+		return nil, ErrInvalidSenML
+	}
+	return pack, nil
+}
+
+// EncodeSenMLCBOR encodes a pack as application/senml+cbor
+func EncodeSenMLCBOR(pack SenMLPack) ([]byte, error) {
+	if pack == nil {
+		pack = SenMLPack{}
+	}
+	return CBORMarshal(pack)
+}
+
+// DecodeSenMLCBOR decodes an application/senml+cbor pack
+func DecodeSenMLCBOR(data []byte) (SenMLPack, error) {
+	var pack SenMLPack
+	if err := CBORUnmarshal(data, &pack); err != nil {
+		return nil, ErrInvalidSenML
+	}
+	return pack, nil
+}
+
+// Converts the values returned by handlers (a pack, a list of records or a single record) to a pack
+func toSenMLPack(v interface{}) (SenMLPack, error) {
+	switch t := v.(type) {
+	case SenMLPack:
+		return t, nil
+
+	case []SenMLRecord:
+		return SenMLPack(t), nil
+
+	case SenMLRecord:
+		return SenMLPack{t}, nil
+
+	case *SenMLRecord:
+		return SenMLPack{*t}, nil
+	}
+	return nil, ErrUnsupportedRepresentation
+}
+
+// Decodes a pack into the value pointed to by v, which is a *SenMLPack or *[]SenMLRecord
+func setSenMLPack(pack SenMLPack, v interface{}) error {
+	switch t := v.(type) {
+	case *SenMLPack:
+		*t = pack
+
+	case *[]SenMLRecord:
+		*t = pack
+
+	default:
+		return ErrUnsupportedRepresentation
+	}
+	return nil
+}
+
+func init() {
+	RegisterRepresentationEncoder(MediaTypeApplicationSenMLJSON, func(v interface{}) ([]byte, error) {
+		pack, err := toSenMLPack(v)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeSenMLJSON(pack)
+	})
+
+	RegisterRepresentationEncoder(MediaTypeApplicationSenMLCBOR, func(v interface{}) ([]byte, error) {
+		pack, err := toSenMLPack(v)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeSenMLCBOR(pack)
+	})
+
+	RegisterRepresentationDecoder(MediaTypeApplicationSenMLJSON, func(data []byte, v interface{}) error {
+		pack, err := DecodeSenMLJSON(data)
+		if err != nil {
+			return err
+		}
+		return setSenMLPack(pack, v)
+	})
+
+	RegisterRepresentationDecoder(MediaTypeApplicationSenMLCBOR, func(data []byte, v interface{}) error {
+		pack, err := DecodeSenMLCBOR(data)
+		if err != nil {
+			return err
+		}
+		return setSenMLPack(pack, v)
+	})
+}
+
+// DecodeSenMLPayload decodes the SenML pack of a message in application/senml+json or
+// application/senml+cbor
+func DecodeSenMLPayload(msg *Message) (SenMLPack, error) {
+	mt, _ := msg.GetContentFormat()
+	if mt != MediaTypeApplicationSenMLJSON && mt != MediaTypeApplicationSenMLCBOR {
+		return nil, ErrUnsupportedPayloadFormat
+	}
+
+	var pack SenMLPack
+	if err := DecodeMessagePayload(msg, &pack); err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// Sets a SenML pack as the payload of a message in application/senml+json or application/senml+cbor
+func SetSenMLPayload(msg *Message, pack SenMLPack, mt MediaType) error {
+	switch mt {
+	case MediaTypeApplicationSenMLJSON:
+		msg.Payload = NewSenMLJSONPayload(pack)
+
+	case MediaTypeApplicationSenMLCBOR:
+		msg.Payload = NewSenMLCBORPayload(pack)
+
+	default:
+		return ErrUnsupportedPayloadFormat
+	}
+
+	msg.RemoveOptions(OptionContentFormat)
+	msg.AddOption(OptionContentFormat, mt)
+
+	return nil
+}
+
+// Creates a 2.05 Content response to a request carrying a SenML pack, in application/senml+cbor
+// if the request accepts it and in application/senml+json otherwise. Routes with representations
+// encode the pack in the negotiated representation instead
+func NewSenMLResponse(req CoapRequest, records []SenMLRecord) CoapResponse {
+	msg := req.GetMessage()
+	resp := ContentMessage(msg.MessageID, MessageAcknowledgment)
+	resp.Token = msg.Token
+
+	mt := MediaTypeApplicationSenMLJSON
+	if accept, ok := msg.GetAccept(); ok && accept == MediaTypeApplicationSenMLCBOR {
+		mt = MediaTypeApplicationSenMLCBOR
+	}
+
+	resp.AddOption(OptionContentFormat, mt)
+	resp.Payload = NewValuePayload(SenMLPack(records))
+
+	return NewResponseWithMessage(resp)
+}
+
+// Instantiates a new message payload containing a SenML pack in application/senml+json
+func NewSenMLJSONPayload(pack SenMLPack) MessagePayload {
+	return &SenMLJSONPayload{
+		Pack: pack,
+	}
+}
+
+// Represents a message payload containing a SenML pack in application/senml+json
+type SenMLJSONPayload struct {
+	Pack SenMLPack
+}
+
+func (p *SenMLJSONPayload) GetBytes() []byte {
+	b, err := EncodeSenMLJSON(p.Pack)
+
+	if err != nil {
+		log.Println(err)
+
+		return []byte{}
+	}
+
+	return b
+}
+
+func (p *SenMLJSONPayload) Length() int {
+	return len(p.GetBytes())
+}
+
+func (p *SenMLJSONPayload) String() string {
+	return string(p.GetBytes())
+}
+
+// Instantiates a new message payload containing a SenML pack in application/senml+cbor
+func NewSenMLCBORPayload(pack SenMLPack) MessagePayload {
+	return &SenMLCBORPayload{
+		Pack: pack,
+	}
+}
+
+// Represents a message payload containing a SenML pack in application/senml+cbor
+type SenMLCBORPayload struct {
+	Pack SenMLPack
+}
+
+func (p *SenMLCBORPayload) GetBytes() []byte {
+	b, err := EncodeSenMLCBOR(p.Pack)
+
+	if err != nil {
+		log.Println(err)
+
+		return []byte{}
+	}
+
+	return b
+}
+
+func (p *SenMLCBORPayload) Length() int {
+	return len(p.GetBytes())
+}
+
+// Returns the payload in CBOR diagnostic notation
+func (p *SenMLCBORPayload) String() string {
+	return CBORDiagnostic(p.GetBytes())
+}
@@ -0,0 +1,169 @@
+package coap
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func senmlTestPack() SenMLPack {
+	first := NewSenMLValue("voltage", "V", 120.1)
+	first.BaseName = "urn:dev:ow:10e2073a01080063:"
+	first.BaseTime = 1.320067464e+09
+	first.BaseVersion = SenMLVersion
+
+	current := NewSenMLValue("current", "A", 1.2)
+	current.Time = -5
+
+	return SenMLPack{
+		first,
+		current,
+		NewSenMLStringValue("state", "on"),
+		NewSenMLBoolValue("open", true),
+		NewSenMLDataValue("raw", []byte{0xfb, 0xff, 0x00}),
+	}
+}
+
+func TestSenMLJSONRoundTrip(t *testing.T) {
+	pack := senmlTestPack()
+
+	b, err := EncodeSenMLJSON(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeSenMLJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, pack) {
+		t.Fatalf("round trip changed the pack: %s", b)
+	}
+
+	// Data values are base64url encoded without padding
+	if got := string(b); !strings.Contains(got, `"vd":"-_8A"`) {
+		t.Fatalf("data value not encoded in base64url: %s", got)
+	}
+}
+
+func TestSenMLCBORRoundTrip(t *testing.T) {
+	pack := senmlTestPack()
+
+	b, err := EncodeSenMLCBOR(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeSenMLCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, pack) {
+		t.Fatalf("round trip changed the pack: %x", b)
+	}
+
+	// Labels are encoded as integers (RFC 8428 Section 6)
+	b, err = EncodeSenMLCBOR(SenMLPack{NewSenMLValue("t", "", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := hex.EncodeToString(b), "81a200617402f93c00"; got != want {
+		t.Fatalf("EncodeSenMLCBOR = %s, want %s", got, want)
+	}
+}
+
+func TestSenMLDecodeInvalid(t *testing.T) {
+	for _, data := range []string{``, `{}`, `[{"v":"x"}]`, `[{"vd":"!!"}]`, `[1]`} {
+		if _, err := DecodeSenMLJSON([]byte(data)); err != ErrInvalidSenML {
+			t.Errorf("DecodeSenMLJSON(%s) = %v, want %v", data, err, ErrInvalidSenML)
+		}
+	}
+
+	for _, data := range []string{"", "a1", "81a1026174", "8101"} {
+		b, _ := hex.DecodeString(data)
+		if _, err := DecodeSenMLCBOR(b); err != ErrInvalidSenML {
+			t.Errorf("DecodeSenMLCBOR(%s) = %v, want %v", data, err, ErrInvalidSenML)
+		}
+	}
+}
+
+func TestSenMLResolve(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	resolved, err := senmlTestPack().ResolveAt(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resolved[1].Name; got != "urn:dev:ow:10e2073a01080063:current" {
+		t.Errorf("name = %q", got)
+	}
+
+	if got := resolved[1].Time; got != 1.320067459e+09 {
+		t.Errorf("time = %v", got)
+	}
+
+	if got := resolved[1].Unit; got != "A" {
+		t.Errorf("unit = %q", got)
+	}
+
+	// Times below 2**28 are relative to now
+	relative, err := SenMLPack{NewSenMLValue("a", "", 1)}.ResolveAt(now)
+	if err != nil || relative[0].Time != 1500000000 {
+		t.Errorf("relative time = %v (%v)", relative[0].Time, err)
+	}
+
+	tests := []struct {
+		pack SenMLPack
+		err  error
+	}{
+		{SenMLPack{{Name: "novalue"}}, ErrInvalidSenML},
+		{SenMLPack{NewSenMLValue("-bad", "", 1)}, ErrInvalidSenML},
+		{SenMLPack{NewSenMLValue("a b", "", 1)}, ErrInvalidSenML},
+		{SenMLPack{{BaseVersion: SenMLVersion + 1, Name: "a", Value: new(float64)}}, ErrUnsupportedSenMLVersion},
+	}
+
+	for _, test := range tests {
+		if _, err := test.pack.ResolveAt(now); err != test.err {
+			t.Errorf("ResolveAt(%+v) = %v, want %v", test.pack, err, test.err)
+		}
+	}
+}
+
+func TestSenMLPayload(t *testing.T) {
+	for _, mt := range []MediaType{MediaTypeApplicationSenMLJSON, MediaTypeApplicationSenMLCBOR} {
+		msg := NewMessage(MessageConfirmable, Post, 1)
+		if err := SetSenMLPayload(msg, senmlTestPack(), mt); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := MessageToBytes(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := BytesToMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pack, err := DecodeSenMLPayload(decoded)
+		if err != nil {
+			t.Fatalf("DecodeSenMLPayload(%d) failed: %v", mt, err)
+		}
+
+		if !reflect.DeepEqual(pack, senmlTestPack()) {
+			t.Fatalf("payload round trip changed the pack in %d", mt)
+		}
+	}
+
+	msg := NewMessage(MessageConfirmable, Post, 1)
+	if err := SetSenMLPayload(msg, nil, MediaTypeTextPlain); err != ErrUnsupportedPayloadFormat {
+		t.Fatalf("SetSenMLPayload(text/plain) = %v", err)
+	}
+}
@@ -3,10 +3,8 @@ package coap
 import (
 	//"github.com/streamrail/concurrent-map"
 	"sync"
-	"bytes"
 	"log"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 	//"fmt"
@@ -19,24 +17,132 @@ type Responser struct {
 
 type AwaitResponseHandler func(respMsg *Message)
 
-var awaitResponsePool map[uint16]AwaitResponseHandler
+var awaitResponsePool = make(map[uint16]AwaitResponseHandler)
+var awaitTokenResponsePool = make(map[string]AwaitResponseHandler)
+var awaitResponseMutex sync.Mutex
+
 func initResponser() {
 	/*responser = &Responser{}
 	responser.Msg = make(chan *Message)*/
-	awaitResponsePool = make(map[uint16]AwaitResponseHandler)
+	awaitResponseMutex.Lock()
+	if awaitResponsePool == nil {
+		awaitResponsePool = make(map[uint16]AwaitResponseHandler)
+	}
+	awaitResponseMutex.Unlock()
 }
 func RegisterAwaitResponseHandler(messageId uint16, handler AwaitResponseHandler) {
+	awaitResponseMutex.Lock()
 	awaitResponsePool[messageId] = handler
-}
-func RunAwaitResponseHandler(msg *Message) {
-	handler, ok := awaitResponsePool[msg.MessageID]
-	if ok {
-		// remove from Pool
-		delete(awaitResponsePool, msg.MessageID)
+	awaitResponseMutex.Unlock()
+}
+func UnregisterAwaitResponseHandler(messageId uint16) {
+	awaitResponseMutex.Lock()
+	delete(awaitResponsePool, messageId)
+	awaitResponseMutex.Unlock()
+}
+
+// Registers a handler for responses matching a token, such as separate responses which
+// aren't piggybacked in the acknowledgement of a request
+func RegisterAwaitTokenResponseHandler(token []byte, handler AwaitResponseHandler) {
+	awaitResponseMutex.Lock()
+	awaitTokenResponsePool[string(token)] = handler
+	awaitResponseMutex.Unlock()
+}
+func UnregisterAwaitTokenResponseHandler(token []byte) {
+	awaitResponseMutex.Lock()
+	delete(awaitTokenResponsePool, string(token))
+	awaitResponseMutex.Unlock()
+}
+
+// Runs the handler awaiting a message, if any. Acknowledgements and resets are matched by
+// message id, other responses by token. Returns true if a handler was found
+func RunAwaitResponseHandler(msg *Message) bool {
+	var handler AwaitResponseHandler
+	var ok bool
+
+	awaitResponseMutex.Lock()
+	if msg.MessageType == MessageAcknowledgment || msg.MessageType == MessageReset {
+		handler, ok = awaitResponsePool[msg.MessageID]
+		if ok {
+			// remove from Pool
+			delete(awaitResponsePool, msg.MessageID)
+		}
+	}
+
+	if !ok && len(msg.Token) > 0 && IsResponseCode(msg.Code) {
+		handler, ok = awaitTokenResponsePool[string(msg.Token)]
+	}
+	awaitResponseMutex.Unlock()
 
+	if ok {
 		// fire on!
 		handler(msg)
 	}
+	return ok
+}
+
+// SendAndWaitForResponse sends a request through a started server/client to the given address
+// and blocks until its response is received or the timeout elapses. Both piggybacked and separate
+// responses are returned, as are resets rejecting the request. Requests challenged with an Echo
+// option are sent once more echoing its value (RFC 9175 Section 2.3)
+func SendAndWaitForResponse(s CoapServer, req CoapRequest, addr *net.UDPAddr, timeout time.Duration) (*Message, error) {
+	resp, err := sendAndWaitForResponse(s, req, addr, timeout)
+	if err != nil || resp.Code != CoapCodeUnauthorized {
+		return resp, err
+	}
+
+	echo := resp.GetOption(OptionEcho)
+	if echo == nil {
+		return resp, nil
+	}
+
+	msg := req.GetMessage().Clone()
+	msg.MessageID = GenerateMessageID()
+	msg.RemoveOptions(OptionEcho)
+	msg.AddOption(OptionEcho, echo.Value)
+
+	return sendAndWaitForResponse(s, NewRequestFromMessage(msg), addr, timeout)
+}
+
+// Sends a request and waits for its response, see SendAndWaitForResponse
+func sendAndWaitForResponse(s CoapServer, req CoapRequest, addr *net.UDPAddr, timeout time.Duration) (*Message, error) {
+	msg := req.GetMessage()
+	msgID := msg.MessageID
+	ch := make(chan *Message, 1)
+
+	handler := func(respMsg *Message) {
+		select {
+		case ch <- respMsg:
+		default:
+		}
+	}
+
+	RegisterAwaitResponseHandler(msgID, handler)
+	defer UnregisterAwaitResponseHandler(msgID)
+
+	if len(msg.Token) > 0 {
+		RegisterAwaitTokenResponseHandler(msg.Token, handler)
+		defer UnregisterAwaitTokenResponseHandler(msg.Token)
+	}
+
+	if _, err := s.SendTo(req, addr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case respMsg := <-ch:
+			// An empty acknowledgement announces a separate response
+			if respMsg.MessageType == MessageAcknowledgment && respMsg.Code == CoapCodeEmpty && len(msg.Token) > 0 {
+				continue
+			}
+			return respMsg, nil
+
+		case <-deadline:
+			return nil, ErrResponseTimeout
+		}
+	}
 }
 
 type ProxyType int
@@ -81,7 +187,8 @@ func NewServer(local, remote string) CoapServer {
 		observations:      make(map[string][]*Observation),
 		fnHandleCOAPProxy: NullProxyHandler,
 		fnHandleHTTPProxy: NullProxyHandler,
-		fnProxyFilter:     NullProxyFilter,
+		proxyFilters:      NewProxyFilterChain(),
+		maxTokenLength:    DefaultMaxTokenLength,
 		stopChannel:       make(chan int),
 	}
 }
@@ -106,7 +213,12 @@ type DefaultCoapServer struct {
 
 	fnHandleHTTPProxy ProxyHandler
 	fnHandleCOAPProxy ProxyHandler
-	fnProxyFilter     ProxyFilter
+	proxyFilters      *ProxyFilterChain
+	proxyCache        *ProxyCache
+
+	maxTokenLength int
+	echoPolicy     *EchoPolicy
+	blockSize      int
 
 	stopChannel chan int
 }
@@ -116,50 +228,28 @@ func (s *DefaultCoapServer) GetEvents() *Events {
 }
 
 func (s *DefaultCoapServer) Start() {
+	s.NewRoute("/.well-known/core", Get, s.handleDiscoveryRequest)
+	initResponser()
+	s.serveServer()
+}
 
-	var discoveryRoute RouteHandler = func(req CoapRequest) CoapResponse {
-		msg := req.GetMessage()
-
-		ack := ContentMessage(msg.MessageID, MessageAcknowledgment)
-		ack.Token = make([]byte, len(msg.Token))
-		copy(ack.Token, msg.Token)
-
-		ack.AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
-
-		var buf bytes.Buffer
-		for _, r := range s.routes {
-			if r.Path != ".well-known/core" {
-				buf.WriteString("</")
-				buf.WriteString(r.Path)
-				buf.WriteString(">")
-
-				// Media Types
-				lenMt := len(r.MediaTypes)
-				if lenMt > 0 {
-					buf.WriteString(";ct=")
-					for idx, mt := range r.MediaTypes {
+// Responds to /.well-known/core with the server's resources in CoRE Link Format,
+// filtered by any queries (e.g. ?rt=temperature or ?href=/sensors*) in the request
+func (s *DefaultCoapServer) handleDiscoveryRequest(req CoapRequest) CoapResponse {
+	msg := req.GetMessage()
+	s.events.Discover()
 
-						buf.WriteString(strconv.Itoa(int(mt)))
-						if idx+1 < lenMt {
-							buf.WriteString(" ")
-						}
-					}
-				}
+	ack := ContentMessage(msg.MessageID, MessageAcknowledgment)
+	ack.Token = make([]byte, len(msg.Token))
+	copy(ack.Token, msg.Token)
 
-				buf.WriteString(",")
-				// buf.WriteString("</" + r.Path + ">;ct=0,")
-			}
-		}
-		ack.Payload = NewPlainTextPayload(buf.String())
+	ack.AddOption(OptionContentFormat, MediaTypeApplicationLinkFormat)
 
-		resp := NewResponseWithMessage(ack)
+	resources := CoreResourcesFromRoutes(s.routes)
+	resources = FilterCoreResources(resources, msg.GetOptionsAsString(OptionURIQuery))
+	ack.Payload = NewCoreLinkFormatPayload(resources)
 
-		return resp
-	}
-
-	s.NewRoute("/.well-known/core", Get, discoveryRoute)
-	initResponser()
-	s.serveServer()
+	return NewResponseWithMessage(ack)
 }
 
 func (s *DefaultCoapServer) serveServer() {
@@ -183,7 +273,6 @@ func (s *DefaultCoapServer) serveServer() {
 	s.events.Started(s)
 	s.handleMessageIDPurge()
 
-	readBuf := make([]byte, MaxPacketSize)
 	for {
 		select {
 		case <-s.stopChannel:
@@ -193,14 +282,17 @@ func (s *DefaultCoapServer) serveServer() {
 			// continue
 		}
 
-		len, addr, err := conn.ReadFromUDP(readBuf)
+		// Decoded messages don't reference the read buffer, which is returned to the pool once handled
+		readBuf := getMessageBuffer()
+		len, addr, err := conn.ReadFromUDP(*readBuf)
 //fmt.Println("ReadFromUDP: ", len, err)
 		if err == nil {
-
-			msgBuf := make([]byte, len)
-			copy(msgBuf, readBuf)
-
-			go s.handleMessage(msgBuf, conn, addr)
+			go func() {
+				s.handleMessage((*readBuf)[:len], conn, addr)
+				putMessageBuffer(readBuf)
+			}()
+		} else {
+			putMessageBuffer(readBuf)
 		}
 	}
 }
@@ -239,16 +331,83 @@ func (s *DefaultCoapServer) handleMessageIDPurge() {
 	}()
 }
 
+// Sets the longest token the server accepts. Lengths above 8 enable extended token lengths
+// (RFC 8974), and are limited to MaxTokenLength
+func (s *DefaultCoapServer) SetMaxTokenLength(n int) {
+	if n < DefaultMaxTokenLength {
+		n = DefaultMaxTokenLength
+	} else if n > MaxTokenLength {
+		n = MaxTokenLength
+	}
+	s.maxTokenLength = n
+}
+
+// Returns the longest token the server accepts
+func (s *DefaultCoapServer) GetMaxTokenLength() int {
+	return s.maxTokenLength
+}
+
+// Sets the policy deciding which requests are challenged with an Echo option before they are
+// handled. A nil policy challenges no requests
+func (s *DefaultCoapServer) SetEchoPolicy(policy *EchoPolicy) {
+	s.echoPolicy = policy
+}
+
+// Returns the Echo policy of the server, if any
+func (s *DefaultCoapServer) GetEchoPolicy() *EchoPolicy {
+	return s.echoPolicy
+}
+
+// Enables block-wise transfers of responses (RFC 7959): 2.05 Content representations larger
+// than a block are split into Block2 blocks, of which the client requests the one it needs.
+// Sizes are rounded down to a power of two between 16 and 1024. Zero, the default, sends
+// representations whole
+func (s *DefaultCoapServer) SetBlockSize(size int) {
+	if size > 0 {
+		size = NewBlockOption(0, false, size).Size()
+	} else {
+		size = 0
+	}
+	s.blockSize = size
+}
+
+// Returns the block size of block-wise transfers of responses, or zero if they are disabled
+func (s *DefaultCoapServer) GetBlockSize() int {
+	return s.blockSize
+}
+
+// Sets a single filter deciding which requests are proxied, replacing the server's filter chain
 func (s *DefaultCoapServer) SetProxyFilter(fn ProxyFilter) {
-	s.fnProxyFilter = fn
+	s.proxyFilters = NewProxyFilterChain(ProxyFilterFunc(fn))
+}
+
+// Sets the chain of filters deciding which requests are proxied
+func (s *DefaultCoapServer) SetProxyFilterChain(chain *ProxyFilterChain) {
+	s.proxyFilters = chain
+}
+
+// Returns the chain of filters deciding which requests are proxied
+func (s *DefaultCoapServer) GetProxyFilterChain() *ProxyFilterChain {
+	return s.proxyFilters
 }
 
 func (s *DefaultCoapServer) handleMessage(msgBuf []byte, conn *net.UDPConn, addr *net.UDPAddr) {
 	//fmt.Println("handleMessage: ")
 	msg, err := BytesToMessage(msgBuf)
+	if IsMessageFormatError(err) {
+		s.events.Error(err)
+		handleReqMalformedMessage(s, err, msg, conn, addr)
+		return
+	}
+
+	if len(msg.Token) > s.maxTokenLength {
+		s.events.Error(ErrTokenTooLong)
+		handleReqTokenTooLong(s, msg, conn, addr)
+		return
+	}
 	s.events.Message(msg, true)
 //fmt.Println(msg.MessageType)
-	if msg.MessageType == MessageAcknowledgment {
+	if msg.MessageType == MessageAcknowledgment || msg.MessageType == MessageReset || IsResponseCode(msg.Code) {
 		handleResponse(s, msg, conn, addr)
 	} else {
 		handleRequest(s, err, msg, conn, addr)
@@ -293,6 +452,21 @@ func (s *DefaultCoapServer) NewRoute(path string, method CoapCode, fn RouteHandl
 	return route
 }
 
+// Adds routes forwarding all requests below a path prefix (e.g. /site-a) to a pool of
+// upstreams, and starts checking the health of the upstreams
+func (s *DefaultCoapServer) ReverseProxy(prefix string, pool *UpstreamPool) *ReverseProxy {
+	proxy := NewReverseProxy(s, prefix, pool)
+
+	for _, path := range proxy.GetRoutePaths() {
+		for _, method := range []CoapCode{Get, Post, Put, Delete} {
+			s.NewRoute(path, method, proxy.Handle)
+		}
+	}
+	pool.StartHealthCheck(s)
+
+	return proxy
+}
+
 func (s *DefaultCoapServer) Send(req CoapRequest) (CoapResponse, error) {
 	s.events.Message(req.GetMessage(), false)
 	response, err := SendMessageTo(req.GetMessage(), NewUDPConnection(s.localConn), s.remoteAddr)
@@ -336,13 +510,33 @@ func (s *DefaultCoapServer) NotifyChange(resource, value string, confirm bool) {
 			req.SetStringPayload(value)
 			req.SetRequestURI(r.Resource)
 			r.NotifyCount++
-			req.GetMessage().AddOption(OptionObserve, r.NotifyCount)
+			req.GetMessage().AddOption(OptionObserve, r.NotifyCount&0xffffff)
 
 			go s.SendTo(req, r.Addr)
 		}
 	}
 }
 
+// NotifyChangePayload notifies the observers of a resource with a payload of a media type
+func (s *DefaultCoapServer) NotifyChangePayload(resource string, payload MessagePayload, mt MediaType, confirm bool) {
+	msgType := uint8(MessageNonConfirmable)
+	if confirm {
+		msgType = MessageConfirmable
+	}
+
+	for _, r := range s.observations[resource] {
+		r.NotifyCount++
+
+		msg := ContentMessage(GenerateMessageID(), msgType)
+		msg.Token = []byte(r.Token)
+		msg.AddOption(OptionObserve, r.NotifyCount&0xffffff)
+		msg.AddOption(OptionContentFormat, mt)
+		msg.Payload = payload
+
+		go s.SendTo(NewRequestFromMessage(msg), r.Addr)
+	}
+}
+
 func (s *DefaultCoapServer) AddObservation(resource, token string, addr *net.UDPAddr) {
 	s.observations[resource] = append(s.observations[resource], NewObservation(addr, token, resource))
 }
@@ -419,7 +613,7 @@ func (s *DefaultCoapServer) OnMessage(fn FnEventMessage) {
 
 func (s *DefaultCoapServer) ProxyHTTP(enabled bool) {
 	if enabled {
-		s.fnHandleHTTPProxy = HTTPProxyHandler
+		s.fnHandleHTTPProxy = s.cachingProxyHandler(defaultHTTPProxy.Forward)
 	} else {
 		s.fnHandleHTTPProxy = NullProxyHandler
 	}
@@ -427,14 +621,59 @@ func (s *DefaultCoapServer) ProxyHTTP(enabled bool) {
 
 func (s *DefaultCoapServer) ProxyCoap(enabled bool) {
 	if enabled {
-		s.fnHandleCOAPProxy = COAPProxyHandler
+		cached := s.cachingProxyHandler(COAPProxyForward)
+		s.fnHandleCOAPProxy = func(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
+			// Observations are relayed by the proxy and never answered from the cache
+			if msg.GetOption(OptionObserve) != nil {
+				COAPProxyHandler(msg, conn, addr)
+				return
+			}
+			cached(msg, conn, addr)
+		}
 	} else {
 		s.fnHandleCOAPProxy = NullProxyHandler
 	}
 }
 
+// Sets the cache used by the built-in CoAP and HTTP proxy handlers. A nil cache disables caching
+func (s *DefaultCoapServer) SetProxyCache(cache *ProxyCache) {
+	s.proxyCache = cache
+}
+
+// Returns the cache used by the built-in proxy handlers, or nil if caching is disabled
+func (s *DefaultCoapServer) GetProxyCache() *ProxyCache {
+	return s.proxyCache
+}
+
+// Creates a ProxyHandler which answers from the server's proxy cache when one is set
+func (s *DefaultCoapServer) cachingProxyHandler(fwd ProxyForwarder) ProxyHandler {
+	return NewProxyHandler(func(msg *Message) *Message {
+		if s.proxyCache != nil {
+			return s.proxyCache.Forward(fwd)(msg)
+		}
+		return fwd(msg)
+	})
+}
+
+// Sets the handler for proxied requests of a given type, e.g. to forward CoAP-HTTP
+// requests using a custom HTTP client: s.SetProxyHandler(ProxyHTTP, NewHTTPProxy(client).Handle)
+func (s *DefaultCoapServer) SetProxyHandler(proxyType ProxyType, fn ProxyHandler) {
+	switch proxyType {
+	case ProxyHTTP:
+		s.fnHandleHTTPProxy = fn
+
+	case ProxyCOAP:
+		s.fnHandleCOAPProxy = fn
+	}
+}
+
 func (s *DefaultCoapServer) AllowProxyForwarding(msg *Message, addr *net.UDPAddr) bool {
-	return s.fnProxyFilter(msg, addr)
+	return s.FilterProxyRequest(msg, addr).Allowed
+}
+
+// Applies the server's proxy filter chain to a request
+func (s *DefaultCoapServer) FilterProxyRequest(msg *Message, addr *net.UDPAddr) ProxyFilterResult {
+	return s.proxyFilters.Filter(msg, addr)
 }
 
 func (s *DefaultCoapServer) ForwardCoap(msg *Message, conn *net.UDPConn, addr *net.UDPAddr) {
@@ -0,0 +1,300 @@
+package coap
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Default ports of the CoAP URI schemes (RFC 7252 Section 6, RFC 8323 Section 8)
+var coapSchemePorts = map[string]int{
+	"coap":      CoapDefaultPort,
+	"coaps":     CoapsDefaultPort,
+	"coap+tcp":  CoapDefaultPort,
+	"coaps+tcp": CoapsDefaultPort,
+	"coap+ws":   80,
+	"coaps+ws":  443,
+}
+
+// Returns the default port of a CoAP URI scheme, or zero if the scheme isn't a CoAP scheme
+func CoapSchemeDefaultPort(scheme string) int {
+	return coapSchemePorts[strings.ToLower(scheme)]
+}
+
+// Determines if a URI is an absolute URI with a CoAP scheme
+func IsCoapURI(uri string) bool {
+	u, err := url.Parse(uri)
+
+	return err == nil && u.Host != "" && CoapSchemeDefaultPort(u.Scheme) != 0
+}
+
+// CoapURIOptions splits an absolute CoAP URI into the Uri-Host, Uri-Port, Uri-Path and Uri-Query
+// options of a request targeting it (RFC 7252 Section 6.4). Uri-Host is omitted for IP literals,
+// and Uri-Port for the default port of the scheme. Percent-encoded characters are decoded
+func CoapURIOptions(uri string) ([]*Option, error) {
+	_, opts, err := coapURIOptions(uri)
+
+	return opts, err
+}
+
+// CoapURIFromMessage composes the URI of a request from its Uri-Host, Uri-Port, Uri-Path and
+// Uri-Query options (RFC 7252 Section 6.5). Without Uri-Host or Uri-Port, the host and port the
+// request is sent to are used. The port is elided if it is the default port of the scheme
+func CoapURIFromMessage(msg *Message, scheme, host string, port int) (string, error) {
+	defaultPort := CoapSchemeDefaultPort(scheme)
+	if defaultPort == 0 {
+		return "", ErrInvalidRequestURI
+	}
+
+	if opt := msg.GetOption(OptionURIHost); opt != nil {
+		host = opt.StringValue()
+	}
+
+	if opt := msg.GetOption(OptionURIPort); opt != nil {
+		port = opt.IntValue()
+	}
+
+	if host == "" {
+		return "", ErrInvalidRequestURI
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.ToLower(scheme))
+	b.WriteString("://")
+
+	if strings.Contains(host, ":") {
+		// IPv6 literals are enclosed in brackets, with the zone delimiter percent-encoded (RFC 6874)
+		b.WriteString("[" + strings.Replace(host, "%", "%25", 1) + "]")
+	} else {
+		b.WriteString(escapeURIComponent(host, "!$&'()*+,;="))
+	}
+
+	if port != 0 && port != defaultPort {
+		b.WriteString(":" + strconv.Itoa(port))
+	}
+
+	writeURIPathQuery(&b, msg.GetOptions(OptionURIPath), msg.GetOptions(OptionURIQuery))
+
+	return b.String(), nil
+}
+
+// LocationOptions splits a relative reference with an absolute path (e.g. "/a/b?c=d") into
+// Location-Path and Location-Query options. The "." and ".." segments aren't allowed
+// (RFC 7252 Section 5.10.7)
+func LocationOptions(location string) ([]*Option, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Fragment != "" {
+		return nil, ErrInvalidLocation
+	}
+
+	path := u.EscapedPath()
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return nil, ErrInvalidLocation
+	}
+
+	segments, err := splitURIPath(path)
+	if err != nil {
+		return nil, ErrInvalidLocation
+	}
+
+	var opts []*Option
+	for _, segment := range segments {
+		if segment == "." || segment == ".." {
+			return nil, ErrInvalidLocation
+		}
+		opts = append(opts, NewOption(OptionLocationPath, segment))
+	}
+
+	queries, err := splitURIQuery(u.RawQuery)
+	if err != nil {
+		return nil, ErrInvalidLocation
+	}
+
+	for _, q := range queries {
+		opts = append(opts, NewOption(OptionLocationQuery, q))
+	}
+	return opts, nil
+}
+
+// Replaces the Location-Path and Location-Query options of a response, e.g. a 2.01 Created
+// response, with those of a relative reference (e.g. "/a/b?c=d")
+func (m *Message) SetLocation(location string) error {
+	opts, err := LocationOptions(location)
+	if err != nil {
+		return err
+	}
+
+	m.RemoveOptions(OptionLocationPath)
+	m.RemoveOptions(OptionLocationQuery)
+	m.AddOptions(opts)
+
+	return nil
+}
+
+// Returns the relative reference composed from the Location-Path and Location-Query options,
+// or an empty string if the message has neither
+func (m *Message) GetLocation() string {
+	paths := m.GetOptions(OptionLocationPath)
+	queries := m.GetOptions(OptionLocationQuery)
+	if len(paths) == 0 && len(queries) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	writeURIPathQuery(&b, paths, queries)
+
+	return b.String()
+}
+
+// ResolveLocation returns the absolute URI of the location of a response, resolved against the
+// URI of the request it responds to
+func ResolveLocation(requestURI string, resp *Message) (string, error) {
+	base, err := url.Parse(requestURI)
+	if err != nil || !base.IsAbs() {
+		return "", ErrInvalidRequestURI
+	}
+
+	location := resp.GetLocation()
+	if location == "" {
+		return "", ErrInvalidLocation
+	}
+	return base.Scheme + "://" + base.Host + location, nil
+}
+
+// Splits an absolute CoAP URI into options, see CoapURIOptions
+func coapURIOptions(uri string) (*url.URL, []*Option, error) {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return nil, nil, ErrInvalidRequestURI
+	}
+
+	defaultPort := CoapSchemeDefaultPort(u.Scheme)
+	if defaultPort == 0 {
+		return nil, nil, ErrInvalidRequestURI
+	}
+
+	var opts []*Option
+	if host := u.Hostname(); net.ParseIP(host) == nil {
+		opts = append(opts, NewOption(OptionURIHost, strings.ToLower(host)))
+	}
+
+	if p := u.Port(); p != "" {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, nil, ErrInvalidRequestURI
+		}
+
+		if int(port) != defaultPort {
+			opts = append(opts, NewOption(OptionURIPort, uint32(port)))
+		}
+	}
+
+	segments, err := splitURIPath(u.EscapedPath())
+	if err != nil {
+		return nil, nil, ErrInvalidRequestURI
+	}
+
+	for _, segment := range segments {
+		opts = append(opts, NewOption(OptionURIPath, segment))
+	}
+
+	queries, err := splitURIQuery(u.RawQuery)
+	if err != nil {
+		return nil, nil, ErrInvalidRequestURI
+	}
+
+	for _, q := range queries {
+		opts = append(opts, NewOption(OptionURIQuery, q))
+	}
+	return u, opts, nil
+}
+
+// Returns the port of a CoAP URI, or the default port of its scheme
+func coapURIPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	return CoapSchemeDefaultPort(u.Scheme)
+}
+
+// Splits a percent-encoded path into its decoded segments. An empty path or a single slash
+// has no segments
+func splitURIPath(path string) ([]string, error) {
+	if path == "" || path == "/" {
+		return nil, nil
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// Splits a percent-encoded query into its decoded arguments
+func splitURIQuery(query string) ([]string, error) {
+	if query == "" {
+		return nil, nil
+	}
+
+	var args []string
+	for _, arg := range strings.Split(query, "&") {
+		s, err := url.PathUnescape(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+// Writes the path and query composed from path and query options, percent-encoding the
+// characters which aren't allowed in path segments and query arguments
+func writeURIPathQuery(b *strings.Builder, paths, queries []*Option) {
+	if len(paths) == 0 {
+		b.WriteString("/")
+	}
+
+	for _, opt := range paths {
+		b.WriteString("/")
+		b.WriteString(escapeURIComponent(opt.StringValue(), "!$&'()*+,;=:@"))
+	}
+
+	for i, opt := range queries {
+		if i == 0 {
+			b.WriteString("?")
+		} else {
+			b.WriteString("&")
+		}
+		b.WriteString(escapeURIComponent(opt.StringValue(), "!$'()*+,;=:@/?"))
+	}
+}
+
+// Percent-encodes the bytes of s other than unreserved characters and the allowed characters
+func escapeURIComponent(s, allowed string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isURIUnreserved(c) || strings.IndexByte(allowed, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+// Determines if a character is unreserved (RFC 3986 Section 2.3)
+func isURIUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
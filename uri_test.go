@@ -0,0 +1,191 @@
+package coap
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// Renders options as code=value pairs for comparisons
+func uriTestOptions(opts []*Option) []string {
+	var s []string
+	for _, opt := range opts {
+		s = append(s, OptionNumberToString(opt.Code)+"="+fmt.Sprint(opt.Value))
+	}
+	return s
+}
+
+func TestCoapURIOptions(t *testing.T) {
+	tests := []struct {
+		uri  string
+		opts []string
+	}{
+		{"coap://example.com", []string{"Uri-Host=example.com"}},
+		{"coap://EXAMPLE.com:5683/", []string{"Uri-Host=example.com"}},
+		{"coaps://example.com:5683/", []string{"Uri-Host=example.com", "Uri-Port=5683"}},
+		{"coap://192.0.2.1:61616/a/b?c=d&e", []string{"Uri-Port=61616", "Uri-Path=a", "Uri-Path=b", "Uri-Query=c=d", "Uri-Query=e"}},
+		{"coap://[2001:db8::1]/", nil},
+		{"coap+tcp://[2001:db8::1]:5684/x", []string{"Uri-Port=5684", "Uri-Path=x"}},
+
+		// RFC 7252 Section 6.3 examples
+		{"coap://example.com/~sensors/temp.xml", []string{"Uri-Host=example.com", "Uri-Path=~sensors", "Uri-Path=temp.xml"}},
+		{"coap://example.com/%7Esensors/temp.xml", []string{"Uri-Host=example.com", "Uri-Path=~sensors", "Uri-Path=temp.xml"}},
+
+		// Percent-encoded delimiters stay within their segment or argument
+		{"coap://h/a%2Fb/%C3%BC?x%26y=%3D", []string{"Uri-Host=h", "Uri-Path=a/b", "Uri-Path=ü", "Uri-Query=x&y=="}},
+		{"coap://h/a//b/", []string{"Uri-Host=h", "Uri-Path=a", "Uri-Path=", "Uri-Path=b", "Uri-Path="}},
+		{"coap://h/a+b", []string{"Uri-Host=h", "Uri-Path=a+b"}},
+	}
+
+	for _, test := range tests {
+		opts, err := CoapURIOptions(test.uri)
+		if err != nil {
+			t.Errorf("CoapURIOptions(%s) failed: %v", test.uri, err)
+			continue
+		}
+
+		if got := uriTestOptions(opts); !reflect.DeepEqual(got, test.opts) {
+			t.Errorf("CoapURIOptions(%s) = %q, want %q", test.uri, got, test.opts)
+		}
+	}
+
+	for _, uri := range []string{
+		"", "/a", "coap:/a", "http://example.com/", "coap://h/#frag", "coap://h:x/", "coap://h:70000/",
+		"coap://h/%zz", "coap://h/?%zz",
+	} {
+		if _, err := CoapURIOptions(uri); err != ErrInvalidRequestURI {
+			t.Errorf("CoapURIOptions(%q) = %v, want %v", uri, err, ErrInvalidRequestURI)
+		}
+	}
+}
+
+func TestCoapURIRoundTrip(t *testing.T) {
+	for _, uri := range []string{
+		"coap://example.com/",
+		"coap://example.com:61616/a/b?c=d&e",
+		"coaps://example.com/a%2Fb/%C3%BC?x%26y==",
+		"coap://[2001:db8::1]:1234/",
+		"coap+ws://example.com/.well-known/core?rt=x",
+		"coap://example.com/a/?q=a/b?c",
+	} {
+		opts, err := CoapURIOptions(uri)
+		if err != nil {
+			t.Errorf("CoapURIOptions(%s) failed: %v", uri, err)
+			continue
+		}
+
+		msg := NewMessage(MessageConfirmable, Get, 1)
+		msg.AddOptions(opts)
+
+		u, _ := url.Parse(uri)
+
+		// Messages carry neither Uri-Host for IP literals nor Uri-Port for the default port, which
+		// are taken from the destination
+		got, err := CoapURIFromMessage(msg, u.Scheme, "2001:db8::1", CoapSchemeDefaultPort(u.Scheme))
+		if err != nil || got != uri {
+			t.Errorf("CoapURIFromMessage(%s) = %s (%v)", uri, got, err)
+		}
+	}
+
+	msg := NewMessage(MessageConfirmable, Get, 1)
+	if got, _ := CoapURIFromMessage(msg, "coap", "fe80::1%eth0", 5683); got != "coap://[fe80::1%25eth0]/" {
+		t.Errorf("zoned IPv6 URI = %s", got)
+	}
+
+	if _, err := CoapURIFromMessage(msg, "http", "example.com", 80); err != ErrInvalidRequestURI {
+		t.Errorf("CoapURIFromMessage(http) = %v, want %v", err, ErrInvalidRequestURI)
+	}
+
+	if _, err := CoapURIFromMessage(msg, "coap", "", 5683); err != ErrInvalidRequestURI {
+		t.Errorf("CoapURIFromMessage without host = %v, want %v", err, ErrInvalidRequestURI)
+	}
+}
+
+func TestCoapSchemes(t *testing.T) {
+	tests := map[string]int{"coap": 5683, "COAPS": 5684, "coap+tcp": 5683, "coaps+ws": 443, "http": 0}
+	for scheme, port := range tests {
+		if got := CoapSchemeDefaultPort(scheme); got != port {
+			t.Errorf("CoapSchemeDefaultPort(%s) = %d, want %d", scheme, got, port)
+		}
+	}
+
+	for uri, want := range map[string]bool{"coap://h/": true, "coaps+tcp://h": true, "coap:///a": false, "http://h/": false, "/a": false} {
+		if got := IsCoapURI(uri); got != want {
+			t.Errorf("IsCoapURI(%s) = %v", uri, got)
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		opts     []string
+	}{
+		{"/rd/4521", []string{"Location-Path=rd", "Location-Path=4521"}},
+		{"/a%2Fb?c=d&e", []string{"Location-Path=a/b", "Location-Query=c=d", "Location-Query=e"}},
+		{"?q", []string{"Location-Query=q"}},
+	}
+
+	for _, test := range tests {
+		msg := CreatedMessage(1, MessageAcknowledgment)
+		if err := msg.SetLocation(test.location); err != nil {
+			t.Errorf("SetLocation(%s) failed: %v", test.location, err)
+			continue
+		}
+
+		if got := uriTestOptions(msg.Options); !reflect.DeepEqual(got, test.opts) {
+			t.Errorf("SetLocation(%s) = %q, want %q", test.location, got, test.opts)
+		}
+
+		data, err := MessageToBytes(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := BytesToMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := test.location
+		if want[0] == '?' {
+			want = "/" + want
+		}
+
+		if got := decoded.GetLocation(); got != want {
+			t.Errorf("GetLocation = %s, want %s", got, want)
+		}
+	}
+
+	for _, location := range []string{"a/b", "coap://h/a", "//h/a", "/a/../b", "/./a", "/a#f", "/a%zz"} {
+		if _, err := LocationOptions(location); err != ErrInvalidLocation {
+			t.Errorf("LocationOptions(%s) = %v, want %v", location, err, ErrInvalidLocation)
+		}
+	}
+
+	// Setting a location replaces the previous one
+	msg := CreatedMessage(1, MessageAcknowledgment)
+	msg.SetLocation("/a?b")
+	msg.SetLocation("/c")
+	if got := msg.GetLocation(); got != "/c" {
+		t.Errorf("GetLocation = %s, want /c", got)
+	}
+
+	if got := CreatedMessage(1, MessageAcknowledgment).GetLocation(); got != "" {
+		t.Errorf("GetLocation without options = %q", got)
+	}
+
+	uri, err := ResolveLocation("coap://example.com:61616/rd?ep=node", msg)
+	if err != nil || uri != "coap://example.com:61616/c" {
+		t.Errorf("ResolveLocation = %s (%v)", uri, err)
+	}
+
+	if _, err := ResolveLocation("/rd", msg); err != ErrInvalidRequestURI {
+		t.Errorf("ResolveLocation(relative) = %v, want %v", err, ErrInvalidRequestURI)
+	}
+
+	if _, err := ResolveLocation("coap://h/", CreatedMessage(1, MessageAcknowledgment)); err != ErrInvalidLocation {
+		t.Errorf("ResolveLocation without location = %v, want %v", err, ErrInvalidLocation)
+	}
+}
@@ -23,8 +23,12 @@ func SendMessageTo(msg *Message, conn Connection, addr *net.UDPAddr) (CoapRespon
 	}
 
 	//fmt.Println("SendMessageTo::WriteTo")
-	b, _ := MessageToBytes(msg)
-	_, err := conn.WriteTo(b, addr)
+	buf := getMessageBuffer()
+	b, err := msg.MarshalTo((*buf)[:0])
+	if err == nil {
+		_, err = conn.WriteTo(b, addr)
+	}
+	putMessageBuffer(buf)
 
 	if err != nil {
 		return nil, err
@@ -75,8 +79,11 @@ func SendMessage(msg *Message, conn Connection) (CoapResponse, error) {
 		return nil, ErrNilConn
 	}
 
-	b, _ := MessageToBytes(msg)
-	_, err := conn.Write(b)
+	b, err := MessageToBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(b)
 
 	if err != nil {
 		return nil, err
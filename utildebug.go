@@ -25,7 +25,7 @@ func PrintMessage(msg *Message) {
 	log.Println("MessageId: ", msg.MessageID)
 	log.Println("MessageType: ", msg.MessageType)
 	log.Println("Token: ", string(msg.Token))
-	log.Println("Token Length: ", msg.GetTokenLength())
+	log.Println("Token Length: ", msg.GetExtendedTokenLength())
 	log.Println("Payload: ", PayloadAsString(msg.Payload))
 	PrintOptions(msg)
 	log.Println("= = = = = = = = = = = = = = = = ")
@@ -34,62 +34,8 @@ func PrintMessage(msg *Message) {
 
 // OptionNumberToString returns the string representation of a given Option Code
 func OptionNumberToString(o OptionCode) string {
-	switch o {
-	case OptionIfMatch:
-		return "If-Match"
-
-	case OptionURIHost:
-		return "Uri-Host"
-
-	case OptionEtag:
-		return "ETag"
-
-	case OptionIfNoneMatch:
-		return "If-None-Match"
-
-	case OptionURIPort:
-		return "Uri-Port"
-
-	case OptionLocationPath:
-		return "Location-Path"
-
-	case OptionURIPath:
-		return "Uri-Path"
-
-	case OptionContentFormat:
-		return "Content-Format"
-
-	case OptionMaxAge:
-		return "Max-Age"
-
-	case OptionURIQuery:
-		return "Uri-Query"
-
-	case OptionAccept:
-		return "Accept"
-
-	case OptionLocationQuery:
-		return "Location-Query"
-
-	case OptionBlock2:
-		return "Block2"
-
-	case OptionBlock1:
-		return "Block1"
-
-	case OptionProxyURI:
-		return "Proxy-Uri"
-
-	case OptionProxyScheme:
-		return "Proxy-Scheme"
-
-	case OptionSize1:
-		return "Size1"
-
-	case OptionSize2:
-		return "Size2"
-
-	default:
-		return ""
+	if def := GetOptionDefinition(o); def != nil {
+		return def.Name
 	}
+	return ""
 }
@@ -2,13 +2,18 @@ package coap
 
 import (
 	"math/rand"
-	"regexp"
-	"strings"
+	"sync"
 	"time"
 )
 
+// Guards CurrentMessageID, as Message IDs are generated by concurrent requests
+var messageIDMutex sync.Mutex
+
 // GenerateMessageId generate a uint16 Message ID
 func GenerateMessageID() uint16 {
+	messageIDMutex.Lock()
+	defer messageIDMutex.Unlock()
+
 	if CurrentMessageID != 65535 {
 		CurrentMessageID++
 	} else {
@@ -30,28 +35,26 @@ func GenerateToken(l int) string {
 }
 
 // CoreResourcesFromString Converts to CoRE Resources Object from a CoRE String
+// (application/link-format). Malformed links are skipped
 func CoreResourcesFromString(str string) []*CoreResource {
-	var re = regexp.MustCompile(`(<[^>]+>\s*(;\s*\w+\s*(=\s*(\w+|"([^"\\]*(\\.[^"\\]*)*)")\s*)?)*)`)
-	var elemRe = regexp.MustCompile(`<[^>]*>`)
-
 	var resources []*CoreResource
-	m := re.FindAllString(str, -1)
 
-	for _, match := range m {
-		elemMatch := elemRe.FindString(match)
-		target := elemMatch[1 : len(elemMatch)-1]
-
-		resource := NewCoreResource()
-		resource.Target = target
-
-		if len(match) > len(elemMatch) {
-			attrs := strings.Split(match[len(elemMatch)+1:], ";")
+	p := &coreLinkScanner{s: str}
+	for {
+		p.skipWhitespace()
+		for !p.eof() && p.peek() == ',' {
+			p.pos++
+			p.skipWhitespace()
+		}
 
-			for _, attr := range attrs {
-				pair := strings.Split(attr, "=")
+		if p.eof() {
+			break
+		}
 
-				resource.AddAttribute(pair[0], strings.Replace(pair[1], "\"", "", -1))
-			}
+		resource, ok := p.readLink()
+		if !ok {
+			p.skipLink()
+			continue
 		}
 		resources = append(resources, resource)
 	}
@@ -91,6 +94,9 @@ func CoapCodeToString(code CoapCode) string {
 	case CoapCodeContent:
 		return "205 Content"
 
+	case CoapCodeContinue:
+		return "231 Continue"
+
 	case CoapCodeBadRequest:
 		return "400 Bad Request"
 
@@ -112,6 +118,9 @@ func CoapCodeToString(code CoapCode) string {
 	case CoapCodeNotAcceptable:
 		return "406 Not Acceptable"
 
+	case CoapCodeRequestEntityIncomplete:
+		return "408 Request Entity Incomplete"
+
 	case CoapCodePreconditionFailed:
 		return "412 Precondition Failed"
 
@@ -121,6 +130,9 @@ func CoapCodeToString(code CoapCode) string {
 	case CoapCodeUnsupportedContentFormat:
 		return "415 Unsupported Content Format"
 
+	case CoapCodeTooManyRequests:
+		return "429 Too Many Requests"
+
 	case CoapCodeInternalServerError:
 		return "500 Internal Server Error"
 
@@ -139,6 +151,9 @@ func CoapCodeToString(code CoapCode) string {
 	case CoapCodeProxyingNotSupported:
 		return "505 Proxying Not Supported"
 
+	case CoapCodeHopLimitReached:
+		return "508 Hop Limit Reached"
+
 	default:
 		return "Unknown"
 	}
@@ -152,7 +167,9 @@ func ValidCoapMediaTypeCode(mt MediaType) bool {
 		MediaTypeApplicationLinkFormat, MediaTypeApplicationXML, MediaTypeApplicationOctetStream, MediaTypeApplicationRdfXML,
 		MediaTypeApplicationSoapXML, MediaTypeApplicationAtomXML, MediaTypeApplicationXmppXML, MediaTypeApplicationExi,
 		MediaTypeApplicationFastInfoSet, MediaTypeApplicationSoapFastInfoSet, MediaTypeApplicationJSON,
-		MediaTypeApplicationXObitBinary, MediaTypeTextPlainVndOmaLwm2m, MediaTypeTlvVndOmaLwm2m,
+		MediaTypeApplicationXObitBinary, MediaTypeApplicationCBOR, MediaTypeApplicationCBORSeq,
+		MediaTypeApplicationSenMLJSON, MediaTypeApplicationSenMLCBOR,
+		MediaTypeTextPlainVndOmaLwm2m, MediaTypeTlvVndOmaLwm2m,
 		MediaTypeJSONVndOmaLwm2m, MediaTypeOpaqueVndOmaLwm2m:
 		return true
 	}